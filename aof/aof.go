@@ -7,6 +7,8 @@ import (
 	cm "mygodis/common"
 	"mygodis/common/commoninterface"
 	"mygodis/config"
+	"mygodis/lib/clock"
+	"mygodis/lib/metrics"
 	logger "mygodis/log"
 	"mygodis/parse"
 	"mygodis/resp"
@@ -27,6 +29,12 @@ const (
 	No
 )
 
+var fsyncDuration = metrics.NewHistogramVec("mygodis_aof_fsync_duration_seconds", "Time spent flushing the aof file to the disk", metrics.LatencyBuckets)
+
+func init() {
+	metrics.Default.Register(fsyncDuration)
+}
+
 type Payload struct {
 	CmdLine cm.CmdLine
 	DbIndex int
@@ -49,6 +57,8 @@ type Persister struct {
 	currenDbIndex     int
 	listeners         map[Listener]struct{}
 	cmdBuffer         []cm.CmdLine
+	// clock tells which keys have expired when the aof or the rdb file is rewritten
+	clock clock.Clock
 }
 type RewriteContext struct {
 	tmpFile  *os.File
@@ -68,6 +78,7 @@ func NewPersister(db commoninterface.StandaloneDBEngine, filename string, load b
 	persister.listeners = make(map[Listener]struct{})
 	persister.aofFinished = make(chan struct{})
 	persister.currenDbIndex = 0
+	persister.clock = clock.Real
 	aofFile, err := os.OpenFile(persister.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		logger.Errorf("open aof file error: %v", err)
@@ -83,6 +94,19 @@ func NewPersister(db commoninterface.StandaloneDBEngine, filename string, load b
 
 	return persister, nil
 }
+
+// fsync flushes the aof file to the disk and records how long it took
+func (persister *Persister) fsync() error {
+	start := time.Now()
+	err := persister.aofFile.Sync()
+	fsyncDuration.With().Since(start)
+	return err
+}
+
+// SetClock makes the rewrites read the time of c, the clock of the db
+func (persister *Persister) SetClock(c clock.Clock) {
+	persister.clock = c
+}
 func (persister *Persister) ListenCmd() {
 	for payload := range persister.aofChan {
 		persister.writeAof(payload)
@@ -96,7 +120,7 @@ func (persister *Persister) FsyncEverySec() {
 			select {
 			case <-ticker.C:
 				persister.lockForPausingAof.Lock()
-				err := persister.aofFile.Sync()
+				err := persister.fsync()
 				if err != nil {
 					logger.Errorf("aof fsync error: %v", err)
 				}
@@ -194,10 +218,10 @@ func (persister *Persister) writeAof(payload *Payload) {
 	persister.cmdBuffer = append(persister.cmdBuffer, payload.CmdLine)
 	_, err := persister.aofFile.Write(data.ToBytes())
 	if err != nil {
-		logger.Warn("aof file write error: %v", err)
+		logger.Warn("aof file write error:", err)
 	}
 	if persister.aofFsyncAction == Always {
-		err := persister.aofFile.Sync()
+		err := persister.fsync()
 		if err != nil {
 			logger.Errorf("aof fsync error: %v", err)
 		}
@@ -231,6 +255,7 @@ func (persister *Persister) NewRewritePersister() *Persister {
 	return &Persister{
 		aofFilename: persister.aofFilename,
 		db:          persister.tmpDBMaker(),
+		clock:       persister.clock,
 	}
 }
 func (persister *Persister) RewriteAof() error {
@@ -248,7 +273,7 @@ func (persister *Persister) RewriteAof() error {
 func (persister *Persister) StartRewriteAof() (rewriteContext *RewriteContext, err error) {
 	persister.lockForPausingAof.Lock()
 	defer persister.lockForPausingAof.Unlock()
-	err = persister.aofFile.Sync()
+	err = persister.fsync()
 	if err != nil {
 		logger.Errorf("aof fsync error: %v", err)
 		return nil, err
@@ -322,17 +347,18 @@ func (persister *Persister) DoRewriteAof(rewriteContext *RewriteContext) error {
 			logger.Error("tmp file rewrite failed: " + err.Error())
 			return err
 		}
+		now := persister.clock.Now()
 		rewritePersister.db.ForEach(i, func(key string, data *commoninterface.DataEntity, expiration time.Time) bool {
+			if !expiration.IsZero() && !expiration.After(now) {
+				return true
+			}
 			cmd := EntityToCmd(key, data)
 			if cmd != nil {
 				_, _ = tmpFile.Write(cmd.ToBytes())
 			}
-
-			cmd = ExpireToCmd(key, expiration)
-			if cmd != nil {
-				_, _ = tmpFile.Write(cmd.ToBytes())
+			if !expiration.IsZero() {
+				_, _ = tmpFile.Write(ExpireToCmd(key, expiration).ToBytes())
 			}
-
 			return true
 		})
 	}
@@ -0,0 +1,92 @@
+package aof
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/hdt3213/rdb/core"
+	rdb "github.com/hdt3213/rdb/encoder"
+	parse "github.com/hdt3213/rdb/parser"
+	"hash/crc64"
+	"mygodis/common/commoninterface"
+	"strconv"
+)
+
+const (
+	// dumpVersion is the rdb version written in the payloads of DUMP, RESTORE takes payloads up to it
+	dumpVersion = 9
+	// dumpFooterSize is the version and the checksum ending a payload
+	dumpFooterSize = 2 + 8
+	rdbOpSelectDB  = 0xFE
+	rdbOpEOF       = 0xFF
+)
+
+var (
+	ErrDumpPayload = errors.New("DUMP payload version or checksum are wrong")
+	errDumpType    = errors.New("the type of the value can not be dumped")
+	// crc64Table is the reflected Jones polynomial redis checksums its payloads with
+	crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+)
+
+// crc64Jones returns the checksum of p the way redis computes it: no initial or final inversion
+func crc64Jones(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
+
+// DumpEntity serializes the value of entity like DUMP: the rdb type and encoding of the value followed by the rdb
+// version and a crc64 of all of it
+func DumpEntity(entity *commoninterface.DataEntity) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := rdb.NewEncoder(&buf)
+	if err := encoder.WriteHeader(); err != nil {
+		return nil, err
+	}
+	if err := encoder.WriteDBHeader(0, 1, 0); err != nil {
+		return nil, err
+	}
+	start := buf.Len()
+	// the key is written as an empty string, a single zero length
+	if err := WriteEntity(encoder, "", entity); err != nil {
+		return nil, err
+	}
+	object := buf.Bytes()[start:]
+	if len(object) < 2 {
+		return nil, errDumpType
+	}
+	payload := make([]byte, 0, len(object)-1+dumpFooterSize)
+	payload = append(payload, object[0])
+	payload = append(payload, object[2:]...)
+	payload = binary.LittleEndian.AppendUint16(payload, dumpVersion)
+	return binary.LittleEndian.AppendUint64(payload, crc64Jones(0, payload)), nil
+}
+
+// ParseDump reads back a payload of DUMP after checking its version and checksum
+func ParseDump(payload []byte) (parse.RedisObject, error) {
+	if len(payload) < 1+dumpFooterSize {
+		return nil, ErrDumpPayload
+	}
+	body := payload[:len(payload)-8]
+	version := binary.LittleEndian.Uint16(payload[len(payload)-dumpFooterSize:])
+	if version > dumpVersion || crc64Jones(0, body) != binary.LittleEndian.Uint64(payload[len(payload)-8:]) {
+		return nil, ErrDumpPayload
+	}
+	value := body[:len(body)-2]
+	// a file of db 0 holding the value under an empty key
+	var file bytes.Buffer
+	file.WriteString("REDIS000" + strconv.Itoa(dumpVersion))
+	file.Write([]byte{rdbOpSelectDB, 0, value[0], 0})
+	file.Write(value[1:])
+	file.WriteByte(rdbOpEOF)
+	var object parse.RedisObject
+	err := core.NewDecoder(&file).Parse(func(o parse.RedisObject) bool {
+		object = o
+		return false
+	})
+	if err != nil || object == nil {
+		return nil, ErrDumpPayload
+	}
+	return object, nil
+}
@@ -26,11 +26,13 @@ func EntityToCmd(key string, entity *commoninterface.DataEntity) *resp.MultiBulk
 	switch val := entity.Data.(type) {
 	case []byte:
 		result = stringToCmd(key, val)
+	case string:
+		result = stringToCmd(key, []byte(val))
 	case list.List:
 		result = listToCmd(key, val)
 	case *set.Set:
 		result = setToCmd(key, val)
-	case dict.ConcurrentDict:
+	case dict.Dict:
 		result = hashToCmd(key, val)
 	case *sortedset.ZSet:
 		result = zSetToCmd(key, val)
@@ -68,13 +70,19 @@ func setToCmd(key string, set *set.Set) *resp.MultiBulkReply {
 	})
 	return resp.MakeMultiBulkReply(args)
 }
-func hashToCmd(key string, h dict.ConcurrentDict) *resp.MultiBulkReply {
+func hashToCmd(key string, h dict.Dict) *resp.MultiBulkReply {
 	args := make([][]byte, 2+h.Len()*2)
 	args[0] = hmSetCmd
 	args[1] = []byte(key)
 	i := 0
 	h.ForEach(func(field string, val interface{}) bool {
-		bytes, _ := val.([]byte)
+		var bytes []byte
+		switch v := val.(type) {
+		case []byte:
+			bytes = v
+		case string:
+			bytes = []byte(v)
+		}
 		args[2+i*2] = []byte(field)
 		args[3+i*2] = bytes
 		i++
@@ -37,7 +37,7 @@ func (persister *Persister) RewriteAofToRdb(rdbFilename string) error {
 func (persister *Persister) startRewriteRdb(listener Listener, callBack func()) (*RewriteContext, error) {
 	persister.lockForPausingAof.Lock()
 	defer persister.lockForPausingAof.Unlock()
-	err := persister.aofFile.Sync()
+	err := persister.fsync()
 	if err != nil {
 		logger.Warn("fsync failed")
 		return nil, err
@@ -72,7 +72,7 @@ func (persister *Persister) rewriteRdb(ctx *RewriteContext) error {
 		"redis-ver":    "6.0.0",
 		"redis-bits":   "64",
 		"aof-preamble": "0",
-		"ctime":        strconv.FormatInt(time.Now().Unix(), 10),
+		"ctime":        strconv.FormatInt(persister.clock.Now().Unix(), 10),
 	}
 	for k, v := range auxMap {
 		err = encoder.WriteAux(k, v)
@@ -89,49 +89,16 @@ func (persister *Persister) rewriteRdb(ctx *RewriteContext) error {
 		if err != nil {
 			return err
 		}
+		now := persister.clock.Now()
 		rewritePersister.db.ForEach(i, func(key string, entity *commoninterface.DataEntity, expiration time.Time) bool {
+			if !expiration.IsZero() && !expiration.After(now) {
+				return true
+			}
 			var opts []any
 			if !expiration.IsZero() {
 				opts = append(opts, rdb.WithTTL(uint64(expiration.UnixNano()/1e6)))
 			}
-			switch obj := entity.Data.(type) {
-			case []byte:
-				err = encoder.WriteStringObject(key, obj, opts...)
-
-			case list.List:
-				val := make([][]byte, 0, obj.Len())
-				obj.ForEach(func(i int, v any) bool {
-					bytes, _ := v.([]byte)
-					val = append(val, bytes)
-					return true
-				})
-				err = encoder.WriteListObject(key, val, opts...)
-			case *set.Set:
-				val := make([][]byte, 0, obj.Len())
-				obj.ForEach(func(member string) bool {
-					val = append(val, []byte(member))
-					return true
-				})
-				err = encoder.WriteListObject(key, val, opts...)
-			case dict.ConcurrentDict:
-				val := make(map[string][]byte, obj.Len())
-				obj.ForEach(func(field string, v any) bool {
-					bytes, _ := v.([]byte)
-					val[field] = bytes
-					return true
-				})
-				err = encoder.WriteHashMapObject(key, val, opts...)
-			case *sortedset.ZSet:
-				var entries []*model.ZSetEntry
-				obj.ForEach(0, obj.Len(), true, func(element *sortedset.Element) bool {
-					entries = append(entries, &model.ZSetEntry{
-						Score:  element.Score,
-						Member: element.Member,
-					})
-					return true
-				})
-				err = encoder.WriteZSetObject(key, entries, opts...)
-			}
+			err = WriteEntity(encoder, key, entity, opts...)
 			if err != nil {
 				return false
 			}
@@ -166,3 +133,50 @@ func (persister *Persister) RewriteRdbForReplication(rdbFilename string, listene
 	}
 	return nil
 }
+
+// WriteEntity writes key and the value of entity with encoder, values of unknown types are skipped
+func WriteEntity(encoder *rdb.Encoder, key string, entity *commoninterface.DataEntity, opts ...any) (err error) {
+	switch obj := entity.Data.(type) {
+	case []byte:
+		err = encoder.WriteStringObject(key, obj, opts...)
+
+	case list.List:
+		val := make([][]byte, 0, obj.Len())
+		obj.ForEach(func(i int, v any) bool {
+			bytes, _ := v.([]byte)
+			val = append(val, bytes)
+			return true
+		})
+		err = encoder.WriteListObject(key, val, opts...)
+	case *set.Set:
+		val := make([][]byte, 0, obj.Len())
+		obj.ForEach(func(member string) bool {
+			val = append(val, []byte(member))
+			return true
+		})
+		err = encoder.WriteSetObject(key, val, opts...)
+	case dict.Dict:
+		val := make(map[string][]byte, obj.Len())
+		obj.ForEach(func(field string, v any) bool {
+			switch bytes := v.(type) {
+			case []byte:
+				val[field] = bytes
+			case string:
+				val[field] = []byte(bytes)
+			}
+			return true
+		})
+		err = encoder.WriteHashMapObject(key, val, opts...)
+	case *sortedset.ZSet:
+		var entries []*model.ZSetEntry
+		obj.ForEach(0, obj.Len(), true, func(element *sortedset.Element) bool {
+			entries = append(entries, &model.ZSetEntry{
+				Score:  element.Score,
+				Member: element.Member,
+			})
+			return true
+		})
+		err = encoder.WriteZSetObject(key, entries, opts...)
+	}
+	return err
+}
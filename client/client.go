@@ -0,0 +1,135 @@
+// Package client is a go client of mygodis with connection pooling, pipelines, transactions, pub/sub and
+// a cluster mode routing commands by the slot map of the cluster
+package client
+
+import (
+	"mygodis/lib/pool"
+	"time"
+)
+
+// Options configures a Client, zero values take the defaults
+type Options struct {
+	Addr     string
+	Password string
+	DB       int
+	// PoolSize is the most connections open at once, MaxIdle the most kept open while unused
+	PoolSize uint
+	MaxIdle  uint
+	// DialTimeout bounds connecting, ReadTimeout waiting for a reply, a negative ReadTimeout waits forever
+	DialTimeout time.Duration
+	ReadTimeout time.Duration
+}
+
+func (opts *Options) withDefaults() *Options {
+	o := *opts
+	if o.Addr == "" {
+		o.Addr = "127.0.0.1:6379"
+	}
+	if o.PoolSize == 0 {
+		o.PoolSize = 16
+	}
+	if o.MaxIdle == 0 || o.MaxIdle > o.PoolSize {
+		o.MaxIdle = o.PoolSize
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = 5 * time.Second
+	}
+	if o.ReadTimeout == 0 {
+		o.ReadTimeout = 3 * time.Second
+	}
+	return &o
+}
+
+// Client is a pool of connections to one server, it is safe for concurrent use
+type Client struct {
+	Commands
+	opts *Options
+	pool *pool.Pool
+}
+
+// New returns a client of opts.Addr, connections are opened on demand
+func New(opts *Options) *Client {
+	opts = opts.withDefaults()
+	c := &Client{opts: opts}
+	c.pool = pool.NewPool(func() (any, error) {
+		return dial(opts.Addr, opts)
+	}, func(x any) {
+		x.(*Conn).Close()
+	}, pool.Config{MaxIdle: opts.MaxIdle, MaxActive: opts.PoolSize})
+	c.Commands = Commands{do: c.Do}
+	return c
+}
+
+// Close closes the idle connections, connections in use are closed when they are given back
+func (c *Client) Close() {
+	c.pool.Close()
+}
+
+// withConn runs fn on a connection of the pool, a connection broken by fn is not reused
+func (c *Client) withConn(fn func(conn *Conn) error) error {
+	x, err := c.pool.Get()
+	if err != nil {
+		if err == pool.ErrClosed {
+			return ErrClosed
+		}
+		return err
+	}
+	conn := x.(*Conn)
+	err = fn(conn)
+	if conn.broken {
+		c.pool.Discard(conn)
+	} else {
+		c.pool.Put(conn)
+	}
+	return err
+}
+
+// Do executes a command and returns its reply as string, int64, nil or []interface{}, a missing value is Nil
+func (c *Client) Do(args ...interface{}) (interface{}, error) {
+	var value interface{}
+	err := c.withConn(func(conn *Conn) error {
+		var err error
+		value, err = conn.Do(args...)
+		return err
+	})
+	return value, err
+}
+
+// Pipeline returns a pipeline writing its commands to one connection at once
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{exec: func(cmds [][]interface{}) ([]Result, error) {
+		var results []Result
+		err := c.withConn(func(conn *Conn) error {
+			var err error
+			results, err = conn.pipeline(cmds)
+			return err
+		})
+		return results, err
+	}}
+}
+
+// Watch runs fn on one connection watching keys, the transaction fn executes fails with TxFailed if any of
+// them was changed meanwhile
+func (c *Client) Watch(fn func(tx *Tx) error, keys ...string) error {
+	return c.withConn(func(conn *Conn) error {
+		return watch(conn, fn, keys)
+	})
+}
+
+// TxPipeline returns a pipeline whose commands are executed atomically by MULTI and EXEC
+func (c *Client) TxPipeline() *Pipeline {
+	return &Pipeline{exec: func(cmds [][]interface{}) ([]Result, error) {
+		var results []Result
+		err := c.withConn(func(conn *Conn) error {
+			var err error
+			results, err = (&Tx{conn: conn}).exec(cmds)
+			return err
+		})
+		return results, err
+	}}
+}
+
+// Subscribe opens a connection of its own receiving the messages of channels
+func (c *Client) Subscribe(channels ...string) (*PubSub, error) {
+	return subscribe(c.opts.Addr, c.opts, channels)
+}
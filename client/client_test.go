@@ -0,0 +1,365 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mygodis/cluster"
+	"mygodis/common/commoninterface"
+	"mygodis/config"
+	"mygodis/db"
+	"mygodis/lib/slot"
+	"mygodis/server"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve handles the connections of listener like the tcp server does
+func serve(t *testing.T, listener net.Listener, dbi commoninterface.DB) {
+	handler := server.NewHandler(dbi)
+	t.Cleanup(func() {
+		_ = listener.Close()
+		_ = handler.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handler.Handle(context.Background(), conn)
+		}
+	}()
+}
+
+func startStandalone(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Properties = &config.ServerProperties{Databases: 16}
+	serve(t, listener, db.MakeStandaloneServer())
+	return listener.Addr().String()
+}
+
+// exerciseCommands runs every helper of Commands against a server, keys share a hash tag so multi key commands
+// work in a cluster too
+func exerciseCommands(t *testing.T, c Commands) {
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("{t}missing"); err != Nil {
+		t.Errorf("except Nil for a missing key but got %v", err)
+	}
+	if err := c.Set("{t}k", 42); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Incr("{t}k"); err != nil || n != 43 {
+		t.Errorf("except 43 but got %d %v", n, err)
+	}
+	if n, err := c.IncrBy("{t}k", 7); err != nil || n != 50 {
+		t.Errorf("except 50 but got %d %v", n, err)
+	}
+	if f, err := c.IncrByFloat("{t}f", 1.5); err != nil || f != 1.5 {
+		t.Errorf("except 1.5 but got %v %v", f, err)
+	}
+	if ok, err := c.SetNX("{t}k", "other"); err != nil || ok {
+		t.Errorf("except SetNX to keep an existing key but got %v %v", ok, err)
+	}
+	if ok, err := c.SetNX("{t}nx", "v"); err != nil || !ok {
+		t.Errorf("except SetNX to set a missing key but got %v %v", ok, err)
+	}
+	if err := c.SetEX("{t}ttl", "v", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := c.TTL("{t}ttl"); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("except a ttl within a minute but got %v %v", ttl, err)
+	}
+	if ok, err := c.Expire("{t}nx", time.Hour); err != nil || !ok {
+		t.Errorf("except Expire to set a ttl but got %v %v", ok, err)
+	}
+	if ttl, err := c.TTL("{t}k"); err != nil || ttl != -1 {
+		t.Errorf("except -1 for a key without ttl but got %v %v", ttl, err)
+	}
+	if err := c.MSet("{t}a", "1", "{t}b", 2); err != nil {
+		t.Fatal(err)
+	}
+	if values, err := c.MGet("{t}a", "{t}b", "{t}missing"); err != nil || strings.Join(values, ",") != "1,2," {
+		t.Errorf("except [1 2 ''] but got %q %v", values, err)
+	}
+	if n, err := c.Exists("{t}a", "{t}b", "{t}missing"); err != nil || n != 2 {
+		t.Errorf("except 2 existing keys but got %d %v", n, err)
+	}
+	if n, err := c.Del("{t}a", "{t}missing"); err != nil || n != 1 {
+		t.Errorf("except 1 deleted key but got %d %v", n, err)
+	}
+
+	if added, err := c.HSet("{t}h", "f", "v"); err != nil || !added {
+		t.Errorf("except a new field but got %v %v", added, err)
+	}
+	c.HSet("{t}h", "g", "w")
+	if v, err := c.HGet("{t}h", "f"); err != nil || v != "v" {
+		t.Errorf("except v but got %s %v", v, err)
+	}
+	if n, err := c.HDel("{t}h", "g", "missing"); err != nil || n != 1 {
+		t.Errorf("except 1 deleted field but got %d %v", n, err)
+	}
+	if m, err := c.HGetAll("{t}h"); err != nil || len(m) != 1 || m["f"] != "v" {
+		t.Errorf("except f=v but got %v %v", m, err)
+	}
+
+	if _, err := c.RPush("{t}l", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.LPush("{t}l", "a"); err != nil || n != 3 {
+		t.Errorf("except 3 elements but got %d %v", n, err)
+	}
+	if values, err := c.LRange("{t}l", 0, -1); err != nil || strings.Join(values, ",") != "a,b,c" {
+		t.Errorf("except a,b,c but got %v %v", values, err)
+	}
+	if v, err := c.LPop("{t}l"); err != nil || v != "a" {
+		t.Errorf("except a but got %s %v", v, err)
+	}
+
+	if n, err := c.SAdd("{t}s", "x", "y"); err != nil || n != 2 {
+		t.Errorf("except 2 added members but got %d %v", n, err)
+	}
+	if ok, err := c.SIsMember("{t}s", "x"); err != nil || !ok {
+		t.Errorf("except x to be a member but got %v %v", ok, err)
+	}
+	if members, err := c.SMembers("{t}s"); err != nil || len(members) != 2 {
+		t.Errorf("except 2 members but got %v %v", members, err)
+	}
+
+	if n, err := c.ZAdd("{t}z", 2.5, "m"); err != nil || n != 1 {
+		t.Errorf("except 1 added member but got %d %v", n, err)
+	}
+	if score, err := c.ZScore("{t}z", "m"); err != nil || score != 2.5 {
+		t.Errorf("except 2.5 but got %v %v", score, err)
+	}
+	if _, err := c.ZScore("{t}z", "missing"); err != Nil {
+		t.Errorf("except Nil for a missing member but got %v", err)
+	}
+
+	if n, err := c.Publish("nobody", "hello"); err != nil || n != 0 {
+		t.Errorf("except no receiver but got %d %v", n, err)
+	}
+	if info, err := c.Info(""); err != nil || !strings.Contains(info, "# Server:\nserver_addr:") {
+		t.Errorf("except every section but got %q %v", info, err)
+	}
+	if info, err := c.Info("keyspace"); err != nil || !strings.Contains(info, "# Keyspace") {
+		t.Errorf("except the keyspace section but got %q %v", info, err)
+	}
+	if keys, err := c.Keys("{t}n*"); err != nil || len(keys) != 1 || keys[0] != "{t}nx" {
+		t.Errorf("except {t}nx but got %v %v", keys, err)
+	}
+	if n, err := c.DBSize(); err != nil || n != 9 {
+		t.Errorf("except 9 keys but got %d %v", n, err)
+	}
+	var e Error
+	if _, err := c.Incr("{t}h"); !errors.As(err, &e) {
+		t.Errorf("except an error reply but got %v", err)
+	}
+	if err := c.FlushDB(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.DBSize(); err != nil || n != 0 {
+		t.Errorf("except no key after FlushDB but got %d %v", n, err)
+	}
+}
+
+func TestClient_commands(t *testing.T) {
+	c := New(&Options{Addr: startStandalone(t)})
+	defer c.Close()
+	exerciseCommands(t, c.Commands)
+}
+
+func TestClient_pipeline(t *testing.T) {
+	c := New(&Options{Addr: startStandalone(t), PoolSize: 2})
+	defer c.Close()
+	p := c.Pipeline()
+	for i := 0; i < 100; i++ {
+		p.Do("INCR", "counter")
+	}
+	p.Do("GET", "nothing")
+	results, err := p.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 101 || results[99].Val != int64(100) || results[100].Err != Nil {
+		t.Errorf("unexpected results %v", results[99:])
+	}
+	if p.Len() != 0 {
+		t.Errorf("except an empty pipeline after Exec but got %d", p.Len())
+	}
+}
+
+func TestClient_transaction(t *testing.T) {
+	c := New(&Options{Addr: startStandalone(t)})
+	defer c.Close()
+	tx := c.TxPipeline()
+	tx.Do("SET", "a", "1")
+	tx.Do("INCR", "a")
+	results, err := tx.Exec()
+	if err != nil || len(results) != 2 || results[1].Val != int64(2) {
+		t.Fatalf("unexpected transaction results %v %v", results, err)
+	}
+
+	// a watched key changed by another connection fails the transaction
+	err = c.Watch(func(tx *Tx) error {
+		if _, err := tx.Do("GET", "a"); err != nil {
+			return err
+		}
+		if err := c.Set("a", "changed"); err != nil {
+			return err
+		}
+		tx.Queue("SET", "a", "mine")
+		_, err := tx.Exec()
+		return err
+	}, "a")
+	if err != TxFailed {
+		t.Errorf("except TxFailed but got %v", err)
+	}
+	if v, _ := c.Get("a"); v != "changed" {
+		t.Errorf("except the other write to win but got %s", v)
+	}
+	err = c.Watch(func(tx *Tx) error {
+		tx.Queue("SET", "a", "mine")
+		_, err := tx.Exec()
+		return err
+	}, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get("a"); v != "mine" {
+		t.Errorf("except mine but got %s", v)
+	}
+}
+
+func TestClient_pubsub(t *testing.T) {
+	c := New(&Options{Addr: startStandalone(t)})
+	defer c.Close()
+	ps, err := c.Subscribe("news", "sport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	if n, err := c.Publish("news", "hello"); err != nil || n != 1 {
+		t.Fatalf("except one receiver but got %d %v", n, err)
+	}
+	select {
+	case msg := <-ps.Channel():
+		if msg.Channel != "news" || msg.Payload != "hello" {
+			t.Errorf("unexpected message %v", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the message")
+	}
+	if err := ps.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Publish("news", "again"); err != nil || n != 0 {
+		t.Errorf("except no receiver after unsubscribe but got %d %v", n, err)
+	}
+	ps.Close()
+	if _, ok := <-ps.Channel(); ok {
+		t.Error("except the channel to be closed")
+	}
+}
+
+func TestClusterClient(t *testing.T) {
+	listenerA, _ := net.Listen("tcp", "127.0.0.1:0")
+	listenerB, _ := net.Listen("tcp", "127.0.0.1:0")
+	addrA, addrB := listenerA.Addr().String(), listenerB.Addr().String()
+	config.Properties = &config.ServerProperties{Self: addrA, Databases: 16}
+	a := cluster.MakeCluster()
+	serve(t, listenerA, a)
+	config.Properties = &config.ServerProperties{Self: addrB, Databases: 16, Peers: []string{addrA}}
+	b := cluster.MakeCluster()
+	serve(t, listenerB, b)
+
+	seed := New(&Options{Addr: addrA})
+	defer seed.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		slots, _ := seed.Do("CLUSTER", "SLOTS")
+		if ranges, ok := slots.([]interface{}); ok && len(ranges) >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for both nodes to serve slots")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	c, err := NewCluster(&ClusterOptions{Addrs: []string{addrA}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	exerciseCommands(t, c.Commands)
+	if lines, err := c.ClusterNodes(); err != nil || !strings.Contains(lines, addrA) || !strings.Contains(lines, addrB) {
+		t.Errorf("except both nodes but got %q %v", lines, err)
+	}
+	if info, err := c.ClusterInfo(); err != nil || !strings.Contains(info, "cluster_known_nodes:2") {
+		t.Errorf("except two known nodes but got %q %v", info, err)
+	}
+	if lines, err := c.ClusterDistribution(); err != nil || len(lines) != 2 {
+		t.Errorf("except one line per node but got %q %v", lines, err)
+	}
+	if s, err := c.ClusterKeySlot("{t}k"); err != nil || s != int64(slot.Of([]byte("{t}k"))) {
+		t.Errorf("except the slot of {t}k but got %d %v", s, err)
+	}
+	if orphans, err := c.ClusterOrphans(-1); err != nil || len(orphans) != 0 {
+		t.Errorf("except no orphan but got %q %v", orphans, err)
+	}
+	if orphans, err := c.ClusterOrphans(1); err != nil || len(orphans) != 0 {
+		t.Errorf("except no orphan but got %q %v", orphans, err)
+	}
+	if n, err := c.ClusterFixOrphans(); err != nil || n != 0 {
+		t.Errorf("except no orphan moved but got %d %v", n, err)
+	}
+	nodes := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := c.Set(key, i); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+		nodes[c.nodeOf(key, true)] = true
+	}
+	if !nodes[addrA] || !nodes[addrB] {
+		t.Errorf("except keys routed to both nodes but got %v", nodes)
+	}
+	p := c.Pipeline()
+	for i := 0; i < 50; i++ {
+		p.Do("GET", fmt.Sprintf("key%d", i))
+	}
+	results, err := p.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Err != nil || result.Val != fmt.Sprint(i) {
+			t.Errorf("key%d: except %d but got %v %v", i, i, result.Val, result.Err)
+		}
+	}
+
+	// a stale slot map is fixed by the MOVED of the node
+	s, _ := c.ClusterKeySlot("key0")
+	owner := c.nodeOf("key0", true)
+	other := addrA
+	if owner == addrA {
+		other = addrB
+	}
+	c.mu.Lock()
+	c.slots[s] = other
+	c.mu.Unlock()
+	if v, err := c.Get("key0"); err != nil || v != "0" {
+		t.Errorf("except 0 after the redirection but got %v %v", v, err)
+	}
+	if got := c.nodeOf("key0", true); got != owner {
+		t.Errorf("except the slot map to point to %s but got %s", owner, got)
+	}
+}
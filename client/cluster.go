@@ -0,0 +1,354 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"mygodis/lib/slot"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ClusterOptions configures a ClusterClient, Addr of Options is ignored
+type ClusterOptions struct {
+	Options
+	// Addrs are the nodes asked for the slot map, one reachable node is enough
+	Addrs []string
+	// MaxRedirects bounds the MOVED and ASK redirections followed by one command
+	MaxRedirects int
+}
+
+// keylessCommands are sent to any node, the node fans them out to the cluster if needed
+var keylessCommands = map[string]bool{
+	"PING": true, "ECHO": true, "INFO": true, "DBSIZE": true, "KEYS": true, "RANDOMKEY": true, "FLUSHDB": true,
+	"FLUSHALL": true, "CLUSTER": true, "PUBLISH": true, "SELECT": true, "AUTH": true, "TIME": true,
+}
+
+// ClusterClient routes every command to the node serving the slot of its first key by a local copy of the slot
+// map, the map is refreshed when a node answers MOVED. It is safe for concurrent use.
+type ClusterClient struct {
+	Commands
+	opts *ClusterOptions
+
+	mu      sync.RWMutex
+	slots   [slot.Count]string
+	clients map[string]*Client
+	closed  bool
+}
+
+// NewCluster returns a client of the cluster of opts.Addrs, it fails if none of them returns the slot map
+func NewCluster(opts *ClusterOptions) (*ClusterClient, error) {
+	o := *opts
+	o.Options = *o.Options.withDefaults()
+	if o.MaxRedirects <= 0 {
+		o.MaxRedirects = 3
+	}
+	if len(o.Addrs) == 0 {
+		return nil, errors.New("mygodis: no cluster address")
+	}
+	c := &ClusterClient{opts: &o, clients: make(map[string]*Client)}
+	c.Commands = Commands{do: c.Do}
+	if err := c.Refresh(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the clients of every node
+func (c *ClusterClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, client := range c.clients {
+		client.Close()
+	}
+	c.clients = make(map[string]*Client)
+}
+
+// client returns the client of node, it is created on first use
+func (c *ClusterClient) client(node string) (*Client, error) {
+	c.mu.RLock()
+	client, ok := c.clients[node]
+	closed := c.closed
+	c.mu.RUnlock()
+	if ok {
+		return client, nil
+	}
+	if closed {
+		return nil, ErrClosed
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok = c.clients[node]; ok {
+		return client, nil
+	}
+	opts := c.opts.Options
+	opts.Addr = node
+	client = New(&opts)
+	c.clients[node] = client
+	return client, nil
+}
+
+// Refresh reloads the slot map from the first node answering CLUSTER SLOTS
+func (c *ClusterClient) Refresh() error {
+	var lastErr error
+	for _, node := range c.knownNodes() {
+		client, err := c.client(node)
+		if err != nil {
+			return err
+		}
+		value, err := client.Do("CLUSTER", "SLOTS")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var slots [slot.Count]string
+		if err := parseSlots(value, &slots); err != nil {
+			lastErr = err
+			continue
+		}
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("mygodis: can not load the slot map: %v", lastErr)
+}
+
+// knownNodes returns the seeds followed by the nodes seen in the slot map
+func (c *ClusterClient) knownNodes() []string {
+	seen := make(map[string]bool)
+	nodes := make([]string, 0, len(c.opts.Addrs))
+	for _, node := range c.opts.Addrs {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, node := range c.slots {
+		if node != "" && !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// parseSlots fills slots with the ranges of a CLUSTER SLOTS reply: start, end, [host, port, id]
+func parseSlots(value interface{}, slots *[slot.Count]string) error {
+	ranges, ok := value.([]interface{})
+	if !ok {
+		return fmt.Errorf("mygodis: unexpected CLUSTER SLOTS reply %v", value)
+	}
+	for _, r := range ranges {
+		fields, ok := r.([]interface{})
+		if !ok || len(fields) < 3 {
+			return fmt.Errorf("mygodis: unexpected slot range %v", r)
+		}
+		start, _ := fields[0].(int64)
+		end, _ := fields[1].(int64)
+		node, ok := fields[2].([]interface{})
+		if !ok || len(node) < 2 || start < 0 || end >= slot.Count || start > end {
+			return fmt.Errorf("mygodis: unexpected slot range %v", r)
+		}
+		host, _ := node[0].(string)
+		port, _ := node[1].(int64)
+		addr := net.JoinHostPort(host, strconv.FormatInt(port, 10))
+		for s := start; s <= end; s++ {
+			slots[s] = addr
+		}
+	}
+	return nil
+}
+
+// keyOf returns the key a command is routed by, false for key-less commands
+func keyOf(args []interface{}) (string, bool) {
+	if len(args) < 2 || keylessCommands[strings.ToUpper(string(toArgs(args[:1])[0]))] {
+		return "", false
+	}
+	return string(toArgs(args[1:2])[0]), true
+}
+
+// nodeOf returns the node serving key, any node for key-less commands or slots not served yet
+func (c *ClusterClient) nodeOf(key string, hasKey bool) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if hasKey {
+		if node := c.slots[slot.Of([]byte(key))]; node != "" {
+			return node
+		}
+	}
+	for _, node := range c.slots {
+		if node != "" {
+			return node
+		}
+	}
+	return c.opts.Addrs[0]
+}
+
+// redirection parses a MOVED or an ASK error, it sets the slot of a MOVED right away
+func (c *ClusterClient) redirection(err error) (node string, ask bool, ok bool) {
+	var e Error
+	if !errors.As(err, &e) {
+		return "", false, false
+	}
+	fields := strings.Fields(string(e))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", false, false
+	}
+	if fields[0] == "ASK" {
+		return fields[2], true, true
+	}
+	if s, convErr := strconv.Atoi(fields[1]); convErr == nil && s >= 0 && s < slot.Count {
+		c.mu.Lock()
+		c.slots[s] = fields[2]
+		c.mu.Unlock()
+	}
+	return fields[2], false, true
+}
+
+// Do executes a command on the node serving its key, following MOVED and ASK redirections
+func (c *ClusterClient) Do(args ...interface{}) (interface{}, error) {
+	key, hasKey := keyOf(args)
+	return c.doOn(c.nodeOf(key, hasKey), args)
+}
+func (c *ClusterClient) doOn(node string, args []interface{}) (interface{}, error) {
+	ask := false
+	for redirects := 0; ; redirects++ {
+		var value interface{}
+		var err error
+		if ask {
+			value, err = c.doAsking(node, args)
+		} else if client, clientErr := c.client(node); clientErr != nil {
+			return nil, clientErr
+		} else {
+			value, err = client.Do(args...)
+		}
+		if err == nil || redirects >= c.opts.MaxRedirects {
+			return value, err
+		}
+		target, isAsk, ok := c.redirection(err)
+		if !ok {
+			var e Error
+			if errors.As(err, &e) || err == Nil {
+				return value, err
+			}
+			// the node may be gone, a fresh map tells where its slots went
+			if c.Refresh() != nil {
+				return value, err
+			}
+			key, hasKey := keyOf(args)
+			target = c.nodeOf(key, hasKey)
+		} else if !isAsk {
+			go func() {
+				_ = c.Refresh()
+			}()
+		}
+		node, ask = target, isAsk
+	}
+}
+
+// Pipeline returns a pipeline sending the commands of every node at once, results keep the order of the commands
+func (c *ClusterClient) Pipeline() *Pipeline {
+	return &Pipeline{exec: c.pipeline}
+}
+func (c *ClusterClient) pipeline(cmds [][]interface{}) ([]Result, error) {
+	byNode := make(map[string][]int)
+	for i, cmd := range cmds {
+		key, hasKey := keyOf(cmd)
+		node := c.nodeOf(key, hasKey)
+		byNode[node] = append(byNode[node], i)
+	}
+	results := make([]Result, len(cmds))
+	var wg sync.WaitGroup
+	for node, indexes := range byNode {
+		wg.Add(1)
+		go func(node string, indexes []int) {
+			defer wg.Done()
+			batch := make([][]interface{}, len(indexes))
+			for i, index := range indexes {
+				batch[i] = cmds[index]
+			}
+			client, err := c.client(node)
+			var nodeResults []Result
+			if err == nil {
+				err = client.withConn(func(conn *Conn) error {
+					var err error
+					nodeResults, err = conn.pipeline(batch)
+					return err
+				})
+			}
+			for i, index := range indexes {
+				if err != nil {
+					results[index].Err = err
+				} else {
+					results[index] = nodeResults[i]
+				}
+			}
+		}(node, indexes)
+	}
+	wg.Wait()
+	// commands sent to a stale owner are redirected one by one
+	for i, result := range results {
+		if target, ask, ok := c.redirection(result.Err); ok {
+			if ask {
+				results[i].Val, results[i].Err = c.doAsking(target, cmds[i])
+			} else {
+				results[i].Val, results[i].Err = c.doOn(target, cmds[i])
+			}
+		}
+	}
+	return results, nil
+}
+
+// doAsking sends ASKING and the command on one connection of node, ASKING only holds for the next command
+func (c *ClusterClient) doAsking(node string, args []interface{}) (interface{}, error) {
+	client, err := c.client(node)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	err = client.withConn(func(conn *Conn) error {
+		results, err := conn.pipeline([][]interface{}{{"ASKING"}, args})
+		if err != nil {
+			return err
+		}
+		value, err = results[1].Val, results[1].Err
+		return err
+	})
+	return value, err
+}
+
+// Watch runs fn on a connection of the node serving keys, all keys must hash to the same slot
+func (c *ClusterClient) Watch(fn func(tx *Tx) error, keys ...string) error {
+	if len(keys) == 0 {
+		return errors.New("mygodis: watch needs a key to route the transaction")
+	}
+	client, err := c.client(c.nodeOf(keys[0], true))
+	if err != nil {
+		return err
+	}
+	return client.Watch(fn, keys...)
+}
+
+// TxPipeline returns a pipeline executed by MULTI and EXEC on the node serving the key of its first command
+func (c *ClusterClient) TxPipeline() *Pipeline {
+	return &Pipeline{exec: func(cmds [][]interface{}) ([]Result, error) {
+		key, hasKey := keyOf(cmds[0])
+		client, err := c.client(c.nodeOf(key, hasKey))
+		if err != nil {
+			return nil, err
+		}
+		return client.TxPipeline().exec(cmds)
+	}}
+}
+
+// Subscribe subscribes channels on any node, messages are published to every node of the cluster
+func (c *ClusterClient) Subscribe(channels ...string) (*PubSub, error) {
+	opts := c.opts.Options
+	return subscribe(c.nodeOf("", false), &opts, channels)
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Commands are the typed helpers shared by Client and ClusterClient, Do is used for anything else
+type Commands struct {
+	do func(args ...interface{}) (interface{}, error)
+}
+
+func keysArgs(command string, keys []string) []interface{} {
+	args := make([]interface{}, 0, len(keys)+1)
+	args = append(args, command)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	return args
+}
+
+func (c Commands) Ping() error {
+	return toOk(c.do("PING"))
+}
+
+// Get returns Nil if key does not exist
+func (c Commands) Get(key string) (string, error) {
+	return toString(c.do("GET", key))
+}
+func (c Commands) Set(key string, value interface{}) error {
+	return toOk(c.do("SET", key, value))
+}
+
+// SetEX sets key expiring after ttl, ttl is rounded down to milliseconds
+func (c Commands) SetEX(key string, value interface{}, ttl time.Duration) error {
+	return toOk(c.do("SET", key, value, "PX", ttl.Milliseconds()))
+}
+
+// SetNX sets key only if it does not exist and reports whether it did
+func (c Commands) SetNX(key string, value interface{}) (bool, error) {
+	return toBool(c.do("SETNX", key, value))
+}
+func (c Commands) Del(keys ...string) (int64, error) {
+	return toInt64(c.do(keysArgs("DEL", keys)...))
+}
+func (c Commands) Exists(keys ...string) (int64, error) {
+	return toInt64(c.do(keysArgs("EXISTS", keys)...))
+}
+func (c Commands) Expire(key string, ttl time.Duration) (bool, error) {
+	return toBool(c.do("PEXPIRE", key, ttl.Milliseconds()))
+}
+
+// TTL returns the time to live of key, -1 if it has none and -2 if it does not exist like redis
+func (c Commands) TTL(key string) (time.Duration, error) {
+	ms, err := toInt64(c.do("PTTL", key))
+	if err != nil || ms < 0 {
+		return time.Duration(ms), err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+func (c Commands) Incr(key string) (int64, error) {
+	return toInt64(c.do("INCR", key))
+}
+func (c Commands) IncrBy(key string, increment int64) (int64, error) {
+	return toInt64(c.do("INCRBY", key, increment))
+}
+func (c Commands) IncrByFloat(key string, increment float64) (float64, error) {
+	return toFloat64(c.do("INCRBYFLOAT", key, increment))
+}
+
+// MGet returns the values of keys in order, a missing key is an empty string
+func (c Commands) MGet(keys ...string) ([]string, error) {
+	return toStrings(c.do(keysArgs("MGET", keys)...))
+}
+
+// MSet sets key value pairs
+func (c Commands) MSet(pairs ...interface{}) error {
+	return toOk(c.do(append([]interface{}{"MSET"}, pairs...)...))
+}
+func (c Commands) HSet(key string, field string, value interface{}) (bool, error) {
+	return toBool(c.do("HSET", key, field, value))
+}
+func (c Commands) HGet(key string, field string) (string, error) {
+	return toString(c.do("HGET", key, field))
+}
+func (c Commands) HGetAll(key string) (map[string]string, error) {
+	return toStringMap(c.do("HGETALL", key))
+}
+func (c Commands) HDel(key string, fields ...string) (int64, error) {
+	return toInt64(c.do(append([]interface{}{"HDEL"}, keysArgs(key, fields)...)...))
+}
+func (c Commands) LPush(key string, values ...interface{}) (int64, error) {
+	return toInt64(c.do(append([]interface{}{"LPUSH", key}, values...)...))
+}
+func (c Commands) RPush(key string, values ...interface{}) (int64, error) {
+	return toInt64(c.do(append([]interface{}{"RPUSH", key}, values...)...))
+}
+func (c Commands) LPop(key string) (string, error) {
+	return toString(c.do("LPOP", key))
+}
+func (c Commands) LRange(key string, start, stop int64) ([]string, error) {
+	return toStrings(c.do("LRANGE", key, start, stop))
+}
+func (c Commands) SAdd(key string, members ...interface{}) (int64, error) {
+	return toInt64(c.do(append([]interface{}{"SADD", key}, members...)...))
+}
+func (c Commands) SMembers(key string) ([]string, error) {
+	return toStrings(c.do("SMEMBERS", key))
+}
+func (c Commands) SIsMember(key string, member interface{}) (bool, error) {
+	return toBool(c.do("SISMEMBER", key, member))
+}
+func (c Commands) ZAdd(key string, score float64, member interface{}) (int64, error) {
+	return toInt64(c.do("ZADD", key, score, member))
+}
+func (c Commands) ZScore(key string, member interface{}) (float64, error) {
+	return toFloat64(c.do("ZSCORE", key, member))
+}
+
+// Publish posts message on channel and returns the number of subscribers that received it
+func (c Commands) Publish(channel string, message interface{}) (int64, error) {
+	return toInt64(c.do("PUBLISH", channel, message))
+}
+func (c Commands) Keys(pattern string) ([]string, error) {
+	return toStrings(c.do("KEYS", pattern))
+}
+func (c Commands) DBSize() (int64, error) {
+	return toInt64(c.do("DBSIZE"))
+}
+func (c Commands) FlushDB() error {
+	return toOk(c.do("FLUSHDB"))
+}
+
+// Info returns the INFO lines of section joined by newlines, every section if it is empty
+func (c Commands) Info(section string) (string, error) {
+	args := []interface{}{"INFO"}
+	if section != "" {
+		args = append(args, section)
+	}
+	lines, err := toStrings(c.do(args...))
+	return strings.Join(lines, "\n"), err
+}
+
+// ClusterNodes returns the lines of CLUSTER NODES
+func (c Commands) ClusterNodes() (string, error) {
+	return toString(c.do("CLUSTER", "NODES"))
+}
+func (c Commands) ClusterInfo() (string, error) {
+	return toString(c.do("CLUSTER", "INFO"))
+}
+
+// ClusterDistribution returns one line per node with its weight, ring share and slots
+func (c Commands) ClusterDistribution() ([]string, error) {
+	return toStrings(c.do("CLUSTER", "DISTRIBUTION"))
+}
+func (c Commands) ClusterKeySlot(key string) (int64, error) {
+	return toInt64(c.do("CLUSTER", "KEYSLOT", key))
+}
+
+// ClusterOrphans returns at most count keys of the node stored outside of their owner as db, key, owner
+// triples flattened, count < 0 returns them all
+func (c Commands) ClusterOrphans(count int) ([]string, error) {
+	if count < 0 {
+		return toStrings(c.do("CLUSTER", "ORPHANS"))
+	}
+	return toStrings(c.do("CLUSTER", "ORPHANS", strconv.Itoa(count)))
+}
+
+// ClusterFixOrphans moves the orphans of the node to their owners and returns how many there were
+func (c Commands) ClusterFixOrphans() (int64, error) {
+	return toInt64(c.do("CLUSTER", "FIXORPHANS"))
+}
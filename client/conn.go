@@ -0,0 +1,135 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"mygodis/parse"
+	"mygodis/resp"
+	"net"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrClosed is returned by a closed client
+	ErrClosed = errors.New("mygodis: client closed")
+	// ErrTimeout is returned when the server does not answer within ReadTimeout, the connection is dropped
+	ErrTimeout = errors.New("mygodis: timeout waiting for reply")
+)
+
+// Conn is one connection to a server, the replies of the commands written are read in order
+type Conn struct {
+	conn    net.Conn
+	writer  *bufio.Writer
+	replies <-chan *parse.Payload
+	timeout time.Duration
+	// broken is set once the connection can not be trusted to be in sync with the server
+	broken bool
+}
+
+// dial connects to addr, authenticates and selects the db of opts
+func dial(addr string, opts *Options) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, opts.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		conn:    conn,
+		writer:  bufio.NewWriter(conn),
+		replies: parse.Parse(conn),
+		timeout: opts.ReadTimeout,
+	}
+	if opts.Password != "" {
+		if _, err := c.Do("AUTH", opts.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if opts.DB != 0 {
+		if _, err := c.Do("SELECT", opts.DB); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// write sends cmds without waiting for their replies
+func (c *Conn) write(cmds ...[]interface{}) error {
+	for _, cmd := range cmds {
+		args := toArgs(cmd)
+		_, _ = c.writer.WriteString("*" + strconv.Itoa(len(args)) + resp.CRLF)
+		for _, arg := range args {
+			_, _ = c.writer.WriteString("$" + strconv.Itoa(len(arg)) + resp.CRLF)
+			_, _ = c.writer.Write(arg)
+			_, _ = c.writer.WriteString(resp.CRLF)
+		}
+	}
+	if err := c.writer.Flush(); err != nil {
+		c.broken = true
+		return err
+	}
+	return nil
+}
+
+// read returns the next reply, it waits at most timeout if timeout is positive
+func (c *Conn) read(timeout time.Duration) (resp.Reply, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case payload, ok := <-c.replies:
+		if !ok {
+			c.broken = true
+			return nil, ErrClosed
+		}
+		if payload.Err != nil {
+			c.broken = true
+			return nil, payload.Err
+		}
+		return payload.Data, nil
+	case <-expired:
+		c.broken = true
+		return nil, ErrTimeout
+	}
+}
+
+// Do executes one command
+func (c *Conn) Do(args ...interface{}) (interface{}, error) {
+	if err := c.write(args); err != nil {
+		return nil, err
+	}
+	reply, err := c.read(c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return toValue(reply)
+}
+
+// pipeline writes cmds at once and reads their replies, a failed command does not fail the others
+func (c *Conn) pipeline(cmds [][]interface{}) ([]Result, error) {
+	if err := c.write(cmds...); err != nil {
+		return nil, err
+	}
+	results := make([]Result, len(cmds))
+	for i := range cmds {
+		reply, err := c.read(c.timeout)
+		if err != nil {
+			return nil, err
+		}
+		results[i].Val, results[i].Err = toValue(reply)
+	}
+	return results, nil
+}
+
+// Close closes the connection, the replies still parsed are dropped
+func (c *Conn) Close() {
+	_ = c.conn.Close()
+	go func(replies <-chan *parse.Payload) {
+		for range replies {
+		}
+	}(c.replies)
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"errors"
+	"mygodis/resp"
+)
+
+// TxFailed is returned by EXEC when a watched key was changed, none of the queued commands was executed
+var TxFailed = errors.New("mygodis: transaction failed")
+
+// Result is the value or the error of one command of a pipeline
+type Result struct {
+	Val interface{}
+	Err error
+}
+
+// Pipeline queues commands and sends them together on Exec
+type Pipeline struct {
+	cmds [][]interface{}
+	exec func(cmds [][]interface{}) ([]Result, error)
+}
+
+// Do queues a command
+func (p *Pipeline) Do(args ...interface{}) {
+	p.cmds = append(p.cmds, args)
+}
+
+// Len returns the number of queued commands
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Exec sends the queued commands and returns their results in order, the pipeline is empty afterwards
+func (p *Pipeline) Exec() ([]Result, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	return p.exec(cmds)
+}
+
+// Tx is a connection used by a transaction, Do executes at once and the commands queued by Queue are executed
+// atomically by Exec
+type Tx struct {
+	conn   *Conn
+	queued [][]interface{}
+}
+
+// watch runs fn on conn watching keys, the keys are unwatched whatever fn does
+func watch(conn *Conn, fn func(tx *Tx) error, keys []string) error {
+	if len(keys) > 0 {
+		args := make([]interface{}, 0, len(keys)+1)
+		args = append(args, "WATCH")
+		for _, key := range keys {
+			args = append(args, key)
+		}
+		if _, err := conn.Do(args...); err != nil {
+			return err
+		}
+	}
+	err := fn(&Tx{conn: conn})
+	if !conn.broken {
+		if _, unwatchErr := conn.Do("UNWATCH"); unwatchErr != nil && err == nil {
+			err = unwatchErr
+		}
+	}
+	return err
+}
+
+// Do executes a command at once, e.g. to read the watched keys
+func (tx *Tx) Do(args ...interface{}) (interface{}, error) {
+	return tx.conn.Do(args...)
+}
+
+// Queue adds a command to the transaction
+func (tx *Tx) Queue(args ...interface{}) {
+	tx.queued = append(tx.queued, args)
+}
+
+// Exec executes the queued commands with MULTI and EXEC
+func (tx *Tx) Exec() ([]Result, error) {
+	cmds := tx.queued
+	tx.queued = nil
+	return tx.exec(cmds)
+}
+
+// exec writes MULTI, cmds and EXEC at once, the reply of every command is taken from the one of EXEC
+func (tx *Tx) exec(cmds [][]interface{}) ([]Result, error) {
+	all := make([][]interface{}, 0, len(cmds)+2)
+	all = append(all, []interface{}{"MULTI"})
+	all = append(all, cmds...)
+	all = append(all, []interface{}{"EXEC"})
+	if err := tx.conn.write(all...); err != nil {
+		return nil, err
+	}
+	var queueErr error
+	for range all[:len(all)-1] {
+		reply, err := tx.conn.read(tx.conn.timeout)
+		if err != nil {
+			return nil, err
+		}
+		if errReply, ok := reply.(resp.ErrorReply); ok && queueErr == nil {
+			queueErr = Error(errReply.Error())
+		}
+	}
+	reply, err := tx.conn.read(tx.conn.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, empty := reply.(*resp.EmptyMultiBulkReply); empty && len(cmds) > 0 {
+		return nil, TxFailed
+	}
+	if _, null := reply.(*resp.NullBulkReply); null {
+		return nil, TxFailed
+	}
+	value, err := toValue(reply)
+	if err != nil {
+		// EXECABORT tells little, the error of the rejected command is more helpful
+		if queueErr != nil {
+			return nil, queueErr
+		}
+		return nil, err
+	}
+	values, _ := value.([]interface{})
+	results := make([]Result, len(cmds))
+	for i := range results {
+		if i >= len(values) {
+			results[i].Err = errors.New("mygodis: missing reply of EXEC")
+			continue
+		}
+		switch v := values[i].(type) {
+		case error:
+			results[i].Err = v
+		case nil:
+			results[i].Err = Nil
+		default:
+			results[i].Val = v
+		}
+	}
+	return results, nil
+}
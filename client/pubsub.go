@@ -0,0 +1,157 @@
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Message is a message published on a subscribed channel
+type Message struct {
+	Channel string
+	Payload string
+}
+
+// PubSub is a connection of its own in subscribed state, messages are delivered by Channel until Close
+type PubSub struct {
+	conn *Conn
+	// mu serializes Subscribe and Unsubscribe, the replies are read by receive only
+	mu         sync.Mutex
+	subscribed map[string]bool
+	// confirmed counts the confirmations of SUBSCRIBE and UNSUBSCRIBE, confirmC wakes up the waiting call
+	confirmed int64
+	confirmC  chan struct{}
+	messages  chan *Message
+	done      chan struct{}
+	once      sync.Once
+}
+
+// subscribe dials addr and subscribes channels, it returns once the server confirmed them
+func subscribe(addr string, opts *Options, channels []string) (*PubSub, error) {
+	conn, err := dial(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	ps := &PubSub{
+		conn:       conn,
+		subscribed: make(map[string]bool),
+		confirmC:   make(chan struct{}, 1),
+		messages:   make(chan *Message, 128),
+		done:       make(chan struct{}),
+	}
+	go ps.receive()
+	if len(channels) > 0 {
+		if err := ps.Subscribe(channels...); err != nil {
+			ps.Close()
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// Channel returns the messages received, it is closed when the connection is
+func (ps *PubSub) Channel() <-chan *Message {
+	return ps.messages
+}
+
+// Subscribe adds channels and waits until the server confirmed every one
+func (ps *PubSub) Subscribe(channels ...string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, channel := range channels {
+		ps.subscribed[channel] = true
+	}
+	return ps.send("SUBSCRIBE", channels, len(channels))
+}
+
+// Unsubscribe leaves channels, every channel if none is given
+func (ps *PubSub) Unsubscribe(channels ...string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	// the server confirms every channel left, or once if there was none
+	left := channels
+	if len(left) == 0 {
+		for channel := range ps.subscribed {
+			left = append(left, channel)
+		}
+	}
+	for _, channel := range left {
+		delete(ps.subscribed, channel)
+	}
+	confirmations := len(left)
+	if confirmations == 0 {
+		confirmations = 1
+	}
+	return ps.send("UNSUBSCRIBE", channels, confirmations)
+}
+
+// send writes the command and waits for confirmations, it must be called with mu held
+func (ps *PubSub) send(command string, channels []string, confirmations int) error {
+	args := make([]interface{}, 0, len(channels)+1)
+	args = append(args, command)
+	for _, channel := range channels {
+		args = append(args, channel)
+	}
+	target := atomic.LoadInt64(&ps.confirmed) + int64(confirmations)
+	if err := ps.conn.write(args); err != nil {
+		return err
+	}
+	var expired <-chan time.Time
+	if ps.conn.timeout > 0 {
+		timer := time.NewTimer(ps.conn.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for atomic.LoadInt64(&ps.confirmed) < target {
+		select {
+		case <-ps.confirmC:
+		case <-ps.done:
+			return ErrClosed
+		case <-expired:
+			return ErrTimeout
+		}
+	}
+	return nil
+}
+
+// receive reads the pushes of the server until the connection closes
+func (ps *PubSub) receive() {
+	defer close(ps.messages)
+	for {
+		reply, err := ps.conn.read(0)
+		if err != nil {
+			ps.Close()
+			return
+		}
+		value, err := toValue(reply)
+		push, ok := value.([]interface{})
+		if err != nil || !ok || len(push) < 3 {
+			continue
+		}
+		kind, _ := push[0].(string)
+		switch kind {
+		case "message":
+			channel, _ := push[1].(string)
+			payload, _ := push[2].(string)
+			select {
+			case ps.messages <- &Message{Channel: channel, Payload: payload}:
+			case <-ps.done:
+				return
+			}
+		case "subscribe", "unsubscribe":
+			atomic.AddInt64(&ps.confirmed, 1)
+			select {
+			case ps.confirmC <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Close closes the connection and the channel of messages
+func (ps *PubSub) Close() {
+	ps.once.Do(func() {
+		close(ps.done)
+		ps.conn.Close()
+	})
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"mygodis/resp"
+	"strconv"
+)
+
+// Nil is returned when the key or the value does not exist
+var Nil = errors.New("mygodis: nil")
+
+// Error is an error reply of the server
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// toValue turns a reply into a go value: string, int64, nil or []interface{} of them, error replies become errors
+func toValue(reply resp.Reply) (interface{}, error) {
+	switch r := reply.(type) {
+	case resp.ErrorReply:
+		return nil, Error(r.Error())
+	case *resp.SimpleStringReply:
+		return r.SimpleString, nil
+	case *resp.IntReply:
+		return r.Code, nil
+	case *resp.BulkReply:
+		if r.Arg == nil {
+			return nil, Nil
+		}
+		return string(r.Arg), nil
+	case *resp.NullBulkReply:
+		return nil, Nil
+	case *resp.EmptyMultiBulkReply:
+		return []interface{}{}, nil
+	case *resp.MultiBulkReply:
+		values := make([]interface{}, len(r.Args))
+		for i, arg := range r.Args {
+			if arg != nil {
+				values[i] = string(arg)
+			}
+		}
+		return values, nil
+	case *resp.MultiRawReply:
+		values := make([]interface{}, 0, len(r.Replies()))
+		for _, element := range r.Replies() {
+			value, err := toValue(element)
+			if err != nil && err != Nil {
+				value = err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("mygodis: unexpected reply %q", reply.ToBytes())
+}
+
+// toArgs formats the arguments of a command
+func toArgs(args []interface{}) [][]byte {
+	line := make([][]byte, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			line[i] = []byte(v)
+		case []byte:
+			line[i] = v
+		case int:
+			line[i] = []byte(strconv.Itoa(v))
+		case int64:
+			line[i] = []byte(strconv.FormatInt(v, 10))
+		case float64:
+			line[i] = []byte(strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			if v {
+				line[i] = []byte("1")
+			} else {
+				line[i] = []byte("0")
+			}
+		default:
+			line[i] = []byte(fmt.Sprint(v))
+		}
+	}
+	return line
+}
+
+func toString(v interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("mygodis: unexpected value %v", v)
+	}
+	return s, nil
+}
+func toInt64(v interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch n := v.(type) {
+	case int64:
+		return n, nil
+	case string:
+		return strconv.ParseInt(n, 10, 64)
+	}
+	return 0, fmt.Errorf("mygodis: unexpected value %v", v)
+}
+func toFloat64(v interface{}, err error) (float64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch n := v.(type) {
+	case int64:
+		return float64(n), nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	}
+	return 0, fmt.Errorf("mygodis: unexpected value %v", v)
+}
+func toBool(v interface{}, err error) (bool, error) {
+	n, err := toInt64(v, err)
+	return n == 1, err
+}
+func toOk(v interface{}, err error) error {
+	_, err = toString(v, err)
+	return err
+}
+
+// toStrings reads an array, missing values are empty strings
+func toStrings(v interface{}, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	values, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("mygodis: unexpected value %v", v)
+	}
+	result := make([]string, len(values))
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			result[i] = s
+		}
+	}
+	return result, nil
+}
+
+// toStringMap reads an array of field value pairs
+func toStringMap(v interface{}, err error) (map[string]string, error) {
+	pairs, err := toStrings(v, err)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		result[pairs[i]] = pairs[i+1]
+	}
+	return result, nil
+}
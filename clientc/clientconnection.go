@@ -35,7 +35,7 @@ type ClientConnection struct {
 
 	// queued commands for `multi`
 	queue    []cm.CmdLine
-	watching map[string]uint32
+	watching map[string]uint64
 	txErrors []error
 
 	// selected db
@@ -93,20 +93,29 @@ func (c *ClientConnection) GetPassword() string {
 }
 
 func (c *ClientConnection) Subscribe(channel string) {
-	//TODO implement me
-	panic("implement me")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subs == nil {
+		c.subs = make(map[string]bool)
+	}
+	c.subs[channel] = true
 }
 
 func (c *ClientConnection) UnSubscribe(channel string) {
-	//TODO implement me
-	panic("implement me")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.subs, channel)
 }
 
 func (c *ClientConnection) SubsCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return len(c.subs)
 }
 
 func (c *ClientConnection) GetChannels() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	channels := make([]string, 0, len(c.subs))
 	for channel := range c.subs {
 		channels = append(channels, channel)
@@ -141,9 +150,9 @@ func (c *ClientConnection) ClearQueuedCmds() {
 	c.queue = nil
 }
 
-func (c *ClientConnection) GetWatching() map[string]uint32 {
+func (c *ClientConnection) GetWatching() map[string]uint64 {
 	if c.watching == nil {
-		return make(map[string]uint32)
+		c.watching = make(map[string]uint64)
 	}
 	return c.watching
 }
@@ -1,122 +1,124 @@
 package clientc
 
-import cm "mygodis/common"
+import (
+	"bytes"
+	cm "mygodis/common"
+	"sync"
+)
 
+// FakeConnection is an in memory connection used to execute commands without a client, e.g. when loading aof
 type FakeConnection struct {
 	DBindex int
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	password string
+	subs     map[string]bool
+	multi    bool
+	queue    []cm.CmdLine
+	watching map[string]uint64
+	txErrors []error
+	slave    bool
+	master   bool
 }
 
 func NewFakeConnection() *FakeConnection {
 	return &FakeConnection{}
 }
-func (f *FakeConnection) Write(bytes []byte) (int, error) {
-	//TODO implement me
-	panic("implement me")
+
+// Write keeps the bytes so they can be read by Bytes
+func (f *FakeConnection) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.buf.Write(b)
 }
 
+// Bytes returns and clears everything written to the connection
+func (f *FakeConnection) Bytes() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b := append([]byte(nil), f.buf.Bytes()...)
+	f.buf.Reset()
+	return b
+}
 func (f *FakeConnection) Close() error {
-	//TODO implement me
-	panic("implement me")
+	return nil
 }
-
 func (f *FakeConnection) SetPassword(s string) {
-	//TODO implement me
-	panic("implement me")
+	f.password = s
 }
-
 func (f *FakeConnection) GetPassword() string {
-	//TODO implement me
-	panic("implement me")
+	return f.password
 }
-
 func (f *FakeConnection) Subscribe(channel string) {
-	//TODO implement me
-	panic("implement me")
+	if f.subs == nil {
+		f.subs = make(map[string]bool)
+	}
+	f.subs[channel] = true
 }
-
 func (f *FakeConnection) UnSubscribe(channel string) {
-	//TODO implement me
-	panic("implement me")
+	delete(f.subs, channel)
 }
-
 func (f *FakeConnection) SubsCount() int {
-	//TODO implement me
-	panic("implement me")
+	return len(f.subs)
 }
-
 func (f *FakeConnection) GetChannels() []string {
-	//TODO implement me
-	panic("implement me")
+	channels := make([]string, 0, len(f.subs))
+	for channel := range f.subs {
+		channels = append(channels, channel)
+	}
+	return channels
 }
-
 func (f *FakeConnection) InMultiState() bool {
-	return false
+	return f.multi
 }
-
 func (f *FakeConnection) SetMultiState(b bool) {
-	//TODO implement me
-	panic("implement me")
+	if !b {
+		f.watching = nil
+		f.txErrors = nil
+		f.queue = nil
+	}
+	f.multi = b
 }
-
 func (f *FakeConnection) GetQueuedCmdLine() []cm.CmdLine {
-	//TODO implement me
-	panic("implement me")
+	return f.queue
 }
-
 func (f *FakeConnection) EnqueueCmd(i [][]byte) {
-	//TODO implement me
-	panic("implement me")
+	f.queue = append(f.queue, i)
 }
-
 func (f *FakeConnection) ClearQueuedCmds() {
-	//TODO implement me
-	panic("implement me")
+	f.queue = nil
 }
-
-func (f *FakeConnection) GetWatching() map[string]uint32 {
-	//TODO implement me
-	panic("implement me")
+func (f *FakeConnection) GetWatching() map[string]uint64 {
+	if f.watching == nil {
+		f.watching = make(map[string]uint64)
+	}
+	return f.watching
 }
-
 func (f *FakeConnection) AddTxError(err error) {
-	//TODO implement me
-	panic("implement me")
+	f.txErrors = append(f.txErrors, err)
 }
-
 func (f *FakeConnection) GetTxErrors() []error {
-	//TODO implement me
-	panic("implement me")
+	return f.txErrors
 }
-
 func (f *FakeConnection) GetDBIndex() int {
 	return f.DBindex
 }
-
 func (f *FakeConnection) SelectDB(i int) {
 	f.DBindex = i
 }
-
 func (f *FakeConnection) SetSlave() {
-	//TODO implement me
-	panic("implement me")
+	f.slave = true
 }
-
 func (f *FakeConnection) IsSlave() bool {
-	//TODO implement me
-	panic("implement me")
+	return f.slave
 }
-
 func (f *FakeConnection) SetMaster() {
-	//TODO implement me
-	panic("implement me")
+	f.master = true
 }
-
 func (f *FakeConnection) IsMaster() bool {
-	//TODO implement me
-	panic("implement me")
+	return f.master
 }
-
 func (f *FakeConnection) Name() string {
-	//TODO implement me
-	panic("implement me")
+	return "fake"
 }
@@ -0,0 +1,399 @@
+// Package admin implements mygodis cluster, the tool creating, checking and repairing a cluster from outside
+package admin
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mygodis/cluster"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: mygodis cluster [-a password] [-wait duration] <command> <args>
+
+commands:
+  create <addr> <addr>...   let every node join the cluster of the first one
+  check <addr>              compare the ring and the epoch of every member
+  orphans <addr>            list the keys stored on nodes which do not own them
+  fix <addr>                move the orphaned keys to their owners
+  wait <addr>               wait for running migrations and print their progress
+  distribution <addr>       print keys, memory, ring share and slots of every node
+`
+
+// pollInterval is how often fix and wait look at the progress of the nodes
+const pollInterval = 200 * time.Millisecond
+
+var (
+	errInconsistent = errors.New("the members do not agree on the topology")
+	errOrphans      = errors.New("orphaned keys are left")
+	errRunning      = errors.New("migrations are still running")
+)
+
+// Admin talks to the members of one cluster
+type Admin struct {
+	out      io.Writer
+	password string
+	clients  map[string]*cluster.Client
+	// wait bounds how long fix and wait poll the nodes before giving up
+	wait time.Duration
+}
+
+func New(out io.Writer, password string, wait time.Duration) *Admin {
+	return &Admin{
+		out:      out,
+		password: password,
+		clients:  make(map[string]*cluster.Client),
+		wait:     wait,
+	}
+}
+
+// Close closes the connections to the nodes
+func (a *Admin) Close() {
+	for _, client := range a.clients {
+		client.Close()
+	}
+}
+
+// Run executes the command line of mygodis cluster and returns the exit code
+func Run(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("cluster", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		_, _ = fmt.Fprint(out, usage)
+	}
+	password := flags.String("a", "", "password of the nodes")
+	wait := flags.Duration("wait", time.Minute, "how long fix and wait poll the nodes")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	args = flags.Args()
+	if len(args) < 2 {
+		flags.Usage()
+		return 2
+	}
+	a := New(out, *password, *wait)
+	defer a.Close()
+	var err error
+	switch args[0] {
+	case "create":
+		err = a.Create(args[1:])
+	case "check":
+		err = a.Check(args[1])
+	case "orphans":
+		_, err = a.Orphans(args[1], true)
+	case "fix":
+		err = a.Fix(args[1])
+	case "wait":
+		err = a.Wait(args[1])
+	case "distribution":
+		err = a.Distribution(args[1])
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(out, "[ERR]", err)
+		return 1
+	}
+	return 0
+}
+
+// send executes a command on node, error replies are returned as errors
+func (a *Admin) send(node string, args ...string) (resp.Reply, error) {
+	client, ok := a.clients[node]
+	if !ok {
+		client = cluster.MakeClient(node)
+		client.SetPassword(a.password)
+		if err := client.Start(); err != nil {
+			return nil, err
+		}
+		a.clients[node] = client
+	}
+	reply, err := client.Send(cmdutil.ToCmdLine(args...))
+	if err != nil {
+		return nil, err
+	}
+	if errReply, ok := reply.(resp.ErrorReply); ok {
+		return nil, errors.New(errReply.Error())
+	}
+	return reply, nil
+}
+
+// lines executes a command replying a multi bulk of strings on node
+func (a *Admin) lines(node string, args ...string) ([]string, error) {
+	reply, err := a.send(node, args...)
+	if err != nil {
+		return nil, err
+	}
+	if _, empty := reply.(*resp.EmptyMultiBulkReply); empty {
+		return nil, nil
+	}
+	multiBulk, ok := reply.(*resp.MultiBulkReply)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %q", reply.ToBytes())
+	}
+	lines := make([]string, len(multiBulk.Args))
+	for i, arg := range multiBulk.Args {
+		lines[i] = string(arg)
+	}
+	return lines, nil
+}
+
+// topology returns the epoch and the serialized ring of node
+func (a *Admin) topology(node string) (int64, []byte, error) {
+	lines, err := a.lines(node, "CLUSTER", "TOPOLOGY")
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(lines) != 2 {
+		return 0, nil, fmt.Errorf("unexpected topology of %s", node)
+	}
+	epoch, err := strconv.ParseInt(lines[0], 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+	return epoch, []byte(lines[1]), nil
+}
+
+// members returns the members of the ring of node in order
+func (a *Admin) members(node string) ([]string, error) {
+	_, ring, err := a.topology(node)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := cluster.LoadFrom(ring)
+	if err != nil {
+		return nil, err
+	}
+	nodes := ch.GetNodes()
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// Create lets every node of addrs but the first one meet the first one, the members are checked afterwards
+func (a *Admin) Create(addrs []string) error {
+	if len(addrs) < 2 {
+		return errors.New("create needs at least two nodes")
+	}
+	seed := addrs[0]
+	for _, node := range addrs[1:] {
+		if _, err := a.send(node, "CLUSTER", "MEET", seed); err != nil {
+			return fmt.Errorf("%s can not join %s: %v", node, seed, err)
+		}
+		_, _ = fmt.Fprintf(a.out, "%s joined %s\n", node, seed)
+	}
+	return a.Check(seed)
+}
+
+// Check compares the ring and the epoch every member reports with the ones of node
+func (a *Admin) Check(node string) error {
+	epoch, ring, err := a.topology(node)
+	if err != nil {
+		return err
+	}
+	members, err := a.members(node)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(a.out, "%s knows %d members at epoch %d\n", node, len(members), epoch)
+	consistent := true
+	for _, member := range members {
+		memberEpoch, memberRing, err := a.topology(member)
+		switch {
+		case err != nil:
+			consistent = false
+			_, _ = fmt.Fprintf(a.out, "[ERR] %s: %v\n", member, err)
+		case string(memberRing) != string(ring):
+			consistent = false
+			_, _ = fmt.Fprintf(a.out, "[ERR] %s has a different ring at epoch %d\n", member, memberEpoch)
+		case memberEpoch != epoch:
+			_, _ = fmt.Fprintf(a.out, "[WARN] %s has the same ring at epoch %d\n", member, memberEpoch)
+		default:
+			_, _ = fmt.Fprintf(a.out, "[OK] %s\n", member)
+		}
+	}
+	if !consistent {
+		return errInconsistent
+	}
+	_, _ = fmt.Fprintln(a.out, "[OK] all members agree on the ring")
+	return nil
+}
+
+// Orphan is a key stored on a node which does not own it
+type Orphan struct {
+	Node  string
+	DB    string
+	Key   string
+	Owner string
+}
+
+// Orphans asks every member for the keys it stores but does not own, they are printed if verbose
+func (a *Admin) Orphans(node string, verbose bool) ([]Orphan, error) {
+	members, err := a.members(node)
+	if err != nil {
+		return nil, err
+	}
+	orphans := make([]Orphan, 0)
+	for _, member := range members {
+		lines, err := a.lines(member, "CLUSTER", "ORPHANS")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", member, err)
+		}
+		for i := 0; i+2 < len(lines); i += 3 {
+			orphans = append(orphans, Orphan{Node: member, DB: lines[i], Key: lines[i+1], Owner: lines[i+2]})
+		}
+	}
+	if verbose {
+		for _, o := range orphans {
+			_, _ = fmt.Fprintf(a.out, "%s db%s %s -> %s\n", o.Node, o.DB, o.Key, o.Owner)
+		}
+		_, _ = fmt.Fprintf(a.out, "%d orphaned keys\n", len(orphans))
+	}
+	return orphans, nil
+}
+
+// Fix asks every member to move its orphaned keys and waits until none is left
+func (a *Admin) Fix(node string) error {
+	members, err := a.members(node)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		reply, err := a.send(member, "CLUSTER", "FIXORPHANS")
+		if err != nil {
+			return fmt.Errorf("%s: %v", member, err)
+		}
+		if count, ok := reply.(*resp.IntReply); ok && count.Code > 0 {
+			_, _ = fmt.Fprintf(a.out, "%s moves %d orphaned keys\n", member, count.Code)
+		}
+	}
+	deadline := time.Now().Add(a.wait)
+	for {
+		orphans, err := a.Orphans(node, false)
+		if err != nil {
+			return err
+		}
+		if len(orphans) == 0 {
+			_, _ = fmt.Fprintln(a.out, "[OK] no orphaned keys")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			_, _ = fmt.Fprintf(a.out, "%d orphaned keys left\n", len(orphans))
+			return errOrphans
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Wait prints the migrations of every member until none is running, the nodes start them by themselves
+func (a *Admin) Wait(node string) error {
+	members, err := a.members(node)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(a.wait)
+	for {
+		running := 0
+		for _, member := range members {
+			tasks, err := a.lines(member, "CLUSTER", "REBALANCE", "STATUS")
+			if err != nil {
+				return fmt.Errorf("%s: %v", member, err)
+			}
+			for _, task := range tasks {
+				if strings.Contains(task, "state=running") {
+					running++
+					_, _ = fmt.Fprintf(a.out, "%s %s\n", member, task)
+				}
+			}
+		}
+		if running == 0 {
+			_, _ = fmt.Fprintln(a.out, "[OK] no migration is running")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errRunning
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Distribution prints the keys and the memory of every node together with its share of the ring and the slots
+func (a *Admin) Distribution(node string) error {
+	info, err := a.lines(node, "INFO", "cluster")
+	if err != nil {
+		return err
+	}
+	shares, err := a.lines(node, "CLUSTER", "DISTRIBUTION")
+	if err != nil {
+		return err
+	}
+	rows := make(map[string]map[string]string)
+	row := func(addr string) map[string]string {
+		if _, ok := rows[addr]; !ok {
+			rows[addr] = make(map[string]string)
+		}
+		return rows[addr]
+	}
+	for _, line := range info {
+		if !strings.HasPrefix(line, "node") {
+			continue
+		}
+		_, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		fields := parseFields(value, ",")
+		if fields["addr"] != "" {
+			r := row(fields["addr"])
+			for k, v := range fields {
+				r[k] = v
+			}
+		}
+	}
+	for _, line := range shares {
+		fields := parseFields(line, " ")
+		if fields["node"] != "" {
+			r := row(fields["node"])
+			for k, v := range fields {
+				r[k] = v
+			}
+		}
+	}
+	nodes := make([]string, 0, len(rows))
+	for addr := range rows {
+		nodes = append(nodes, addr)
+	}
+	sort.Strings(nodes)
+	w := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NODE\tSTATUS\tKEYS\tMEMORY\tWEIGHT\tRING\tSLOTS")
+	for _, addr := range nodes {
+		r := rows[addr]
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			addr, orDash(r["status"]), orDash(r["keys"]), orDash(r["used_memory"]), orDash(r["weight"]), orDash(r["ring"]), orDash(r["slots"]))
+	}
+	return w.Flush()
+}
+
+// parseFields reads k=v pairs separated by sep
+func parseFields(s string, sep string) map[string]string {
+	fields := make(map[string]string)
+	for _, pair := range strings.Split(s, sep) {
+		if k, v, found := strings.Cut(pair, "="); found {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"bytes"
+	"mygodis/clientc"
+	"mygodis/cluster"
+	"mygodis/config"
+	"mygodis/parse"
+	"mygodis/resp"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startNode serves a cluster node of its own on a loopback port
+func startNode(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	config.Properties = &config.ServerProperties{
+		Self:      listener.Addr().String(),
+		Databases: 16,
+	}
+	c := cluster.MakeCluster()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				connection := clientc.NewConn(conn)
+				for payload := range parse.Parse(conn) {
+					if payload.Err != nil {
+						_ = conn.Close()
+						return
+					}
+					if line, ok := payload.Data.(*resp.MultiBulkReply); ok {
+						_, _ = conn.Write(c.Exec(connection, line.Args).ToBytes())
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestAdmin(t *testing.T) {
+	a, b := startNode(t), startNode(t)
+	out := &bytes.Buffer{}
+	if code := Run([]string{"create", a, b}, out); code != 0 {
+		t.Fatalf("except create to succeed but got %d: %s", code, out)
+	}
+	if !strings.Contains(out.String(), "all members agree") {
+		t.Errorf("except a consistent ring after create but got %s", out)
+	}
+
+	// a key written on both nodes around the routing is an orphan on the one not owning it
+	admin := New(out, "", 5*time.Second)
+	defer admin.Close()
+	if lines, err := admin.lines(a, "CLUSTER", "ORPHANS"); err != nil || len(lines) != 0 {
+		t.Fatalf("except no orphans yet but got %v %v", lines, err)
+	}
+	for _, node := range []string{a, b} {
+		if _, err := admin.send(node, "CLUSTER", "LOCALEXEC", "0", "SET", "orphan", "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orphans, err := admin.Orphans(a, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 {
+		t.Fatalf("except one orphan but got %v", orphans)
+	}
+	stray := orphans[0].Node
+	if err := admin.Fix(a); err != nil {
+		t.Fatalf("fix: %v\n%s", err, out)
+	}
+	if reply, _ := admin.send(stray, "CLUSTER", "LOCALEXEC", "0", "EXISTS", "orphan"); string(reply.ToBytes()) != ":0\r\n" {
+		t.Errorf("except orphan removed from %s but got %q", stray, reply.ToBytes())
+	}
+
+	out.Reset()
+	if code := Run([]string{"wait", a}, out); code != 0 || !strings.Contains(out.String(), "no migration is running") {
+		t.Errorf("except wait to find no running migration but got %d: %s", code, out)
+	}
+
+	out.Reset()
+	if err := admin.Distribution(a); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range []string{a, b} {
+		if !strings.Contains(out.String(), node) {
+			t.Errorf("except %s in distribution but got\n%s", node, out)
+		}
+	}
+}
@@ -1,65 +1,265 @@
 package cluster
 
 import (
+	"bytes"
+	"errors"
 	cm "mygodis/common"
+	logger "mygodis/log"
 	"mygodis/parse"
 	"mygodis/resp"
+	"mygodis/util/cmdutil"
 	"net"
 	"sync"
 	"time"
 )
 
 const timeout = 3 * time.Second
-const bufferSize = 1 << 12
 
+// maxBatch is the most requests written to a peer with one write
+const maxBatch = 256
+
+// maxInFlight is the most requests waiting for their replies on one connection
+const maxInFlight = 1 << 12
+
+// reconnectInterval is how long a client waits before dialing a peer again after a failed dial
+const reconnectInterval = 200 * time.Millisecond
+
+var (
+	errClientClosed = errors.New("client closed")
+	errTimeout      = errors.New("timeout waiting for reply")
+)
+
+// request is a command waiting for its reply
+type request struct {
+	args  cm.CmdLine
+	reply resp.Reply
+	err   error
+	done  chan struct{}
+}
+
+func (r *request) finish(reply resp.Reply, err error) {
+	r.reply, r.err = reply, err
+	close(r.done)
+}
+
+// Client is a pipelined connection to a peer. Many goroutines may send through one client, their commands are
+// written in batches and the replies are read by a streaming parser and matched in order. A broken connection
+// fails the commands in flight and is dialed again by the next command
 type Client struct {
-	conn  net.Conn
-	addr  string
-	bytes *sync.Pool
+	addr     string
+	password string
+	pending  chan *request
+	stop     chan struct{}
+	once     sync.Once
+
+	mu       sync.Mutex
+	conn     net.Conn
+	waiting  chan *request
+	dialErr  error
+	dialedAt time.Time
 }
 
 func MakeClient(addr string) *Client {
-	pool := &sync.Pool{New: func() any {
-		return make([]byte, bufferSize)
-	}}
-	r := &Client{addr: addr, bytes: pool}
-	return r
+	return &Client{
+		addr:    addr,
+		pending: make(chan *request, maxBatch),
+		stop:    make(chan struct{}),
+	}
+}
+
+// SetPassword makes the client authenticate with AUTH password on every connection
+func (c *Client) SetPassword(password string) {
+	c.password = password
 }
+
+// Start dials the peer and starts writing queued commands
 func (c *Client) Start() error {
-	conn, err := net.DialTimeout("tcp", c.addr, timeout)
+	c.mu.Lock()
+	err := c.connect()
+	c.mu.Unlock()
 	if err != nil {
 		return err
 	}
-	c.conn = conn
+	go c.writeLoop()
 	return nil
 }
 func (c *Client) Close() {
-	if c.conn != nil {
-		c.conn.Close()
-	}
+	c.once.Do(func() {
+		close(c.stop)
+		c.mu.Lock()
+		if c.conn != nil {
+			_ = c.conn.Close()
+		}
+		c.mu.Unlock()
+	})
 }
+
+// Send executes one command on the peer
 func (c *Client) Send(cmd cm.CmdLine) (resp.Reply, error) {
-	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+	replies, err := c.Pipeline([]cm.CmdLine{cmd})
+	if err != nil {
 		return nil, err
 	}
-	if err := c.writeCmd(cmd); err != nil {
-		return nil, err
+	return replies[0], nil
+}
+
+// Pipeline executes cmds on the peer without waiting for each reply and returns the replies in order
+func (c *Client) Pipeline(cmds []cm.CmdLine) ([]resp.Reply, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	requests := make([]*request, len(cmds))
+	for i, cmd := range cmds {
+		requests[i] = &request{args: cmd, done: make(chan struct{})}
+		select {
+		case c.pending <- requests[i]:
+		case <-c.stop:
+			return nil, errClientClosed
+		case <-timer.C:
+			return nil, errTimeout
+		}
 	}
-	bytes := c.bytes.Get().([]byte)
-	defer c.bytes.Put(bytes)
-	if n, err := c.conn.Read(bytes); err != nil {
-		return nil, err
-	} else {
-		payload, err := parse.ParseOne(bytes[:n])
-		if err != nil {
-			return nil, err
+	replies := make([]resp.Reply, len(cmds))
+	for i, req := range requests {
+		select {
+		case <-req.done:
+			if req.err != nil {
+				return nil, req.err
+			}
+			replies[i] = req.reply
+		case <-c.stop:
+			return nil, errClientClosed
+		case <-timer.C:
+			// the peer does not answer, the connection is dropped so that later commands dial it again
+			c.reset()
+			return nil, errTimeout
 		}
-		return payload, nil
 	}
+	return replies, nil
+}
 
+// connect dials the peer if there is no connection, it must be called with mu held
+func (c *Client) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+	if c.dialErr != nil && time.Since(c.dialedAt) < reconnectInterval {
+		return c.dialErr
+	}
+	c.dialedAt = time.Now()
+	conn, err := net.DialTimeout("tcp", c.addr, timeout)
+	c.dialErr = err
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.waiting = make(chan *request, maxInFlight)
+	go c.readLoop(conn, c.waiting)
+	if c.password != "" {
+		// the reply of AUTH is read like any other and dropped
+		auth := &request{args: cmdutil.ToCmdLine("AUTH", c.password), done: make(chan struct{})}
+		c.waiting <- auth
+		if _, err = conn.Write(resp.MakeMultiBulkReply(auth.args).ToBytes()); err != nil {
+			c.drop()
+			return err
+		}
+	}
+	return nil
+}
+
+// reset closes the current connection, its reader fails the commands in flight
+func (c *Client) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drop()
 }
-func (c *Client) writeCmd(cmd cm.CmdLine) error {
-	multiBulk := resp.MakeMultiBulkReply(cmd)
-	_, err := c.conn.Write(multiBulk.ToBytes())
-	return err
+
+// drop closes the current connection so that the next command dials again, it must be called with mu held
+func (c *Client) drop() {
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// writeLoop writes the queued commands, commands queued meanwhile are written together
+func (c *Client) writeLoop() {
+	batch := make([]*request, 0, maxBatch)
+	for {
+		select {
+		case <-c.stop:
+			return
+		case req := <-c.pending:
+			batch = append(batch[:0], req)
+		}
+	drain:
+		for len(batch) < maxBatch {
+			select {
+			case req := <-c.pending:
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		c.write(batch)
+	}
+}
+func (c *Client) write(batch []*request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.connect(); err != nil {
+		for _, req := range batch {
+			req.finish(nil, err)
+		}
+		return
+	}
+	var buf bytes.Buffer
+	for _, req := range batch {
+		c.waiting <- req
+		buf.Write(resp.MakeMultiBulkReply(req.args).ToBytes())
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		logger.Warn("write to", c.addr, "failed", err)
+		c.drop()
+	}
+}
+
+// readLoop matches the replies read from conn with the commands written to it
+func (c *Client) readLoop(conn net.Conn, waiting chan *request) {
+	payloads := parse.Parse(conn)
+	err := errClientClosed
+	for payload := range payloads {
+		if payload.Err != nil {
+			err = payload.Err
+			break
+		}
+		select {
+		case req := <-waiting:
+			req.finish(payload.Data, nil)
+		default:
+			logger.Warn("unexpected reply from", c.addr)
+		}
+	}
+	_ = conn.Close()
+	go func() {
+		for range payloads {
+		}
+	}()
+	// a writer holding mu may be blocked on a full waiting, so it is drained before taking mu
+	failAll(waiting, err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	failAll(waiting, err)
+}
+func failAll(waiting chan *request, err error) {
+	for {
+		select {
+		case req := <-waiting:
+			req.finish(nil, err)
+		default:
+			return
+		}
+	}
 }
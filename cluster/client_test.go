@@ -1,27 +1,151 @@
 package cluster
 
 import (
+	"mygodis/clientc"
+	cm "mygodis/common"
+	"mygodis/resp"
 	"mygodis/util/cmdutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// startTestNode serves a single node cluster on a loopback listener
+func startTestNode(t *testing.T) (string, *Cluster, net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	c := makeTestCluster(addr)
+	go serveCluster(listener, c)
+	return addr, c, listener
+}
+
 func TestClient_Send(t *testing.T) {
-	client := MakeClient("localhost:6379")
-	client.Start()
-	clusterJoin := cmdutil.ToCmdLineWithName("cluster", "join", "localhost:6389")
-	reply, err := client.Send(clusterJoin)
+	addr, c, listener := startTestNode(t)
+	defer listener.Close()
+	defer c.gossip.stop()
+	client := MakeClient(addr)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// replies far larger than a tcp segment
+	value := strings.Repeat("v", 1<<20)
+	if reply, err := client.Send(cmdutil.ToCmdLine("SET", "big", value)); err != nil || resp.IsErrorReply(reply) {
+		t.Fatalf("set failed %v %v", reply, err)
+	}
+	reply, err := client.Send(cmdutil.ToCmdLine("GET", "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bulk, ok := reply.(*resp.BulkReply); !ok || string(bulk.Arg) != value {
+		t.Fatalf("except value of %d bytes", len(value))
+	}
+
+	keys := []string{"MGET"}
+	conn := clientc.NewFakeConnection()
+	for i := 0; i < 5000; i++ {
+		key := "key" + strconv.Itoa(i)
+		c.Exec(conn, cmdutil.ToCmdLine("SET", key, strconv.Itoa(i)))
+		keys = append(keys, key)
+	}
+	keys = append(keys, "missing")
+	reply, err = client.Send(cmdutil.ToCmdLine(keys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, ok := reply.(*resp.MultiBulkReply)
+	if !ok || len(values.Args) != 5001 {
+		t.Fatalf("except 5001 values but got %T", reply)
+	}
+	if string(values.Args[4999]) != "4999" || values.Args[5000] != nil {
+		t.Errorf("unexpected values %q %q", values.Args[4999], values.Args[5000])
+	}
+	reply, err = client.Send(cmdutil.ToCmdLine("KEYS", "key*"))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if all, ok := reply.(*resp.MultiBulkReply); !ok || len(all.Args) != 5000 {
+		t.Errorf("except 5000 keys but got %T", reply)
+	}
+}
+
+func TestClient_Pipeline(t *testing.T) {
+	addr, c, listener := startTestNode(t)
+	defer listener.Close()
+	defer c.gossip.stop()
+	client := MakeClient(addr)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			cmds := make([]cm.CmdLine, 0, 1000)
+			for i := 0; i < 1000; i++ {
+				cmds = append(cmds, cmdutil.ToCmdLine("INCR", "counter"+strconv.Itoa(g)))
+			}
+			replies, err := client.Pipeline(cmds)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for i, reply := range replies {
+				if got := string(reply.ToBytes()); got != ":"+strconv.Itoa(i+1)+"\r\n" {
+					t.Errorf("except reply %d in order but got %q", i+1, got)
+					return
+				}
+			}
+		}(g)
 	}
-	t.Log(reply)
+	wg.Wait()
 }
-func TestClient_Send1(t *testing.T) {
-	client := MakeClient("localhost:6379")
-	client.Start()
-	get := cmdutil.ToCmdLineWithName("GET", "k")
-	reply, err := client.Send(get)
+
+func TestClient_reconnect(t *testing.T) {
+	addr, c, listener := startTestNode(t)
+	defer c.gossip.stop()
+	client := MakeClient(addr)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Send(cmdutil.ToCmdLine("SET", "k", "v")); err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	client.reset()
+	if _, err := client.Send(cmdutil.ToCmdLine("GET", "k")); err == nil {
+		t.Fatal("except error while the peer is down")
+	}
+
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		t.Error(err)
+		t.Skip("address reused by another process")
+	}
+	defer listener.Close()
+	go serveCluster(listener, c)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		reply, err := client.Send(cmdutil.ToCmdLine("GET", "k"))
+		if err == nil {
+			if got := string(reply.ToBytes()); got != "$1\r\nv\r\n" {
+				t.Errorf("unexpected reply %q", got)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("except client reconnected but got %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
 	}
-	t.Log(reply)
 }
@@ -8,19 +8,42 @@ import (
 	"mygodis/datadriver/dict"
 	"mygodis/db"
 	"mygodis/lib/id"
+	"mygodis/lib/raft"
+	logger "mygodis/log"
 	"mygodis/resp"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type Cluster struct {
+	// props is read instead of config.Properties, so several clusters can run in one process
+	props              *config.ServerProperties
 	self               string
 	nodes              dict.Dict
 	db                 *db.StandaloneServer
 	nodeConnectionPool *ConnectionPool
 	transactions       dict.Dict
 	idGenerator        *id.Snowflake
-	ch                 *ConsistentHash
-	epoch              int64
+	// ch holds the ring, which is replaced by a changed copy and never changed in place, ringMu orders the changes
+	ch     atomic.Pointer[ConsistentHash]
+	ringMu sync.Mutex
+	epoch  int64
+	// slots is used to route keys when proxy is false
+	slots      *slotTable
+	proxy      bool
+	asking     sync.Map
+	rebalancer *rebalancer
+	gossip     *gossiper
+	// coordinator and txlog drive the transactions spanning several nodes
+	coordinator *txCoordinator
+	txlog       *txLog
+	// topology persists the ring and the epoch to cluster-config-file
+	topology *topologyStore
+	// hints keeps the writes of replicas which were down
+	hints *hintStore
+	// raft keeps the ring, the failed nodes and the pinned slots consistent when cluster-raft is set
+	raft *raft.Node
 }
 
 func (c *Cluster) AddClient(connection cmi.Connection) {
@@ -36,11 +59,17 @@ func (c *Cluster) dumpCluster() {
 	fmt.Printf("###############\n")
 	fmt.Printf("self is:%s\n", c.self)
 	fmt.Printf("nodes%v\n", c.nodes.Keys())
-	serialize, _ := c.ch.Serialize()
+	serialize, _ := c.ring().Serialize()
 	fmt.Printf("ConsistentHash : %s\n", string(serialize))
 }
 func (c *Cluster) Exec(connection cmi.Connection, args cm.CmdLine) (reply resp.Reply) {
 	cmdName := strings.ToUpper(string(args[0]))
+	if isTxControl(cmdName) {
+		return c.execTxControl(connection, cmdName, args)
+	}
+	if connection.InMultiState() {
+		return c.enqueue(connection, args)
+	}
 	switch cmdName {
 	case "PING":
 		return execPing(c)
@@ -48,6 +77,10 @@ func (c *Cluster) Exec(connection cmi.Connection, args cm.CmdLine) (reply resp.R
 		return execCPing()
 	case "INFO":
 		return execInfo(c, args[1:])
+	case "ASKING":
+		return c.execAsking(connection)
+	case "READONLY", "READWRITE":
+		return resp.MakeOkReply()
 	}
 	if cmdName == "CLUSTER" {
 		return c.execCluster(connection, args[1:])
@@ -60,47 +93,39 @@ func (c *Cluster) Exec(connection cmi.Connection, args cm.CmdLine) (reply resp.R
 	return cmd(c, connection, args)
 }
 
-func execInfo(c *Cluster, cmd cm.CmdLine) resp.Reply {
-	if len(cmd) == 1 {
-		param := string(cmd[0])
-		switch param {
-		case "server":
-			return resp.MakeMultiBulkReply(db.ServerInfo(c.db))
-		case "client":
-			return resp.MakeMultiBulkReply(db.ClientInfo(c.db))
-		case "cluster":
-			return resp.MakeMultiBulkReply([][]byte{
-				[]byte("# Cluster"),
-				[]byte(fmt.Sprintf("cluster_enabled: %v", config.Properties.ClusterEnable)),
-				[]byte(fmt.Sprintf("cluster_node_count: %d", c.nodes.Len())),
-				[]byte(fmt.Sprintf("cluster_nodes: %v", c.nodes.Keys())),
-			})
-		case "memory":
-			return resp.MakeMultiBulkReply(db.MemoryInfo(c.db))
-		case "persistence":
-			return resp.MakeMultiBulkReply(db.PersistenceInfo(c.db))
-		case "cpu":
-			return resp.MakeMultiBulkReply(db.CpuInfo(c.db))
-		}
-	}
-	return db.AllInfo(c.db)
-}
 func (c *Cluster) AfterClientClose(connection cmi.Connection) {
 	c.db.AfterClientClose(connection)
 }
 func (c *Cluster) Close() {
+	c.gossip.stop()
+	if c.raft != nil {
+		c.raft.Stop()
+	}
+	c.coordinator.stop()
+	c.txlog.close()
 	c.db.Close()
 	c.nodeConnectionPool.Close()
 }
 
 func MakeCluster() *Cluster {
+	ch := MakeConsistentHash(
+		WithReplicas(config.Properties.ClusterVirtualNodes),
+		WithHash(config.Properties.ClusterHashFunc),
+	)
 	cluster := &Cluster{
+		props:              config.Properties,
 		nodes:              dict.NewConcurrentDict(),
 		self:               config.Properties.Self,
 		db:                 db.MakeStandaloneServer(),
 		nodeConnectionPool: NewConnectionPool(),
 		transactions:       dict.NewConcurrentDict(),
-		ch:                 MakeConsistentHash(),
+		slots:              makeSlotTable(),
+		proxy:              config.Properties.ClusterProxy,
+		rebalancer:         makeRebalancer(),
+		gossip:             makeGossiper(),
+		coordinator:        makeTxCoordinator(),
+		topology:           makeTopologyStore(config.Properties.ClusterConfigFile),
+		hints:              makeHintStore(),
 		idGenerator: func() *id.Snowflake {
 			snowflake, err := id.NewSnowflake(config.Properties.DataCenterId, config.Properties.WorkerId)
 			if err != nil {
@@ -109,7 +134,23 @@ func MakeCluster() *Cluster {
 			return snowflake
 		}(),
 	}
-	cluster.ch.AddNode(cluster.self)
-
+	if name := config.Properties.ClusterHashFunc; name != "" && ch.Hash != name {
+		logger.Warn("unknown cluster-hash-func", name, "use", ch.Hash)
+	}
+	ch.AddWeightedNode(cluster.self, config.Properties.ClusterWeight)
+	cluster.ch.Store(ch)
+	if saved := cluster.topology.load(); saved != nil {
+		cluster.restoreTopology(saved)
+	}
+	cluster.topologyChanged()
+	txlog, inDoubt := openTxLog(config.Properties.ClusterTxLog)
+	cluster.txlog = txlog
+	cluster.recoverTx(inDoubt)
+	if config.Properties.ClusterRaft {
+		cluster.startRaft()
+	}
+	cluster.startGossip()
+	cluster.startHandoff()
+	go cluster.bootstrap(cluster.seeds())
 	return cluster
 }
@@ -6,6 +6,8 @@ import (
 	"mygodis/resp"
 )
 
+var cmdContainer = make(map[string]CmdFunc)
+
 type CmdFunc func(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply
 
 func RegisterCmd(name string, cmd CmdFunc) {
@@ -18,28 +20,19 @@ func DispatchCmd(name string) (CmdFunc, bool) {
 
 var (
 	defaultFunc = func(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
-		if isMultiKeyCmd(cmdLine) {
-			name := string(cmdLine[0])
-			if IsSupportMulti(name) {
-				switch name {
-				case "MSET", "MSETNX":
-					return execMSet0(cluster, connection, cmdLine)
-				case "MGET":
-					return execMGet(cluster, connection, cmdLine)
-				case "DEL":
-					return execDel(cluster, connection, cmdLine)
-				}
-			}
-			return resp.MakeErrReply("not support multi key command " + name)
+		if cluster.replicated() {
+			return cluster.execReplicated(connection, cmdLine)
+		}
+		if !cluster.proxy {
+			return cluster.execRedirect(connection, cmdLine)
 		}
 		key := cmdLine[1]
-		node := cluster.ch.GetNode(key)
+		node := cluster.ring().GetNode(key)
 		if node == cluster.self {
-			reply := cluster.db.Exec(connection, cmdLine)
+			reply := cluster.execLocal(connection, cmdLine)
 			return reply
 		}
-		client := cluster.nodeConnectionPool.GetConnection(node)
-		reply, err := client.Send(cmdLine)
+		reply, err := cluster.relay(node, cmdLine)
 		if err != nil {
 			return resp.MakeErrReply(err.Error())
 		}
@@ -48,20 +41,17 @@ var (
 )
 
 func init() {
-	RegisterSupportMultiKey("MSET", "METNX", "MGET", "DEL")
 	RegisterCmd("SET", defaultFunc)
 	RegisterCmd("GETEX", defaultFunc)
 	RegisterCmd("GET", defaultFunc)
 	RegisterCmd("SETNX", defaultFunc)
 	RegisterCmd("SETEX", defaultFunc)
 	RegisterCmd("PSETEX", defaultFunc)
-	RegisterCmd("MSET", defaultFunc)
-	RegisterCmd("MGET", defaultFunc)
-	RegisterCmd("MSETNX", defaultFunc)
+	RegisterCmd("MSETNX", execMSetNX)
 	RegisterCmd("GETSET", defaultFunc)
 	RegisterCmd("GETDEL", defaultFunc)
 	RegisterCmd("INCR", defaultFunc)
-	RegisterCmd("INCTBY", defaultFunc)
+	RegisterCmd("INCRBY", defaultFunc)
 	RegisterCmd("INCRBYFLOAT", defaultFunc)
 	RegisterCmd("DECR", defaultFunc)
 	RegisterCmd("DECRBY", defaultFunc)
@@ -72,7 +62,6 @@ func init() {
 	RegisterCmd("SETBIT", defaultFunc)
 	RegisterCmd("GETBIT", defaultFunc)
 	RegisterCmd("BITCOUNT", defaultFunc)
-	RegisterCmd("BITOP", defaultFunc)
 	RegisterCmd("LINDEX", defaultFunc)
 	RegisterCmd("LLEN", defaultFunc)
 	RegisterCmd("LPOP", defaultFunc)
@@ -82,7 +71,6 @@ func init() {
 	RegisterCmd("LREM", defaultFunc)
 	RegisterCmd("LSET", defaultFunc)
 	RegisterCmd("RPOP", defaultFunc)
-	RegisterCmd("RPOPLPUSH", defaultFunc)
 	RegisterCmd("RPUSH", defaultFunc)
 	RegisterCmd("RPUSHX", defaultFunc)
 	RegisterCmd("LTRIM", defaultFunc)
@@ -101,15 +89,17 @@ func init() {
 	RegisterCmd("HVALS", defaultFunc)
 	RegisterCmd("SADD", defaultFunc)
 	RegisterCmd("SCARD", defaultFunc)
-	RegisterCmd("SDIFF", defaultFunc)
-	RegisterCmd("SDIFFSTORE", defaultFunc)
-	RegisterCmd("SINTER", defaultFunc)
-	RegisterCmd("SINTERSTORE", defaultFunc)
 	RegisterCmd("SISMEMBER", defaultFunc)
-	RegisterCmd("SMOVE", defaultFunc)
+	RegisterCmd("SMEMBERS", defaultFunc)
 	RegisterCmd("SPOP", defaultFunc)
 	RegisterCmd("SRANDMEMBER", defaultFunc)
 	RegisterCmd("SREM", defaultFunc)
-	RegisterCmd("SUNION", defaultFunc)
-	RegisterCmd("SUNIOMSTORE", defaultFunc)
+	RegisterCmd("ZADD", defaultFunc)
+	RegisterCmd("ZCARD", defaultFunc)
+	RegisterCmd("ZCOUNT", defaultFunc)
+	RegisterCmd("ZINCRBY", defaultFunc)
+	RegisterCmd("ZRANK", defaultFunc)
+	RegisterCmd("ZREM", defaultFunc)
+	RegisterCmd("ZREVRANK", defaultFunc)
+	RegisterCmd("ZSCORE", defaultFunc)
 }
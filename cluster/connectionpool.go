@@ -4,11 +4,13 @@ import (
 	"mygodis/config"
 	"mygodis/lib/pool"
 	logger "mygodis/log"
-	"mygodis/util/cmdutil"
+	"sync"
 )
 
 type ConnectionPool struct {
-	cps map[string]*pool.Pool
+	mu       sync.RWMutex
+	cps      map[string]*pool.Pool
+	password string
 }
 
 var cpConfig = pool.Config{
@@ -16,86 +18,109 @@ var cpConfig = pool.Config{
 	MaxActive: 16,
 }
 
+func newNodePool(node string, password string) *pool.Pool {
+	factory := func() (any, error) {
+		client := MakeClient(node)
+		client.password = password
+		if err := client.Start(); err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	finalizer := func(x any) {
+		client := x.(*Client)
+		client.Close()
+	}
+	return pool.NewPool(factory, finalizer, cpConfig)
+}
+
 func NewConnectionPool() *ConnectionPool {
 	c := &ConnectionPool{
-		cps: make(map[string]*pool.Pool),
+		cps:      make(map[string]*pool.Pool),
+		password: config.Properties.RequirePass,
 	}
 	peers := config.Properties.Peers
 	peers = append(peers, config.Properties.Self)
-	for _, peer := range peers {
-		factory := func() (any, error) {
-			client := MakeClient(peer)
-			err := client.Start()
-			if err != nil {
-				return nil, err
-			}
-			if config.Properties.RequirePass != "" {
-				client.Send(cmdutil.ToCmdLineWithName("AUTH", config.Properties.RequirePass))
-			}
-			return client, nil
-		}
-		finalizer := func(x any) {
-			client := x.(*Client)
-			client.Close()
-		}
-		c.cps[peer] = pool.NewPool(factory, finalizer, cpConfig)
-	}
+	c.AddConnection(peers...)
 	return c
 }
-func (p *ConnectionPool) GetConnection(targetNode string) *Client {
+func (p *ConnectionPool) nodePool(targetNode string) *pool.Pool {
+	p.mu.RLock()
 	obj, ok := p.cps[targetNode]
-	if !ok {
-		factory := func() (any, error) {
-			client := MakeClient(targetNode)
-			err := client.Start()
-			if err != nil {
-				return nil, err
-			}
-			if config.Properties.RequirePass != "" {
-				client.Send(cmdutil.ToCmdLineWithName("AUTH", config.Properties.RequirePass))
-			}
-			return client, nil
-		}
-		finalizer := func(x any) {
-			client := x.(*Client)
-			client.Close()
-		}
-		newPool := pool.NewPool(factory, finalizer, cpConfig)
-		p.cps[targetNode] = newPool
-		obj = p.cps[targetNode]
+	p.mu.RUnlock()
+	if ok {
+		return obj
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if obj, ok = p.cps[targetNode]; !ok {
+		obj = newNodePool(targetNode, p.password)
+		p.cps[targetNode] = obj
 		logger.Info("new connection pool for node", targetNode)
 	}
-	client, err := obj.Get()
+	return obj
+}
+
+// Borrow takes a client of targetNode, it must be given back by ReturnConnection or Discard
+func (p *ConnectionPool) Borrow(targetNode string) (*Client, error) {
+	client, err := p.nodePool(targetNode).Get()
+	if err != nil {
+		return nil, err
+	}
+	return client.(*Client), nil
+}
+func (p *ConnectionPool) GetConnection(targetNode string) *Client {
+	client, err := p.Borrow(targetNode)
 	if err != nil {
 		logger.Error(err.Error())
 	}
-	return client.(*Client)
+	return client
+}
+func (p *ConnectionPool) ReturnConnection(targetNode string, client *Client) {
+	p.nodePool(targetNode).Put(client)
+}
+
+// Discard closes a broken client of targetNode
+func (p *ConnectionPool) Discard(targetNode string, client *Client) {
+	p.nodePool(targetNode).Discard(client)
 }
 func (p *ConnectionPool) AddConnection(newNodes ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	for _, newNode := range newNodes {
 		if _, ok := p.cps[newNode]; ok {
 			continue
 		}
-		factory := func() (any, error) {
-			client := MakeClient(newNode)
-			err := client.Start()
-			if err != nil {
-				return nil, err
-			}
-			if config.Properties.RequirePass != "" {
-				client.Send(cmdutil.ToCmdLineWithName("AUTH", config.Properties.RequirePass))
-			}
-			return client, err
-		}
-		finalizer := func(x any) {
-			client := x.(*Client)
-			client.Close()
+		p.cps[newNode] = newNodePool(newNode, p.password)
+	}
+}
+
+// RemoveConnection closes the clients of nodes which left the cluster
+func (p *ConnectionPool) RemoveConnection(nodes ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, node := range nodes {
+		if poolItem, ok := p.cps[node]; ok {
+			poolItem.Close()
+			delete(p.cps, node)
 		}
-		p.cps[newNode] = pool.NewPool(factory, finalizer, cpConfig)
 	}
 }
 func (p *ConnectionPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	for _, poolItem := range p.cps {
 		poolItem.Close()
 	}
 }
+
+// Stats returns the stats of the pool of every node
+func (p *ConnectionPool) Stats() map[string]pool.Stats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	stats := make(map[string]pool.Stats, len(p.cps))
+	for node, nodePool := range p.cps {
+		stats[node] = nodePool.Stats()
+	}
+	return stats
+}
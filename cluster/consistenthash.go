@@ -1,47 +1,206 @@
 package cluster
 
 import (
+	"crypto/sha1"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"hash/crc64"
+	"hash/fnv"
+	"math"
+	"mygodis/lib/slot"
+	"mygodis/util/option"
 	"sort"
-	"strings"
+	"strconv"
+	"sync"
 )
 
-const capacity = 1 << 14
+// defaultReplicas is the number of virtual nodes of a node with weight 1
+const defaultReplicas = 160
 
+// defaultHash is the hash function used when none is configured, it is the one rings were always built with
+const defaultHash = "crc64"
+
+// ChFunction hashes a key onto the ring, the values should spread over the whole uint64 range
 type ChFunction func(key []byte) uint64
+
+// ConsistentHash is not changed once it is shared, a cluster changes a Clone and publishes it in its place
 type ConsistentHash struct {
-	ChFunc ChFunction `json:"-"`
-	Nodes  []uint64
-	ChMap  map[uint64]string
+	ChFunc   ChFunction `json:"-"`
+	Hash     string
+	Replicas int
+	// Weights holds the members of the ring, a node with weight w is placed w*Replicas times
+	Weights map[string]int
+	Nodes   []uint64
+	ChMap   map[uint64]string
+}
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+var chFunctions = map[string]ChFunction{
+	"crc64": func(key []byte) uint64 {
+		return crc64.Checksum(key, crc64Table)
+	},
+	"fnv": func(key []byte) uint64 {
+		h := fnv.New64a()
+		h.Write(key)
+		return h.Sum64()
+	},
+	"sha1": func(key []byte) uint64 {
+		sum := sha1.Sum(key)
+		return binary.BigEndian.Uint64(sum[:8])
+	},
+}
+var chFunctionsMu sync.RWMutex
+
+// RegisterChFunction makes a hash function available to rings by name, every member of a cluster must register it
+func RegisterChFunction(name string, f ChFunction) {
+	chFunctionsMu.Lock()
+	defer chFunctionsMu.Unlock()
+	chFunctions[name] = f
+}
+func getChFunction(name string) (ChFunction, bool) {
+	chFunctionsMu.RLock()
+	defer chFunctionsMu.RUnlock()
+	f, ok := chFunctions[name]
+	return f, ok
 }
 
-func MakeConsistentHash() *ConsistentHash {
+// WithReplicas sets the number of virtual nodes per unit of weight
+func WithReplicas(replicas int) option.Option[ConsistentHash] {
+	return func(ch *ConsistentHash) {
+		if replicas > 0 {
+			ch.Replicas = replicas
+		}
+	}
+}
+
+// WithHash selects a hash function registered by RegisterChFunction, unknown names are ignored
+func WithHash(name string) option.Option[ConsistentHash] {
+	return func(ch *ConsistentHash) {
+		if f, ok := getChFunction(name); ok {
+			ch.Hash = name
+			ch.ChFunc = f
+		}
+	}
+}
+
+func MakeConsistentHash(opts ...option.Option[ConsistentHash]) *ConsistentHash {
 	ch := &ConsistentHash{
-		ChFunc: func(key []byte) uint64 {
-			return crc64.Checksum(key, crc64.MakeTable(crc64.ECMA))
-		},
-		ChMap: make(map[uint64]string),
+		Replicas: defaultReplicas,
+		Weights:  make(map[string]int),
+		ChMap:    make(map[uint64]string),
+	}
+	WithHash(defaultHash)(ch)
+	for _, opt := range opts {
+		opt(ch)
 	}
 	return ch
 }
 
 func (ch *ConsistentHash) AddNode(node string) {
-	position := ch.getPosition([]byte(node))
-	ch.Nodes = append(ch.Nodes, position)
+	if _, ok := ch.Weights[node]; ok {
+		return
+	}
+	ch.AddWeightedNode(node, 1)
+}
+
+// AddWeightedNode adds node or changes its weight, the share of keys served by a node is proportional to its weight
+func (ch *ConsistentHash) AddWeightedNode(node string, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	ch.Weights[node] = weight
+	ch.rebuild()
+}
+
+// RemoveNode takes node off the ring, keys it served fall to its successor
+func (ch *ConsistentHash) RemoveNode(node string) {
+	if _, ok := ch.Weights[node]; !ok {
+		return
+	}
+	delete(ch.Weights, node)
+	ch.rebuild()
+}
+
+// Weight returns the weight of node, 0 if it is not a member
+func (ch *ConsistentHash) Weight(node string) int {
+	return ch.Weights[node]
+}
+
+// rebuild places the virtual nodes of all members again. Members are placed in order of their names and a
+// virtual node landing on a taken position moves to the next free one, so every member computes the same ring
+// no matter in which order the nodes were added
+func (ch *ConsistentHash) rebuild() {
+	ch.Nodes = ch.Nodes[:0]
+	ch.ChMap = make(map[uint64]string)
+	for _, node := range ch.GetNodes() {
+		for i := 0; i < ch.Weights[node]*ch.Replicas; i++ {
+			label := node
+			if i > 0 {
+				label = node + "#" + strconv.Itoa(i)
+			}
+			position := ch.getPosition([]byte(label))
+			for {
+				if _, taken := ch.ChMap[position]; !taken {
+					break
+				}
+				position++
+			}
+			ch.ChMap[position] = node
+			ch.Nodes = append(ch.Nodes, position)
+		}
+	}
 	sort.Slice(ch.Nodes, func(i, j int) bool {
 		return ch.Nodes[i] < ch.Nodes[j]
 	})
-	ch.ChMap[position] = node
+}
+
+// Clone returns a copy of the ring which can be modified independently
+func (ch *ConsistentHash) Clone() *ConsistentHash {
+	clone := &ConsistentHash{
+		ChFunc:   ch.ChFunc,
+		Hash:     ch.Hash,
+		Replicas: ch.Replicas,
+		Weights:  make(map[string]int, len(ch.Weights)),
+		Nodes:    make([]uint64, len(ch.Nodes)),
+		ChMap:    make(map[uint64]string, len(ch.ChMap)),
+	}
+	copy(clone.Nodes, ch.Nodes)
+	for position, node := range ch.ChMap {
+		clone.ChMap[position] = node
+	}
+	for node, weight := range ch.Weights {
+		clone.Weights[node] = weight
+	}
+	return clone
 }
 
 func LoadFrom(chBytes []byte) (*ConsistentHash, error) {
 	ch := &ConsistentHash{}
 	err := json.Unmarshal(chBytes, &ch)
-	ch.ChFunc = func(key []byte) uint64 {
-		return crc64.Checksum(key, crc64.MakeTable(crc64.ECMA))
+	if err != nil {
+		return ch, err
+	}
+	if ch.Hash == "" {
+		ch.Hash = defaultHash
+	}
+	f, ok := getChFunction(ch.Hash)
+	if !ok {
+		return ch, fmt.Errorf("unknown hash function %s", ch.Hash)
+	}
+	ch.ChFunc = f
+	if ch.Replicas <= 0 {
+		ch.Replicas = 1
+	}
+	if len(ch.Weights) == 0 {
+		// rings serialized before weights existed only have ChMap
+		ch.Weights = make(map[string]int)
+		for _, node := range ch.ChMap {
+			ch.Weights[node] = 1
+		}
 	}
-	return ch, err
+	ch.rebuild()
+	return ch, nil
 }
 
 // Serialize this consistent hash
@@ -51,17 +210,19 @@ func (ch *ConsistentHash) Serialize() ([]byte, error) {
 }
 
 func (ch *ConsistentHash) getPartitionKey(key []byte) []byte {
-	s := string(key)
-	indexL := strings.Index(s, "{")
-	indexR := strings.Index(s, "}")
-	if indexL == -1 || indexR == -1 {
-		return key
-	}
-	return []byte(s[indexL+1 : indexR])
+	return slot.HashTag(key)
+}
+
+// KeyPosition returns the position of key on the ring
+func (ch *ConsistentHash) KeyPosition(key []byte) uint64 {
+	return ch.getPosition(ch.getPartitionKey(key))
 }
 
 func (ch *ConsistentHash) GetNode(key []byte) string {
-	position := ch.getPosition(ch.getPartitionKey(key))
+	if len(ch.Nodes) == 0 {
+		return ""
+	}
+	position := ch.KeyPosition(key)
 	search := sort.Search(len(ch.Nodes), func(i int) bool {
 		return ch.Nodes[i] >= position
 	})
@@ -71,9 +232,29 @@ func (ch *ConsistentHash) GetNode(key []byte) string {
 	return ch.ChMap[ch.Nodes[search]]
 }
 
+// PreferenceList returns the first n distinct nodes met walking the ring clockwise from the position of key,
+// they are the replicas of key
+func (ch *ConsistentHash) PreferenceList(key []byte, n int) []string {
+	if len(ch.Nodes) == 0 || n <= 0 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	nodes := make([]string, 0, n)
+	code := ch.Nodes[ch.find(ch.KeyPosition(key))]
+	node := ch.ChMap[code]
+	for i := 0; i < len(ch.Nodes) && len(nodes) < n; i++ {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+		node, code = ch.nextNode(code)
+	}
+	return nodes
+}
+
 func (ch *ConsistentHash) find(position uint64) int {
 	i := sort.Search(len(ch.Nodes), func(i int) bool {
-		return ch.Nodes[i] == position
+		return ch.Nodes[i] >= position
 	})
 	if i >= len(ch.Nodes) {
 		return 0
@@ -81,10 +262,21 @@ func (ch *ConsistentHash) find(position uint64) int {
 	return i
 }
 
+// positionsOf returns the ring positions held by node
+func (ch *ConsistentHash) positionsOf(node string) []uint64 {
+	positions := make([]uint64, 0)
+	for _, position := range ch.Nodes {
+		if ch.ChMap[position] == node {
+			positions = append(positions, position)
+		}
+	}
+	return positions
+}
+
 func (ch *ConsistentHash) nextNode(position uint64) (node string, code uint64) {
 	find := ch.find(position)
 	if find+1 == len(ch.Nodes) {
-		return ch.ChMap[0], ch.Nodes[0]
+		return ch.ChMap[ch.Nodes[0]], ch.Nodes[0]
 	}
 	next := ch.Nodes[find+1]
 	return ch.ChMap[next], next
@@ -101,13 +293,36 @@ func (ch *ConsistentHash) preNode(position uint64) (node string, code uint64) {
 }
 
 func (ch *ConsistentHash) getPosition(key []byte) uint64 {
-	hCode := ch.ChFunc(key)
-	return (hCode + 1) % capacity
+	return ch.ChFunc(key)
 }
+
+// GetNodes returns the members of the ring ordered by name
 func (ch *ConsistentHash) GetNodes() []string {
-	var nodes []string
-	for _, v := range ch.ChMap {
-		nodes = append(nodes, v)
+	nodes := make([]string, 0, len(ch.Weights))
+	for node := range ch.Weights {
+		nodes = append(nodes, node)
 	}
+	sort.Strings(nodes)
 	return nodes
 }
+
+// Distribution returns the share of the key space every member serves, the shares sum up to 1
+func (ch *ConsistentHash) Distribution() map[string]float64 {
+	shares := make(map[string]float64, len(ch.Weights))
+	for node := range ch.Weights {
+		shares[node] = 0
+	}
+	if len(ch.Nodes) == 0 {
+		return shares
+	}
+	if len(ch.Nodes) == 1 {
+		shares[ch.ChMap[ch.Nodes[0]]] = 1
+		return shares
+	}
+	for i, position := range ch.Nodes {
+		pre := ch.Nodes[(i+len(ch.Nodes)-1)%len(ch.Nodes)]
+		// the arc (pre, position] wraps around zero for the first position, uint64 arithmetic handles it
+		shares[ch.ChMap[position]] += float64(position-pre) / math.Exp2(64)
+	}
+	return shares
+}
@@ -3,6 +3,7 @@ package cluster
 import (
 	"fmt"
 	"math/rand"
+	"reflect"
 	"strconv"
 	"testing"
 )
@@ -80,3 +81,47 @@ func TestLoadFrom(t *testing.T) {
 	fmt.Println()
 
 }
+
+func TestConsistentHash_Distribution(t *testing.T) {
+	ch := MakeConsistentHash()
+	ch.AddNode("node0")
+	ch.AddNode("node1")
+	ch.AddWeightedNode("node2", 2)
+	shares := ch.Distribution()
+	total := 0.0
+	for _, share := range shares {
+		total += share
+	}
+	if total < 0.999 || total > 1.001 {
+		t.Errorf("except shares sum up to 1 but got %f", total)
+	}
+	if shares["node2"] < 0.4 || shares["node2"] > 0.6 {
+		t.Errorf("except node2 serves about half of the ring but got %f", shares["node2"])
+	}
+	if len(ch.Nodes) != 4*defaultReplicas {
+		t.Errorf("except %d virtual nodes but got %d", 4*defaultReplicas, len(ch.Nodes))
+	}
+}
+
+func TestConsistentHash_Collision(t *testing.T) {
+	RegisterChFunction("constant", func(key []byte) uint64 {
+		return 42
+	})
+	ch := MakeConsistentHash(WithHash("constant"), WithReplicas(2))
+	ch.AddNode("node1")
+	ch.AddNode("node0")
+	if len(ch.ChMap) != 4 || len(ch.Nodes) != 4 {
+		t.Fatalf("except 4 distinct positions but got %v", ch.ChMap)
+	}
+	if ch.ChMap[42] != "node0" || ch.ChMap[44] != "node1" {
+		t.Errorf("except collisions resolved by node order but got %v", ch.ChMap)
+	}
+	serialize, _ := ch.Serialize()
+	loaded, err := LoadFrom(serialize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.ChMap, ch.ChMap) || loaded.Hash != "constant" {
+		t.Errorf("except same ring after LoadFrom but got %v", loaded.ChMap)
+	}
+}
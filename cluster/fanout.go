@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"mygodis/clientc"
+	cm "mygodis/common"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultFanoutTimeout = timeout
+
+// fanoutPolicy decides whether a command sent to every node succeeded with the replies it got
+type fanoutPolicy int
+
+const (
+	// requireAll fails unless every node answered
+	requireAll fanoutPolicy = iota
+	// requireQuorum fails unless more than half of the nodes answered
+	requireQuorum
+	// allowPartial uses whatever nodes answered
+	allowPartial
+)
+
+// fanoutResult is the reply or the error of every node a command was sent to
+type fanoutResult struct {
+	nodes   []string
+	replies map[string]resp.Reply
+	errs    map[string]error
+}
+
+func (c *Cluster) fanoutTimeout() time.Duration {
+	if ms := c.props.ClusterFanoutTimeout; ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return defaultFanoutTimeout
+}
+
+// partialPolicy is the policy of commands whose result may miss the keys of failed nodes if configured so
+func (c *Cluster) partialPolicy() fanoutPolicy {
+	if c.props.ClusterPartialResults {
+		return allowPartial
+	}
+	return requireAll
+}
+
+// members returns every node of the ring and every known node, this one included
+func (c *Cluster) members() []string {
+	seen := map[string]bool{c.self: true}
+	nodes := []string{c.self}
+	for _, node := range append(c.ring().GetNodes(), c.nodes.Keys()...) {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// fanout sends cmdLine to nodes in parallel, a node which does not answer within deadline counts as failed.
+// Commands for this node are executed in process
+func (c *Cluster) fanout(nodes []string, cmdLine cm.CmdLine, deadline time.Duration) *fanoutResult {
+	type answer struct {
+		node  string
+		reply resp.Reply
+		err   error
+	}
+	answers := make(chan answer, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			var reply resp.Reply
+			var err error
+			if node == c.self {
+				reply = c.Exec(clientc.NewFakeConnection(), cmdLine)
+			} else {
+				reply, err = c.relay(node, cmdLine)
+			}
+			if err == nil && resp.IsErrorReply(reply) {
+				err = errors.New(errorMessage(reply))
+			}
+			answers <- answer{node: node, reply: reply, err: err}
+		}(node)
+	}
+	result := &fanoutResult{
+		nodes:   nodes,
+		replies: make(map[string]resp.Reply),
+		errs:    make(map[string]error),
+	}
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+	for pending := len(nodes); pending > 0; pending-- {
+		select {
+		case a := <-answers:
+			if a.err != nil {
+				result.errs[a.node] = a.err
+			} else {
+				result.replies[a.node] = a.reply
+			}
+		case <-timer.C:
+			for _, node := range nodes {
+				if _, ok := result.replies[node]; !ok && result.errs[node] == nil {
+					result.errs[node] = errTimeout
+				}
+			}
+			return result
+		}
+	}
+	return result
+}
+
+// fanoutLocal executes cmdLine on every node in the db of dbIndex, each node only touches its own keys
+func (c *Cluster) fanoutLocal(dbIndex int, cmdLine cm.CmdLine) *fanoutResult {
+	line := cmdutil.ToCmdLine("CLUSTER", "LOCALEXEC", strconv.Itoa(dbIndex))
+	return c.fanout(c.members(), append(line, cmdLine...), c.fanoutTimeout())
+}
+
+// check returns an error naming the failed nodes if the result does not satisfy policy
+func (r *fanoutResult) check(policy fanoutPolicy) error {
+	switch policy {
+	case requireAll:
+		if len(r.errs) == 0 {
+			return nil
+		}
+	case requireQuorum:
+		if len(r.replies) > len(r.nodes)/2 {
+			return nil
+		}
+	default:
+		if len(r.replies) > 0 || len(r.nodes) == 0 {
+			return nil
+		}
+	}
+	return r.failure()
+}
+func (r *fanoutResult) failure() error {
+	failed := make([]string, 0, len(r.errs))
+	for node, err := range r.errs {
+		failed = append(failed, node+" ("+err.Error()+")")
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("CLUSTERDOWN %d of %d nodes failed: %s", len(r.errs), len(r.nodes), strings.Join(failed, ", "))
+}
+
+// execLocalExec serves CLUSTER LOCALEXEC db command args..., the command is executed on this node only
+func (c *Cluster) execLocalExec(args cm.CmdLine) resp.Reply {
+	if len(args) < 2 {
+		return resp.MakeArgNumErrReply("cluster localexec")
+	}
+	dbIndex, err := strconv.Atoi(string(args[0]))
+	if err != nil || dbIndex < 0 || dbIndex >= len(c.db.Dbs) {
+		return resp.MakeErrReply("ERR invalid db index")
+	}
+	conn := &clientc.FakeConnection{DBindex: dbIndex}
+	conn.SetPassword(c.props.RequirePass)
+	return c.db.Exec(conn, args[1:])
+}
@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"mygodis/clientc"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCluster_fanout(t *testing.T) {
+	listenerA, _ := net.Listen("tcp", "127.0.0.1:0")
+	listenerB, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listenerA.Close()
+	defer listenerB.Close()
+	addrA, addrB := listenerA.Addr().String(), listenerB.Addr().String()
+	a := makeTestCluster(addrA, addrB)
+	b := makeTestCluster(addrB, addrA)
+	defer a.gossip.stop()
+	defer b.gossip.stop()
+	go serveCluster(listenerA, a)
+	go serveCluster(listenerB, b)
+
+	conn := clientc.NewFakeConnection()
+	for i := 0; i < 3; i++ {
+		a.Exec(conn, cmdutil.ToCmdLine("SET", keyOf(a, addrA, "a"+string(rune('0'+i))), "1"))
+		b.Exec(conn, cmdutil.ToCmdLine("SET", keyOf(a, addrB, "b"+string(rune('0'+i))), "1"))
+	}
+	a.Exec(conn, cmdutil.ToCmdLine("PEXPIRE", keyOf(a, addrA, "a0"), "100000"))
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("DBSIZE")).ToBytes()); got != ":6\r\n" {
+		t.Errorf("except :6 but got %q", got)
+	}
+	if keys, ok := a.Exec(conn, cmdutil.ToCmdLine("KEYS", "*")).(*resp.MultiBulkReply); !ok || len(keys.Args) != 6 {
+		t.Errorf("except keys of both nodes")
+	}
+	if _, ok := a.Exec(conn, cmdutil.ToCmdLine("RANDOMKEY")).(*resp.BulkReply); !ok {
+		t.Errorf("except a random key")
+	}
+	info := string(a.Exec(conn, cmdutil.ToCmdLine("INFO")).ToBytes())
+	if !strings.Contains(info, "db0:keys=6,expires=1") || !strings.Contains(info, "status=ok") {
+		t.Errorf("except keyspace summed over nodes but got %q", info)
+	}
+
+	// a node which never answers fails commands needing every node unless partial results are allowed
+	dead := "127.0.0.1:1"
+	a.updateRing(func(ch *ConsistentHash) { ch.AddNode(dead) })
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("DBSIZE")).ToBytes()); !strings.HasPrefix(got, "-CLUSTERDOWN 1 of 3 nodes failed: "+dead) {
+		t.Errorf("except failure naming %s but got %q", dead, got)
+	}
+	a.props.ClusterPartialResults = true
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("DBSIZE")).ToBytes()); got != ":6\r\n" {
+		t.Errorf("except partial result :6 but got %q", got)
+	}
+	a.props.ClusterPartialResults = false
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("PING")).ToBytes()); got != "+PONG\r\n" {
+		t.Errorf("except PONG from a majority but got %q", got)
+	}
+	clusterInfo := string(a.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "INFO")).ToBytes())
+	if !strings.Contains(clusterInfo, "cluster_known_nodes:3") || !strings.Contains(clusterInfo, "cluster_reachable_nodes:2") {
+		t.Errorf("unexpected cluster info %q", clusterInfo)
+	}
+	a.updateRing(func(ch *ConsistentHash) { ch.RemoveNode(dead) })
+
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("FLUSHALL", "ASYNC")).ToBytes()); got != "+OK\r\n" {
+		t.Fatalf("except +OK but got %q", got)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for string(a.Exec(conn, cmdutil.ToCmdLine("DBSIZE")).ToBytes()) != ":0\r\n" {
+		if time.Now().After(deadline) {
+			t.Fatal("except every node flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,439 @@
+package cluster
+
+import (
+	cm "mygodis/common"
+	"mygodis/config"
+	logger "mygodis/log"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	stateOnline = "online"
+	// statePFail means this node got no pong from the node within the node timeout
+	statePFail = "pfail"
+	// stateFail means a majority agreed the node is down, it is removed from the ring
+	stateFail = "fail"
+)
+
+const gossipInterval = time.Second
+const defaultNodeTimeout = 15 * time.Second
+
+// forgetBan is how long a forgotten node can not join again, like redis CLUSTER FORGET
+const forgetBan = time.Minute
+
+// nodeHealth is the view of this node on a peer
+type nodeHealth struct {
+	state    string
+	pingSent time.Time
+	pongRecv time.Time
+	linkUp   bool
+	// reports holds the members which reported the node as pfail or fail and when
+	reports map[string]time.Time
+}
+
+// gossiper detects failed peers by exchanging heartbeats carrying the views of the members
+type gossiper struct {
+	mu      sync.Mutex
+	health  map[string]*nodeHealth
+	banned  map[string]time.Time
+	timeout time.Duration
+	stopC   chan struct{}
+	stopped sync.Once
+}
+
+func makeGossiper() *gossiper {
+	timeout := time.Duration(config.Properties.ClusterNodeTimeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultNodeTimeout
+	}
+	return &gossiper{
+		health:  make(map[string]*nodeHealth),
+		banned:  make(map[string]time.Time),
+		timeout: timeout,
+		stopC:   make(chan struct{}),
+	}
+}
+
+// get returns the health of node, unknown nodes are assumed online from now on
+func (g *gossiper) get(node string) *nodeHealth {
+	h, ok := g.health[node]
+	if !ok {
+		h = &nodeHealth{
+			state:    stateOnline,
+			pongRecv: time.Now(),
+			linkUp:   true,
+			reports:  make(map[string]time.Time),
+		}
+		g.health[node] = h
+	}
+	return h
+}
+func (g *gossiper) state(node string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if h, ok := g.health[node]; ok {
+		return h.state
+	}
+	return stateOnline
+}
+func (g *gossiper) snapshot(node string) nodeHealth {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return *g.get(node)
+}
+
+// failedNodes returns the nodes agreed failed, they are no longer members of the ring
+func (g *gossiper) failedNodes() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	nodes := make([]string, 0)
+	for node, h := range g.health {
+		if h.state == stateFail {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+func (g *gossiper) forget(node string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.health, node)
+	g.banned[node] = time.Now().Add(forgetBan)
+}
+func (g *gossiper) isBanned(node string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	until, ok := g.banned[node]
+	if ok && time.Now().After(until) {
+		delete(g.banned, node)
+		return false
+	}
+	return ok
+}
+func (g *gossiper) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.health = make(map[string]*nodeHealth)
+}
+func (g *gossiper) stop() {
+	g.stopped.Do(func() {
+		close(g.stopC)
+	})
+}
+
+// startGossip pings some peers every gossipInterval until the cluster is closed
+func (c *Cluster) startGossip() {
+	go func() {
+		ticker := time.NewTicker(gossipInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.gossip.stopC:
+				return
+			case <-ticker.C:
+				c.gossipRound()
+			}
+		}
+	}()
+}
+
+// gossipRound sends heartbeats to a random fanout of peers and to every peer not heard of for half the node timeout
+func (c *Cluster) gossipRound() {
+	peers := make([]string, 0)
+	for _, node := range c.ring().GetNodes() {
+		if node != c.self {
+			peers = append(peers, node)
+		}
+	}
+	if len(peers) == 0 {
+		return
+	}
+	targets := make(map[string]struct{})
+	for _, node := range pickNodes(peers, 0.5, Fanout) {
+		targets[node] = struct{}{}
+	}
+	now := time.Now()
+	c.gossip.mu.Lock()
+	for _, node := range peers {
+		h := c.gossip.get(node)
+		if now.Sub(h.pongRecv) > c.gossip.timeout/2 {
+			targets[node] = struct{}{}
+		}
+		if now.Sub(h.pongRecv) > c.gossip.timeout && h.state == stateOnline {
+			h.state = statePFail
+			logger.Warn("node", node, "is not reachable, mark as pfail")
+		}
+	}
+	c.gossip.mu.Unlock()
+	line := c.gossipLine()
+	var wg sync.WaitGroup
+	for node := range targets {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			c.ping(node, line)
+		}(node)
+	}
+	wg.Wait()
+	for _, node := range peers {
+		c.checkFailure(node)
+	}
+}
+
+// gossipLine builds CLUSTER GOSSIP sender epoch followed by the state of every member this node knows
+func (c *Cluster) gossipLine() cm.CmdLine {
+	args := []string{"GOSSIP", c.self, strconv.FormatInt(atomic.LoadInt64(&c.epoch), 10)}
+	args = append(args, c.gossipView()...)
+	return cmdutil.ToCmdLineWithName("CLUSTER", args...)
+}
+func (c *Cluster) gossipView() []string {
+	view := make([]string, 0)
+	c.gossip.mu.Lock()
+	defer c.gossip.mu.Unlock()
+	for _, node := range c.ring().GetNodes() {
+		if node == c.self {
+			continue
+		}
+		view = append(view, node, c.gossip.get(node).state)
+	}
+	for node, h := range c.gossip.health {
+		if h.state == stateFail {
+			view = append(view, node, stateFail)
+		}
+	}
+	return view
+}
+func (c *Cluster) ping(node string, line cm.CmdLine) {
+	c.gossip.mu.Lock()
+	c.gossip.get(node).pingSent = time.Now()
+	c.gossip.mu.Unlock()
+	reply, err := c.relay(node, line)
+	c.gossip.mu.Lock()
+	h := c.gossip.get(node)
+	if err != nil || resp.IsErrorReply(reply) {
+		h.linkUp = false
+		c.gossip.mu.Unlock()
+		return
+	}
+	h.linkUp = true
+	h.pongRecv = time.Now()
+	if h.state == statePFail {
+		h.state = stateOnline
+	}
+	c.gossip.mu.Unlock()
+	if multiBulk, ok := reply.(*resp.MultiBulkReply); ok && len(multiBulk.Args) > 0 {
+		c.mergeGossip(node, multiBulk.Args)
+	}
+}
+
+// execGossip handles CLUSTER GOSSIP sender epoch [node state ...] and replies the view of this node as the pong
+func (c *Cluster) execGossip(args cm.CmdLine) resp.Reply {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return resp.MakeArgNumErrReply("cluster|gossip")
+	}
+	sender := string(args[0])
+	c.gossip.mu.Lock()
+	h := c.gossip.get(sender)
+	h.pongRecv = time.Now()
+	h.linkUp = true
+	if h.state == statePFail {
+		h.state = stateOnline
+	}
+	c.gossip.mu.Unlock()
+	c.mergeGossip(sender, args[1:])
+	pong := []string{strconv.FormatInt(atomic.LoadInt64(&c.epoch), 10)}
+	pong = append(pong, c.gossipView()...)
+	return resp.MakeMultiBulkReply(cmdutil.ToCmdLine(pong...))
+}
+
+// mergeGossip adopts a higher epoch together with the topology of reporter and records the failure reports in its view
+func (c *Cluster) mergeGossip(reporter string, view cm.CmdLine) {
+	if epoch, err := strconv.ParseInt(string(view[0]), 10, 64); err == nil && epoch > atomic.LoadInt64(&c.epoch) && c.raft == nil {
+		c.adoptEpoch(epoch)
+		go c.syncTopology(reporter)
+	}
+	failed := make([]string, 0)
+	c.gossip.mu.Lock()
+	for i := 1; i+1 < len(view); i += 2 {
+		node, state := string(view[i]), string(view[i+1])
+		if node == c.self {
+			continue
+		}
+		h := c.gossip.get(node)
+		switch state {
+		case stateFail:
+			if h.state != stateFail {
+				failed = append(failed, node)
+			}
+			fallthrough
+		case statePFail:
+			h.reports[reporter] = time.Now()
+		default:
+			delete(h.reports, reporter)
+		}
+	}
+	c.gossip.mu.Unlock()
+	for _, node := range failed {
+		c.markFailed(node)
+	}
+	for i := 1; i+1 < len(view); i += 2 {
+		c.checkFailure(string(view[i]))
+	}
+}
+
+// checkFailure marks node failed once the majority of the members, this node included, reported it unreachable
+func (c *Cluster) checkFailure(node string) {
+	if node == c.self {
+		return
+	}
+	c.gossip.mu.Lock()
+	h, ok := c.gossip.health[node]
+	if !ok || h.state != statePFail {
+		c.gossip.mu.Unlock()
+		return
+	}
+	votes := 1
+	for reporter, at := range h.reports {
+		if time.Since(at) > c.gossip.timeout*2 {
+			delete(h.reports, reporter)
+			continue
+		}
+		if reporter != c.self {
+			votes++
+		}
+	}
+	c.gossip.mu.Unlock()
+	if votes >= len(c.ring().GetNodes())/2+1 {
+		c.markFailed(node)
+		c.broadcast(cmdutil.ToCmdLine("CLUSTER", "FAIL", node, strconv.FormatInt(atomic.LoadInt64(&c.epoch), 10)))
+	}
+}
+
+// markFailed removes a failed node from the ring, it has to MEET the cluster again once it is back
+func (c *Cluster) markFailed(node string) {
+	c.gossip.mu.Lock()
+	h := c.gossip.get(node)
+	if h.state == stateFail {
+		c.gossip.mu.Unlock()
+		return
+	}
+	h.state = stateFail
+	c.gossip.mu.Unlock()
+	if c.raft != nil {
+		// the leader of the metadata group removes the node for everyone
+		if c.raft.IsLeader() {
+			go c.proposeFailure(node)
+		}
+		return
+	}
+	logger.Warn("node", node, "failed, remove it from the ring")
+	atomic.AddInt64(&c.epoch, 1)
+	c.nodes.Remove(node)
+	c.updateRing(func(ch *ConsistentHash) { ch.RemoveNode(node) })
+	c.topologyChanged()
+	if !c.proxy {
+		c.rebalance()
+	}
+}
+
+// execFail handles CLUSTER FAIL node epoch broadcast by the member which agreed the failure
+func (c *Cluster) execFail(args cm.CmdLine) resp.Reply {
+	if len(args) != 2 {
+		return resp.MakeArgNumErrReply("cluster|fail")
+	}
+	if epoch, err := strconv.ParseInt(string(args[1]), 10, 64); err == nil && c.raft == nil {
+		c.adoptEpoch(epoch)
+	}
+	if node := string(args[0]); node != c.self {
+		c.markFailed(node)
+	}
+	return resp.MakeOkReply()
+}
+
+// adoptEpoch makes the epoch of this node at least epoch
+func (c *Cluster) adoptEpoch(epoch int64) {
+	for {
+		current := atomic.LoadInt64(&c.epoch)
+		if epoch <= current {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&c.epoch, current, epoch) {
+			c.saveTopology()
+			return
+		}
+	}
+}
+
+// execForget implements CLUSTER FORGET node, the node is removed and can not join again for a minute
+func (c *Cluster) execForget(args cm.CmdLine) resp.Reply {
+	if len(args) != 1 {
+		return resp.MakeArgNumErrReply("cluster|forget")
+	}
+	node, ok := c.findNode(string(args[0]))
+	if !ok {
+		for _, failed := range c.gossip.failedNodes() {
+			if failed == string(args[0]) || nodeID(failed) == string(args[0]) {
+				node, ok = failed, true
+			}
+		}
+	}
+	if !ok {
+		return resp.MakeErrReply("ERR Unknown node " + string(args[0]))
+	}
+	if node == c.self {
+		return resp.MakeErrReply("ERR I tried hard but I can't forget myself...")
+	}
+	c.gossip.forget(node)
+	if c.raft != nil {
+		if err := c.proposeMeta(metaCommand{Op: metaDelNode, Node: node}); err != nil {
+			return metaErrReply(err)
+		}
+		return resp.MakeOkReply()
+	}
+	c.nodes.Remove(node)
+	c.updateRing(func(ch *ConsistentHash) { ch.RemoveNode(node) })
+	c.nodeConnectionPool.RemoveConnection(node)
+	atomic.AddInt64(&c.epoch, 1)
+	c.topologyChanged()
+	return resp.MakeOkReply()
+}
+
+// execReset implements CLUSTER RESET [SOFT|HARD], this node forgets every peer, HARD also sets the epoch to 0
+func (c *Cluster) execReset(args cm.CmdLine) resp.Reply {
+	hard := false
+	if len(args) > 1 {
+		return resp.MakeArgNumErrReply("cluster|reset")
+	}
+	if len(args) == 1 {
+		switch string(args[0]) {
+		case "HARD", "hard":
+			hard = true
+		case "SOFT", "soft":
+		default:
+			return resp.MakeSyntaxErrReply()
+		}
+	}
+	for i := range c.db.Dbs {
+		if size, _ := c.db.GetDBSize(i); size > 0 {
+			return resp.MakeErrReply("ERR CLUSTER RESET can't be called with master nodes containing keys")
+		}
+	}
+	for _, node := range c.ring().GetNodes() {
+		if node != c.self {
+			c.updateRing(func(ch *ConsistentHash) { ch.RemoveNode(node) })
+			c.nodes.Remove(node)
+		}
+	}
+	c.gossip.reset()
+	c.slots.reset()
+	if hard {
+		atomic.StoreInt64(&c.epoch, 0)
+	}
+	c.topologyChanged()
+	return resp.MakeOkReply()
+}
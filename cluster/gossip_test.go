@@ -0,0 +1,72 @@
+package cluster
+
+import (
+	"mygodis/clientc"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCluster_failureDetection(t *testing.T) {
+	c := makeTestCluster("127.0.0.1:7001", "127.0.0.1:7002", "127.0.0.1:7003")
+	defer c.gossip.stop()
+	c.gossip.mu.Lock()
+	c.gossip.get("127.0.0.1:7003").state = statePFail
+	c.gossip.mu.Unlock()
+	conn := clientc.NewFakeConnection()
+	reply := c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "NODES"))
+	if got := string(reply.ToBytes()); !strings.Contains(got, "master,fail? ") {
+		t.Errorf("except suspected node in %s", got)
+	}
+	c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "GOSSIP", "127.0.0.1:7002", "5", "127.0.0.1:7003", statePFail))
+	if state := c.gossip.state("127.0.0.1:7003"); state != stateFail {
+		t.Fatalf("except node failed by majority but got %s", state)
+	}
+	for _, node := range c.ring().GetNodes() {
+		if node == "127.0.0.1:7003" {
+			t.Errorf("except failed node removed from ring")
+		}
+	}
+	if epoch := atomic.LoadInt64(&c.epoch); epoch <= 5 {
+		t.Errorf("except epoch above 5 but got %d", epoch)
+	}
+	reply = c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "FORGET", "127.0.0.1:7003"))
+	if resp.IsErrorReply(reply) {
+		t.Errorf("except forget ok but got %s", reply.ToBytes())
+	}
+	reply = c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "ADDNODE", "127.0.0.1:7003"))
+	if !resp.IsErrorReply(reply) {
+		t.Errorf("except forgotten node banned")
+	}
+	reply = c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "RESET", "HARD"))
+	if resp.IsErrorReply(reply) {
+		t.Errorf("except reset ok but got %s", reply.ToBytes())
+	}
+	if nodes := c.ring().GetNodes(); len(nodes) != 1 || atomic.LoadInt64(&c.epoch) != 0 {
+		t.Errorf("except only myself after reset but got %v", nodes)
+	}
+}
+
+func TestCluster_resetUnderTraffic(t *testing.T) {
+	c := makeTestCluster("127.0.0.1:7001")
+	defer c.gossip.stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn := clientc.NewFakeConnection()
+		for i := 0; i < 200; i++ {
+			c.Exec(conn, cmdutil.ToCmdLine("GET", "key"))
+			c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "SLOTS"))
+			c.View()
+		}
+	}()
+	conn := clientc.NewFakeConnection()
+	for i := 0; i < 50; i++ {
+		if reply := c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "RESET")); resp.IsErrorReply(reply) {
+			t.Fatalf("except reset to succeed but got %s", reply.ToBytes())
+		}
+	}
+	<-done
+}
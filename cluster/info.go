@@ -0,0 +1,178 @@
+package cluster
+
+import (
+	"fmt"
+	cm "mygodis/common"
+	"mygodis/db"
+	"mygodis/lib/slot"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// nodeInfo is what a node reported about itself in INFO
+type nodeInfo struct {
+	node       string
+	err        error
+	usedMemory int64
+	keys       int64
+	// keyspace is keys and expires of every db
+	keyspace map[int][2]int64
+}
+
+// parseNodeInfo reads the memory and keyspace lines of the INFO reply of a node
+func parseNodeInfo(node string, reply resp.Reply) nodeInfo {
+	info := nodeInfo{node: node, keyspace: make(map[int][2]int64)}
+	lines, ok := reply.(*resp.MultiBulkReply)
+	if !ok {
+		info.err = fmt.Errorf("unexpected reply %q", reply.ToBytes())
+		return info
+	}
+	for _, line := range lines.Args {
+		name, value, found := strings.Cut(string(line), ":")
+		if !found {
+			continue
+		}
+		if name == "used_memory" {
+			info.usedMemory, _ = strconv.ParseInt(value, 10, 64)
+			continue
+		}
+		dbIndex, err := strconv.Atoi(strings.TrimPrefix(name, "db"))
+		if !strings.HasPrefix(name, "db") || err != nil {
+			continue
+		}
+		var keys, expires int64
+		if _, err := fmt.Sscanf(value, "keys=%d,expires=%d", &keys, &expires); err == nil {
+			info.keyspace[dbIndex] = [2]int64{keys, expires}
+			info.keys += keys
+		}
+	}
+	return info
+}
+
+// gatherInfo asks every node for its INFO, failed nodes are kept with their error
+func (c *Cluster) gatherInfo() []nodeInfo {
+	result := c.fanoutLocal(0, cmdutil.ToCmdLine("INFO"))
+	infos := make([]nodeInfo, 0, len(result.nodes))
+	for _, node := range result.nodes {
+		if err, failed := result.errs[node]; failed {
+			infos = append(infos, nodeInfo{node: node, err: err})
+			continue
+		}
+		infos = append(infos, parseNodeInfo(node, result.replies[node]))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].node < infos[j].node
+	})
+	return infos
+}
+func clusterSection(c *Cluster, infos []nodeInfo) [][]byte {
+	lines := [][]byte{
+		[]byte("# Cluster"),
+		[]byte(fmt.Sprintf("cluster_enabled:%v", c.props.ClusterEnable)),
+		[]byte(fmt.Sprintf("cluster_node_count:%d", len(infos))),
+	}
+	for i, info := range infos {
+		if info.err != nil {
+			lines = append(lines, []byte(fmt.Sprintf("node%d:addr=%s,status=fail,error=%s", i, info.node, info.err)))
+			continue
+		}
+		lines = append(lines, []byte(fmt.Sprintf("node%d:addr=%s,status=ok,used_memory=%d,keys=%d", i, info.node, info.usedMemory, info.keys)))
+	}
+	return lines
+}
+func memorySection(infos []nodeInfo) [][]byte {
+	total := int64(0)
+	for _, info := range infos {
+		total += info.usedMemory
+	}
+	return [][]byte{
+		[]byte("# Memory:"),
+		[]byte(fmt.Sprintf("used_memory:%d", total)),
+	}
+}
+func keyspaceSection(infos []nodeInfo) [][]byte {
+	sums := make(map[int][2]int64)
+	for _, info := range infos {
+		for dbIndex, counts := range info.keyspace {
+			sum := sums[dbIndex]
+			sums[dbIndex] = [2]int64{sum[0] + counts[0], sum[1] + counts[1]}
+		}
+	}
+	dbs := make([]int, 0, len(sums))
+	for dbIndex := range sums {
+		dbs = append(dbs, dbIndex)
+	}
+	sort.Ints(dbs)
+	lines := [][]byte{[]byte("# Keyspace:")}
+	for _, dbIndex := range dbs {
+		lines = append(lines, []byte(fmt.Sprintf("db%d:keys=%d,expires=%d", dbIndex, sums[dbIndex][0], sums[dbIndex][1])))
+	}
+	return lines
+}
+
+// execInfo serves INFO in cluster mode, memory and keyspace are summed over the nodes which answered
+func execInfo(c *Cluster, cmd cm.CmdLine) resp.Reply {
+	section := "all"
+	if len(cmd) == 1 {
+		section = strings.ToLower(string(cmd[0]))
+	}
+	switch section {
+	case "server":
+		return resp.MakeMultiBulkReply(db.ServerInfo(c.db))
+	case "client":
+		return resp.MakeMultiBulkReply(db.ClientInfo(c.db))
+	case "persistence":
+		return resp.MakeMultiBulkReply(db.PersistenceInfo(c.db))
+	case "cpu":
+		return resp.MakeMultiBulkReply(db.CpuInfo(c.db))
+	case "cluster":
+		return resp.MakeMultiBulkReply(clusterSection(c, c.gatherInfo()))
+	case "memory":
+		return resp.MakeMultiBulkReply(memorySection(c.gatherInfo()))
+	case "keyspace":
+		return resp.MakeMultiBulkReply(keyspaceSection(c.gatherInfo()))
+	}
+	infos := c.gatherInfo()
+	lines := db.ServerInfo(c.db)
+	lines = append(lines, db.ClientInfo(c.db)...)
+	lines = append(lines, clusterSection(c, infos)...)
+	lines = append(lines, memorySection(infos)...)
+	lines = append(lines, db.PersistenceInfo(c.db)...)
+	lines = append(lines, db.CpuInfo(c.db)...)
+	lines = append(lines, keyspaceSection(infos)...)
+	return resp.MakeMultiBulkReply(lines)
+}
+
+// execClusterInfo serves CLUSTER INFO, the state is ok while every slot is served and a majority of nodes answers
+func (c *Cluster) execClusterInfo() resp.Reply {
+	result := c.fanout(c.members(), cmdutil.ToCmdLine("CPING"), c.fanoutTimeout())
+	assigned := 0
+	for s := 0; s < slot.Count; s++ {
+		if c.slots.owner(s) != "" {
+			assigned++
+		}
+	}
+	state := "ok"
+	if assigned < slot.Count || result.check(requireQuorum) != nil {
+		state = "fail"
+	}
+	mode := "slots"
+	if c.proxy {
+		mode = "proxy"
+	}
+	lines := []string{
+		"cluster_state:" + state,
+		"cluster_mode:" + mode,
+		"cluster_slots_assigned:" + strconv.Itoa(assigned),
+		"cluster_known_nodes:" + strconv.Itoa(len(result.nodes)),
+		"cluster_reachable_nodes:" + strconv.Itoa(len(result.replies)),
+		"cluster_failed_nodes:" + strconv.Itoa(len(c.gossip.failedNodes())),
+		"cluster_current_epoch:" + strconv.FormatInt(atomic.LoadInt64(&c.epoch), 10),
+	}
+	lines = append(lines, c.raftInfo()...)
+	return resp.MakeBulkReply([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+}
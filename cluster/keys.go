@@ -1,196 +1,218 @@
 package cluster
 
 import (
+	"math/rand"
 	cm "mygodis/common"
 	cmi "mygodis/common/commoninterface"
+	"mygodis/db"
+	logger "mygodis/log"
 	"mygodis/resp"
 	"mygodis/util/cmdutil"
-	"mygodis/util/ternaryoperator"
+	"strings"
 )
 
-func execFlushDb(cluster *Cluster, args cm.CmdLine) resp.Reply {
-	result, errs := cluster.broadcast(cmdutil.ToCmdLineWithName("cflushdb"))
-	if len(errs) == 0 && cluster.isAllOk(result) {
+// execFlushDb flushes the selected db on every node
+func execFlushDb(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	async, ok := parseFlushMode(cmdLine[1:])
+	if !ok {
+		return resp.MakeErrReply("ERR syntax error")
+	}
+	return cluster.flush(connection.GetDBIndex(), cmdutil.ToCmdLine("FLUSHDB"), async, cluster.partialPolicy())
+}
+
+// execFlushAll flushes every db on every node, with ASYNC it replies before the nodes are done
+func execFlushAll(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	async, ok := parseFlushMode(cmdLine[1:])
+	if !ok {
+		return resp.MakeErrReply("ERR syntax error")
+	}
+	return cluster.flush(0, cmdutil.ToCmdLine("FLUSHALL"), async, requireAll)
+}
+func (c *Cluster) flush(dbIndex int, cmdLine cm.CmdLine, async bool, policy fanoutPolicy) resp.Reply {
+	if async {
+		go func() {
+			if err := c.fanoutLocal(dbIndex, cmdLine).check(policy); err != nil {
+				logger.Warn("async", string(cmdLine[0]), "failed", err)
+			}
+		}()
 		return resp.MakeOkReply()
 	}
-	return resp.MakeErrReply("error occurs")
+	if err := c.fanoutLocal(dbIndex, cmdLine).check(policy); err != nil {
+		return resp.MakeErrReply(err.Error())
+	}
+	return resp.MakeOkReply()
+}
+func parseFlushMode(args cm.CmdLine) (async bool, ok bool) {
+	if len(args) == 0 {
+		return false, true
+	}
+	if len(args) > 1 {
+		return false, false
+	}
+	switch strings.ToUpper(string(args[0])) {
+	case "ASYNC":
+		return true, true
+	case "SYNC":
+		return false, true
+	}
+	return false, false
 }
+
+// execPing replies PONG while a majority of the nodes is reachable
 func execPing(cluster *Cluster) resp.Reply {
-	result, errs := cluster.broadcast(cmdutil.ToCmdLineWithName("cping"))
-	if len(errs) == 0 && cluster.isAllOk(result) {
-		return resp.MakePongReply()
+	result := cluster.fanout(cluster.members(), cmdutil.ToCmdLine("CPING"), cluster.fanoutTimeout())
+	if err := result.check(requireQuorum); err != nil {
+		return resp.MakeErrReply(err.Error())
 	}
-	return resp.MakeErrReply("error occurs")
+	return resp.MakePongReply()
 }
 func execCPing() resp.Reply {
 	return resp.MakePongReply()
 }
 
+// execKeys collects the matching keys of every node
 func execKeys(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
-	reply := cluster.db.Exec(connection, cmdutil.ToCmdLineWithBytes("KEYS", cmdLine[1:]...))
-	results, errs := cluster.broadcast(cmdutil.ToCmdLineWithBytes("CKEYS", cmdLine[1:]...))
-	results[cluster.self] = reply
-	if errs != nil || len(errs) != 0 || !cluster.isAllOk(results) {
-		return resp.MakeErrReply("cluster error")
+	if len(cmdLine) != 2 {
+		return resp.MakeArgNumErrReply("keys")
 	}
-	keys := make([][]byte, 0)
-	for _, reply := range results {
-		bulkReply, ok := reply.(*resp.MultiBulkReply)
-		if ok {
-			keys = append(keys, bulkReply.Args...)
-		}
+	result := cluster.fanoutLocal(connection.GetDBIndex(), cmdutil.ToCmdLine("KEYS", string(cmdLine[1])))
+	if err := result.check(cluster.partialPolicy()); err != nil {
+		return resp.MakeErrReply(err.Error())
 	}
-
-	return ternaryoperator.Which(len(keys) == 0, resp.MakeMultiBulkReply([][]byte{}), resp.MakeMultiBulkReply(keys))
-}
-func execCKeys(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
-	cmdLine[0] = []byte("KEYS")
-	reply := cluster.db.Exec(connection, cmdLine)
-	return reply
-}
-func execDel(cluster *Cluster, connection cmi.Connection, line cm.CmdLine) resp.Reply {
-	if len(line) < 2 {
-		return resp.MakeErrReply("wrong number of arguments for 'del' command")
-	}
-	results := make(map[string]resp.Reply)
-	keys := make([][]byte, 0, len(line)-1)
-	for i := 1; i < len(line); i++ {
-		key := line[i]
-		keys = append(keys, key)
-		node := cluster.ch.GetNode(key)
-		if node != cluster.self {
-			client := cluster.nodeConnectionPool.GetConnection(node)
-			reply, err := client.Send(cmdutil.ToCmdLineWithBytes("DEL", line[i]))
-			if err != nil {
-				return resp.MakeErrReply(err.Error())
+	keys := make([][]byte, 0)
+	// a replicated key is listed by each of its replicas
+	seen := make(map[string]bool)
+	for _, reply := range result.replies {
+		if multiBulk, ok := reply.(*resp.MultiBulkReply); ok {
+			for _, key := range multiBulk.Args {
+				if !seen[string(key)] {
+					seen[string(key)] = true
+					keys = append(keys, key)
+				}
 			}
-			results[string(key)] = reply
-			continue
 		}
-		reply := cluster.db.Exec(connection, cmdutil.ToCmdLineWithBytes("DEL", line[i]))
-		results[string(key)] = reply
 	}
-	if len(results) == 0 {
-		return resp.MakeErrReply("cluster error")
+	if len(keys) == 0 {
+		return resp.MakeEmptyMultiBulkReply()
 	}
-	var count int64
-	for _, key := range keys {
-		reply, ok := results[string(key)]
-		if !ok {
-			return resp.MakeErrReply("cluster error")
-		}
-		if reply == nil {
-			continue
-		}
-		count += reply.(*resp.IntReply).Code
-	}
-	return resp.MakeIntReply(count)
+	return resp.MakeMultiBulkReply(keys)
 }
-func execMGet(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
-	if len(cmdLine) < 2 {
-		return resp.MakeErrReply("wrong number of arguments for 'mget' command")
-	}
-	results := make(map[string]resp.Reply)
-	keys := make([][]byte, 0, len(cmdLine)-1)
-	for i := 1; i < len(cmdLine); i++ {
-		key := cmdLine[i]
-		keys = append(keys, key)
-		node := cluster.ch.GetNode(key)
-		if node != cluster.self {
-			client := cluster.nodeConnectionPool.GetConnection(node)
-			reply, err := client.Send(cmdutil.ToCmdLineWithBytes("GET", cmdLine[i]))
-			if err != nil {
-				return resp.MakeErrReply(err.Error())
-			}
-			results[string(key)] = reply
-			continue
+
+// execDBSize sums the keys of the selected db over every node, replicated keys are counted once
+func execDBSize(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	if len(cmdLine) != 1 {
+		return resp.MakeArgNumErrReply("dbsize")
+	}
+	if cluster.replicated() {
+		reply := execKeys(cluster, connection, cmdutil.ToCmdLine("KEYS", "*"))
+		if keys, ok := reply.(*resp.MultiBulkReply); ok {
+			return resp.MakeIntReply(int64(len(keys.Args)))
+		}
+		if resp.IsErrorReply(reply) {
+			return reply
 		}
-		reply := cluster.db.Exec(connection, cmdutil.ToCmdLineWithBytes("GET", cmdLine[i]))
-		results[string(key)] = reply
+		return resp.MakeIntReply(0)
 	}
-	if len(results) == 0 {
-		return resp.MakeErrReply("cluster error")
+	result := cluster.fanoutLocal(connection.GetDBIndex(), cmdutil.ToCmdLine("DBSIZE"))
+	if err := result.check(cluster.partialPolicy()); err != nil {
+		return resp.MakeErrReply(err.Error())
 	}
-	bytes := make([][]byte, 0, len(results))
-	for _, key := range keys {
-		reply, ok := results[string(key)]
-		if !ok {
-			return resp.MakeErrReply("cluster error")
+	size := int64(0)
+	for _, reply := range result.replies {
+		if n, ok := reply.(*resp.IntReply); ok {
+			size += n.Code
 		}
-		if reply == nil {
-			continue
-		}
-		bytes = append(bytes, reply.(*resp.BulkReply).Arg)
 	}
-
-	return resp.MakeMultiBulkReply(bytes)
+	return resp.MakeIntReply(size)
 }
-func execMSet0(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
-	if len(cmdLine) < 3 {
-		return resp.MakeErrReply("wrong number of arguments for 'mset' command")
-	}
-	if len(cmdLine)%2 != 1 {
-		return resp.MakeErrReply("wrong number of arguments for 'mset' command")
-	}
-	results := make(map[string]resp.Reply)
-	for i := 1; i < len(cmdLine); i += 2 {
-		key := cmdLine[i]
-		node := cluster.ch.GetNode(key)
-		set := ternaryoperator.Which(string(cmdLine[0]) == "MSETNX", "SETNX", "SET")
-		if node != cluster.self {
-			client := cluster.nodeConnectionPool.GetConnection(node)
-			reply, err := client.Send(cmdutil.ToCmdLineWithBytes(set, cmdLine[i], cmdLine[i+1]))
-			if err != nil {
-				return resp.MakeErrReply(err.Error())
-			}
-			results[string(key)] = reply
-			continue
+
+// execRandomKey returns a random key of a random node which has keys, failed nodes are skipped
+func execRandomKey(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	if len(cmdLine) != 1 {
+		return resp.MakeArgNumErrReply("randomkey")
+	}
+	result := cluster.fanoutLocal(connection.GetDBIndex(), cmdutil.ToCmdLine("RANDOMKEY"))
+	if err := result.check(allowPartial); err != nil {
+		return resp.MakeErrReply(err.Error())
+	}
+	keys := make([]resp.Reply, 0, len(result.replies))
+	for _, reply := range result.replies {
+		if _, ok := reply.(*resp.BulkReply); ok {
+			keys = append(keys, reply)
 		}
-		reply := cluster.db.Exec(connection, cmdutil.ToCmdLineWithBytes(set, cmdLine[i], cmdLine[i+1]))
-		results[string(key)] = reply
 	}
-	if len(results) == 0 || !cluster.isAllOk(results) {
-		return resp.MakeErrReply("cluster error")
+	if len(keys) == 0 {
+		return resp.MakeNullBulkReply()
 	}
-	return resp.MakeOkReply()
+	return keys[rand.Intn(len(keys))]
 }
 
-var cmdContainer = make(map[string]CmdFunc)
-var supportMulti = make(map[string]struct{})
-
-func RegisterSupportMultiKey(cmdNames ...string) {
-	for _, cmdName := range cmdNames {
-		supportMulti[cmdName] = struct{}{}
+// execKeyIntrospection runs OBJECT and MEMORY on the owner of their key, the subcommands without a key are about
+// this node
+func execKeyIntrospection(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	keys := relatedKeys(cmdLine)
+	if len(keys) == 0 || cluster.replicated() {
+		return cluster.db.Exec(connection, cmdLine)
 	}
-}
-func IsSupportMulti(cmdName string) bool {
-	_, ok := supportMulti[cmdName]
-	return ok
+	if !cluster.proxy {
+		return cluster.execRedirect(connection, cmdLine)
+	}
+	return cluster.execOnOwner(connection, cluster.ownerOf(keys[0]), keys[0], cmdLine)
 }
 
-func isMultiKeyCmd(cmdLine cm.CmdLine) bool {
-	cmdName := string(cmdLine[0])
-	switch cmdName {
-	case "MSET", "MGET", "MSETNX":
-		if len(cmdLine) < 3 {
-			return false
+// execMigrate runs MIGRATE on the node owning its keys, which must all be owned by the same node. The copies of
+// replicated keys can not be moved together, so it is refused when keys are replicated.
+func execMigrate(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	keys := relatedKeys(cmdLine)
+	if len(keys) == 0 {
+		return cluster.db.Exec(connection, cmdLine)
+	}
+	if cluster.replicated() {
+		return resp.MakeErrReply("ERR MIGRATE is not supported when keys are replicated")
+	}
+	if !cluster.proxy {
+		return cluster.execRedirect(connection, cmdLine)
+	}
+	owner := cluster.ownerOf(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.ownerOf(key) != owner {
+			return resp.MakeErrReply("CROSSSLOT Keys in request don't hash to the same node")
 		}
-	case "DEL":
-		if len(cmdLine) < 2 {
-			return false
+	}
+	return cluster.execOnOwner(connection, owner, keys[0], cmdLine)
+}
+
+// execSort runs SORT and SORT_RO. Without BY or GET patterns their keys are gathered like those of any multi key
+// command, but the keys patterns derive are only known to the node sorting, so they must share its slot through a
+// hash tag.
+func execSort(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	writeKeys, readKeys, ok := db.GetRelatedKeys(cmdLine)
+	// the first key read is the one sorted, the others are patterns
+	if !ok || len(readKeys) < 2 || cluster.replicated() {
+		return execScatter(cluster, connection, cmdLine)
+	}
+	keys := append(append([]string{}, readKeys...), writeKeys...)
+	if !cluster.proxy {
+		if !sameSlot(keys) {
+			return resp.MakeErrReply("CROSSSLOT BY and GET patterns of SORT must hash to the slot of the key")
 		}
-	case "BITOP":
-		if len(cmdLine) < 4 {
-			return false
+		return cluster.execRedirect(connection, cmdLine)
+	}
+	owner := cluster.ownerOf(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.ownerOf(key) != owner {
+			return resp.MakeErrReply("CROSSSLOT BY and GET patterns of SORT must hash to the node of the key")
 		}
-	case "RPOPLPUSH", "SMOVE", "SDIFF", "SINTER", "SUNION", "SUNIONSTORE", "SDIFFSTORE", "SINTERSTORE", "ZINTERSTORE", "ZUNIONSTORE", "ZINTER", "ZUNION":
-		return true
 	}
-	return false
+	return cluster.execOnOwner(connection, owner, keys[0], cmdLine)
+}
+func execCKeys(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	cmdLine[0] = []byte("KEYS")
+	reply := cluster.db.Exec(connection, cmdLine)
+	return reply
 }
 func init() {
 
-	RegisterCmd("EXISTS", defaultFunc)
 	RegisterCmd("TTL", defaultFunc)
 	RegisterCmd("PTTL", defaultFunc)
 	RegisterCmd("TYPE", defaultFunc)
@@ -200,5 +222,16 @@ func init() {
 	RegisterCmd("PEXPIREAT", defaultFunc)
 	RegisterCmd("PERSIST", defaultFunc)
 	RegisterCmd("KEYS", execKeys)
+	RegisterCmd("DBSIZE", execDBSize)
+	RegisterCmd("RANDOMKEY", execRandomKey)
+	RegisterCmd("FLUSHDB", execFlushDb)
+	RegisterCmd("FLUSHALL", execFlushAll)
 	RegisterCmd("CKEYS", execCKeys)
+	RegisterCmd("OBJECT", execKeyIntrospection)
+	RegisterCmd("MEMORY", execKeyIntrospection)
+	RegisterCmd("DUMP", defaultFunc)
+	RegisterCmd("RESTORE", defaultFunc)
+	RegisterCmd("MIGRATE", execMigrate)
+	RegisterCmd("SORT", execSort)
+	RegisterCmd("SORT_RO", execSort)
 }
@@ -0,0 +1,370 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	cm "mygodis/common"
+	"mygodis/lib/raft"
+	logger "mygodis/log"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"sync/atomic"
+	"time"
+)
+
+// raftHeartbeat and raftElectionTimeout are the timers of the metadata group
+var (
+	raftHeartbeat       = 100 * time.Millisecond
+	raftElectionTimeout = time.Second
+)
+
+const (
+	// raftSnapshotThreshold is the number of applied entries after which the metadata log is compacted
+	raftSnapshotThreshold = 256
+	// metaTimeout bounds a metadata change or a linearizable read, it is below the timeout of relayed commands
+	metaTimeout = 2 * time.Second
+)
+
+// operations of the metadata log
+const (
+	metaAddNode = "addnode"
+	metaDelNode = "delnode"
+	metaFail    = "fail"
+	metaSetSlot = "setslot"
+)
+
+// metaCommand is one change of the cluster metadata
+type metaCommand struct {
+	Op     string `json:"op"`
+	Node   string `json:"node"`
+	Weight int    `json:"weight,omitempty"`
+	Slot   int    `json:"slot,omitempty"`
+}
+
+// metaSnapshot is the cluster metadata a member restores instead of replaying the compacted log
+type metaSnapshot struct {
+	Epoch  int64           `json:"epoch"`
+	Ring   json.RawMessage `json:"ring"`
+	Failed []string        `json:"failed,omitempty"`
+	Pins   map[int]string  `json:"pins,omitempty"`
+}
+
+// metaMachine applies the committed metadata log to the cluster, every member applies the same changes in the same order.
+// The ring is changed on a copy swapped in whole, requests keep reading the ring they loaded meanwhile
+type metaMachine struct {
+	c *Cluster
+}
+
+func (m *metaMachine) Apply(data []byte) {
+	var cmd metaCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		logger.Error("broken metadata entry", err)
+		return
+	}
+	c := m.c
+	atomic.AddInt64(&c.epoch, 1)
+	switch cmd.Op {
+	case metaAddNode:
+		c.setHealth(cmd.Node, stateOnline)
+		if cmd.Node != c.self {
+			c.nodes.Put(cmd.Node, struct{}{})
+			c.nodeConnectionPool.AddConnection(cmd.Node)
+		}
+		c.updateRing(func(ch *ConsistentHash) { ch.AddWeightedNode(cmd.Node, cmd.Weight) })
+		c.topologyChanged()
+		if cmd.Node != c.self {
+			c.rebalanceAfterJoin(cmd.Node)
+		}
+	case metaDelNode, metaFail:
+		if cmd.Op == metaFail && cmd.Node != c.self {
+			c.setHealth(cmd.Node, stateFail)
+		}
+		c.nodes.Remove(cmd.Node)
+		c.updateRing(func(ch *ConsistentHash) { ch.RemoveNode(cmd.Node) })
+		c.topologyChanged()
+		// a node agreed failed by the others keeps its keys until it hears of it
+		if !c.proxy && (cmd.Op == metaDelNode || cmd.Node != c.self) {
+			c.rebalance()
+		}
+	case metaSetSlot:
+		c.slots.pin(cmd.Slot, cmd.Node)
+		c.saveTopology()
+	default:
+		logger.Warn("unknown metadata operation", cmd.Op)
+	}
+}
+func (m *metaMachine) Snapshot() ([]byte, error) {
+	c := m.c
+	ring, err := c.ring().Serialize()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(metaSnapshot{
+		Epoch:  atomic.LoadInt64(&c.epoch),
+		Ring:   ring,
+		Failed: c.gossip.failedNodes(),
+		Pins:   c.slots.pins(),
+	})
+}
+func (m *metaMachine) Restore(data []byte) error {
+	var snapshot metaSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	ch, err := LoadFrom(snapshot.Ring)
+	if err != nil {
+		return err
+	}
+	c := m.c
+	for _, node := range c.nodes.Keys() {
+		if ch.Weight(node) == 0 {
+			c.nodes.Remove(node)
+		}
+	}
+	for _, node := range ch.GetNodes() {
+		if node != c.self {
+			c.nodes.Put(node, struct{}{})
+			c.nodeConnectionPool.AddConnection(node)
+		}
+	}
+	for _, node := range snapshot.Failed {
+		if node != c.self {
+			c.setHealth(node, stateFail)
+		}
+	}
+	c.setRing(ch)
+	atomic.StoreInt64(&c.epoch, snapshot.Epoch)
+	c.slots.setPins(snapshot.Pins)
+	c.topologyChanged()
+	if !c.proxy {
+		c.rebalance()
+	}
+	return nil
+}
+
+// setHealth forces the gossip state of node, the metadata log has the last word on failures
+func (c *Cluster) setHealth(node string, state string) {
+	c.gossip.mu.Lock()
+	defer c.gossip.mu.Unlock()
+	h := c.gossip.get(node)
+	h.state = state
+	if state == stateOnline {
+		h.reports = make(map[string]time.Time)
+		h.pongRecv = time.Now()
+	}
+}
+
+// raftTransport carries raft messages as CLUSTER RAFT over the connections to the peers
+type raftTransport struct {
+	c *Cluster
+}
+
+func (t *raftTransport) Send(to string, m *raft.Message) (*raft.Message, error) {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := t.c.relay(to, cmdutil.ToCmdLineWithBytes("CLUSTER", []byte("RAFT"), payload))
+	if err != nil {
+		return nil, err
+	}
+	bulk, ok := reply.(*resp.BulkReply)
+	if !ok {
+		return nil, errors.New("unexpected raft reply " + errorMessage(reply))
+	}
+	response := &raft.Message{}
+	if err := json.Unmarshal(bulk.Arg, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// startRaft creates the member of the metadata group, a node without a seed to join starts a new group
+func (c *Cluster) startRaft() {
+	var storage raft.Storage = raft.NewMemoryStorage()
+	if path := c.props.ClusterRaftFile; path != "" {
+		storage = raft.NewFileStorage(path)
+	}
+	state, snapshot, entries, err := storage.Load()
+	if err != nil {
+		panic(err)
+	}
+	fresh := state.Term == 0 && snapshot == nil && len(entries) == 0
+	var peers []string
+	if fresh && (c.props.ClusterAsSeed || len(c.seeds()) == 0) {
+		peers = []string{c.self}
+	}
+	node, err := raft.NewNode(raft.Config{
+		ID:                c.self,
+		Peers:             peers,
+		Transport:         &raftTransport{c: c},
+		StateMachine:      &metaMachine{c: c},
+		Storage:           storage,
+		ElectionTimeout:   raftElectionTimeout,
+		HeartbeatInterval: raftHeartbeat,
+		SnapshotThreshold: raftSnapshotThreshold,
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.raft = node
+	node.Start()
+	if len(peers) > 0 {
+		go c.announceSelf()
+	}
+}
+
+// announceSelf records the node which started the group in the metadata once it leads the group
+func (c *Cluster) announceSelf() {
+	for {
+		select {
+		case <-c.gossip.stopC:
+			return
+		case <-time.After(raftHeartbeat):
+		}
+		if !c.raft.IsLeader() {
+			continue
+		}
+		err := c.proposeMeta(metaCommand{Op: metaAddNode, Node: c.self, Weight: c.ring().Weight(c.self)})
+		if err == nil {
+			return
+		}
+		logger.Warn("announce", c.self, "to the metadata group failed", err)
+	}
+}
+
+// proposeMeta commits cmd to the metadata log, members enter and leave the raft group together with the ring
+func (c *Cluster) proposeMeta(cmd metaCommand) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(metaTimeout)
+	for {
+		err = c.proposeOnce(cmd, data)
+		if err != raft.ErrConfigInProgress && err != raft.ErrNotLeader || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(raftHeartbeat)
+	}
+}
+
+// proposeOnce proposes cmd if this node leads the group, otherwise the leader is asked with CLUSTER METAPROPOSE
+func (c *Cluster) proposeOnce(cmd metaCommand, data []byte) error {
+	if !c.raft.IsLeader() {
+		leader := c.raft.Leader()
+		if leader == "" || leader == c.self {
+			return raft.ErrNotLeader
+		}
+		reply, err := c.relay(leader, cmdutil.ToCmdLineWithBytes("CLUSTER", []byte("METAPROPOSE"), data))
+		if err != nil {
+			return err
+		}
+		if resp.IsErrorReply(reply) {
+			return errors.New(errorMessage(reply))
+		}
+		return nil
+	}
+	var err error
+	switch cmd.Op {
+	case metaAddNode:
+		err = c.raft.AddPeer(cmd.Node, metaTimeout)
+	case metaDelNode, metaFail:
+		err = c.raft.RemovePeer(cmd.Node, metaTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	return c.raft.Propose(data, metaTimeout)
+}
+
+// joinMeta adds node to the metadata and replies the ring including it to CLUSTER JOIN
+func (c *Cluster) joinMeta(node string, weight int) resp.Reply {
+	if err := c.proposeMeta(metaCommand{Op: metaAddNode, Node: node, Weight: weight}); err != nil {
+		return metaErrReply(err)
+	}
+	// a follower may not have applied the join yet
+	if errReply := c.readMeta(); errReply != nil {
+		return errReply
+	}
+	ring, err := c.ring().Serialize()
+	if err != nil {
+		return resp.MakeErrReply(err.Error())
+	}
+	return resp.MakeSimpleStringReply(string(ring))
+}
+
+// proposeFailure removes a node agreed failed from the metadata
+func (c *Cluster) proposeFailure(node string) {
+	logger.Warn("node", node, "failed, remove it from the metadata")
+	if err := c.proposeMeta(metaCommand{Op: metaFail, Node: node}); err != nil {
+		logger.Error("remove failed node", node, err)
+	}
+}
+
+// execRaft handles CLUSTER RAFT message sent by another member of the metadata group
+func (c *Cluster) execRaft(args cm.CmdLine) resp.Reply {
+	if len(args) != 1 {
+		return resp.MakeArgNumErrReply("cluster|raft")
+	}
+	if c.raft == nil {
+		return resp.MakeErrReply("ERR cluster-raft is not enabled")
+	}
+	m := &raft.Message{}
+	if err := json.Unmarshal(args[0], m); err != nil {
+		return resp.MakeErrReply("ERR malformed raft message")
+	}
+	response, err := json.Marshal(c.raft.Handle(m))
+	if err != nil {
+		return resp.MakeErrReply(err.Error())
+	}
+	return resp.MakeBulkReply(response)
+}
+
+// execMetaPropose handles CLUSTER METAPROPOSE command forwarded to the leader of the metadata group
+func (c *Cluster) execMetaPropose(args cm.CmdLine) resp.Reply {
+	if len(args) != 1 {
+		return resp.MakeArgNumErrReply("cluster|metapropose")
+	}
+	if c.raft == nil {
+		return resp.MakeErrReply("ERR cluster-raft is not enabled")
+	}
+	var cmd metaCommand
+	if err := json.Unmarshal(args[0], &cmd); err != nil {
+		return resp.MakeErrReply("ERR malformed metadata command")
+	}
+	if err := c.proposeMeta(cmd); err != nil {
+		return metaErrReply(err)
+	}
+	return resp.MakeOkReply()
+}
+
+// readMeta waits until this node applied every metadata change committed before the call
+func (c *Cluster) readMeta() resp.Reply {
+	if c.raft == nil {
+		return nil
+	}
+	if err := c.raft.ReadBarrier(metaTimeout); err != nil {
+		return metaErrReply(err)
+	}
+	return nil
+}
+func metaErrReply(err error) resp.Reply {
+	return resp.MakeErrReply(fmt.Sprintf("CLUSTERDOWN cluster metadata is not available: %v", err))
+}
+
+// raftInfo is appended to CLUSTER INFO when the metadata is kept in raft
+func (c *Cluster) raftInfo() []string {
+	if c.raft == nil {
+		return nil
+	}
+	status := c.raft.Status()
+	return []string{
+		"cluster_raft_state:" + status.State,
+		fmt.Sprintf("cluster_raft_term:%d", status.Term),
+		"cluster_raft_leader:" + status.Leader,
+		fmt.Sprintf("cluster_raft_commit:%d", status.Commit),
+		fmt.Sprintf("cluster_raft_members:%d", len(status.Peers)),
+	}
+}
@@ -0,0 +1,91 @@
+package cluster
+
+import (
+	"mygodis/clientc"
+	"mygodis/config"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeRaftCluster starts a member of a metadata group on listener, a seed starts the group and the others join it
+func makeRaftCluster(t *testing.T, listener net.Listener, seed string) *Cluster {
+	config.Properties = &config.ServerProperties{
+		Self:          listener.Addr().String(),
+		Databases:     16,
+		ClusterRaft:   true,
+		ClusterAsSeed: seed == "",
+	}
+	if seed != "" {
+		config.Properties.Peers = []string{seed}
+	}
+	c := MakeCluster()
+	t.Cleanup(func() {
+		c.gossip.stop()
+		c.raft.Stop()
+	})
+	go serveCluster(listener, c)
+	return c
+}
+
+func sortedMembers(c *Cluster) string {
+	nodes := c.ring().GetNodes()
+	sort.Strings(nodes)
+	return strings.Join(nodes, ",")
+}
+
+func TestCluster_raftMetadata(t *testing.T) {
+	heartbeat, election := raftHeartbeat, raftElectionTimeout
+	raftHeartbeat, raftElectionTimeout = 20*time.Millisecond, 200*time.Millisecond
+	defer func() {
+		raftHeartbeat, raftElectionTimeout = heartbeat, election
+	}()
+	listeners := make([]net.Listener, 3)
+	for i := range listeners {
+		listeners[i], _ = net.Listen("tcp", "127.0.0.1:0")
+		defer listeners[i].Close()
+	}
+	seed := listeners[0].Addr().String()
+	a := makeRaftCluster(t, listeners[0], "")
+	// b and c join at the same time, the leader changes the group one member at a time
+	b := makeRaftCluster(t, listeners[1], seed)
+	c := makeRaftCluster(t, listeners[2], seed)
+	members := []*Cluster{a, b, c}
+	waitFor(t, "every node in the ring of every node", func() bool {
+		for _, node := range members {
+			if len(node.ring().GetNodes()) != 3 || len(node.raft.Status().Peers) != 3 {
+				return false
+			}
+		}
+		return true
+	})
+	for _, node := range members[1:] {
+		if got, want := sortedMembers(node), sortedMembers(a); got != want {
+			t.Errorf("%s has ring %s but %s has %s", node.self, got, a.self, want)
+		}
+	}
+
+	// a slot moved through one member is seen by a read on any other right after
+	conn := clientc.NewFakeConnection()
+	reply := c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "SETSLOT", "5", "NODE", b.self))
+	if resp.IsErrorReply(reply) {
+		t.Fatalf("except setslot ok but got %s", reply.ToBytes())
+	}
+	for _, node := range members {
+		if reply := node.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "NODES")); resp.IsErrorReply(reply) {
+			t.Fatalf("except nodes of %s but got %s", node.self, reply.ToBytes())
+		}
+		if owner := node.slots.owner(5); owner != b.self {
+			t.Errorf("except slot 5 served by %s on %s but got %s", b.self, node.self, owner)
+		}
+	}
+	info := string(a.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "INFO")).ToBytes())
+	if !strings.Contains(info, "cluster_raft_members:"+strconv.Itoa(len(members))) {
+		t.Errorf("except raft members in cluster info but got %q", info)
+	}
+}
@@ -0,0 +1,17 @@
+package cluster
+
+import "mygodis/lib/metrics"
+
+var (
+	peerRPCDuration = metrics.NewHistogramVec("mygodis_cluster_peer_rpc_duration_seconds", "Time a peer took to answer a relayed command", metrics.LatencyBuckets, "peer")
+	peerRPCErrors   = metrics.NewCounterVec("mygodis_cluster_peer_rpc_errors_total", "Relayed commands which got no answer from the peer", "peer")
+)
+
+func init() {
+	metrics.Default.Register(peerRPCDuration, peerRPCErrors)
+}
+
+// Collect writes the gauges of the local server of the node
+func (c *Cluster) Collect(w *metrics.Writer) {
+	c.db.Collect(w)
+}
@@ -0,0 +1,229 @@
+package cluster
+
+import (
+	"errors"
+	cm "mygodis/common"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/db"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"strconv"
+	"strings"
+)
+
+// isTxControl returns whether name is executed at once even if the connection is in MULTI
+func isTxControl(name string) bool {
+	switch name {
+	case "MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH":
+		return true
+	}
+	return false
+}
+
+// execTxControl serves MULTI, EXEC, DISCARD, WATCH and UNWATCH in cluster mode
+func (c *Cluster) execTxControl(connection cmi.Connection, name string, args cm.CmdLine) resp.Reply {
+	switch name {
+	case "MULTI":
+		if len(args) != 1 {
+			return resp.MakeArgNumErrReply("multi")
+		}
+		return db.StartMulti(connection)
+	case "DISCARD":
+		if len(args) != 1 {
+			return resp.MakeArgNumErrReply("discard")
+		}
+		return db.DiscardMulti(connection)
+	case "EXEC":
+		if len(args) != 1 {
+			return resp.MakeArgNumErrReply("exec")
+		}
+		return c.execMulti(connection)
+	case "WATCH":
+		return c.execWatch(connection, args[1:])
+	default:
+		watching := connection.GetWatching()
+		for key := range watching {
+			delete(watching, key)
+		}
+		return resp.MakeOkReply()
+	}
+}
+
+// ownerOfKeys returns the node serving all keys of cmdLine, this node for commands without keys
+func (c *Cluster) ownerOfKeys(cmdLine cm.CmdLine) (string, error) {
+	keys := relatedKeys(cmdLine)
+	if len(keys) == 0 {
+		return c.self, nil
+	}
+	owner := c.ownerOf(keys[0])
+	if owner == "" {
+		return "", errors.New("CLUSTERDOWN Hash slot not served")
+	}
+	for _, key := range keys[1:] {
+		if c.ownerOf(key) != owner {
+			return "", errors.New("CROSSSLOT Keys in request don't hash to the same node")
+		}
+	}
+	return owner, nil
+}
+
+// enqueue queues a command of MULTI, commands may go to different nodes but one command must not span nodes
+func (c *Cluster) enqueue(connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	if _, _, ok := db.GetRelatedKeys(cmdLine); ok {
+		if _, err := c.ownerOfKeys(cmdLine); err != nil {
+			reply := resp.MakeErrReply(err.Error())
+			connection.AddTxError(reply)
+			return reply
+		}
+	}
+	return db.EnQueue(connection, cmdLine)
+}
+
+// execMulti executes the queued commands in place if this node serves all of them, otherwise in a cross node transaction
+func (c *Cluster) execMulti(connection cmi.Connection) resp.Reply {
+	if !connection.InMultiState() {
+		return resp.MakeErrReply("ERR EXEC without MULTI")
+	}
+	defer connection.SetMultiState(false)
+	if len(connection.GetTxErrors()) > 0 {
+		return resp.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+	cmdLines := connection.GetQueuedCmdLine()
+	watching := connection.GetWatching()
+	branches := make(map[string]*txBranch)
+	owners := make([]string, len(cmdLines))
+	branchOf := func(node string) *txBranch {
+		branch, ok := branches[node]
+		if !ok {
+			branch = &txBranch{node: node, watching: make(map[string]uint64)}
+			branches[node] = branch
+		}
+		return branch
+	}
+	for i, cmdLine := range cmdLines {
+		owner, err := c.ownerOfKeys(cmdLine)
+		if err != nil {
+			return resp.MakeErrReply("EXECABORT Transaction discarded because the cluster changed: " + err.Error())
+		}
+		owners[i] = owner
+		branch := branchOf(owner)
+		branch.cmdLines = append(branch.cmdLines, cmdLine)
+	}
+	for key, version := range watching {
+		owner := c.ownerOf(key)
+		if owner == "" {
+			return resp.MakeEmptyMultiBulkReply()
+		}
+		branchOf(owner).watching[key] = version
+	}
+	if _, local := branches[c.self]; local && len(branches) == 1 {
+		return c.db.ExecMulti(connection, watching, cmdLines)
+	}
+	list := make([]*txBranch, 0, len(branches))
+	for _, branch := range branches {
+		list = append(list, branch)
+	}
+	results, err := c.execTx(connection.GetDBIndex(), list)
+	if err != nil {
+		if err.Error() == errTxWatch {
+			return resp.MakeEmptyMultiBulkReply()
+		}
+		return resp.MakeErrReply("EXECABORT Transaction discarded because of: " + err.Error())
+	}
+	// execTx sorted the branches, pick the replies in the order the commands were queued
+	next := make(map[string]int)
+	index := make(map[string]int)
+	for i, branch := range list {
+		index[branch.node] = i
+	}
+	replies := make([]resp.Reply, 0, len(cmdLines))
+	for _, owner := range owners {
+		replies = append(replies, results[index[owner]][next[owner]])
+		next[owner]++
+	}
+	return resp.MakeMultiRawReply(replies...)
+}
+
+// execWatch records the versions of keys on the nodes serving them, EXEC fails if any of them changed
+func (c *Cluster) execWatch(connection cmi.Connection, keys cm.CmdLine) resp.Reply {
+	if len(keys) == 0 {
+		return resp.MakeArgNumErrReply("watch")
+	}
+	if connection.InMultiState() {
+		return resp.MakeErrReply("ERR WATCH inside MULTI is not allowed")
+	}
+	dbIndex := connection.GetDBIndex()
+	groups := make(map[string][]string)
+	for _, key := range keys {
+		owner := c.ownerOf(string(key))
+		if owner == "" {
+			return resp.MakeErrReply("CLUSTERDOWN Hash slot not served")
+		}
+		groups[owner] = append(groups[owner], string(key))
+	}
+	watching := connection.GetWatching()
+	for node, group := range groups {
+		if node == c.self {
+			for _, key := range group {
+				watching[key] = c.db.GetVersion(dbIndex, key)
+			}
+			continue
+		}
+		line := cmdutil.ToCmdLine(append([]string{"CLUSTER", "TX", "VERSION", strconv.Itoa(dbIndex)}, group...)...)
+		reply, err := c.relay(node, line)
+		if err != nil {
+			return resp.MakeErrReply(err.Error())
+		}
+		versions, ok := reply.(*resp.MultiBulkReply)
+		if !ok || len(versions.Args) != len(group) {
+			return resp.MakeErrReply("ERR unexpected reply " + strings.TrimSpace(string(reply.ToBytes())))
+		}
+		for i, key := range group {
+			version, err := strconv.ParseUint(string(versions.Args[i]), 10, 64)
+			if err != nil {
+				return resp.MakeErrReply("ERR invalid version of " + key)
+			}
+			watching[key] = version
+		}
+	}
+	return resp.MakeOkReply()
+}
+
+// execMSetNX sets all pairs or none of them, pairs served by several nodes are set in one transaction
+func execMSetNX(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	if len(cmdLine) < 3 || len(cmdLine)%2 != 1 {
+		return resp.MakeArgNumErrReply("msetnx")
+	}
+	branches := make(map[string]*txBranch)
+	for i := 1; i < len(cmdLine); i += 2 {
+		key := string(cmdLine[i])
+		owner := cluster.ownerOf(key)
+		if owner == "" {
+			return resp.MakeErrReply("CLUSTERDOWN Hash slot not served")
+		}
+		branch, ok := branches[owner]
+		if !ok {
+			branch = &txBranch{node: owner, cmdLines: []cm.CmdLine{cmdutil.ToCmdLine("MSET")}}
+			branches[owner] = branch
+		}
+		branch.cmdLines[0] = append(branch.cmdLines[0], cmdLine[i], cmdLine[i+1])
+		branch.absent = append(branch.absent, key)
+	}
+	if _, local := branches[cluster.self]; local && len(branches) == 1 {
+		return cluster.execLocal(connection, cmdLine)
+	}
+	if len(branches) == 1 {
+		return defaultFunc(cluster, connection, cmdLine)
+	}
+	list := make([]*txBranch, 0, len(branches))
+	for _, branch := range branches {
+		list = append(list, branch)
+	}
+	if _, err := cluster.execTx(connection.GetDBIndex(), list); err != nil {
+		if err.Error() == errTxExists {
+			return resp.MakeIntReply(0)
+		}
+		return resp.MakeErrReply(err.Error())
+	}
+	return resp.MakeIntReply(1)
+}
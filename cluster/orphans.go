@@ -0,0 +1,69 @@
+package cluster
+
+import (
+	cm "mygodis/common"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/resp"
+	"strconv"
+	"time"
+)
+
+// orphanOwner returns the node a key stored here belongs to, ok is false if this node should keep the key
+func (c *Cluster) orphanOwner(key string) (string, bool) {
+	if c.replicated() {
+		replicas, _ := c.replicasOf(key)
+		if len(replicas) == 0 || contains(replicas, c.self) {
+			return "", false
+		}
+		return replicas[0], true
+	}
+	owner := c.ownerOf(key)
+	return owner, owner != "" && owner != c.self
+}
+
+// execOrphans implements CLUSTER ORPHANS [count], it replies db, key and owner of the keys stored on this node
+// but owned by others
+func (c *Cluster) execOrphans(args cm.CmdLine) resp.Reply {
+	if len(args) > 1 {
+		return resp.MakeArgNumErrReply("cluster|orphans")
+	}
+	limit := -1
+	if len(args) == 1 {
+		n, err := strconv.Atoi(string(args[0]))
+		if err != nil || n < 0 {
+			return resp.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		limit = n
+	}
+	result := make([][]byte, 0)
+	for i := range c.db.Dbs {
+		c.db.ForEach(i, func(key string, data *cmi.DataEntity, expiration time.Time) bool {
+			if limit >= 0 && len(result) >= limit*3 {
+				return false
+			}
+			if owner, ok := c.orphanOwner(key); ok {
+				result = append(result, []byte(strconv.Itoa(i)), []byte(key), []byte(owner))
+			}
+			return true
+		})
+	}
+	return resp.MakeMultiBulkReply(result)
+}
+
+// execFixOrphans implements CLUSTER FIXORPHANS, the orphans are moved to their owners in background and
+// the number of orphans found is replied
+func (c *Cluster) execFixOrphans() resp.Reply {
+	count := 0
+	for i := range c.db.Dbs {
+		c.db.ForEach(i, func(key string, data *cmi.DataEntity, expiration time.Time) bool {
+			if _, ok := c.orphanOwner(key); ok {
+				count++
+			}
+			return true
+		})
+	}
+	if count > 0 {
+		c.rebalance()
+	}
+	return resp.MakeIntReply(int64(count))
+}
@@ -0,0 +1,33 @@
+package cluster
+
+import (
+	cm "mygodis/common"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/resp"
+)
+
+// execSubscribe serves SUBSCRIBE and UNSUBSCRIBE on this node, messages published on any node reach it
+func execSubscribe(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	return cluster.db.Exec(connection, cmdLine)
+}
+
+// execPublish delivers the message to the subscribers of every node and replies how many received it
+func execPublish(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	if len(cmdLine) != 3 {
+		return resp.MakeArgNumErrReply("publish")
+	}
+	result := cluster.fanoutLocal(0, cmdLine)
+	received := int64(0)
+	for _, reply := range result.replies {
+		if n, ok := reply.(*resp.IntReply); ok {
+			received += n.Code
+		}
+	}
+	return resp.MakeIntReply(received)
+}
+
+func init() {
+	RegisterCmd("SUBSCRIBE", execSubscribe)
+	RegisterCmd("UNSUBSCRIBE", execSubscribe)
+	RegisterCmd("PUBLISH", execPublish)
+}
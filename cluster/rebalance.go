@@ -0,0 +1,566 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"mygodis/aof"
+	"mygodis/clientc"
+	cm "mygodis/common"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/db"
+	logger "mygodis/log"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	taskRunning = "running"
+	taskDone    = "done"
+	taskFailed  = "failed"
+)
+
+// maxTaskHistory is the number of finished migration tasks kept for CLUSTER REBALANCE STATUS
+const maxTaskHistory = 16
+
+// errMissing is replied by the old owner when a read forwarded by the importer finds no key
+const errMissing = "MISSING key is not held by this node"
+
+// migrationTask is the hand-off of keys between this node and peer
+type migrationTask struct {
+	id       int64
+	outgoing bool
+	peer     string
+	state    string
+	total    int
+	moved    int
+	skipped  int
+	failed   int
+	err      string
+	started  time.Time
+	finished time.Time
+	// seen holds the keys imported or written here during an incoming task, older copies of them are ignored
+	seen map[dbKey]struct{}
+}
+
+// rebalancer keeps the migration tasks of this node
+type rebalancer struct {
+	mu       sync.Mutex
+	nextID   int64
+	tasks    []*migrationTask
+	incoming map[string]*migrationTask
+}
+
+type dbKey struct {
+	db  int
+	key string
+}
+
+// ringRange is the half open range (start, end] of the ring
+type ringRange struct {
+	start uint64
+	end   uint64
+}
+
+func (r ringRange) contains(position uint64) bool {
+	if r.start < r.end {
+		return position > r.start && position <= r.end
+	}
+	return position > r.start || position <= r.end
+}
+
+func makeRebalancer() *rebalancer {
+	return &rebalancer{
+		incoming: make(map[string]*migrationTask),
+	}
+}
+func (r *rebalancer) newTask(peer string, outgoing bool) *migrationTask {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	task := &migrationTask{
+		id:       r.nextID,
+		outgoing: outgoing,
+		peer:     peer,
+		state:    taskRunning,
+		started:  time.Now(),
+	}
+	if !outgoing {
+		task.seen = make(map[dbKey]struct{})
+	}
+	r.tasks = append(r.tasks, task)
+	if len(r.tasks) > maxTaskHistory {
+		for i, t := range r.tasks {
+			if t.state != taskRunning {
+				r.tasks = append(r.tasks[:i], r.tasks[i+1:]...)
+				break
+			}
+		}
+	}
+	return task
+}
+func (r *rebalancer) finish(task *migrationTask, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	task.finished = time.Now()
+	task.state = taskDone
+	if err != nil {
+		task.state = taskFailed
+		task.err = err.Error()
+	}
+	task.seen = nil
+	if !task.outgoing && r.incoming[task.peer] == task {
+		delete(r.incoming, task.peer)
+	}
+}
+
+// beginImport registers the keys of source will be streamed to this node
+func (r *rebalancer) beginImport(source string) *migrationTask {
+	r.mu.Lock()
+	task, ok := r.incoming[source]
+	r.mu.Unlock()
+	if ok {
+		return task
+	}
+	task = r.newTask(source, false)
+	r.mu.Lock()
+	r.incoming[source] = task
+	r.mu.Unlock()
+	return task
+}
+func (r *rebalancer) importing(source string) (*migrationTask, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	task, ok := r.incoming[source]
+	return task, ok
+}
+
+// sources returns the nodes still streaming keys to this node
+func (r *rebalancer) sources() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sources := make([]string, 0, len(r.incoming))
+	for source := range r.incoming {
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// markSeen records keys are up to date on this node for every running import, it returns false if one of them was
+// already recorded. The records of an import are dropped when it finishes.
+func (r *rebalancer) markSeen(keys ...dbKey) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fresh := true
+	for _, task := range r.incoming {
+		for _, key := range keys {
+			if _, ok := task.seen[key]; ok {
+				fresh = false
+			}
+			task.seen[key] = struct{}{}
+		}
+	}
+	return fresh
+}
+func (r *rebalancer) isSeen(key dbKey) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, task := range r.incoming {
+		if _, ok := task.seen[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+func (r *rebalancer) update(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f()
+}
+func (r *rebalancer) status() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lines := make([][]byte, 0, len(r.tasks))
+	for _, task := range r.tasks {
+		direction := "incoming"
+		if task.outgoing {
+			direction = "outgoing"
+		}
+		end := time.Now()
+		if task.state != taskRunning {
+			end = task.finished
+		}
+		line := fmt.Sprintf("id=%d direction=%s peer=%s state=%s total=%d moved=%d skipped=%d failed=%d started=%s elapsed=%s",
+			task.id, direction, task.peer, task.state, task.total, task.moved, task.skipped, task.failed,
+			task.started.Format(time.RFC3339), end.Sub(task.started).Round(time.Millisecond))
+		if task.err != "" {
+			line += " error=" + task.err
+		}
+		lines = append(lines, []byte(line))
+	}
+	return lines
+}
+
+// takenRanges returns the ranges node took over from owner when it joined ch,
+// every range ends at a position of node and starts at its preNode, it was served by the first successor other than node
+func takenRanges(ch *ConsistentHash, node string, owner string) []ringRange {
+	ranges := make([]ringRange, 0)
+	for _, position := range ch.positionsOf(node) {
+		_, pre := ch.preNode(position)
+		next, code := ch.nextNode(position)
+		for i := 0; next == node && i < len(ch.Nodes); i++ {
+			next, code = ch.nextNode(code)
+		}
+		if next == owner {
+			ranges = append(ranges, ringRange{start: pre, end: position})
+		}
+	}
+	return ranges
+}
+
+// rebalanceAfterJoin hands the keys now served by node over to it
+func (c *Cluster) rebalanceAfterJoin(node string) {
+	if !c.proxy || c.replicated() {
+		c.rebalance()
+		return
+	}
+	ranges := takenRanges(c.ring(), node, c.self)
+	if len(ranges) == 0 {
+		return
+	}
+	ch := c.ring()
+	go c.migrate(func(key string) (string, bool) {
+		position := ch.KeyPosition([]byte(key))
+		for _, r := range ranges {
+			if r.contains(position) {
+				return node, true
+			}
+		}
+		return "", false
+	})
+}
+
+// rebalance hands every key this node does not serve any more over to its owner,
+// with replication every key is copied to its replicas instead
+func (c *Cluster) rebalance() {
+	if c.replicated() {
+		go c.rereplicate()
+		return
+	}
+	go c.migrate(c.orphanOwner)
+}
+
+// migrate streams the keys chosen by target to their new owners and removes them locally once imported
+func (c *Cluster) migrate(target func(key string) (string, bool)) {
+	groups := make(map[string][]dbKey)
+	for i := range c.db.Dbs {
+		c.db.ForEach(i, func(key string, data *cmi.DataEntity, expiration time.Time) bool {
+			if node, ok := target(key); ok {
+				groups[node] = append(groups[node], dbKey{db: i, key: key})
+			}
+			return true
+		})
+	}
+	for node, keys := range groups {
+		task := c.rebalancer.newTask(node, true)
+		c.rebalancer.update(func() { task.total = len(keys) })
+		err := c.migrateTo(node, keys, task)
+		if err != nil {
+			logger.Errorf("migrate keys to %s failed: %v", node, err)
+		}
+		c.rebalancer.finish(task, err)
+	}
+}
+func (c *Cluster) migrateTo(node string, keys []dbKey, task *migrationTask) error {
+	reply, err := c.relay(node, cmdutil.ToCmdLine("CLUSTER", "REBALANCE", "BEGIN", c.self))
+	if err != nil {
+		return err
+	}
+	if resp.IsErrorReply(reply) {
+		return errors.New(string(reply.ToBytes()))
+	}
+	for _, k := range keys {
+		line, ok := c.dumpKey(k)
+		if !ok {
+			c.rebalancer.update(func() { task.skipped++ })
+			continue
+		}
+		importLine := cmdutil.ToCmdLineWithBytes("CLUSTER", append([][]byte{[]byte("REBALANCE"), []byte("IMPORT"), []byte(c.self), []byte(strconv.Itoa(k.db))}, line...)...)
+		reply, err = c.relay(node, importLine)
+		if err != nil || resp.IsErrorReply(reply) {
+			c.rebalancer.update(func() { task.failed++ })
+			continue
+		}
+		c.db.Exec(&clientc.FakeConnection{DBindex: k.db}, cmdutil.ToCmdLine("DEL", k.key))
+		c.rebalancer.update(func() {
+			if intReply, ok := reply.(*resp.IntReply); ok && intReply.Code == 0 {
+				task.skipped++
+			} else {
+				task.moved++
+			}
+		})
+	}
+	reply, err = c.relay(node, cmdutil.ToCmdLine("CLUSTER", "REBALANCE", "END", c.self))
+	if err != nil {
+		return err
+	}
+	failed := 0
+	c.rebalancer.update(func() { failed = task.failed })
+	if failed > 0 {
+		return fmt.Errorf("%d keys not migrated", failed)
+	}
+	return nil
+}
+
+// dumpKey serializes a key as its expire time in unix milliseconds (-1 for none) followed by the command rebuilding it
+func (c *Cluster) dumpKey(k dbKey) (cm.CmdLine, bool) {
+	entity, ok := c.db.GetEntity(k.db, k.key)
+	if !ok {
+		return nil, false
+	}
+	payload := aof.EntityToCmd(k.key, entity)
+	if payload == nil {
+		return nil, false
+	}
+	expireAt := int64(-1)
+	if expiration := c.db.GetExpiration(k.db, k.key); !expiration.IsZero() {
+		expireAt = expiration.UnixNano() / 1e6
+	}
+	return append(cm.CmdLine{[]byte(strconv.FormatInt(expireAt, 10))}, payload.Args...), true
+}
+
+// loadKey rebuilds a key serialized by dumpKey, it returns false if the key expired meanwhile
+func (c *Cluster) loadKey(dbIndex int, line cm.CmdLine) (bool, error) {
+	if len(line) < 3 {
+		return false, errors.New("ERR invalid key payload")
+	}
+	expireAt, err := strconv.ParseInt(string(line[0]), 10, 64)
+	if err != nil {
+		return false, errors.New("ERR invalid expire time")
+	}
+	expiration := time.Unix(0, expireAt*int64(time.Millisecond))
+	if expireAt >= 0 && expiration.Before(time.Now()) {
+		return false, nil
+	}
+	conn := &clientc.FakeConnection{DBindex: dbIndex}
+	if reply := c.db.Exec(conn, line[1:]); resp.IsErrorReply(reply) {
+		return false, errors.New(string(reply.ToBytes()))
+	}
+	if expireAt >= 0 {
+		c.db.Exec(conn, aof.ExpireToCmd(string(line[2]), expiration).Args)
+	}
+	return true, nil
+}
+
+// execLocal executes cmdLine on this node, keys still held by the old owner during a migration are served by it
+func (c *Cluster) execLocal(connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	sources := c.rebalancer.sources()
+	if len(sources) == 0 {
+		return c.db.Exec(connection, cmdLine)
+	}
+	dbIndex := connection.GetDBIndex()
+	writeKeys, readKeys, ok := db.GetRelatedKeys(cmdLine)
+	if !ok {
+		return c.db.Exec(connection, cmdLine)
+	}
+	missing := make([]string, 0)
+	for _, key := range append(writeKeys, readKeys...) {
+		if _, exists := c.db.GetEntity(dbIndex, key); !exists && !c.rebalancer.isSeen(dbKey{db: dbIndex, key: key}) {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return c.db.Exec(connection, cmdLine)
+	}
+	if len(writeKeys) == 0 && len(missing) == len(readKeys) {
+		for _, source := range sources {
+			line := cmdutil.ToCmdLineWithBytes("CLUSTER", append([][]byte{[]byte("REBALANCE"), []byte("READ"), []byte(strconv.Itoa(dbIndex))}, cmdLine...)...)
+			reply, err := c.relay(source, line)
+			if err == nil && !strings.HasPrefix(string(reply.ToBytes()), "-"+errMissing) {
+				return reply
+			}
+		}
+		return c.db.Exec(connection, cmdLine)
+	}
+	for _, key := range missing {
+		c.pullKey(sources, dbIndex, key)
+	}
+	keys := make([]dbKey, 0, len(writeKeys))
+	for _, key := range writeKeys {
+		keys = append(keys, dbKey{db: dbIndex, key: key})
+	}
+	c.rebalancer.markSeen(keys...)
+	return c.db.Exec(connection, cmdLine)
+}
+
+// pullKey moves key from the node still holding it to this node ahead of the migration
+func (c *Cluster) pullKey(sources []string, dbIndex int, key string) {
+	for _, source := range sources {
+		reply, err := c.relay(source, cmdutil.ToCmdLine("CLUSTER", "REBALANCE", "PULL", strconv.Itoa(dbIndex), key))
+		if err != nil {
+			continue
+		}
+		multiBulk, ok := reply.(*resp.MultiBulkReply)
+		if !ok || len(multiBulk.Args) == 0 {
+			continue
+		}
+		if _, err = c.loadKey(dbIndex, multiBulk.Args); err != nil {
+			logger.Errorf("pull key %s from %s failed: %v", key, source, err)
+		}
+		c.rebalancer.markSeen(dbKey{db: dbIndex, key: key})
+		if task, ok := c.rebalancer.importing(source); ok {
+			c.rebalancer.update(func() { task.moved++ })
+		}
+		return
+	}
+}
+
+// execRebalance implements CLUSTER REBALANCE STATUS and the internal BEGIN, IMPORT, END, PULL and READ steps of a migration
+func (c *Cluster) execRebalance(args cm.CmdLine) resp.Reply {
+	if len(args) == 0 {
+		return resp.MakeArgNumErrReply("cluster|rebalance")
+	}
+	switch strings.ToUpper(string(args[0])) {
+	case "STATUS":
+		return resp.MakeMultiBulkReply(c.rebalancer.status())
+	case "BEGIN":
+		if len(args) != 2 {
+			return resp.MakeArgNumErrReply("cluster|rebalance")
+		}
+		// a new round from the same source starts over, what was seen in the last one is stale
+		if task, ok := c.rebalancer.importing(string(args[1])); ok {
+			c.rebalancer.finish(task, nil)
+		}
+		c.rebalancer.beginImport(string(args[1]))
+		return resp.MakeOkReply()
+	case "END":
+		if len(args) != 2 {
+			return resp.MakeArgNumErrReply("cluster|rebalance")
+		}
+		if task, ok := c.rebalancer.importing(string(args[1])); ok {
+			c.rebalancer.finish(task, nil)
+		}
+		return resp.MakeOkReply()
+	case "IMPORT":
+		return c.execImport(args[1:])
+	case "PULL":
+		return c.execPull(args[1:])
+	case "READ":
+		return c.execRead(args[1:])
+	}
+	return resp.MakeSyntaxErrReply()
+}
+
+// execImport implements CLUSTER REBALANCE IMPORT source db expireAt cmd..., it replies 0 if this node has a newer copy of the key
+func (c *Cluster) execImport(args cm.CmdLine) resp.Reply {
+	if len(args) < 5 {
+		return resp.MakeArgNumErrReply("cluster|rebalance")
+	}
+	dbIndex, err := strconv.Atoi(string(args[1]))
+	if err != nil || dbIndex < 0 || dbIndex >= len(c.db.Dbs) {
+		return resp.MakeErrReply("ERR DB index is out of range")
+	}
+	task := c.rebalancer.beginImport(string(args[0]))
+	k := dbKey{db: dbIndex, key: string(args[4])}
+	if _, exists := c.db.GetEntity(dbIndex, k.key); exists || !c.rebalancer.markSeen(k) {
+		c.rebalancer.update(func() { task.skipped++ })
+		return resp.MakeIntReply(0)
+	}
+	imported, err := c.loadKey(dbIndex, args[2:])
+	if err != nil {
+		c.rebalancer.update(func() { task.failed++ })
+		return resp.MakeErrReply(err.Error())
+	}
+	c.rebalancer.update(func() {
+		task.total++
+		if imported {
+			task.moved++
+		} else {
+			task.skipped++
+		}
+	})
+	return resp.MakeIntReply(1)
+}
+
+// execPull implements CLUSTER REBALANCE PULL db key, it replies the serialized key and removes it from this node
+func (c *Cluster) execPull(args cm.CmdLine) resp.Reply {
+	if len(args) != 2 {
+		return resp.MakeArgNumErrReply("cluster|rebalance")
+	}
+	dbIndex, err := strconv.Atoi(string(args[0]))
+	if err != nil || dbIndex < 0 || dbIndex >= len(c.db.Dbs) {
+		return resp.MakeErrReply("ERR DB index is out of range")
+	}
+	k := dbKey{db: dbIndex, key: string(args[1])}
+	line, ok := c.dumpKey(k)
+	if !ok {
+		return resp.MakeNullBulkReply()
+	}
+	c.db.Exec(&clientc.FakeConnection{DBindex: dbIndex}, cmdutil.ToCmdLine("DEL", k.key))
+	return resp.MakeMultiBulkReply(line)
+}
+
+// execRead implements CLUSTER REBALANCE READ db cmd..., it executes a read only command here without routing
+func (c *Cluster) execRead(args cm.CmdLine) resp.Reply {
+	if len(args) < 2 {
+		return resp.MakeArgNumErrReply("cluster|rebalance")
+	}
+	dbIndex, err := strconv.Atoi(string(args[0]))
+	if err != nil || dbIndex < 0 || dbIndex >= len(c.db.Dbs) {
+		return resp.MakeErrReply("ERR DB index is out of range")
+	}
+	cmdLine := args[1:]
+	if !db.IsReadOnlyCommand(cmdLine) {
+		return resp.MakeErrReply("ERR only read only commands can be forwarded")
+	}
+	if !c.allExist(&clientc.FakeConnection{DBindex: dbIndex}, relatedKeys(cmdLine)) {
+		return resp.MakeErrReply(errMissing)
+	}
+	return c.db.Exec(&clientc.FakeConnection{DBindex: dbIndex}, cmdLine)
+}
+
+// execLeave implements CLUSTER LEAVE, this node quits the ring and hands all its keys over to the remaining members
+func (c *Cluster) execLeave() resp.Reply {
+	if len(c.ring().GetNodes()) <= 1 {
+		return resp.MakeErrReply("ERR this node is the only member of the cluster")
+	}
+	if c.raft != nil {
+		if err := c.proposeMeta(metaCommand{Op: metaDelNode, Node: c.self}); err != nil {
+			return metaErrReply(err)
+		}
+		return resp.MakeOkReply()
+	}
+	epoch := atomic.AddInt64(&c.epoch, 1)
+	result, errs := c.broadcast(cmdutil.ToCmdLine("CLUSTER", "DELNODE", c.self, strconv.FormatInt(epoch, 10)))
+	if len(errs) != 0 || !c.isAllOk(result) {
+		return resp.MakeErrReply("leave failed")
+	}
+	c.updateRing(func(ch *ConsistentHash) { ch.RemoveNode(c.self) })
+	c.topologyChanged()
+	c.rebalance()
+	return resp.MakeOkReply()
+}
+
+// execDelNode handles CLUSTER DELNODE node [epoch], it removes a node which left the cluster
+func (c *Cluster) execDelNode(args cm.CmdLine) resp.Reply {
+	if len(args) != 1 && len(args) != 2 {
+		return resp.MakeArgNumErrReply("cluster|delnode")
+	}
+	if len(args) == 2 {
+		if epoch, err := strconv.ParseInt(string(args[1]), 10, 64); err == nil {
+			c.adoptEpoch(epoch)
+		}
+	}
+	node := string(args[0])
+	c.nodes.Remove(node)
+	c.updateRing(func(ch *ConsistentHash) { ch.RemoveNode(node) })
+	c.topologyChanged()
+	if !c.proxy {
+		c.rebalance()
+	}
+	return resp.MakeOkReply()
+}
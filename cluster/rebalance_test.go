@@ -0,0 +1,86 @@
+package cluster
+
+import (
+	"mygodis/clientc"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTakenRanges(t *testing.T) {
+	ch := MakeConsistentHash()
+	ch.AddNode("node0")
+	ch.AddNode("node1")
+	before := ch.Clone()
+	ch.AddNode("node2")
+	for _, owner := range []string{"node0", "node1"} {
+		ranges := takenRanges(ch, "node2", owner)
+		for i := 0; i < 1000; i++ {
+			key := []byte("key" + strconv.Itoa(i))
+			moved := before.GetNode(key) == owner && ch.GetNode(key) == "node2"
+			contained := false
+			for _, r := range ranges {
+				contained = contained || r.contains(ch.KeyPosition(key))
+			}
+			if moved != contained {
+				t.Fatalf("key %s moved %v but contained %v", key, moved, contained)
+			}
+		}
+	}
+}
+
+func TestCluster_execRebalance(t *testing.T) {
+	c := makeTestCluster("127.0.0.1:7001")
+	conn := clientc.NewFakeConnection()
+	importLine := cmdutil.ToCmdLine("CLUSTER", "REBALANCE", "IMPORT", "127.0.0.1:7002", "0", "-1", "RPUSH", "list", "a", "b")
+	reply := c.Exec(conn, importLine)
+	if got := string(reply.ToBytes()); got != ":1\r\n" {
+		t.Fatalf("except :1 but got %s", got)
+	}
+	reply = c.Exec(conn, importLine)
+	if got := string(reply.ToBytes()); got != ":0\r\n" {
+		t.Errorf("except stale copy skipped but got %s", got)
+	}
+	reply = c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "REBALANCE", "STATUS"))
+	status := string(reply.ToBytes())
+	if !strings.Contains(status, "direction=incoming peer=127.0.0.1:7002 state=running total=1 moved=1 skipped=1") {
+		t.Errorf("unexpected status %s", status)
+	}
+	c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "REBALANCE", "END", "127.0.0.1:7002"))
+	if got := string(c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "REBALANCE", "STATUS")).ToBytes()); !strings.Contains(got, "state=done") {
+		t.Errorf("except task done but got %s", got)
+	}
+	reply = c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "REBALANCE", "PULL", "0", "list"))
+	multiBulk, ok := reply.(*resp.MultiBulkReply)
+	if !ok || len(multiBulk.Args) != 5 || string(multiBulk.Args[0]) != "-1" || string(multiBulk.Args[1]) != "RPUSH" {
+		t.Fatalf("unexpected pull reply %s", reply.ToBytes())
+	}
+	if _, exists := c.db.GetEntity(0, "list"); exists {
+		t.Errorf("except pulled key removed")
+	}
+}
+
+func TestRebalancer_seen(t *testing.T) {
+	r := makeRebalancer()
+	key := dbKey{db: 0, key: "k"}
+	first := r.beginImport("a")
+	r.beginImport("b")
+	if !r.markSeen(key) || r.markSeen(key) {
+		t.Fatalf("except only the first mark of a key to be fresh")
+	}
+	r.finish(first, nil)
+	if !r.isSeen(key) {
+		t.Errorf("except the key still seen by the import from b")
+	}
+	b, _ := r.importing("b")
+	r.finish(b, nil)
+	if r.isSeen(key) || len(first.seen) != 0 || len(b.seen) != 0 {
+		t.Errorf("except the records dropped with the imports")
+	}
+	r.beginImport("a")
+	if !r.markSeen(key) {
+		t.Errorf("except a new round to start with nothing seen")
+	}
+}
@@ -0,0 +1,71 @@
+package cluster
+
+import (
+	"fmt"
+	cm "mygodis/common"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/db"
+	"mygodis/lib/slot"
+	"mygodis/resp"
+)
+
+// relatedKeys returns all keys touched by cmdLine, write keys first
+func relatedKeys(cmdLine cm.CmdLine) []string {
+	writeKeys, readKeys, ok := db.GetRelatedKeys(cmdLine)
+	if !ok {
+		return nil
+	}
+	return append(writeKeys, readKeys...)
+}
+
+// execRedirect executes cmdLine if this node serves its slot, otherwise replies -MOVED or -ASK like redis cluster
+func (c *Cluster) execRedirect(connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	asking := c.takeAsking(connection)
+	keys := relatedKeys(cmdLine)
+	if len(keys) == 0 {
+		return c.db.Exec(connection, cmdLine)
+	}
+	s := slot.Of([]byte(keys[0]))
+	for _, key := range keys[1:] {
+		if slot.Of([]byte(key)) != s {
+			return resp.MakeErrReply("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+	owner := c.slots.owner(s)
+	if owner == "" {
+		return resp.MakeErrReply(fmt.Sprintf("CLUSTERDOWN Hash slot %d not served", s))
+	}
+	if owner == c.self {
+		if target, ok := c.slots.migratingTo(s); ok && !c.allExist(connection, keys) {
+			return resp.MakeErrReply(fmt.Sprintf("ASK %d %s", s, target))
+		}
+		return c.execLocal(connection, cmdLine)
+	}
+	if _, ok := c.slots.importingFrom(s); ok && asking {
+		return c.db.Exec(connection, cmdLine)
+	}
+	return resp.MakeErrReply(fmt.Sprintf("MOVED %d %s", s, owner))
+}
+func (c *Cluster) allExist(connection cmi.Connection, keys []string) bool {
+	for _, key := range keys {
+		if _, ok := c.db.GetEntity(connection.GetDBIndex(), key); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// execAsking flags the connection so its next command may be served by an importing slot
+func (c *Cluster) execAsking(connection cmi.Connection) resp.Reply {
+	c.asking.Store(connection, struct{}{})
+	return resp.MakeOkReply()
+}
+
+// takeAsking returns whether the connection sent ASKING and clears the flag, ASKING only affects one command
+func (c *Cluster) takeAsking(connection cmi.Connection) bool {
+	if connection == nil {
+		return false
+	}
+	_, ok := c.asking.LoadAndDelete(connection)
+	return ok
+}
@@ -0,0 +1,508 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"mygodis/clientc"
+	cm "mygodis/common"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/db"
+	logger "mygodis/log"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handoffInterval is how often a node tries to hand the writes it keeps for unreachable replicas over to them
+const handoffInterval = time.Second
+
+// replicationFactor returns how many nodes hold every key, at least 1
+func (c *Cluster) replicationFactor() int {
+	if n := c.props.ReplicationFactor; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// quorum returns configured clamped to [1, n], a majority of n if it is not configured
+func quorum(configured int, n int) int {
+	if configured <= 0 {
+		return n/2 + 1
+	}
+	if configured > n {
+		return n
+	}
+	return configured
+}
+
+// replicated returns whether keys are written to several nodes
+func (c *Cluster) replicated() bool {
+	return c.replicationFactor() > 1
+}
+
+// replicasOf returns the replicas of key followed by the other members in ring order, the latter keep the
+// writes of replicas which are down
+func (c *Cluster) replicasOf(key string) (replicas []string, spares []string) {
+	nodes := c.ring().PreferenceList([]byte(key), len(c.ring().GetNodes()))
+	n := c.replicationFactor()
+	if n > len(nodes) {
+		n = len(nodes)
+	}
+	return nodes[:n], nodes[n:]
+}
+
+// execReplicated executes a single key command on the replicas of its key, any node may coordinate it
+func (c *Cluster) execReplicated(connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	key := string(cmdLine[1])
+	if db.IsReadOnlyCommand(cmdLine) {
+		return c.replicatedRead(connection.GetDBIndex(), key, cmdLine)
+	}
+	return c.replicatedWrite(connection.GetDBIndex(), key, cmdLine)
+}
+
+// execReplicatedMulti splits MGET, MSET, DEL and EXISTS into commands of one key each, other commands with
+// several keys are not supported with replication
+func (c *Cluster) execReplicatedMulti(connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	name := strings.ToUpper(string(cmdLine[0]))
+	args := cmdLine[1:]
+	switch name {
+	case "MGET":
+		values := make([][]byte, len(args))
+		for i, key := range args {
+			reply := c.execReplicated(connection, cmdutil.ToCmdLineWithBytes("GET", key))
+			if resp.IsErrorReply(reply) {
+				return reply
+			}
+			if bulk, ok := reply.(*resp.BulkReply); ok {
+				values[i] = bulk.Arg
+			}
+		}
+		return resp.MakeMultiBulkReply(values)
+	case "MSET":
+		if len(args) == 0 || len(args)%2 != 0 {
+			return resp.MakeArgNumErrReply(name)
+		}
+		for i := 0; i < len(args); i += 2 {
+			if reply := c.execReplicated(connection, cmdutil.ToCmdLineWithBytes("SET", args[i], args[i+1])); resp.IsErrorReply(reply) {
+				return reply
+			}
+		}
+		return resp.MakeOkReply()
+	case "DEL", "EXISTS":
+		if len(args) == 0 {
+			return resp.MakeArgNumErrReply(name)
+		}
+		count := int64(0)
+		for _, key := range args {
+			reply := c.execReplicated(connection, cmdutil.ToCmdLineWithBytes(name, key))
+			if resp.IsErrorReply(reply) {
+				return reply
+			}
+			if intReply, ok := reply.(*resp.IntReply); ok {
+				count += intReply.Code
+			}
+		}
+		return resp.MakeIntReply(count)
+	}
+	return resp.MakeErrReply("ERR " + name + " is not supported when replication-factor is above 1")
+}
+
+// execOn executes cmdLine on node in the db of dbIndex, an error means node was not reachable
+func (c *Cluster) execOn(node string, dbIndex int, cmdLine cm.CmdLine) (resp.Reply, error) {
+	if node == c.self {
+		conn := &clientc.FakeConnection{DBindex: dbIndex}
+		conn.SetPassword(c.props.RequirePass)
+		return c.db.Exec(conn, cmdLine), nil
+	}
+	line := cmdutil.ToCmdLine("CLUSTER", "LOCALEXEC", strconv.Itoa(dbIndex))
+	return c.relay(node, append(line, cmdLine...))
+}
+
+// replicatedWrite executes cmdLine on the first replica which is up, then copies the key it ended with to the
+// other replicas. The writes of unreachable replicas are kept by spare nodes until they are back
+func (c *Cluster) replicatedWrite(dbIndex int, key string, cmdLine cm.CmdLine) resp.Reply {
+	replicas, spares := c.replicasOf(key)
+	if len(replicas) == 0 {
+		return resp.MakeErrReply("CLUSTERDOWN no node serves the key")
+	}
+	var reply resp.Reply
+	primary := ""
+	down := make([]string, 0)
+	for _, node := range replicas {
+		var err error
+		if reply, err = c.execOn(node, dbIndex, cmdLine); err == nil {
+			primary = node
+			break
+		}
+		down = append(down, node)
+	}
+	if primary == "" {
+		return resp.MakeErrReply("CLUSTERDOWN no replica of the key is reachable")
+	}
+	if resp.IsErrorReply(reply) {
+		return reply
+	}
+	acks := 1
+	dump, err := c.readDump(primary, dbIndex, key)
+	if err != nil {
+		logger.Warn("read written key from", primary, "failed", err)
+	} else {
+		others := make([]string, 0, len(replicas))
+		for _, node := range replicas {
+			if node != primary && !contains(down, node) {
+				others = append(others, node)
+			}
+		}
+		failed, refused := c.pushReplicas(others, dbIndex, key, dump)
+		acks += len(others) - len(failed) - len(refused)
+		if len(refused) > 0 {
+			// the write lost against a newer copy, a hint would be refused the same way
+			logger.Warn("write of", key, "refused by", refused, "which hold a newer version")
+		}
+		for _, node := range append(down, failed...) {
+			if c.handOff(spares, node, dbIndex, key, dump) {
+				acks++
+			}
+		}
+	}
+	if w := quorum(c.props.WriteQuorum, len(replicas)); acks < w {
+		return resp.MakeErrReply(fmt.Sprintf("NOREPLICAS %d of %d replicas acknowledged the write, %d required", acks, len(replicas), w))
+	}
+	return reply
+}
+
+// replicatedRead asks the replicas for the version of key and executes cmdLine on the newest one once the read
+// quorum answered, replicas found stale are repaired in the background
+func (c *Cluster) replicatedRead(dbIndex int, key string, cmdLine cm.CmdLine) resp.Reply {
+	replicas, _ := c.replicasOf(key)
+	if len(replicas) == 0 {
+		return resp.MakeErrReply("CLUSTERDOWN no node serves the key")
+	}
+	result := c.fanout(replicas, cmdutil.ToCmdLine("CLUSTER", "KEYVERSION", strconv.Itoa(dbIndex), key), c.fanoutTimeout())
+	if r := quorum(c.props.ReadQuorum, len(replicas)); len(result.replies) < r {
+		return resp.MakeErrReply(fmt.Sprintf("NOQUORUM %d of %d replicas answered, %d required", len(result.replies), len(replicas), r))
+	}
+	versions := make(map[string]int64, len(result.replies))
+	newest := ""
+	for _, node := range replicas {
+		reply, ok := result.replies[node].(*resp.IntReply)
+		if !ok {
+			continue
+		}
+		versions[node] = reply.Code
+		if newest == "" || reply.Code > versions[newest] || reply.Code == versions[newest] && node == c.self {
+			newest = node
+		}
+	}
+	stale := make([]string, 0)
+	for node, version := range versions {
+		if version < versions[newest] {
+			stale = append(stale, node)
+		}
+	}
+	if len(stale) > 0 {
+		go c.repair(newest, stale, dbIndex, key)
+	}
+	reply, err := c.execOn(newest, dbIndex, cmdLine)
+	if err != nil {
+		return resp.MakeErrReply(err.Error())
+	}
+	return reply
+}
+
+// repair copies key from source to the stale replicas
+func (c *Cluster) repair(source string, stale []string, dbIndex int, key string) {
+	dump, err := c.readDump(source, dbIndex, key)
+	if err != nil {
+		logger.Warn("read repair of", key, "failed", err)
+		return
+	}
+	if failed, _ := c.pushReplicas(stale, dbIndex, key, dump); len(failed) > 0 {
+		logger.Warn("read repair of", key, "failed on", failed)
+	}
+}
+
+// readDump returns the version of key on node followed by the commands rebuilding it
+func (c *Cluster) readDump(node string, dbIndex int, key string) ([][]byte, error) {
+	if node == c.self {
+		return c.dumpKeys(dbIndex, []string{key}), nil
+	}
+	reply, err := c.relay(node, cmdutil.ToCmdLine("CLUSTER", "DUMPKEYS", strconv.Itoa(dbIndex), key))
+	if err != nil {
+		return nil, err
+	}
+	multiBulk, ok := reply.(*resp.MultiBulkReply)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %s", reply.ToBytes())
+	}
+	return multiBulk.Args, nil
+}
+
+// decodeDump reads a dump written by readDump
+func decodeDump(dump [][]byte) (uint64, []cm.CmdLine, error) {
+	if len(dump) == 0 {
+		return 0, nil, errMalformedDump
+	}
+	version, err := strconv.ParseUint(string(dump[0]), 10, 64)
+	if err != nil {
+		return 0, nil, errMalformedDump
+	}
+	lines, end, err := readCmdLines(dump, 1)
+	if err != nil || end != len(dump) {
+		return 0, nil, errMalformedDump
+	}
+	return version, lines, nil
+}
+
+// errReplicaNewer means the replica refused a copy of a key as its own copy is as new
+var errReplicaNewer = errors.New("replica holds an equal or newer version")
+
+// pushReplicas sends a dump of key to nodes in parallel, it returns the nodes which could not be reached and the
+// nodes which refused the dump holding an equal or newer version. Neither took the write.
+func (c *Cluster) pushReplicas(nodes []string, dbIndex int, key string, dump [][]byte) (failed []string, refused []string) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed, refused = make([]string, 0), make([]string, 0)
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			err := c.pushReplica(node, dbIndex, key, dump)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == errReplicaNewer:
+				refused = append(refused, node)
+			case err != nil:
+				failed = append(failed, node)
+			}
+		}(node)
+	}
+	wg.Wait()
+	return failed, refused
+}
+func (c *Cluster) pushReplica(node string, dbIndex int, key string, dump [][]byte) error {
+	args := append([][]byte{[]byte("REPLICATE"), []byte(strconv.Itoa(dbIndex)), []byte(key)}, dump...)
+	var reply resp.Reply
+	if node == c.self {
+		reply = c.execReplicate(args[1:])
+	} else {
+		var err error
+		if reply, err = c.relay(node, cmdutil.ToCmdLineWithBytes("CLUSTER", args...)); err != nil {
+			return err
+		}
+	}
+	if resp.IsErrorReply(reply) {
+		return errors.New(errorMessage(reply))
+	}
+	if applied, ok := reply.(*resp.IntReply); ok && applied.Code == 0 {
+		return errReplicaNewer
+	}
+	return nil
+}
+
+// execReplicate serves CLUSTER REPLICATE db key version lines..., the key is replaced unless the local copy is as new
+func (c *Cluster) execReplicate(args cm.CmdLine) resp.Reply {
+	if len(args) < 4 {
+		return resp.MakeArgNumErrReply("cluster|replicate")
+	}
+	dbIndex, err := strconv.Atoi(string(args[0]))
+	if err != nil || dbIndex < 0 || dbIndex >= len(c.db.Dbs) {
+		return resp.MakeErrReply("ERR invalid db index")
+	}
+	version, lines, err := decodeDump(args[2:])
+	if err != nil {
+		return resp.MakeErrReply(err.Error())
+	}
+	if c.db.ApplyVersion(dbIndex, string(args[1]), version, lines) {
+		return resp.MakeIntReply(1)
+	}
+	return resp.MakeIntReply(0)
+}
+
+// execKeyVersion serves CLUSTER KEYVERSION db key
+func (c *Cluster) execKeyVersion(args cm.CmdLine) resp.Reply {
+	if len(args) != 2 {
+		return resp.MakeArgNumErrReply("cluster|keyversion")
+	}
+	dbIndex, err := strconv.Atoi(string(args[0]))
+	if err != nil || dbIndex < 0 || dbIndex >= len(c.db.Dbs) {
+		return resp.MakeErrReply("ERR invalid db index")
+	}
+	return resp.MakeIntReply(int64(c.db.GetVersion(dbIndex, string(args[1]))))
+}
+
+// hint is a write kept for a replica which was down
+type hint struct {
+	dbIndex int
+	key     string
+	dump    [][]byte
+}
+
+// hintStore keeps the hints of every unreachable replica, only the newest write of a key is kept
+type hintStore struct {
+	mu    sync.Mutex
+	hints map[string]map[string]*hint
+}
+
+func makeHintStore() *hintStore {
+	return &hintStore{hints: make(map[string]map[string]*hint)}
+}
+func (s *hintStore) add(target string, h *hint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hints[target] == nil {
+		s.hints[target] = make(map[string]*hint)
+	}
+	id := strconv.Itoa(h.dbIndex) + " " + h.key
+	if old, ok := s.hints[target][id]; ok && old.dump != nil {
+		oldVersion, _ := strconv.ParseUint(string(old.dump[0]), 10, 64)
+		newVersion, _ := strconv.ParseUint(string(h.dump[0]), 10, 64)
+		if oldVersion >= newVersion {
+			return
+		}
+	}
+	s.hints[target][id] = h
+}
+
+// remove drops h unless a newer hint of the same key replaced it
+func (s *hintStore) remove(target string, h *hint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := strconv.Itoa(h.dbIndex) + " " + h.key
+	if s.hints[target][id] == h {
+		delete(s.hints[target], id)
+	}
+	if len(s.hints[target]) == 0 {
+		delete(s.hints, target)
+	}
+}
+func (s *hintStore) drop(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.hints, target)
+}
+func (s *hintStore) snapshot() map[string][]*hint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make(map[string][]*hint, len(s.hints))
+	for target, hints := range s.hints {
+		for _, h := range hints {
+			result[target] = append(result[target], h)
+		}
+	}
+	return result
+}
+
+// handOff gives the write of target to the first spare which takes it
+func (c *Cluster) handOff(spares []string, target string, dbIndex int, key string, dump [][]byte) bool {
+	args := append([][]byte{[]byte("HINT"), []byte(target), []byte(strconv.Itoa(dbIndex)), []byte(key)}, dump...)
+	for _, spare := range spares {
+		var reply resp.Reply
+		if spare == c.self {
+			reply = c.execHint(args[1:])
+		} else {
+			var err error
+			if reply, err = c.relay(spare, cmdutil.ToCmdLineWithBytes("CLUSTER", args...)); err != nil {
+				continue
+			}
+		}
+		if !resp.IsErrorReply(reply) {
+			return true
+		}
+	}
+	return false
+}
+
+// execHint serves CLUSTER HINT target db key version lines..., the write is kept until target is back
+func (c *Cluster) execHint(args cm.CmdLine) resp.Reply {
+	if len(args) < 5 {
+		return resp.MakeArgNumErrReply("cluster|hint")
+	}
+	dbIndex, err := strconv.Atoi(string(args[1]))
+	if err != nil || dbIndex < 0 || dbIndex >= len(c.db.Dbs) {
+		return resp.MakeErrReply("ERR invalid db index")
+	}
+	if _, _, err := decodeDump(args[3:]); err != nil {
+		return resp.MakeErrReply(err.Error())
+	}
+	c.hints.add(string(args[0]), &hint{dbIndex: dbIndex, key: string(args[2]), dump: args[3:]})
+	return resp.MakeOkReply()
+}
+
+// startHandoff delivers the hints every handoffInterval until the cluster is closed
+func (c *Cluster) startHandoff() {
+	go func() {
+		ticker := time.NewTicker(handoffInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.gossip.stopC:
+				return
+			case <-ticker.C:
+				c.deliverHints()
+			}
+		}
+	}()
+}
+
+// deliverHints sends the kept writes to their replicas, hints of nodes which left the ring are dropped
+func (c *Cluster) deliverHints() {
+	for target, hints := range c.hints.snapshot() {
+		if c.ring().Weight(target) == 0 {
+			c.hints.drop(target)
+			continue
+		}
+		for _, h := range hints {
+			// a hint refused for a newer copy is obsolete
+			if err := c.pushReplica(target, h.dbIndex, h.key, h.dump); err != nil && err != errReplicaNewer {
+				break
+			}
+			c.hints.remove(target, h)
+		}
+	}
+}
+
+// rereplicate copies every key to its replicas under the current ring, keys this node is no longer a replica
+// of are dropped once every replica took them
+func (c *Cluster) rereplicate() {
+	for i := range c.db.Dbs {
+		keys := make([]string, 0)
+		c.db.ForEach(i, func(key string, data *cmi.DataEntity, expiration time.Time) bool {
+			keys = append(keys, key)
+			return true
+		})
+		for _, key := range keys {
+			replicas, _ := c.replicasOf(key)
+			others := make([]string, 0, len(replicas))
+			for _, node := range replicas {
+				if node != c.self {
+					others = append(others, node)
+				}
+			}
+			dump := c.dumpKeys(i, []string{key})
+			// a replica refusing the copy already holds one as new
+			failed, _ := c.pushReplicas(others, i, key, dump)
+			if len(others) < len(replicas) {
+				continue
+			}
+			// a write reaching this node since the dump is not on the replicas yet, the key is kept for the next round
+			version, _ := strconv.ParseUint(string(dump[0]), 10, 64)
+			if len(failed) == 0 && !c.db.DropKeyAt(i, key, version) {
+				logger.Info("key", key, "changed while it was rereplicated, it is kept")
+			}
+		}
+	}
+}
+
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
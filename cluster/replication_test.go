@@ -0,0 +1,152 @@
+package cluster
+
+import (
+	"mygodis/clientc"
+	"mygodis/util/cmdutil"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestConsistentHash_PreferenceList(t *testing.T) {
+	ch := MakeConsistentHash(WithReplicas(16))
+	for _, node := range []string{"a:1", "b:1", "c:1"} {
+		ch.AddNode(node)
+	}
+	nodes := ch.PreferenceList([]byte("key"), 2)
+	if len(nodes) != 2 || nodes[0] != ch.GetNode([]byte("key")) || nodes[0] == nodes[1] {
+		t.Errorf("unexpected preference list %v", nodes)
+	}
+	if all := ch.PreferenceList([]byte("key"), 5); len(all) != 3 {
+		t.Errorf("except every node once but got %v", all)
+	}
+}
+
+// replicatedKey returns a key whose replicas are exactly replicas, in any order
+func replicatedKey(c *Cluster, replicas ...string) string {
+	for i := 0; ; i++ {
+		key := "key" + strconv.Itoa(i)
+		nodes, _ := c.replicasOf(key)
+		matched := len(nodes) == len(replicas)
+		for _, node := range replicas {
+			matched = matched && contains(nodes, node)
+		}
+		if matched {
+			return key
+		}
+	}
+}
+
+func TestCluster_replication(t *testing.T) {
+	listenerA, _ := net.Listen("tcp", "127.0.0.1:0")
+	listenerB, _ := net.Listen("tcp", "127.0.0.1:0")
+	listenerC, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listenerA.Close()
+	defer listenerB.Close()
+	addrA, addrB, addrC := listenerA.Addr().String(), listenerB.Addr().String(), listenerC.Addr().String()
+	// c is down until the hints are checked
+	listenerC.Close()
+	a := makeTestCluster(addrA, addrB, addrC)
+	b := makeTestCluster(addrB, addrA, addrC)
+	defer a.gossip.stop()
+	defer b.gossip.stop()
+	go serveCluster(listenerA, a)
+	go serveCluster(listenerB, b)
+	for _, node := range []*Cluster{a, b} {
+		node.props.ReplicationFactor = 2
+		node.props.WriteQuorum = 2
+	}
+
+	conn := clientc.NewFakeConnection()
+	key := replicatedKey(a, addrA, addrB)
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("SET", key, "v")).ToBytes()); got != "+OK\r\n" {
+		t.Fatalf("except +OK but got %q", got)
+	}
+	for _, node := range []*Cluster{a, b} {
+		if _, ok := node.db.GetEntity(0, key); !ok {
+			t.Errorf("except %s written to %s", key, node.self)
+		}
+	}
+
+	// a stale replica is answered around and repaired
+	b.db.DropKey(0, key)
+	if got := string(b.Exec(conn, cmdutil.ToCmdLine("GET", key)).ToBytes()); got != "$1\r\nv\r\n" {
+		t.Errorf("except newest value but got %q", got)
+	}
+	waitFor(t, "stale replica repaired", func() bool {
+		_, ok := b.db.GetEntity(0, key)
+		return ok
+	})
+	b.Exec(conn, cmdutil.ToCmdLine("DEL", key))
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("EXISTS", key)).ToBytes()); got != ":0\r\n" {
+		t.Errorf("except deleted key gone from every replica but got %q", got)
+	}
+
+	// the write of c is kept by the spare until c is back
+	key = replicatedKey(a, addrA, addrC)
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("SET", key, "h")).ToBytes()); got != "+OK\r\n" {
+		t.Fatalf("except write acknowledged by a hint but got %q", got)
+	}
+	a.props.WriteQuorum = 0
+	b.props.WriteQuorum = 0
+	listenerC, err := net.Listen("tcp", addrC)
+	if err != nil {
+		t.Skip("address reused by another process")
+	}
+	defer listenerC.Close()
+	c := makeTestCluster(addrC, addrA, addrB)
+	defer c.gossip.stop()
+	c.props.ReplicationFactor = 2
+	go serveCluster(listenerC, c)
+	waitFor(t, "hint handed over", func() bool {
+		_, ok := c.db.GetEntity(0, key)
+		return ok
+	})
+}
+
+func TestCluster_pushReplicaRefused(t *testing.T) {
+	c := makeTestCluster("127.0.0.1:0")
+	defer c.gossip.stop()
+	conn := clientc.NewFakeConnection()
+	c.db.Exec(conn, cmdutil.ToCmdLine("SET", "k", "old"))
+	stale := c.dumpKeys(0, []string{"k"})
+	c.db.Exec(conn, cmdutil.ToCmdLine("SET", "k", "new"))
+	if err := c.pushReplica(c.self, 0, "k", stale); err != errReplicaNewer {
+		t.Errorf("except an older copy refused but got %v", err)
+	}
+	failed, refused := c.pushReplicas([]string{c.self}, 0, "k", stale)
+	if len(failed) != 0 || len(refused) != 1 {
+		t.Errorf("except the refusal not to count as an ack but got %v %v", failed, refused)
+	}
+	if got := string(c.db.Exec(conn, cmdutil.ToCmdLine("GET", "k")).ToBytes()); got != "$3\r\nnew\r\n" {
+		t.Errorf("except the newer copy kept but got %q", got)
+	}
+}
+
+func TestCluster_replicatedDBSize(t *testing.T) {
+	listenerA, _ := net.Listen("tcp", "127.0.0.1:0")
+	listenerB, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listenerA.Close()
+	defer listenerB.Close()
+	addrA, addrB := listenerA.Addr().String(), listenerB.Addr().String()
+	a := makeTestCluster(addrA, addrB)
+	b := makeTestCluster(addrB, addrA)
+	defer a.gossip.stop()
+	defer b.gossip.stop()
+	go serveCluster(listenerA, a)
+	go serveCluster(listenerB, b)
+	for _, node := range []*Cluster{a, b} {
+		node.props.ReplicationFactor = 2
+		node.props.WriteQuorum = 2
+	}
+	conn := clientc.NewFakeConnection()
+	for i := 0; i < 5; i++ {
+		a.Exec(conn, cmdutil.ToCmdLine("SET", "key"+strconv.Itoa(i), "v"))
+	}
+	if size, _ := b.db.GetDBSize(0); size != 5 {
+		t.Fatalf("except every key on both nodes but got %d on b", size)
+	}
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("DBSIZE")).ToBytes()); got != ":5\r\n" {
+		t.Errorf("except every key counted once but got %q", got)
+	}
+}
@@ -0,0 +1,231 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	cm "mygodis/common"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/db"
+	"mygodis/lib/slot"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"strconv"
+)
+
+// scatterRetries is how often a command is computed again when its keys changed meanwhile
+const scatterRetries = 3
+
+// scatterCommands have several keys which may be served by different nodes
+var scatterCommands = []string{
+	"MGET", "MSET", "DEL", "EXISTS",
+	"SINTER", "SINTERSTORE", "SUNION", "SUNIONSTORE", "SDIFF", "SDIFFSTORE", "SMOVE",
+	"RPOPLPUSH", "RENAME", "RENAMENX", "ZUNIONSTORE", "ZINTERSTORE", "BITOP",
+}
+
+func init() {
+	for _, name := range scatterCommands {
+		RegisterCmd(name, execScatter)
+	}
+}
+
+// execScatter executes a multi key command. Keys served by one node take the usual path, otherwise the keys are
+// gathered from their owners into a scratch db, the command runs there and the written keys are stored back to
+// their owners in one transaction which fails if any gathered key changed meanwhile
+func execScatter(cluster *Cluster, connection cmi.Connection, cmdLine cm.CmdLine) resp.Reply {
+	if cluster.replicated() {
+		return cluster.execReplicatedMulti(connection, cmdLine)
+	}
+	writeKeys, readKeys, ok := db.GetRelatedKeys(cmdLine)
+	if !ok {
+		return defaultFunc(cluster, connection, cmdLine)
+	}
+	keys := append(append([]string{}, writeKeys...), readKeys...)
+	if len(keys) == 0 || !cluster.proxy && sameSlot(keys) {
+		return defaultFunc(cluster, connection, cmdLine)
+	}
+	groups := make(map[string][]string)
+	for _, key := range keys {
+		owner := cluster.ownerOf(key)
+		if owner == "" {
+			return resp.MakeErrReply(fmt.Sprintf("CLUSTERDOWN Hash slot %d not served", slot.Of([]byte(key))))
+		}
+		groups[owner] = appendUnique(groups[owner], key)
+	}
+	if len(groups) == 1 {
+		for owner := range groups {
+			return cluster.execOnOwner(connection, owner, keys[0], cmdLine)
+		}
+	}
+	dbIndex := connection.GetDBIndex()
+	for i := 0; i < scatterRetries; i++ {
+		scratch, versions, err := cluster.gather(dbIndex, groups)
+		if err != nil {
+			return resp.MakeErrReply(err.Error())
+		}
+		reply := scratch.ExecNormal(cmdLine)
+		if len(writeKeys) == 0 || resp.IsErrorReply(reply) {
+			return reply
+		}
+		branches := make([]*txBranch, 0, len(groups))
+		for owner, group := range groups {
+			branch := &txBranch{node: owner, watching: make(map[string]uint64)}
+			for _, key := range group {
+				branch.watching[key] = versions[key]
+			}
+			for _, key := range writeKeys {
+				if cluster.ownerOf(key) == owner {
+					branch.cmdLines = append(branch.cmdLines, db.RestoreCmdLines(scratch, key)...)
+				}
+			}
+			branches = append(branches, branch)
+		}
+		_, err = cluster.execTx(dbIndex, branches)
+		if err == nil {
+			return reply
+		}
+		if err.Error() != errTxWatch {
+			return resp.MakeErrReply(err.Error())
+		}
+	}
+	return resp.MakeErrReply("TRYAGAIN keys changed while the command was executed")
+}
+
+// execOnOwner executes a command whose keys are all served by owner
+func (c *Cluster) execOnOwner(connection cmi.Connection, owner string, key string, cmdLine cm.CmdLine) resp.Reply {
+	if owner == c.self {
+		return c.execLocal(connection, cmdLine)
+	}
+	if !c.proxy {
+		return resp.MakeErrReply(fmt.Sprintf("MOVED %d %s", slot.Of([]byte(key)), owner))
+	}
+	reply, err := c.relay(owner, cmdLine)
+	if err != nil {
+		return resp.MakeErrReply(err.Error())
+	}
+	return reply
+}
+
+// gather copies the keys of every node into a scratch db and returns the versions they had
+func (c *Cluster) gather(dbIndex int, groups map[string][]string) (*db.DataBaseImpl, map[string]uint64, error) {
+	scratch := db.NewDB()
+	versions := make(map[string]uint64)
+	for node, keys := range groups {
+		var args [][]byte
+		if node == c.self {
+			args = c.dumpKeys(dbIndex, keys)
+		} else {
+			line := cmdutil.ToCmdLine(append([]string{"CLUSTER", "DUMPKEYS", strconv.Itoa(dbIndex)}, keys...)...)
+			reply, err := c.relay(node, line)
+			if err != nil {
+				return nil, nil, err
+			}
+			if resp.IsErrorReply(reply) {
+				return nil, nil, errors.New(errorMessage(reply))
+			}
+			multiBulk, ok := reply.(*resp.MultiBulkReply)
+			if !ok {
+				return nil, nil, fmt.Errorf("unexpected reply %s", reply.ToBytes())
+			}
+			args = multiBulk.Args
+		}
+		i := 0
+		for _, key := range keys {
+			if i >= len(args) {
+				return nil, nil, errMalformedDump
+			}
+			version, err := strconv.ParseUint(string(args[i]), 10, 64)
+			if err != nil {
+				return nil, nil, errMalformedDump
+			}
+			versions[key] = version
+			var lines []cm.CmdLine
+			if lines, i, err = readCmdLines(args, i+1); err != nil {
+				return nil, nil, err
+			}
+			for _, line := range lines {
+				scratch.ExecNormal(line)
+			}
+		}
+	}
+	return scratch, versions, nil
+}
+
+var errMalformedDump = errors.New("ERR malformed key dump")
+
+// dumpKeys encodes every key as its version followed by the commands rebuilding it
+func (c *Cluster) dumpKeys(dbIndex int, keys []string) [][]byte {
+	args := make([][]byte, 0, len(keys)*4)
+	for _, key := range keys {
+		version, lines := c.db.DumpKey(dbIndex, key)
+		args = append(args, []byte(strconv.FormatUint(version, 10)))
+		args = appendCmdLines(args, lines)
+	}
+	return args
+}
+
+// execDumpKeys serves CLUSTER DUMPKEYS db key...
+func (c *Cluster) execDumpKeys(args cm.CmdLine) resp.Reply {
+	if len(args) < 2 {
+		return resp.MakeArgNumErrReply("cluster dumpkeys")
+	}
+	dbIndex, err := strconv.Atoi(string(args[0]))
+	if err != nil || dbIndex < 0 || dbIndex >= len(c.db.Dbs) {
+		return resp.MakeErrReply("ERR invalid db index")
+	}
+	keys := make([]string, 0, len(args)-1)
+	for _, key := range args[1:] {
+		keys = append(keys, string(key))
+	}
+	return resp.MakeMultiBulkReply(c.dumpKeys(dbIndex, keys))
+}
+
+// appendCmdLines encodes lines flat as n [argc arg...]...
+func appendCmdLines(args [][]byte, lines []cm.CmdLine) [][]byte {
+	args = append(args, []byte(strconv.Itoa(len(lines))))
+	for _, line := range lines {
+		args = append(args, []byte(strconv.Itoa(len(line))))
+		args = append(args, line...)
+	}
+	return args
+}
+
+// readCmdLines decodes the lines encoded by appendCmdLines at args[i] and returns the index after them
+func readCmdLines(args [][]byte, i int) ([]cm.CmdLine, int, error) {
+	if i >= len(args) {
+		return nil, i, errMalformedDump
+	}
+	n, err := strconv.Atoi(string(args[i]))
+	if err != nil || n < 0 {
+		return nil, i, errMalformedDump
+	}
+	i++
+	lines := make([]cm.CmdLine, 0, n)
+	for j := 0; j < n; j++ {
+		if i >= len(args) {
+			return nil, i, errMalformedDump
+		}
+		argc, err := strconv.Atoi(string(args[i]))
+		if err != nil || argc <= 0 || i+1+argc > len(args) {
+			return nil, i, errMalformedDump
+		}
+		lines = append(lines, args[i+1:i+1+argc])
+		i += 1 + argc
+	}
+	return lines, i, nil
+}
+func sameSlot(keys []string) bool {
+	for _, key := range keys[1:] {
+		if slot.Of([]byte(key)) != slot.Of([]byte(keys[0])) {
+			return false
+		}
+	}
+	return true
+}
+func appendUnique(keys []string, key string) []string {
+	for _, k := range keys {
+		if k == key {
+			return keys
+		}
+	}
+	return append(keys, key)
+}
@@ -0,0 +1,122 @@
+package cluster
+
+import (
+	"mygodis/clientc"
+	"mygodis/util/cmdutil"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestCluster_execScatter(t *testing.T) {
+	listenerA, _ := net.Listen("tcp", "127.0.0.1:0")
+	listenerB, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listenerA.Close()
+	defer listenerB.Close()
+	addrA, addrB := listenerA.Addr().String(), listenerB.Addr().String()
+	a := makeTestCluster(addrA, addrB)
+	b := makeTestCluster(addrB, addrA)
+	defer a.gossip.stop()
+	defer b.gossip.stop()
+	go serveCluster(listenerA, a)
+	go serveCluster(listenerB, b)
+
+	conn := clientc.NewFakeConnection()
+	setA, setB, dest := keyOf(a, addrA, "a"), keyOf(a, addrB, "b"), keyOf(a, addrB, "d")
+	a.Exec(conn, cmdutil.ToCmdLine("SADD", setA, "1", "2"))
+	b.Exec(conn, cmdutil.ToCmdLine("SADD", setB, "2", "3"))
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("SUNIONSTORE", dest, setA, setB)).ToBytes()); got != ":3\r\n" {
+		t.Fatalf("except :3 but got %q", got)
+	}
+	if got := string(b.Exec(conn, cmdutil.ToCmdLine("SCARD", dest)).ToBytes()); got != ":3\r\n" {
+		t.Errorf("except union stored on %s but got %q", addrB, got)
+	}
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("SINTER", setA, setB)).ToBytes()); got != "*1\r\n$1\r\n2\r\n" {
+		t.Errorf("unexpected intersection %q", got)
+	}
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("EXISTS", setA, setB, "{"+setA+"}missing")).ToBytes()); got != ":2\r\n" {
+		t.Errorf("except :2 but got %q", got)
+	}
+
+	renamed := keyOf(a, addrA, "r")
+	b.Exec(conn, cmdutil.ToCmdLine("SET", "{"+setB+"}s", "v"))
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("RENAME", "{"+setB+"}s", renamed)).ToBytes()); got != "+OK\r\n" {
+		t.Fatalf("except +OK but got %q", got)
+	}
+	if _, ok := b.db.GetEntity(0, "{"+setB+"}s"); ok {
+		t.Errorf("except source removed")
+	}
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("GET", renamed)).ToBytes()); got != "$1\r\nv\r\n" {
+		t.Errorf("except renamed key on %s but got %q", addrA, got)
+	}
+}
+
+func TestCluster_scatterZSetStore(t *testing.T) {
+	listenerA, _ := net.Listen("tcp", "127.0.0.1:0")
+	listenerB, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listenerA.Close()
+	defer listenerB.Close()
+	addrA, addrB := listenerA.Addr().String(), listenerB.Addr().String()
+	a := makeTestCluster(addrA, addrB)
+	b := makeTestCluster(addrB, addrA)
+	defer a.gossip.stop()
+	defer b.gossip.stop()
+	go serveCluster(listenerA, a)
+	go serveCluster(listenerB, b)
+
+	conn := clientc.NewFakeConnection()
+	zsetA, zsetB, dest := keyOf(a, addrA, "za"), keyOf(a, addrB, "zb"), keyOf(a, addrB, "zd")
+	a.Exec(conn, cmdutil.ToCmdLine("ZADD", zsetA, "1", "x", "2", "y"))
+	b.Exec(conn, cmdutil.ToCmdLine("ZADD", zsetB, "3", "y", "4", "z"))
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("ZUNIONSTORE", dest, "2", zsetA, zsetB, "WEIGHTS", "2", "1")).ToBytes()); got != ":3\r\n" {
+		t.Fatalf("except :3 but got %q", got)
+	}
+	if got := string(b.Exec(conn, cmdutil.ToCmdLine("ZSCORE", dest, "y")).ToBytes()); got != "$1\r\n7\r\n" {
+		t.Errorf("except the union stored on %s but got %q", addrB, got)
+	}
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("ZINTERSTORE", dest, "2", zsetA, zsetB, "AGGREGATE", "MAX")).ToBytes()); got != ":1\r\n" {
+		t.Fatalf("except :1 but got %q", got)
+	}
+	if got := string(b.Exec(conn, cmdutil.ToCmdLine("ZSCORE", dest, "y")).ToBytes()); got != "$1\r\n3\r\n" {
+		t.Errorf("except the intersection stored on %s but got %q", addrB, got)
+	}
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("ZINTERSTORE", dest, "2", zsetA, "{"+zsetB+"}missing")).ToBytes()); got != ":0\r\n" {
+		t.Fatalf("except :0 but got %q", got)
+	}
+	if _, ok := b.db.GetEntity(0, dest); ok {
+		t.Errorf("except an empty intersection to delete %s", dest)
+	}
+}
+
+func TestCluster_execSort(t *testing.T) {
+	listenerA, _ := net.Listen("tcp", "127.0.0.1:0")
+	listenerB, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listenerA.Close()
+	defer listenerB.Close()
+	addrA, addrB := listenerA.Addr().String(), listenerB.Addr().String()
+	a := makeTestCluster(addrA, addrB)
+	b := makeTestCluster(addrB, addrA)
+	defer a.gossip.stop()
+	defer b.gossip.stop()
+	go serveCluster(listenerA, a)
+	go serveCluster(listenerB, b)
+
+	conn := clientc.NewFakeConnection()
+	ids, dest := keyOf(a, addrA, "ids"), keyOf(a, addrB, "d")
+	a.Exec(conn, cmdutil.ToCmdLine("RPUSH", ids, "1", "2", "3"))
+	for i, weight := range []string{"20", "30", "10"} {
+		a.Exec(conn, cmdutil.ToCmdLine("SET", "{"+ids+"}w_"+strconv.Itoa(i+1), weight))
+	}
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("SORT", ids, "BY", "{"+ids+"}w_*", "GET", "#", "GET", "{"+ids+"}w_*")).ToBytes()); got != "*6\r\n$1\r\n3\r\n$2\r\n10\r\n$1\r\n1\r\n$2\r\n20\r\n$1\r\n2\r\n$2\r\n30\r\n" {
+		t.Errorf("except the ids sorted by the weights sharing their slot but got %q", got)
+	}
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("SORT", ids, "BY", "w_*")).ToBytes()); got[:10] != "-CROSSSLOT" {
+		t.Errorf("except patterns of another slot refused but got %q", got)
+	}
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("SORT", ids, "DESC", "STORE", dest)).ToBytes()); got != ":3\r\n" {
+		t.Fatalf("except the ids stored on %s but got %q", addrB, got)
+	}
+	if got := string(b.Exec(conn, cmdutil.ToCmdLine("LRANGE", dest, "0", "-1")).ToBytes()); got != "*3\r\n$1\r\n3\r\n$1\r\n2\r\n$1\r\n1\r\n" {
+		t.Errorf("unexpected list stored %q", got)
+	}
+}
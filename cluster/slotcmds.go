@@ -0,0 +1,256 @@
+package cluster
+
+import (
+	"fmt"
+	cm "mygodis/common"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/lib/slot"
+	"mygodis/resp"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func splitAddr(node string) (string, int) {
+	host, portStr, err := net.SplitHostPort(node)
+	if err != nil {
+		return node, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+func parseSlot(arg []byte) (int, resp.Reply) {
+	s, err := strconv.Atoi(string(arg))
+	if err != nil || s < 0 || s >= slot.Count {
+		return 0, resp.MakeErrReply("ERR Invalid or out of range slot")
+	}
+	return s, nil
+}
+
+// findNode resolves a node given by address or by node id
+func (c *Cluster) findNode(name string) (string, bool) {
+	for _, node := range c.ring().GetNodes() {
+		if node == name || nodeID(node) == name {
+			return node, true
+		}
+	}
+	return "", false
+}
+
+// sortedNodes returns the ring members ordered by address
+func (c *Cluster) sortedNodes() []string {
+	seen := make(map[string]struct{})
+	nodes := make([]string, 0)
+	for _, node := range c.ring().GetNodes() {
+		if _, ok := seen[node]; ok {
+			continue
+		}
+		seen[node] = struct{}{}
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+func (c *Cluster) execKeySlot(args cm.CmdLine) resp.Reply {
+	if len(args) != 1 {
+		return resp.MakeArgNumErrReply("cluster|keyslot")
+	}
+	return resp.MakeIntReply(int64(slot.Of(args[0])))
+}
+func (c *Cluster) execMyID() resp.Reply {
+	return resp.MakeBulkReply([]byte(nodeID(c.self)))
+}
+func (c *Cluster) execCountKeysInSlot(args cm.CmdLine) resp.Reply {
+	if len(args) != 1 {
+		return resp.MakeArgNumErrReply("cluster|countkeysinslot")
+	}
+	s, errReply := parseSlot(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	count := 0
+	c.db.ForEach(0, func(key string, data *cmi.DataEntity, expiration time.Time) bool {
+		if slot.Of([]byte(key)) == s {
+			count++
+		}
+		return true
+	})
+	return resp.MakeIntReply(int64(count))
+}
+func (c *Cluster) execGetKeysInSlot(args cm.CmdLine) resp.Reply {
+	if len(args) != 2 {
+		return resp.MakeArgNumErrReply("cluster|getkeysinslot")
+	}
+	s, errReply := parseSlot(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	limit, err := strconv.Atoi(string(args[1]))
+	if err != nil || limit < 0 {
+		return resp.MakeErrReply("ERR Invalid number of keys")
+	}
+	keys := make([][]byte, 0)
+	c.db.ForEach(0, func(key string, data *cmi.DataEntity, expiration time.Time) bool {
+		if len(keys) >= limit {
+			return false
+		}
+		if slot.Of([]byte(key)) == s {
+			keys = append(keys, []byte(key))
+		}
+		return true
+	})
+	return resp.MakeMultiBulkReply(keys)
+}
+func nodeDescription(node string) resp.Reply {
+	host, port := splitAddr(node)
+	return resp.MakeMultiRawReply(
+		resp.MakeBulkReply([]byte(host)),
+		resp.MakeIntReply(int64(port)),
+		resp.MakeBulkReply([]byte(nodeID(node))),
+	)
+}
+func (c *Cluster) execSlots() resp.Reply {
+	ranges := c.slots.ranges()
+	replies := make([]resp.Reply, 0, len(ranges))
+	for _, r := range ranges {
+		replies = append(replies, resp.MakeMultiRawReply(
+			resp.MakeIntReply(int64(r.start)),
+			resp.MakeIntReply(int64(r.end)),
+			nodeDescription(r.node),
+		))
+	}
+	return resp.MakeMultiRawReply(replies...)
+}
+func (c *Cluster) execShards() resp.Reply {
+	ranges := c.slots.ranges()
+	replies := make([]resp.Reply, 0)
+	for _, node := range c.sortedNodes() {
+		slotReplies := make([]resp.Reply, 0)
+		for _, r := range ranges {
+			if r.node == node {
+				slotReplies = append(slotReplies, resp.MakeIntReply(int64(r.start)), resp.MakeIntReply(int64(r.end)))
+			}
+		}
+		host, port := splitAddr(node)
+		nodeReply := resp.MakeMultiRawReply(
+			resp.MakeBulkReply([]byte("id")), resp.MakeBulkReply([]byte(nodeID(node))),
+			resp.MakeBulkReply([]byte("port")), resp.MakeIntReply(int64(port)),
+			resp.MakeBulkReply([]byte("ip")), resp.MakeBulkReply([]byte(host)),
+			resp.MakeBulkReply([]byte("endpoint")), resp.MakeBulkReply([]byte(host)),
+			resp.MakeBulkReply([]byte("role")), resp.MakeBulkReply([]byte("master")),
+			resp.MakeBulkReply([]byte("replication-offset")), resp.MakeIntReply(0),
+			resp.MakeBulkReply([]byte("health")), resp.MakeBulkReply([]byte("online")),
+		)
+		replies = append(replies, resp.MakeMultiRawReply(
+			resp.MakeBulkReply([]byte("slots")), resp.MakeMultiRawReply(slotReplies...),
+			resp.MakeBulkReply([]byte("nodes")), resp.MakeMultiRawReply(nodeReply),
+		))
+	}
+	return resp.MakeMultiRawReply(replies...)
+}
+
+// execNodes replies the node table in the format of redis CLUSTER NODES
+func (c *Cluster) execNodes() resp.Reply {
+	if errReply := c.readMeta(); errReply != nil {
+		return errReply
+	}
+	ranges := c.slots.ranges()
+	var builder strings.Builder
+	epoch := atomic.LoadInt64(&c.epoch)
+	for _, node := range append(c.sortedNodes(), c.gossip.failedNodes()...) {
+		host, port := splitAddr(node)
+		flags := "master"
+		var pingSent, pongRecv int64
+		link := "connected"
+		if node == c.self {
+			flags = "myself,master"
+		} else {
+			health := c.gossip.snapshot(node)
+			switch health.state {
+			case statePFail:
+				flags += ",fail?"
+			case stateFail:
+				flags += ",fail"
+			}
+			if !health.pingSent.IsZero() {
+				pingSent = health.pingSent.UnixMilli()
+			}
+			pongRecv = health.pongRecv.UnixMilli()
+			if !health.linkUp {
+				link = "disconnected"
+			}
+		}
+		builder.WriteString(fmt.Sprintf("%s %s:%d@%d %s - %d %d %d %s", nodeID(node), host, port, port+10000, flags, pingSent, pongRecv, epoch, link))
+		for _, r := range ranges {
+			if r.node != node {
+				continue
+			}
+			if r.start == r.end {
+				builder.WriteString(" " + strconv.Itoa(r.start))
+			} else {
+				builder.WriteString(fmt.Sprintf(" %d-%d", r.start, r.end))
+			}
+		}
+		builder.WriteString("\n")
+	}
+	return resp.MakeBulkReply([]byte(builder.String()))
+}
+
+// execSetSlot implements CLUSTER SETSLOT <slot> IMPORTING|MIGRATING|NODE <node> and CLUSTER SETSLOT <slot> STABLE
+func (c *Cluster) execSetSlot(args cm.CmdLine) resp.Reply {
+	if len(args) < 2 {
+		return resp.MakeArgNumErrReply("cluster|setslot")
+	}
+	s, errReply := parseSlot(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	action := strings.ToUpper(string(args[1]))
+	if action == "STABLE" {
+		c.slots.setStable(s)
+		return resp.MakeOkReply()
+	}
+	if len(args) != 3 {
+		return resp.MakeArgNumErrReply("cluster|setslot")
+	}
+	node, ok := c.findNode(string(args[2]))
+	if !ok {
+		return resp.MakeErrReply("ERR I don't know about node " + string(args[2]))
+	}
+	switch action {
+	case "IMPORTING":
+		c.slots.setImporting(s, node)
+	case "MIGRATING":
+		c.slots.setMigrating(s, node)
+	case "NODE":
+		if c.raft != nil {
+			if err := c.proposeMeta(metaCommand{Op: metaSetSlot, Node: node, Slot: s}); err != nil {
+				return metaErrReply(err)
+			}
+			break
+		}
+		c.slots.pin(s, node)
+	default:
+		return resp.MakeSyntaxErrReply()
+	}
+	return resp.MakeOkReply()
+}
+
+// execDistribution reports the share of the key space served by every node, on the ring and in slots
+func (c *Cluster) execDistribution() resp.Reply {
+	ch := c.ring()
+	shares := ch.Distribution()
+	slots := make(map[string]int)
+	for _, r := range c.slots.ranges() {
+		slots[r.node] += r.end - r.start + 1
+	}
+	lines := make([][]byte, 0, len(shares))
+	for _, node := range ch.GetNodes() {
+		lines = append(lines, []byte(fmt.Sprintf("node=%s weight=%d vnodes=%d ring=%.2f%% slots=%d",
+			node, ch.Weight(node), len(ch.positionsOf(node)), shares[node]*100, slots[node])))
+	}
+	return resp.MakeMultiBulkReply(lines)
+}
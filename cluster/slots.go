@@ -0,0 +1,176 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"mygodis/lib/slot"
+	"sort"
+	"sync"
+)
+
+type slotRange struct {
+	start int
+	end   int
+	node  string
+}
+
+// slotTable maps every hash slot to the node serving it
+type slotTable struct {
+	mu        sync.RWMutex
+	owners    []string
+	pinned    map[int]string
+	migrating map[int]string
+	importing map[int]string
+}
+
+func makeSlotTable() *slotTable {
+	return &slotTable{
+		owners:    make([]string, slot.Count),
+		pinned:    make(map[int]string),
+		migrating: make(map[int]string),
+		importing: make(map[int]string),
+	}
+}
+
+// reset forgets the owners and the pinned, migrating and importing slots
+func (t *slotTable) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.owners = make([]string, slot.Count)
+	t.pinned = make(map[int]string)
+	t.migrating = make(map[int]string)
+	t.importing = make(map[int]string)
+}
+
+// assign spreads all slots evenly over nodes, slots pinned by CLUSTER SETSLOT NODE keep their owner
+func (t *slotTable) assign(nodes []string) {
+	weights := make(map[string]int, len(nodes))
+	for _, node := range nodes {
+		weights[node] = 1
+	}
+	t.assignWeighted(weights)
+}
+
+// assignWeighted gives every node a contiguous share of the slots proportional to its weight
+func (t *slotTable) assignWeighted(weights map[string]int) {
+	sorted := make([]string, 0, len(weights))
+	seen := make(map[string]struct{}, len(weights))
+	total := 0
+	for node, weight := range weights {
+		seen[node] = struct{}{}
+		sorted = append(sorted, node)
+		total += weight
+	}
+	sort.Strings(sorted)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, bound := 0, 0
+	if len(sorted) > 0 {
+		bound = weights[sorted[0]]
+	}
+	for i := 0; i < slot.Count; i++ {
+		if len(sorted) == 0 {
+			t.owners[i] = ""
+			continue
+		}
+		for i*total/slot.Count >= bound {
+			j++
+			bound += weights[sorted[j]]
+		}
+		t.owners[i] = sorted[j]
+	}
+	for s, node := range t.pinned {
+		if _, ok := seen[node]; ok {
+			t.owners[s] = node
+		} else {
+			delete(t.pinned, s)
+		}
+	}
+}
+func (t *slotTable) owner(s int) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.owners[s]
+}
+func (t *slotTable) pin(s int, node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pinned[s] = node
+	t.owners[s] = node
+	delete(t.migrating, s)
+	delete(t.importing, s)
+}
+
+// pins returns a copy of the slots pinned by CLUSTER SETSLOT NODE
+func (t *slotTable) pins() map[int]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	pins := make(map[int]string, len(t.pinned))
+	for s, node := range t.pinned {
+		pins[s] = node
+	}
+	return pins
+}
+
+// setPins replaces the pinned slots, they take effect with the next assignment
+func (t *slotTable) setPins(pins map[int]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pinned = make(map[int]string, len(pins))
+	for s, node := range pins {
+		t.pinned[s] = node
+	}
+}
+func (t *slotTable) setMigrating(s int, target string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.migrating[s] = target
+}
+func (t *slotTable) setImporting(s int, source string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.importing[s] = source
+}
+func (t *slotTable) setStable(s int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.migrating, s)
+	delete(t.importing, s)
+}
+func (t *slotTable) migratingTo(s int) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	target, ok := t.migrating[s]
+	return target, ok
+}
+func (t *slotTable) importingFrom(s int) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	source, ok := t.importing[s]
+	return source, ok
+}
+
+// ranges returns the contiguous slot ranges ordered by start slot
+func (t *slotTable) ranges() []slotRange {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	result := make([]slotRange, 0)
+	for i := 0; i < slot.Count; i++ {
+		node := t.owners[i]
+		if node == "" {
+			continue
+		}
+		if n := len(result); n > 0 && result[n-1].node == node && result[n-1].end == i-1 {
+			result[n-1].end = i
+			continue
+		}
+		result = append(result, slotRange{start: i, end: i, node: node})
+	}
+	return result
+}
+
+// nodeID returns the redis style 40 chars id of node, it is derived from the address so every member agrees on it
+func nodeID(node string) string {
+	sum := sha1.Sum([]byte(node))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,99 @@
+package cluster
+
+import (
+	"mygodis/clientc"
+	"mygodis/config"
+	"mygodis/lib/slot"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func makeTestCluster(self string, peers ...string) *Cluster {
+	config.Properties = &config.ServerProperties{
+		Self:      self,
+		Databases: 16,
+	}
+	c := MakeCluster()
+	for _, peer := range peers {
+		c.updateRing(func(ch *ConsistentHash) { ch.AddNode(peer) })
+	}
+	c.topologyChanged()
+	return c
+}
+
+func TestSlotTable_assign(t *testing.T) {
+	table := makeSlotTable()
+	table.assign([]string{"b:1", "a:1", "c:1", "a:1"})
+	ranges := table.ranges()
+	if len(ranges) != 3 {
+		t.Fatalf("except 3 ranges but got %d", len(ranges))
+	}
+	if ranges[0].node != "a:1" || ranges[0].start != 0 || ranges[2].end != slot.Count-1 {
+		t.Errorf("unexpected ranges %v", ranges)
+	}
+	table.pin(0, "c:1")
+	table.assign([]string{"a:1", "b:1", "c:1"})
+	if got := table.owner(0); got != "c:1" {
+		t.Errorf("except pinned owner c:1 but got %s", got)
+	}
+}
+
+func TestCluster_execRedirect(t *testing.T) {
+	c := makeTestCluster("127.0.0.1:7001", "127.0.0.1:7002")
+	conn := clientc.NewFakeConnection()
+	var local, remote string
+	for i := 0; local == "" || remote == ""; i++ {
+		key := "key" + strconv.Itoa(i)
+		if c.slots.owner(slot.Of([]byte(key))) == c.self {
+			local = key
+		} else {
+			remote = key
+		}
+	}
+	if reply := c.Exec(conn, cmdutil.ToCmdLine("SET", local, "v")); resp.IsErrorReply(reply) {
+		t.Errorf("except local set ok but got %s", reply.ToBytes())
+	}
+	reply := c.Exec(conn, cmdutil.ToCmdLine("GET", remote))
+	moved := "-MOVED " + strconv.Itoa(slot.Of([]byte(remote))) + " 127.0.0.1:7002"
+	if !strings.HasPrefix(string(reply.ToBytes()), moved) {
+		t.Errorf("except %s but got %s", moved, reply.ToBytes())
+	}
+	reply = c.Exec(conn, cmdutil.ToCmdLine("MGET", local, "{"+local+"}x"))
+	if got := string(reply.ToBytes()); got != "*2\r\n$1\r\nv\r\n$-1\r\n" {
+		t.Errorf("except keys sharing a hash tag served locally but got %q", got)
+	}
+	s := strconv.Itoa(slot.Of([]byte(local)))
+	c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "SETSLOT", s, "MIGRATING", "127.0.0.1:7002"))
+	reply = c.Exec(conn, cmdutil.ToCmdLine("GET", local+"{"+local+"}"))
+	if got := string(reply.ToBytes()); !strings.HasPrefix(got, "-ASK "+s+" 127.0.0.1:7002") {
+		t.Errorf("except ASK redirection but got %s", got)
+	}
+	reply = c.Exec(conn, cmdutil.ToCmdLine("GET", local))
+	if got := string(reply.ToBytes()); strings.HasPrefix(got, "-") {
+		t.Errorf("except existing key served locally but got %s", got)
+	}
+}
+
+func TestCluster_execSlots(t *testing.T) {
+	c := makeTestCluster("127.0.0.1:7001", "127.0.0.1:7002", "127.0.0.1:7003")
+	conn := clientc.NewFakeConnection()
+	reply := c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "KEYSLOT", "foo"))
+	if got := string(reply.ToBytes()); got != ":12182\r\n" {
+		t.Errorf("except :12182 but got %s", got)
+	}
+	reply = c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "NODES"))
+	nodes := strings.Split(strings.TrimSpace(string(reply.(*resp.BulkReply).Arg)), "\n")
+	if len(nodes) != 3 {
+		t.Fatalf("except 3 nodes but got %d", len(nodes))
+	}
+	if !strings.Contains(nodes[0], "myself,master") || !strings.HasSuffix(nodes[0], "0-5461") {
+		t.Errorf("unexpected node line %s", nodes[0])
+	}
+	reply = c.Exec(conn, cmdutil.ToCmdLine("CLUSTER", "SLOTS"))
+	if got := string(reply.ToBytes()); !strings.HasPrefix(got, "*3\r\n*3\r\n:0\r\n:5461\r\n*3\r\n$9\r\n127.0.0.1\r\n:7001\r\n") {
+		t.Errorf("unexpected slots reply %q", got)
+	}
+}
@@ -0,0 +1,302 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	logger "mygodis/log"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bootstrapInterval is how long a node waits before asking the seeds again when none of them answered
+const bootstrapInterval = time.Second
+
+// topology is what cluster-config-file holds, it is rewritten whenever the ring or the epoch changes
+type topology struct {
+	Epoch int64           `json:"epoch"`
+	Self  string          `json:"self"`
+	Nodes []string        `json:"nodes"`
+	Ring  json.RawMessage `json:"ring"`
+}
+
+// topologyStore writes the topology of this node to path, nothing is persisted if path is empty
+type topologyStore struct {
+	mu   sync.Mutex
+	path string
+	// syncing is set while the topology of a peer with a higher epoch is being adopted
+	syncing int32
+}
+
+func makeTopologyStore(path string) *topologyStore {
+	return &topologyStore{path: path}
+}
+
+// load reads the topology saved by a previous run, it returns nil if there is none
+func (s *topologyStore) load() *topology {
+	if s.path == "" {
+		return nil
+	}
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("read cluster config file", err)
+		}
+		return nil
+	}
+	t := &topology{}
+	if err := json.Unmarshal(content, t); err != nil {
+		logger.Error("broken cluster config file", s.path, err)
+		return nil
+	}
+	return t
+}
+
+// save replaces the file with t, the new content is synced aside first so a crash leaves the old or the new file
+func (s *topologyStore) save(t *topology) {
+	if s.path == "" {
+		return
+	}
+	content, err := json.Marshal(t)
+	if err != nil {
+		logger.Error("encode cluster config", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := writeFileSync(s.path, content); err != nil {
+		logger.Error("write cluster config file", err)
+	}
+}
+
+// writeFileSync replaces the file at path with content, the content and the rename are synced before it returns
+func writeFileSync(path string, content []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// currentTopology is the ring, the epoch and the known nodes of this node, nil if the ring cannot be serialized
+func (c *Cluster) currentTopology() *topology {
+	ring, err := c.ring().Serialize()
+	if err != nil {
+		logger.Error("serialize the ring", err)
+		return nil
+	}
+	return &topology{
+		Epoch: atomic.LoadInt64(&c.epoch),
+		Self:  c.self,
+		Nodes: c.nodes.Keys(),
+		Ring:  ring,
+	}
+}
+func (c *Cluster) saveTopology() {
+	if t := c.currentTopology(); t != nil {
+		c.topology.save(t)
+	}
+}
+
+// restoreTopology takes over the topology saved by a previous run, this node is kept in the ring
+func (c *Cluster) restoreTopology(t *topology) {
+	if t.Self != "" && t.Self != c.self {
+		logger.Warn("cluster config file belongs to", t.Self, "ignore it")
+		return
+	}
+	ch, err := LoadFrom(t.Ring)
+	if err != nil {
+		logger.Error("broken ring in cluster config file", err)
+		return
+	}
+	if ch.Weight(c.self) == 0 {
+		ch.AddWeightedNode(c.self, c.props.ClusterWeight)
+	}
+	c.setRing(ch)
+	for _, node := range append(t.Nodes, ch.GetNodes()...) {
+		if node != c.self {
+			c.nodes.Put(node, struct{}{})
+			c.nodeConnectionPool.AddConnection(node)
+		}
+	}
+	atomic.StoreInt64(&c.epoch, t.Epoch)
+	logger.Info("restored cluster topology of epoch", t.Epoch, "with", len(ch.GetNodes()), "members")
+}
+
+// fetchTopology asks node for its epoch and ring with CLUSTER TOPOLOGY
+func (c *Cluster) fetchTopology(node string) (int64, *ConsistentHash, error) {
+	reply, err := c.relay(node, cmdutil.ToCmdLine("CLUSTER", "TOPOLOGY"))
+	if err != nil {
+		return 0, nil, err
+	}
+	multiBulk, ok := reply.(*resp.MultiBulkReply)
+	if !ok || len(multiBulk.Args) != 2 {
+		return 0, nil, errors.New("unexpected topology reply " + string(reply.ToBytes()))
+	}
+	epoch, err := strconv.ParseInt(string(multiBulk.Args[0]), 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+	ch, err := LoadFrom(multiBulk.Args[1])
+	if err != nil {
+		return 0, nil, err
+	}
+	return epoch, ch, nil
+}
+
+// execTopology serves CLUSTER TOPOLOGY with the epoch and the serialized ring of this node
+func (c *Cluster) execTopology() resp.Reply {
+	ring, err := c.ring().Serialize()
+	if err != nil {
+		return resp.MakeErrReply(err.Error())
+	}
+	return resp.MakeMultiBulkReply([][]byte{[]byte(strconv.FormatInt(atomic.LoadInt64(&c.epoch), 10)), ring})
+}
+
+// seeds returns the nodes a starting node asks for the topology: the seed, the peers and the members it remembers
+func (c *Cluster) seeds() []string {
+	seen := map[string]bool{c.self: true}
+	seeds := make([]string, 0)
+	candidates := append([]string{}, c.props.Peers...)
+	if !c.props.ClusterAsSeed && c.props.ClusterSeed != "" {
+		candidates = append([]string{c.props.ClusterSeed}, candidates...)
+	}
+	candidates = append(candidates, c.ring().GetNodes()...)
+	for _, node := range candidates {
+		if node != "" && !seen[node] {
+			seen[node] = true
+			seeds = append(seeds, node)
+		}
+	}
+	return seeds
+}
+
+// bootstrap joins the cluster through the first seed which answers, it retries until one does or the cluster closes
+func (c *Cluster) bootstrap(seeds []string) {
+	if len(seeds) == 0 {
+		return
+	}
+	for {
+		for _, seed := range seeds {
+			if c.joinThrough(seed) {
+				return
+			}
+		}
+		select {
+		case <-c.gossip.stopC:
+			return
+		case <-time.After(bootstrapInterval):
+		}
+	}
+}
+
+// joinThrough reconciles the topology of this node with the one of seed, the view with the higher epoch wins
+func (c *Cluster) joinThrough(seed string) bool {
+	epoch, ch, err := c.fetchTopology(seed)
+	if err != nil {
+		logger.Warn("seed", seed, "is not reachable", err)
+		return false
+	}
+	local := atomic.LoadInt64(&c.epoch)
+	if ch.Weight(c.self) > 0 {
+		// with raft the metadata arrives through the log of the group
+		if epoch > local && c.raft == nil {
+			c.adoptTopology(epoch, ch)
+		}
+		// otherwise the seed adopts the view of this node once it hears the higher epoch by gossip
+		return true
+	}
+	if local > epoch && c.ring().Weight(seed) > 0 && c.raft == nil {
+		return true
+	}
+	if reply := c.execMeet(cmdutil.ToCmdLine(seed)); resp.IsErrorReply(reply) {
+		logger.Warn("join through", seed, "failed", string(reply.ToBytes()))
+		return false
+	}
+	logger.Info("joined the cluster through", seed)
+	return true
+}
+
+// syncTopology adopts the topology of node, it is called when node gossips a higher epoch than this node had
+func (c *Cluster) syncTopology(node string) {
+	if !atomic.CompareAndSwapInt32(&c.topology.syncing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&c.topology.syncing, 0)
+	epoch, ch, err := c.fetchTopology(node)
+	if err != nil || epoch < atomic.LoadInt64(&c.epoch) {
+		return
+	}
+	if ch.Weight(c.self) == 0 {
+		// the newer view misses this node, it joins again rather than dropping itself
+		c.joinThrough(node)
+		return
+	}
+	c.adoptTopology(epoch, ch)
+}
+
+// ring returns the ring in use, it is never changed in place so it can be read without a lock
+func (c *Cluster) ring() *ConsistentHash {
+	return c.ch.Load()
+}
+
+// updateRing applies change to a copy of the ring and swaps it in, readers keep the ring they loaded
+func (c *Cluster) updateRing(change func(ch *ConsistentHash)) {
+	c.ringMu.Lock()
+	defer c.ringMu.Unlock()
+	ch := c.ch.Load().Clone()
+	change(ch)
+	c.ch.Store(ch)
+}
+
+// setRing replaces the ring with ch, which must not be changed afterwards
+func (c *Cluster) setRing(ch *ConsistentHash) {
+	c.ringMu.Lock()
+	defer c.ringMu.Unlock()
+	c.ch.Store(ch)
+}
+
+// adoptTopology replaces the ring of this node with ch and moves the keys it does not own anymore
+func (c *Cluster) adoptTopology(epoch int64, ch *ConsistentHash) {
+	for _, node := range c.nodes.Keys() {
+		if ch.Weight(node) == 0 {
+			c.nodes.Remove(node)
+		}
+	}
+	for _, node := range ch.GetNodes() {
+		if node != c.self {
+			c.nodes.Put(node, struct{}{})
+			c.nodeConnectionPool.AddConnection(node)
+		}
+	}
+	c.setRing(ch)
+	c.adoptEpoch(epoch)
+	c.topologyChanged()
+	c.rebalance()
+	logger.Info("adopted cluster topology of epoch", epoch)
+}
@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"mygodis/clientc"
+	"mygodis/config"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCluster_topologyPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	config.Properties = &config.ServerProperties{
+		Self:              "127.0.0.1:7101",
+		Databases:         16,
+		ClusterConfigFile: path,
+	}
+	c := MakeCluster()
+	reply := c.Exec(clientc.NewFakeConnection(), cmdutil.ToCmdLine("CLUSTER", "ADDNODE", "127.0.0.1:7102", "2", "7"))
+	if resp.IsErrorReply(reply) {
+		t.Fatalf("except addnode ok but got %s", reply.ToBytes())
+	}
+	c.gossip.stop()
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("except the file written aside to be renamed but got %v", err)
+	}
+
+	restarted := MakeCluster()
+	defer restarted.gossip.stop()
+	if epoch := atomic.LoadInt64(&restarted.epoch); epoch != 7 {
+		t.Errorf("except epoch 7 restored but got %d", epoch)
+	}
+	if weight := restarted.ring().Weight("127.0.0.1:7102"); weight != 2 {
+		t.Errorf("except member of weight 2 restored but got %d", weight)
+	}
+	if _, known := restarted.nodes.Get("127.0.0.1:7102"); !known || restarted.ring().Weight("127.0.0.1:7101") != 1 {
+		t.Errorf("unexpected restored members %v", restarted.ring().GetNodes())
+	}
+}
+
+// waitFor polls cond until it holds or a few gossip rounds passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for " + what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCluster_bootstrap(t *testing.T) {
+	listenerA, _ := net.Listen("tcp", "127.0.0.1:0")
+	listenerB, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listenerA.Close()
+	defer listenerB.Close()
+	addrA, addrB := listenerA.Addr().String(), listenerB.Addr().String()
+	a := makeTestCluster(addrA)
+	defer a.gossip.stop()
+	go serveCluster(listenerA, a)
+
+	config.Properties = &config.ServerProperties{
+		Self:      addrB,
+		Databases: 16,
+		Peers:     []string{addrA},
+	}
+	b := MakeCluster()
+	defer b.gossip.stop()
+	go serveCluster(listenerB, b)
+	waitFor(t, "b joined through its peer", func() bool {
+		return a.ring().Weight(addrB) > 0 && b.ring().Weight(addrA) > 0
+	})
+
+	// a view with a higher epoch replaces the one of b
+	ch := a.ring().Clone()
+	ch.AddWeightedNode(addrB, 3)
+	a.setRing(ch)
+	atomic.StoreInt64(&a.epoch, 10)
+	a.topologyChanged()
+	waitFor(t, "b adopted the higher epoch", func() bool {
+		return b.ring().Weight(addrB) == 3 && atomic.LoadInt64(&b.epoch) == 10
+	})
+}
@@ -0,0 +1,612 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"mygodis/clientc"
+	cm "mygodis/common"
+	"mygodis/db"
+	logger "mygodis/log"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// states of a transaction on a participant
+const (
+	txPrepared   = "prepared"
+	txCommitting = "committing"
+	txCommitted  = "committed"
+	txRolledBack = "rolledback"
+	// txInDoubt is a transaction found committing after a restart, its commands may have run already
+	txInDoubt = "indoubt"
+)
+
+// decisions of a coordinator
+const (
+	txPending = "pending"
+	txCommit  = "commit"
+	txAbort   = "abort"
+	txDone    = "done"
+)
+
+const defaultTxTimeout = 5 * time.Second
+
+const (
+	errTxWatch   = "TXABORT watched keys changed"
+	errTxExists  = "TXABORT keys already exist"
+	errTxUnknown = "TXUNKNOWN transaction is not known"
+	errTxInDoubt = "TXINDOUBT transaction was committing when this node stopped, it is not run again"
+)
+
+// transaction is the branch of a cross node transaction executed by this node
+type transaction struct {
+	mu          sync.Mutex
+	id          string
+	coordinator string
+	dbIndex     int
+	cmdLines    []cm.CmdLine
+	// watching holds the versions the keys must still have, absent the keys which must not exist
+	watching  map[string]uint64
+	absent    []string
+	writeKeys []string
+	readKeys  []string
+	undoLogs  [][]cm.CmdLine
+	replies   []resp.Reply
+	state     string
+	timer     *time.Timer
+}
+
+// txBranch is the part of a cross node transaction sent to one participant
+type txBranch struct {
+	node     string
+	cmdLines []cm.CmdLine
+	watching map[string]uint64
+	absent   []string
+}
+
+// txCoordinator remembers the decisions of the transactions coordinated by this node until every participant
+// finished, participants holding a prepared transaction too long ask for them
+type txCoordinator struct {
+	mu        sync.Mutex
+	decisions map[string]string
+	stopC     chan struct{}
+	stopped   sync.Once
+}
+
+func makeTxCoordinator() *txCoordinator {
+	return &txCoordinator{
+		decisions: make(map[string]string),
+		stopC:     make(chan struct{}),
+	}
+}
+func (tc *txCoordinator) set(id string, decision string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if decision == txDone {
+		delete(tc.decisions, id)
+		return
+	}
+	tc.decisions[id] = decision
+}
+
+// status returns the decision of id, a transaction not known is presumed aborted
+func (tc *txCoordinator) status(id string) string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if decision, ok := tc.decisions[id]; ok {
+		return decision
+	}
+	return txAbort
+}
+func (tc *txCoordinator) stop() {
+	tc.stopped.Do(func() {
+		close(tc.stopC)
+	})
+}
+func (c *Cluster) txTimeout() time.Duration {
+	if ms := c.props.ClusterTxTimeout; ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return defaultTxTimeout
+}
+
+// execTx executes branches atomically with two phase commit and returns the replies of every branch. Participants
+// are prepared one by one in the order of their names, so concurrent transactions lock nodes in the same order
+func (c *Cluster) execTx(dbIndex int, branches []*txBranch) ([][]resp.Reply, error) {
+	sort.Slice(branches, func(i, j int) bool {
+		return branches[i].node < branches[j].node
+	})
+	id := strconv.FormatInt(c.idGenerator.NextID(), 10)
+	c.coordinator.set(id, txPending)
+	nodes := make([]string, 0, len(branches))
+	for _, branch := range branches {
+		reply, err := c.txCall(branch.node, encodeTxPrepare(id, c.self, dbIndex, branch))
+		if err == nil && resp.IsErrorReply(reply) {
+			err = errors.New(errorMessage(reply))
+		}
+		if err != nil {
+			c.abortTx(id, nodes)
+			return nil, err
+		}
+		nodes = append(nodes, branch.node)
+	}
+	// the decision is durable before any participant executes, participants in doubt ask for it
+	c.coordinator.set(id, txCommit)
+	c.txlog.append(txRecord{ID: id, Role: roleCoordinator, State: txCommit, Nodes: nodes})
+	results := make([][]resp.Reply, len(branches))
+	lost := make([]string, 0)
+	for i, branch := range branches {
+		reply, err := c.txCall(branch.node, cmdutil.ToCmdLine("CLUSTER", "TX", "COMMIT", id))
+		if err != nil {
+			lost = append(lost, branch.node)
+			continue
+		}
+		replies, err := decodeTxReplies(reply)
+		if err != nil {
+			// the decision is final once durable, a participant which answered badly is in doubt like a silent one
+			logger.Warn("transaction", id, "got a bad reply from", branch.node, err)
+			lost = append(lost, branch.node)
+			continue
+		}
+		results[i] = replies
+	}
+	if len(lost) > 0 {
+		go c.completeTx(id, lost, txCommit)
+		return nil, fmt.Errorf("ERR TXINDOUBT transaction %s is committed but the replies of %s are lost", id, strings.Join(lost, ","))
+	}
+	c.coordinator.set(id, txDone)
+	c.txlog.append(txRecord{ID: id, Role: roleCoordinator, State: txDone})
+	return results, nil
+}
+
+// abortTx rolls back the prepared participants of id, participants not reached roll back once they ask for the decision
+func (c *Cluster) abortTx(id string, nodes []string) {
+	c.coordinator.set(id, txAbort)
+	c.txlog.append(txRecord{ID: id, Role: roleCoordinator, State: txAbort, Nodes: nodes})
+	for _, node := range nodes {
+		if _, err := c.txCall(node, cmdutil.ToCmdLine("CLUSTER", "TX", "ROLLBACK", id)); err != nil {
+			logger.Warn("rollback transaction", id, "on", node, err)
+		}
+	}
+	c.coordinator.set(id, txDone)
+	c.txlog.append(txRecord{ID: id, Role: roleCoordinator, State: txDone})
+}
+
+// completeTx sends decision to nodes until all of them acknowledged it
+func (c *Cluster) completeTx(id string, nodes []string, decision string) {
+	action := "COMMIT"
+	if decision == txAbort {
+		action = "ROLLBACK"
+	}
+	for len(nodes) > 0 {
+		rest := make([]string, 0, len(nodes))
+		for _, node := range nodes {
+			reply, err := c.txCall(node, cmdutil.ToCmdLine("CLUSTER", "TX", action, id))
+			if err != nil {
+				rest = append(rest, node)
+				continue
+			}
+			if resp.IsErrorReply(reply) && !strings.HasPrefix(errorMessage(reply), "TXUNKNOWN") {
+				logger.Warn("transaction", id, "failed on", node, errorMessage(reply))
+			}
+		}
+		nodes = rest
+		if len(nodes) == 0 {
+			break
+		}
+		select {
+		case <-c.coordinator.stopC:
+			return
+		case <-time.After(c.txTimeout()):
+		}
+	}
+	c.coordinator.set(id, txDone)
+	c.txlog.append(txRecord{ID: id, Role: roleCoordinator, State: txDone})
+}
+
+// txCall sends a CLUSTER TX command to node, commands for this node are executed in process
+func (c *Cluster) txCall(node string, cmdLine cm.CmdLine) (resp.Reply, error) {
+	if node == c.self {
+		return c.execTxCommand(cmdLine[2:]), nil
+	}
+	return c.relay(node, cmdLine)
+}
+
+// execTxCommand serves CLUSTER TX PREPARE|COMMIT|ROLLBACK|STATUS|VERSION
+func (c *Cluster) execTxCommand(args cm.CmdLine) resp.Reply {
+	if len(args) < 2 {
+		return resp.MakeArgNumErrReply("cluster tx")
+	}
+	id := string(args[1])
+	switch strings.ToUpper(string(args[0])) {
+	case "PREPARE":
+		tx, err := decodeTxPrepare(args[1:])
+		if err != nil {
+			return resp.MakeErrReply(err.Error())
+		}
+		if err := c.prepareTx(tx, true); err != nil {
+			return resp.MakeErrReply(err.Error())
+		}
+		return resp.MakeOkReply()
+	case "COMMIT":
+		return c.commitTx(id)
+	case "ROLLBACK":
+		return c.rollbackTx(id)
+	case "STATUS":
+		return resp.MakeBulkReply([]byte(c.coordinator.status(id)))
+	case "VERSION":
+		return c.execTxVersion(args[1:])
+	}
+	return resp.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'")
+}
+
+// execTxVersion replies the versions of keys in a db, WATCH on another node uses it
+func (c *Cluster) execTxVersion(args cm.CmdLine) resp.Reply {
+	if len(args) < 2 {
+		return resp.MakeArgNumErrReply("cluster tx version")
+	}
+	dbIndex, err := strconv.Atoi(string(args[0]))
+	if err != nil || dbIndex < 0 || dbIndex >= len(c.db.Dbs) {
+		return resp.MakeErrReply("ERR invalid db index")
+	}
+	versions := make([][]byte, 0, len(args)-1)
+	for _, key := range args[1:] {
+		versions = append(versions, []byte(strconv.FormatUint(c.db.GetVersion(dbIndex, string(key)), 10)))
+	}
+	return resp.MakeMultiBulkReply(versions)
+}
+
+// prepareTx locks the keys of tx and captures its undo logs, the locks are held until commit or rollback.
+// Conditions are not checked again when a transaction is recovered, they held when it was prepared first
+func (c *Cluster) prepareTx(tx *transaction, check bool) error {
+	for _, line := range tx.cmdLines {
+		writeKeys, readKeys, ok := db.GetLockKeys(line)
+		if !ok {
+			return fmt.Errorf("ERR command '%s' cannot be used in a transaction", line[0])
+		}
+		tx.writeKeys = append(tx.writeKeys, writeKeys...)
+		tx.readKeys = append(tx.readKeys, readKeys...)
+	}
+	for key := range tx.watching {
+		tx.readKeys = append(tx.readKeys, key)
+	}
+	tx.readKeys = append(tx.readKeys, tx.absent...)
+	if _, exists := c.transactions.Get(tx.id); exists {
+		return fmt.Errorf("ERR transaction %s is already prepared", tx.id)
+	}
+	c.db.RWLocks(tx.dbIndex, tx.writeKeys, tx.readKeys)
+	if check {
+		if err := c.checkTx(tx); err != nil {
+			c.db.RWUnLocks(tx.dbIndex, tx.writeKeys, tx.readKeys)
+			return err
+		}
+		// a command failing now fails the prepare, once the coordinator decided to commit there is no way back
+		if reply := c.db.DryRun(tx.dbIndex, tx.cmdLines); reply != nil {
+			c.db.RWUnLocks(tx.dbIndex, tx.writeKeys, tx.readKeys)
+			return errors.New(errorMessage(reply))
+		}
+	}
+	for _, line := range tx.cmdLines {
+		tx.undoLogs = append(tx.undoLogs, c.db.GetUndoLogs(tx.dbIndex, line))
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.state = txPrepared
+	c.transactions.Put(tx.id, tx)
+	c.txlog.append(txRecord{
+		ID:          tx.id,
+		Role:        roleParticipant,
+		State:       txPrepared,
+		Coordinator: tx.coordinator,
+		DB:          tx.dbIndex,
+		CmdLines:    tx.cmdLines,
+	})
+	tx.timer = time.AfterFunc(c.txTimeout(), func() {
+		c.resolveTx(tx)
+	})
+	return nil
+}
+func (c *Cluster) checkTx(tx *transaction) error {
+	for key, version := range tx.watching {
+		if c.db.GetVersion(tx.dbIndex, key) != version {
+			return errors.New(errTxWatch)
+		}
+	}
+	for _, key := range tx.absent {
+		if _, exists := c.db.GetEntity(tx.dbIndex, key); exists {
+			return errors.New(errTxExists)
+		}
+	}
+	return nil
+}
+
+// commitTx executes the commands of a prepared transaction, it is rolled back if any command fails
+func (c *Cluster) commitTx(id string) resp.Reply {
+	val, ok := c.transactions.Get(id)
+	if !ok {
+		return resp.MakeErrReply(errTxUnknown)
+	}
+	tx := val.(*transaction)
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	switch tx.state {
+	case txCommitted:
+		return encodeTxReplies(tx.replies)
+	case txRolledBack:
+		return resp.MakeErrReply("ERR transaction " + id + " is rolled back")
+	case txInDoubt:
+		return c.answerInDoubt(tx)
+	}
+	tx.timer.Stop()
+	// the commands also reach the aof as they run, a crash before committed is logged must not run them twice
+	c.txlog.append(txRecord{ID: id, Role: roleParticipant, State: txCommitting})
+	conn := &clientc.FakeConnection{DBindex: tx.dbIndex}
+	replies := make([]resp.Reply, 0, len(tx.cmdLines))
+	for i, line := range tx.cmdLines {
+		reply := c.db.ExecWithLock(conn, line)
+		if resp.IsErrorReply(reply) {
+			c.undoTx(tx, i)
+			c.finishTx(tx, txRolledBack)
+			return reply
+		}
+		replies = append(replies, reply)
+	}
+	tx.replies = replies
+	c.finishTx(tx, txCommitted)
+	return encodeTxReplies(replies)
+}
+
+// rollbackTx releases a prepared transaction or undoes a committed one
+func (c *Cluster) rollbackTx(id string) resp.Reply {
+	val, ok := c.transactions.Get(id)
+	if !ok {
+		return resp.MakeOkReply()
+	}
+	tx := val.(*transaction)
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	switch tx.state {
+	case txInDoubt:
+		return c.answerInDoubt(tx)
+	case txPrepared:
+		tx.timer.Stop()
+		c.finishTx(tx, txRolledBack)
+	case txCommitted:
+		c.db.RWLocks(tx.dbIndex, tx.writeKeys, tx.readKeys)
+		c.undoTx(tx, len(tx.cmdLines))
+		tx.state = txPrepared
+		c.finishTx(tx, txRolledBack)
+	}
+	return resp.MakeOkReply()
+}
+
+// undoTx applies the undo logs of the first n commands in reverse order
+func (c *Cluster) undoTx(tx *transaction, n int) {
+	conn := &clientc.FakeConnection{DBindex: tx.dbIndex}
+	for i := n - 1; i >= 0; i-- {
+		for _, line := range tx.undoLogs[i] {
+			c.db.ExecWithLock(conn, line)
+		}
+	}
+}
+
+// finishTx releases the locks of a prepared transaction, it is forgotten once no coordinator could retry it
+func (c *Cluster) finishTx(tx *transaction, state string) {
+	if tx.state == txPrepared {
+		c.db.RWUnLocks(tx.dbIndex, tx.writeKeys, tx.readKeys)
+	}
+	tx.state = state
+	c.txlog.append(txRecord{ID: tx.id, Role: roleParticipant, State: state})
+	time.AfterFunc(c.txTimeout(), func() {
+		c.transactions.Remove(tx.id)
+	})
+}
+
+// answerInDoubt tells the coordinator a recovered transaction is in doubt, it is forgotten once told
+func (c *Cluster) answerInDoubt(tx *transaction) resp.Reply {
+	c.txlog.append(txRecord{ID: tx.id, Role: roleParticipant, State: txInDoubt})
+	time.AfterFunc(c.txTimeout(), func() {
+		c.transactions.Remove(tx.id)
+	})
+	return resp.MakeErrReply(errTxInDoubt)
+}
+
+// resolveTx asks the coordinator about a transaction prepared too long ago, its locks are held until the
+// coordinator decided
+func (c *Cluster) resolveTx(tx *transaction) {
+	tx.mu.Lock()
+	state := tx.state
+	tx.mu.Unlock()
+	if state != txPrepared {
+		return
+	}
+	decision, err := c.queryTxStatus(tx.coordinator, tx.id)
+	switch {
+	case err != nil || decision == txPending:
+		if err != nil {
+			logger.Warn("transaction", tx.id, "in doubt, coordinator", tx.coordinator, "unreachable", err)
+		}
+		tx.mu.Lock()
+		if tx.state == txPrepared {
+			tx.timer.Reset(c.txTimeout())
+		}
+		tx.mu.Unlock()
+	case decision == txCommit:
+		c.commitTx(tx.id)
+	default:
+		c.rollbackTx(tx.id)
+	}
+}
+func (c *Cluster) queryTxStatus(coordinator string, id string) (string, error) {
+	reply, err := c.txCall(coordinator, cmdutil.ToCmdLine("CLUSTER", "TX", "STATUS", id))
+	if err != nil {
+		return "", err
+	}
+	bulk, ok := reply.(*resp.BulkReply)
+	if !ok {
+		return "", fmt.Errorf("unexpected reply %s", reply.ToBytes())
+	}
+	return string(bulk.Arg), nil
+}
+
+// recoverTx resumes the transactions in doubt found in the log, prepared participants lock their keys again and
+// wait for the decision, decided coordinators send it again
+func (c *Cluster) recoverTx(records []txRecord) {
+	for _, record := range records {
+		if record.Role == roleCoordinator && (record.State == txCommit || record.State == txAbort) {
+			c.coordinator.set(record.ID, record.State)
+		}
+	}
+	for _, record := range records {
+		switch record.Role {
+		case roleCoordinator:
+			if record.State == txCommit || record.State == txAbort {
+				logger.Info("recover transaction", record.ID, record.State)
+				go c.completeTx(record.ID, record.Nodes, record.State)
+			}
+		case roleParticipant:
+			if record.State == txCommitting {
+				logger.Warn("transaction", record.ID, "was committing, it is in doubt")
+				c.transactions.Put(record.ID, &transaction{id: record.ID, state: txInDoubt})
+				continue
+			}
+			if record.State != txPrepared {
+				continue
+			}
+			tx := &transaction{
+				id:          record.ID,
+				coordinator: record.Coordinator,
+				dbIndex:     record.DB,
+				cmdLines:    record.CmdLines,
+			}
+			if err := c.prepareTx(tx, false); err != nil {
+				logger.Error("recover transaction", record.ID, err)
+			}
+		}
+	}
+}
+
+// encodeTxPrepare builds CLUSTER TX PREPARE id coordinator db nWatch [key version]... nAbsent [key]... nCmd [argc arg...]...
+func encodeTxPrepare(id string, coordinator string, dbIndex int, branch *txBranch) cm.CmdLine {
+	line := cmdutil.ToCmdLine("CLUSTER", "TX", "PREPARE", id, coordinator, strconv.Itoa(dbIndex))
+	line = append(line, []byte(strconv.Itoa(len(branch.watching))))
+	for key, version := range branch.watching {
+		line = append(line, []byte(key), []byte(strconv.FormatUint(version, 10)))
+	}
+	line = append(line, []byte(strconv.Itoa(len(branch.absent))))
+	for _, key := range branch.absent {
+		line = append(line, []byte(key))
+	}
+	line = append(line, []byte(strconv.Itoa(len(branch.cmdLines))))
+	for _, cmdLine := range branch.cmdLines {
+		line = append(line, []byte(strconv.Itoa(len(cmdLine))))
+		line = append(line, cmdLine...)
+	}
+	return line
+}
+
+var errTxSyntax = errors.New("ERR malformed transaction")
+
+// decodeTxPrepare parses the arguments of CLUSTER TX PREPARE after the subcommand
+func decodeTxPrepare(args cm.CmdLine) (*transaction, error) {
+	if len(args) < 6 {
+		return nil, errTxSyntax
+	}
+	tx := &transaction{
+		id:          string(args[0]),
+		coordinator: string(args[1]),
+		watching:    make(map[string]uint64),
+	}
+	var err error
+	if tx.dbIndex, err = strconv.Atoi(string(args[2])); err != nil {
+		return nil, errTxSyntax
+	}
+	i := 3
+	next := func() (int, bool) {
+		if i >= len(args) {
+			return 0, false
+		}
+		n, err := strconv.Atoi(string(args[i]))
+		i++
+		return n, err == nil && n >= 0
+	}
+	nWatch, ok := next()
+	if !ok || i+2*nWatch > len(args) {
+		return nil, errTxSyntax
+	}
+	for j := 0; j < nWatch; j++ {
+		version, err := strconv.ParseUint(string(args[i+1]), 10, 64)
+		if err != nil {
+			return nil, errTxSyntax
+		}
+		tx.watching[string(args[i])] = version
+		i += 2
+	}
+	nAbsent, ok := next()
+	if !ok || i+nAbsent > len(args) {
+		return nil, errTxSyntax
+	}
+	for j := 0; j < nAbsent; j++ {
+		tx.absent = append(tx.absent, string(args[i]))
+		i++
+	}
+	nCmd, ok := next()
+	if !ok {
+		return nil, errTxSyntax
+	}
+	for j := 0; j < nCmd; j++ {
+		argc, ok := next()
+		if !ok || argc == 0 || i+argc > len(args) {
+			return nil, errTxSyntax
+		}
+		tx.cmdLines = append(tx.cmdLines, args[i:i+argc])
+		i += argc
+	}
+	if i != len(args) {
+		return nil, errTxSyntax
+	}
+	return tx, nil
+}
+
+// rawReply is a reply relayed to the client as it was produced by another node
+type rawReply []byte
+
+func (r rawReply) ToBytes() []byte {
+	return r
+}
+
+// encodeTxReplies packs the replies of a branch into bulk strings so they survive the trip to the coordinator
+func encodeTxReplies(replies []resp.Reply) resp.Reply {
+	args := make([][]byte, 0, len(replies))
+	for _, reply := range replies {
+		args = append(args, reply.ToBytes())
+	}
+	return resp.MakeMultiBulkReply(args)
+}
+func decodeTxReplies(reply resp.Reply) ([]resp.Reply, error) {
+	if resp.IsErrorReply(reply) {
+		return nil, errors.New(errorMessage(reply))
+	}
+	multiBulk, ok := reply.(*resp.MultiBulkReply)
+	if !ok {
+		if _, empty := reply.(*resp.EmptyMultiBulkReply); empty {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unexpected reply %s", reply.ToBytes())
+	}
+	replies := make([]resp.Reply, 0, len(multiBulk.Args))
+	for _, arg := range multiBulk.Args {
+		replies = append(replies, rawReply(arg))
+	}
+	return replies, nil
+}
+
+// errorMessage returns the message of an error reply without the leading '-' and CRLF
+func errorMessage(reply resp.Reply) string {
+	return strings.TrimSuffix(strings.TrimPrefix(string(reply.ToBytes()), "-"), "\r\n")
+}
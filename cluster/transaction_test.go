@@ -0,0 +1,204 @@
+package cluster
+
+import (
+	"mygodis/clientc"
+	cm "mygodis/common"
+	"mygodis/config"
+	"mygodis/parse"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serveCluster answers the connections accepted by listener with c, like the server of a node
+func serveCluster(listener net.Listener, c *Cluster) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			connection := clientc.NewConn(conn)
+			for payload := range parse.Parse(conn) {
+				if payload.Err != nil {
+					_ = conn.Close()
+					return
+				}
+				line, ok := payload.Data.(*resp.MultiBulkReply)
+				if !ok {
+					continue
+				}
+				_, _ = conn.Write(c.Exec(connection, line.Args).ToBytes())
+			}
+		}()
+	}
+}
+
+// keyOf returns a key served by node
+func keyOf(c *Cluster, node string, prefix string) string {
+	for i := 0; ; i++ {
+		key := prefix + strconv.Itoa(i)
+		if c.ownerOf(key) == node {
+			return key
+		}
+	}
+}
+
+func TestCluster_crossNodeTransaction(t *testing.T) {
+	listenerA, _ := net.Listen("tcp", "127.0.0.1:0")
+	listenerB, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listenerA.Close()
+	defer listenerB.Close()
+	addrA, addrB := listenerA.Addr().String(), listenerB.Addr().String()
+	a := makeTestCluster(addrA, addrB)
+	b := makeTestCluster(addrB, addrA)
+	defer a.gossip.stop()
+	defer b.gossip.stop()
+	go serveCluster(listenerA, a)
+	go serveCluster(listenerB, b)
+
+	keyA, keyB := keyOf(a, addrA, "a"), keyOf(a, addrB, "b")
+	conn := clientc.NewFakeConnection()
+	a.Exec(conn, cmdutil.ToCmdLine("WATCH", keyB))
+	a.Exec(conn, cmdutil.ToCmdLine("MULTI"))
+	a.Exec(conn, cmdutil.ToCmdLine("SET", keyA, "1"))
+	a.Exec(conn, cmdutil.ToCmdLine("SET", keyB, "2"))
+	a.Exec(conn, cmdutil.ToCmdLine("INCR", keyA))
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("EXEC")).ToBytes()); got != "*3\r\n+OK\r\n+OK\r\n:2\r\n" {
+		t.Fatalf("unexpected exec reply %q", got)
+	}
+	if _, ok := b.db.GetEntity(0, keyB); !ok {
+		t.Fatalf("except %s written on %s", keyB, addrB)
+	}
+
+	a.Exec(conn, cmdutil.ToCmdLine("WATCH", keyB))
+	b.Exec(clientc.NewFakeConnection(), cmdutil.ToCmdLine("SET", keyB, "3"))
+	a.Exec(conn, cmdutil.ToCmdLine("MULTI"))
+	a.Exec(conn, cmdutil.ToCmdLine("SET", keyA, "4"))
+	a.Exec(conn, cmdutil.ToCmdLine("SET", keyB, "4"))
+	if reply := a.Exec(conn, cmdutil.ToCmdLine("EXEC")); resp.IsErrorReply(reply) {
+		t.Fatalf("except nil reply but got %s", reply.ToBytes())
+	}
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("GET", keyA)).ToBytes()); got != "$1\r\n2\r\n" {
+		t.Errorf("except transaction aborted by watched key but got %q", got)
+	}
+
+	// the second command would fail on b, so b refuses to prepare and nothing is committed on a
+	a.Exec(conn, cmdutil.ToCmdLine("MULTI"))
+	a.Exec(conn, cmdutil.ToCmdLine("SET", keyA, "5"))
+	a.Exec(conn, cmdutil.ToCmdLine("SADD", keyB, "x"))
+	if reply := a.Exec(conn, cmdutil.ToCmdLine("EXEC")); !resp.IsErrorReply(reply) {
+		t.Errorf("except exec failed but got %s", reply.ToBytes())
+	}
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("GET", keyA)).ToBytes()); got != "$1\r\n2\r\n" {
+		t.Errorf("except %s rolled back but got %q", keyA, got)
+	}
+
+	keyA2, keyB2 := keyOf(a, addrA, "x"), keyOf(a, addrB, "y")
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("MSETNX", keyA2, "1", keyB)).ToBytes()); got[0] != '-' {
+		t.Errorf("except argument error but got %q", got)
+	}
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("MSETNX", keyA2, "1", keyB, "1")).ToBytes()); got != ":0\r\n" {
+		t.Errorf("except :0 as %s exists but got %q", keyB, got)
+	}
+	if _, ok := a.db.GetEntity(0, keyA2); ok {
+		t.Errorf("except %s not set", keyA2)
+	}
+	if got := string(a.Exec(conn, cmdutil.ToCmdLine("MSETNX", keyA2, "1", keyB2, "1")).ToBytes()); got != ":1\r\n" {
+		t.Errorf("except :1 but got %q", got)
+	}
+	if _, ok := b.db.GetEntity(0, keyB2); !ok {
+		t.Errorf("except %s set", keyB2)
+	}
+}
+
+func TestCluster_recoverTx(t *testing.T) {
+	self := "127.0.0.1:7001"
+	path := filepath.Join(t.TempDir(), "tx.log")
+	err := writeTxLog(path, []txRecord{
+		{ID: "1", Role: roleParticipant, State: txPrepared, Coordinator: self, CmdLines: []cm.CmdLine{cmdutil.ToCmdLine("SET", "committed", "1")}},
+		{ID: "1", Role: roleCoordinator, State: txCommit, Nodes: []string{self}},
+		{ID: "2", Role: roleParticipant, State: txPrepared, Coordinator: self, CmdLines: []cm.CmdLine{cmdutil.ToCmdLine("SET", "aborted", "1")}},
+		{ID: "3", Role: roleCoordinator, State: txDone},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Properties = &config.ServerProperties{
+		Self:             self,
+		Databases:        16,
+		ClusterTxLog:     path,
+		ClusterTxTimeout: 20,
+	}
+	c := MakeCluster()
+	defer c.gossip.stop()
+	defer c.coordinator.stop()
+	defer c.txlog.close()
+	done := make(chan struct{})
+	go func() {
+		// blocks until the transaction in doubt released its lock
+		c.Exec(clientc.NewFakeConnection(), cmdutil.ToCmdLine("SET", "aborted", "2"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("except transaction without decision rolled back")
+	}
+	if got := string(c.Exec(clientc.NewFakeConnection(), cmdutil.ToCmdLine("GET", "committed")).ToBytes()); got != "$1\r\n1\r\n" {
+		t.Errorf("except decided transaction committed but got %q", got)
+	}
+	if got := string(c.Exec(clientc.NewFakeConnection(), cmdutil.ToCmdLine("GET", "aborted")).ToBytes()); got != "$1\r\n2\r\n" {
+		t.Errorf("unexpected value %q", got)
+	}
+	data, _ := os.ReadFile(path)
+	if len(data) == 0 {
+		t.Errorf("except log written")
+	}
+}
+
+func TestCluster_recoverCommittingTx(t *testing.T) {
+	self := "127.0.0.1:7001"
+	path := filepath.Join(t.TempDir(), "tx.log")
+	// the node stopped while running the commands, they may be in the aof already
+	err := writeTxLog(path, []txRecord{
+		{ID: "1", Role: roleParticipant, State: txPrepared, Coordinator: self, CmdLines: []cm.CmdLine{cmdutil.ToCmdLine("INCR", "counter")}},
+		{ID: "1", Role: roleCoordinator, State: txCommit, Nodes: []string{self}},
+		{ID: "1", Role: roleParticipant, State: txCommitting},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Properties = &config.ServerProperties{
+		Self:             self,
+		Databases:        16,
+		ClusterTxLog:     path,
+		ClusterTxTimeout: 20,
+	}
+	c := MakeCluster()
+	defer c.gossip.stop()
+	defer c.coordinator.stop()
+	defer c.txlog.close()
+	// the decision is forgotten once every participant acknowledged it
+	waitFor(t, "decision sent again", func() bool {
+		return c.coordinator.status("1") == txAbort
+	})
+	if got := string(c.Exec(clientc.NewFakeConnection(), cmdutil.ToCmdLine("GET", "counter")).ToBytes()); got != "$-1\r\n" {
+		t.Errorf("except the commands not run again but got %q", got)
+	}
+	answered := false
+	for _, record := range readTxLog(path) {
+		answered = answered || record.Role == roleParticipant && record.State == txInDoubt
+	}
+	if !answered {
+		t.Errorf("except the commit answered in doubt")
+	}
+	if pending := pendingRecords(readTxLog(path)); len(pending) != 0 {
+		t.Errorf("except nothing left in doubt in the log but got %v", pending)
+	}
+}
@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	cm "mygodis/common"
+	logger "mygodis/log"
+	"os"
+	"sync"
+)
+
+const (
+	roleCoordinator = "coordinator"
+	roleParticipant = "participant"
+)
+
+// txRecord is one line of the transaction log
+type txRecord struct {
+	ID    string `json:"id"`
+	Role  string `json:"role"`
+	State string `json:"state"`
+	// Nodes are the participants, written with the decision of a coordinator
+	Nodes []string `json:"nodes,omitempty"`
+	// Coordinator, DB and CmdLines are written when a participant prepares
+	Coordinator string       `json:"coordinator,omitempty"`
+	DB          int          `json:"db,omitempty"`
+	CmdLines    []cm.CmdLine `json:"cmdLines,omitempty"`
+}
+
+// txLog appends the states of cross node transactions to a file, the ones not finished are in doubt after a restart
+type txLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openTxLog opens the log at path, the log only lives in memory if path is empty
+func openTxLog(path string) (*txLog, []txRecord) {
+	l := &txLog{}
+	if path == "" {
+		return l, nil
+	}
+	records := readTxLog(path)
+	pending := pendingRecords(records)
+	// compact the log so it only holds the transactions still in doubt
+	tmp := path + ".tmp"
+	if err := writeTxLog(tmp, pending); err != nil {
+		logger.Error("compact tx log", err)
+	} else if err := os.Rename(tmp, path); err != nil {
+		logger.Error("compact tx log", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Error("open tx log", err)
+		return l, pending
+	}
+	l.file = file
+	return l, pending
+}
+func readTxLog(path string) []txRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	records := make([]txRecord, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 1<<16), 1<<30)
+	for scanner.Scan() {
+		var record txRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// the last line may be torn by a crash
+			logger.Warn("skip broken tx log line", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
+func writeTxLog(path string, records []txRecord) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+// pendingRecords folds the log into the latest record of every unfinished transaction, a participant keeps its
+// prepared record because it holds the commands to execute
+func pendingRecords(records []txRecord) []txRecord {
+	type key struct{ id, role string }
+	latest := make(map[key]txRecord)
+	order := make([]key, 0)
+	for _, record := range records {
+		k := key{record.ID, record.Role}
+		prev, ok := latest[k]
+		if !ok {
+			order = append(order, k)
+		}
+		if ok && record.Role == roleCoordinator && len(record.Nodes) == 0 {
+			record.Nodes = prev.Nodes
+		}
+		latest[k] = record
+	}
+	pending := make([]txRecord, 0)
+	for _, k := range order {
+		record := latest[k]
+		switch {
+		case record.Role == roleCoordinator && record.State == txDone:
+		case record.Role == roleParticipant &&
+			(record.State == txRolledBack || record.State == txCommitted || record.State == txInDoubt):
+		default:
+			pending = append(pending, record)
+		}
+	}
+	return pending
+}
+
+// append writes record, decisions are synced to disk before they are sent to anyone
+func (l *txLog) append(record txRecord) {
+	if l == nil || l.file == nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		logger.Error("marshal tx record", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		logger.Error("write tx log", err)
+		return
+	}
+	if err := l.file.Sync(); err != nil {
+		logger.Error("sync tx log", err)
+	}
+}
+func (l *txLog) close() {
+	if l == nil || l.file == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_ = l.file.Close()
+	l.file = nil
+}
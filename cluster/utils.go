@@ -7,31 +7,53 @@ import (
 	cm "mygodis/common"
 	cmi "mygodis/common/commoninterface"
 	"mygodis/config"
+	"mygodis/lib/slot"
 	"mygodis/resp"
 	"mygodis/util/cmdutil"
 	"mygodis/util/com"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 const Fanout = 1 << 2
 
+// broadcast sends args to every other node in parallel
 func (c *Cluster) broadcast(args cm.CmdLine) (result map[string]resp.Reply, errs []error) {
-	result = make(map[string]resp.Reply)
-	nodes := c.nodes.Keys()
-	for _, node := range nodes {
-		if node == c.self {
-			continue
-		}
-		client := c.nodeConnectionPool.GetConnection(node)
-		reply, _ := client.Send(args)
-		if resp.IsErrorReply(reply) {
-			errs = append(errs, errors.New("broadcast error"+string(reply.ToBytes())))
+	nodes := make([]string, 0)
+	for _, node := range c.nodes.Keys() {
+		if node != c.self {
+			nodes = append(nodes, node)
 		}
-		result[node] = reply
+	}
+	fanned := c.fanout(nodes, args, c.fanoutTimeout())
+	result = fanned.replies
+	for node, err := range fanned.errs {
+		errs = append(errs, errors.New("broadcast error "+node+": "+err.Error()))
+		result[node] = resp.MakeErrReply(err.Error())
 	}
 	return result, errs
 }
+
+// relay sends cmdLine to node and gives the connection back to the pool
+func (c *Cluster) relay(node string, cmdLine cm.CmdLine) (resp.Reply, error) {
+	client, err := c.nodeConnectionPool.Borrow(node)
+	if err != nil {
+		peerRPCErrors.With(node).Inc()
+		return nil, err
+	}
+	start := time.Now()
+	reply, err := client.Send(cmdLine)
+	peerRPCDuration.With(node).Since(start)
+	if err != nil {
+		peerRPCErrors.With(node).Inc()
+		c.nodeConnectionPool.Discard(node, client)
+		return nil, err
+	}
+	c.nodeConnectionPool.ReturnConnection(node, client)
+	return reply, nil
+}
 func (c *Cluster) isAllOk(spreadResult map[string]resp.Reply) bool {
 	for _, reply := range spreadResult {
 		isErrorReply := resp.IsErrorReply(reply)
@@ -55,8 +77,7 @@ func (c *Cluster) isMoreThanHalfOk(spreadResult map[string]resp.Reply) bool {
 func (c *Cluster) toClusterCommand(newTTL int, args ...string) cm.CmdLine {
 	cmd := make(cm.CmdLine, 0)
 	cmd = append(cmd, []byte("CLUSTER"))
-	c.epoch++
-	epoch := c.epoch
+	epoch := atomic.AddInt64(&c.epoch, 1)
 	cmd = append(cmd, []byte(fmt.Sprintf("%d", epoch)))
 	cmd = append(cmd, []byte(c.self))
 	cmd = append(cmd, []byte(strconv.Itoa(newTTL)))
@@ -125,24 +146,32 @@ func (c *Cluster) spread(args cm.CmdLine) map[string]resp.Reply {
 	nodes := c.nodes.Keys()
 	pickedNodes := pickNodes(nodes, 0.5, Fanout, c.self)
 	for _, node := range pickedNodes {
-		client := c.nodeConnectionPool.GetConnection(node)
-		reply, _ := client.Send(args)
+		reply, err := c.relay(node, args)
+		if err != nil {
+			reply = resp.MakeErrReply(err.Error())
+		}
 		result[node] = reply
 	}
 	return result
 }
-func (c *Cluster) addNewNode(node string) []byte {
+func (c *Cluster) addNewNode(node string, weight int) []byte {
+	atomic.AddInt64(&c.epoch, 1)
 	c.nodes.Put(node, struct{}{})
 	c.nodeConnectionPool.AddConnection(node)
-	c.ch.AddNode(node)
-	serialize, err := c.ch.Serialize()
+	c.updateRing(func(ch *ConsistentHash) { ch.AddWeightedNode(node, weight) })
+	c.topologyChanged()
+	c.rebalanceAfterJoin(node)
+	serialize, err := c.ring().Serialize()
 	if err != nil {
 		panic(err)
 	}
 	return serialize
 }
 func (c *Cluster) execCluster(connection cmi.Connection, args cm.CmdLine) (reply resp.Reply) {
-	clusterCommand := string(args[0])
+	if len(args) == 0 {
+		return resp.MakeArgNumErrReply("cluster")
+	}
+	clusterCommand := strings.ToUpper(string(args[0]))
 	switch clusterCommand {
 	case "MEET":
 		reply = c.execMeet(args[1:])
@@ -154,30 +183,81 @@ func (c *Cluster) execCluster(connection cmi.Connection, args cm.CmdLine) (reply
 		reply = c.execCFlushDB()
 	case "NODES":
 		reply = c.execNodes()
+	case "SLOTS":
+		reply = c.execSlots()
+	case "SHARDS":
+		reply = c.execShards()
+	case "KEYSLOT":
+		reply = c.execKeySlot(args[1:])
+	case "COUNTKEYSINSLOT":
+		reply = c.execCountKeysInSlot(args[1:])
+	case "GETKEYSINSLOT":
+		reply = c.execGetKeysInSlot(args[1:])
+	case "MYID":
+		reply = c.execMyID()
+	case "SETSLOT":
+		reply = c.execSetSlot(args[1:])
+	case "DISTRIBUTION":
+		reply = c.execDistribution()
+	case "GOSSIP":
+		reply = c.execGossip(args[1:])
+	case "FAIL":
+		reply = c.execFail(args[1:])
+	case "FORGET":
+		reply = c.execForget(args[1:])
+	case "RESET":
+		reply = c.execReset(args[1:])
+	case "REBALANCE":
+		reply = c.execRebalance(args[1:])
+	case "TX":
+		reply = c.execTxCommand(args[1:])
+	case "DUMPKEYS":
+		reply = c.execDumpKeys(args[1:])
+	case "LOCALEXEC":
+		reply = c.execLocalExec(args[1:])
+	case "INFO":
+		reply = c.execClusterInfo()
+	case "LEAVE":
+		reply = c.execLeave()
+	case "DELNODE":
+		reply = c.execDelNode(args[1:])
+	case "TOPOLOGY":
+		reply = c.execTopology()
+	case "REPLICATE":
+		reply = c.execReplicate(args[1:])
+	case "KEYVERSION":
+		reply = c.execKeyVersion(args[1:])
+	case "HINT":
+		reply = c.execHint(args[1:])
+	case "RAFT":
+		reply = c.execRaft(args[1:])
+	case "METAPROPOSE":
+		reply = c.execMetaPropose(args[1:])
+	case "ORPHANS":
+		reply = c.execOrphans(args[1:])
+	case "FIXORPHANS":
+		reply = c.execFixOrphans()
 		//case "CNODES":
 		//	reply = c.execCNodes()
+	default:
+		reply = resp.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'")
 	}
 	//c.dumpCluster()
 	return
 }
-func (c *Cluster) execNodes() resp.Reply {
-	nodes := c.nodes.Keys()
-	//results, errs := c.broadcast(cmdutil.ToCmdLineWithName("CLUSTER", "CNODES"))
-	//if errs != nil || len(errs) != 0 {
-	//	return resp.MakeErrReply("cluster error")
-	//}
-	//resultNodes := make([][]string, len(nodes))
-	//for _, reply := range results {
-	//	itemNodes, ok := reply.(*resp.MultiBulkReply)
-	//	if ok {
-	//		resultNodes = append(resultNodes, com.BytesToString(itemNodes.Args))
-	//	}
-	//}
-	//resultNodes = append(resultNodes, nodes)
-	//if com.AreSlicesEqual(resultNodes...) {
-	return resp.MakeMultiBulkReply(com.StringsToBytes(nodes))
-	//}
-	//return resp.MakeErrReply("cluster error")
+
+// topologyChanged is called after the members of the ring changed, the new topology is persisted
+func (c *Cluster) topologyChanged() {
+	c.slots.assignWeighted(c.ring().Weights)
+	c.saveTopology()
+}
+
+// ownerOf returns the node serving key
+func (c *Cluster) ownerOf(key string) string {
+	if c.proxy {
+		return c.ring().GetNode([]byte(key))
+	}
+	return c.slots.owner(slot.Of([]byte(key)))
 }
 func (c *Cluster) execCNodes() resp.Reply {
 	nodes := c.nodes.Keys()
@@ -187,9 +267,10 @@ func (c *Cluster) execCNodes() resp.Reply {
 }
 func (c *Cluster) execMeet(args cm.CmdLine) resp.Reply {
 	targetNode := string(args[0])
-	connectionPool := c.nodeConnectionPool
-	client := connectionPool.GetConnection(targetNode)
-	chbytes, _ := client.Send(cmdutil.ToCmdLineWithName("CLUSTER", "JOIN", c.self))
+	chbytes, err := c.relay(targetNode, cmdutil.ToCmdLineWithName("CLUSTER", "JOIN", c.self, strconv.Itoa(c.ring().Weight(c.self))))
+	if err != nil {
+		return resp.MakeErrReply(err.Error())
+	}
 	bulkReply, ok := chbytes.(*resp.SimpleStringReply)
 	if ok {
 		arg := bulkReply.SimpleString
@@ -199,22 +280,63 @@ func (c *Cluster) execMeet(args cm.CmdLine) resp.Reply {
 		}
 		clusterNodes := ch.GetNodes()
 		c.nodeConnectionPool.AddConnection(clusterNodes...)
-		c.ch = ch
-		c.nodes.Put(targetNode, struct{}{})
+		c.setRing(ch)
+		for _, node := range clusterNodes {
+			if node != c.self {
+				c.nodes.Put(node, struct{}{})
+			}
+		}
+		c.topologyChanged()
+		c.rebalance()
 		return resp.MakeOkReply()
 	}
 	return resp.MakeErrReply("meet failed")
 }
+
+// parseWeight reads the optional weight following the node address of JOIN and ADDNODE
+func parseWeight(args cm.CmdLine) int {
+	if len(args) < 2 {
+		return 1
+	}
+	weight, err := strconv.Atoi(string(args[1]))
+	if err != nil || weight <= 0 {
+		return 1
+	}
+	return weight
+}
 func (c *Cluster) execAddNode(args cm.CmdLine) resp.Reply {
+	if len(args) == 0 {
+		return resp.MakeArgNumErrReply("cluster|addnode")
+	}
 	targetNode := string(args[0])
+	if c.gossip.isBanned(targetNode) {
+		return resp.MakeErrReply("ERR node " + targetNode + " was forgotten recently")
+	}
+	if len(args) > 2 {
+		if epoch, err := strconv.ParseInt(string(args[2]), 10, 64); err == nil {
+			c.adoptEpoch(epoch)
+		}
+	}
 	c.nodes.Put(targetNode, struct{}{})
-	c.ch.AddNode(targetNode)
+	c.updateRing(func(ch *ConsistentHash) { ch.AddWeightedNode(targetNode, parseWeight(args)) })
+	c.topologyChanged()
+	c.rebalanceAfterJoin(targetNode)
 	return resp.MakeOkReply()
 }
 func (c *Cluster) execJoin(connection cmi.Connection, line cm.CmdLine) resp.Reply {
+	if len(line) == 0 {
+		return resp.MakeArgNumErrReply("cluster|join")
+	}
 	newNode := string(line[0])
-	chbytes := c.addNewNode(newNode)
-	broadcastResult, errs := c.broadcast(cmdutil.ToCmdLineWithName("CLUSTER", "ADDNODE", newNode))
+	if c.gossip.isBanned(newNode) {
+		return resp.MakeErrReply("ERR node " + newNode + " was forgotten recently")
+	}
+	weight := parseWeight(line)
+	if c.raft != nil {
+		return c.joinMeta(newNode, weight)
+	}
+	chbytes := c.addNewNode(newNode, weight)
+	broadcastResult, errs := c.broadcast(cmdutil.ToCmdLineWithName("CLUSTER", "ADDNODE", newNode, strconv.Itoa(weight), strconv.FormatInt(atomic.LoadInt64(&c.epoch), 10)))
 	if len(errs) == 0 && c.isAllOk(broadcastResult) {
 		return resp.MakeSimpleStringReply(string(chbytes))
 	}
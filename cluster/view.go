@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"math"
+	"mygodis/db"
+	"mygodis/lib/pool"
+	"mygodis/lib/slot"
+	"sync/atomic"
+)
+
+// View is the topology of the cluster seen by this node, shown by the dashboard
+type View struct {
+	Self     string     `json:"self"`
+	Epoch    int64      `json:"epoch"`
+	Mode     string     `json:"mode"`
+	Hash     string     `json:"hash"`
+	Replicas int        `json:"replicas"`
+	Nodes    []NodeView `json:"nodes"`
+	// Ring holds the virtual nodes in ring order
+	Ring []RingPoint `json:"ring"`
+}
+
+// NodeView is a member of the ring or a known node, Keys and UsedMemory are what it answered to INFO
+type NodeView struct {
+	Addr   string  `json:"addr"`
+	ID     string  `json:"id"`
+	Self   bool    `json:"self"`
+	Member bool    `json:"member"`
+	Weight int     `json:"weight"`
+	Share  float64 `json:"share"`
+	Slots  int     `json:"slots"`
+	// State is online, pfail or fail, LastPong is 0 for this node
+	State      string      `json:"state"`
+	LinkUp     bool        `json:"linkUp"`
+	LastPong   int64       `json:"lastPong"`
+	Keys       int64       `json:"keys"`
+	UsedMemory int64       `json:"usedMemory"`
+	Error      string      `json:"error,omitempty"`
+	Pool       *pool.Stats `json:"pool,omitempty"`
+}
+
+// RingPoint is a virtual node, Angle is its position on the ring between 0 and 1
+type RingPoint struct {
+	Node  string  `json:"node"`
+	Angle float64 `json:"angle"`
+}
+
+// View gathers the topology and asks every node for its INFO, nodes which do not answer carry their error
+func (c *Cluster) View() *View {
+	ch := c.ring()
+	mode := "slots"
+	if c.proxy {
+		mode = "proxy"
+	}
+	view := &View{
+		Self:     c.self,
+		Epoch:    atomic.LoadInt64(&c.epoch),
+		Mode:     mode,
+		Hash:     ch.Hash,
+		Replicas: ch.Replicas,
+		Ring:     make([]RingPoint, 0, len(ch.Nodes)),
+	}
+	for _, position := range ch.Nodes {
+		view.Ring = append(view.Ring, RingPoint{Node: ch.ChMap[position], Angle: float64(position) / math.Exp2(64)})
+	}
+	slots := make(map[string]int)
+	for s := 0; s < slot.Count; s++ {
+		slots[c.slots.owner(s)]++
+	}
+	shares := ch.Distribution()
+	infos := c.gatherInfo()
+	// taken after INFO, which opened the pools of the nodes not asked before
+	poolStats := c.nodeConnectionPool.Stats()
+	for _, info := range infos {
+		node := NodeView{
+			Addr:       info.node,
+			ID:         nodeID(info.node),
+			Self:       info.node == c.self,
+			Weight:     ch.Weight(info.node),
+			Share:      shares[info.node],
+			Slots:      slots[info.node],
+			Keys:       info.keys,
+			UsedMemory: info.usedMemory,
+			State:      stateOnline,
+			LinkUp:     true,
+		}
+		node.Member = node.Weight > 0
+		if info.err != nil {
+			node.Error = info.err.Error()
+		}
+		if !node.Self {
+			health := c.gossip.snapshot(info.node)
+			node.State, node.LinkUp, node.LastPong = health.state, health.linkUp, health.pongRecv.UnixMilli()
+		}
+		if stats, ok := poolStats[info.node]; ok {
+			node.Pool = &stats
+		}
+		view.Nodes = append(view.Nodes, node)
+	}
+	return view
+}
+
+// LocalDB returns the server holding the keys of this node
+func (c *Cluster) LocalDB() *db.StandaloneServer {
+	return c.db
+}
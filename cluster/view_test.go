@@ -0,0 +1,54 @@
+package cluster
+
+import (
+	"math"
+	"mygodis/clientc"
+	"mygodis/util/cmdutil"
+	"net"
+	"testing"
+)
+
+func TestCluster_View(t *testing.T) {
+	listenerA, _ := net.Listen("tcp", "127.0.0.1:0")
+	listenerB, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listenerA.Close()
+	defer listenerB.Close()
+	addrA, addrB := listenerA.Addr().String(), listenerB.Addr().String()
+	a := makeTestCluster(addrA, addrB)
+	defer a.gossip.stop()
+	b := makeTestCluster(addrB, addrA)
+	defer b.gossip.stop()
+	go serveCluster(listenerA, a)
+	go serveCluster(listenerB, b)
+	// the node not serving the slot of a key answers MOVED
+	for _, key := range []string{"a", "b", "c", "d"} {
+		a.Exec(clientc.NewFakeConnection(), cmdutil.ToCmdLine("SET", key, "v"))
+		b.Exec(clientc.NewFakeConnection(), cmdutil.ToCmdLine("SET", key, "v"))
+	}
+
+	view := a.View()
+	if view.Self != addrA || len(view.Nodes) != 2 || len(view.Ring) != 2*defaultReplicas {
+		t.Fatalf("unexpected view %+v", view)
+	}
+	keys, share, slots := int64(0), 0.0, 0
+	for i, point := range view.Ring {
+		if point.Angle < 0 || point.Angle >= 1 || i > 0 && point.Angle < view.Ring[i-1].Angle {
+			t.Fatalf("except the ring in order but got %v", view.Ring[i-1:i+1])
+		}
+	}
+	for _, node := range view.Nodes {
+		if node.Error != "" || !node.Member || node.State != stateOnline || node.ID != nodeID(node.Addr) {
+			t.Errorf("unexpected node %+v", node)
+		}
+		if node.Self != (node.Addr == addrA) {
+			t.Errorf("except only %s to be self but got %+v", addrA, node)
+		}
+		if !node.Self && node.Pool == nil {
+			t.Errorf("except the pool of %s", node.Addr)
+		}
+		keys, share, slots = keys+node.Keys, share+node.Share, slots+node.Slots
+	}
+	if keys != 4 || math.Abs(share-1) > 1e-9 || slots != 16384 {
+		t.Errorf("except 4 keys, the whole ring and every slot but got %d %f %d", keys, share, slots)
+	}
+}
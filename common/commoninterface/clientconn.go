@@ -19,7 +19,7 @@ type Connection interface {
 	GetQueuedCmdLine() []cm.CmdLine
 	EnqueueCmd([][]byte)
 	ClearQueuedCmds()
-	GetWatching() map[string]uint32
+	GetWatching() map[string]uint64
 	AddTxError(err error)
 	GetTxErrors() []error
 
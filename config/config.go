@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"io"
 	logger "mygodis/log"
+	"net"
 	"os"
 	"reflect"
 	"strconv"
@@ -28,10 +29,59 @@ type ServerProperties struct {
 	ClusterEnable     bool     `cfg:"cluster-enable"`
 	ClusterAsSeed     bool     `cfg:"cluster-as-seed"`
 	ClusterSeed       string   `cfg:"cluster-seed"`
+	ClusterProxy      bool     `cfg:"cluster-proxy"`
 	Peers             []string `cfg:"peers"`
 	Self              string   `cfg:"self"`
 	DataCenterId      int64    `cfg:"datacenter-id"`
 	WorkerId          int64    `cfg:"worker-id"`
+
+	// ClusterVirtualNodes is the number of ring positions per unit of weight
+	ClusterVirtualNodes int    `cfg:"cluster-virtual-nodes"`
+	ClusterWeight       int    `cfg:"cluster-weight"`
+	ClusterHashFunc     string `cfg:"cluster-hash-func"`
+	// ClusterNodeTimeout is the milliseconds a node may be unreachable before it is suspected to fail
+	ClusterNodeTimeout int `cfg:"cluster-node-timeout"`
+	// ClusterTxTimeout is the milliseconds a prepared cross node transaction holds its locks before asking its coordinator
+	ClusterTxTimeout int `cfg:"cluster-tx-timeout"`
+	// ClusterTxLog is the file recording cross node transactions so they can be recovered after restart
+	ClusterTxLog string `cfg:"cluster-tx-log"`
+	// ClusterFanoutTimeout is the milliseconds every node has to answer a command sent to the whole cluster
+	ClusterFanoutTimeout int `cfg:"cluster-fanout-timeout"`
+	// ClusterPartialResults lets KEYS, DBSIZE and FLUSHDB answer with the nodes which replied when some failed
+	ClusterPartialResults bool `cfg:"cluster-partial-results"`
+	// ClusterConfigFile is the file keeping the ring, the epoch and the members of the cluster across restarts
+	ClusterConfigFile string `cfg:"cluster-config-file"`
+	// ReplicationFactor is the number of ring successors every key is written to, 1 keeps a single copy
+	ReplicationFactor int `cfg:"replication-factor"`
+	// WriteQuorum and ReadQuorum are the replicas a write or a read waits for, a majority of them if not set
+	WriteQuorum int `cfg:"write-quorum"`
+	ReadQuorum  int `cfg:"read-quorum"`
+	// ClusterRaft keeps the ring, the failed nodes and the pinned slots in a raft log instead of gossiping them
+	ClusterRaft bool `cfg:"cluster-raft"`
+	// ClusterRaftFile is the file keeping the raft log across restarts, it is kept in memory if not set
+	ClusterRaftFile string `cfg:"cluster-raft-file"`
+
+	// DashboardEnabled serves the http dashboard on DashboardBind:DashboardPort, 127.0.0.1:10088 if they are not set
+	DashboardEnabled bool   `cfg:"dashboard-enabled"`
+	DashboardBind    string `cfg:"dashboard-bind"`
+	DashboardPort    int    `cfg:"dashboard-port"`
+	// DashboardAuth is token, basic or none, token if not set. The token is DashboardToken or requirepass if it is
+	// not set, basic checks DashboardUser and DashboardPassword
+	DashboardAuth     string `cfg:"dashboard-auth"`
+	DashboardToken    string `cfg:"dashboard-token"`
+	DashboardUser     string `cfg:"dashboard-user"`
+	DashboardPassword string `cfg:"dashboard-password"`
+
+	// HashMaxListpackEntries and HashMaxListpackValue are the most fields of a hash kept in a listpack and its
+	// longest field or value, 128 and 64 if not set. A negative value keeps every hash in a hash table.
+	HashMaxListpackEntries int `cfg:"hash-max-listpack-entries"`
+	HashMaxListpackValue   int `cfg:"hash-max-listpack-value"`
+	// SetMaxIntsetEntries is the most members of a set of integers kept in an intset, 512 if not set
+	SetMaxIntsetEntries    int `cfg:"set-max-intset-entries"`
+	SetMaxListpackEntries  int `cfg:"set-max-listpack-entries"`
+	SetMaxListpackValue    int `cfg:"set-max-listpack-value"`
+	ZSetMaxListpackEntries int `cfg:"zset-max-listpack-entries"`
+	ZSetMaxListpackValue   int `cfg:"zset-max-listpack-value"`
 }
 
 var Properties *ServerProperties
@@ -118,3 +168,15 @@ func SetupConfig(configFilename string) {
 func (p *ServerProperties) AnnounceAddress() string {
 	return p.AnnounceHost + ":" + strconv.Itoa(p.Port)
 }
+
+// DashboardAddress returns the address the dashboard listens on
+func (p *ServerProperties) DashboardAddress() string {
+	bind, port := p.DashboardBind, p.DashboardPort
+	if bind == "" {
+		bind = "127.0.0.1"
+	}
+	if port == 0 {
+		port = 10088
+	}
+	return net.JoinHostPort(bind, strconv.Itoa(port))
+}
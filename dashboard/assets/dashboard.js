@@ -0,0 +1,305 @@
+new Vue({
+    el: "#app",
+    delimiters: ["[[", "]]"],
+    data: {
+        chart: null,
+        chartOptions: {
+            tooltip: {
+                trigger: "axis",
+            },
+            legend: {
+                data: ["CPU 使用率", "内存 使用率"],
+            },
+            xAxis: {
+                type: "category",
+                data: [],
+            },
+            yAxis: {
+                type: "value",
+                axisLabel: {
+                    formatter: "{value} %",
+                },
+            },
+            series: [
+                {
+                    name: "CPU 使用率",
+                    type: "line",
+                    data: [],
+                },
+                {
+                    name: "内存 使用率",
+                    type: "line",
+                    data: [],
+                },
+            ],
+        },
+        socket: null,
+        token: "",
+        filter: {
+            cmd: "",
+            key: "",
+            db: "",
+        },
+        feed: [],
+        live: {
+            connected: false,
+            ops: 0,
+            p99: 0,
+            clients: 0,
+        },
+        liveCharts: {},
+        cluster: null,
+        ringChart: null,
+        meetNode: "",
+        cpuInfo: {
+            modelName: "",
+            cores: 0,
+            mhz: 0,
+            vendorID: "",
+        },
+        memoryInfo: {
+            active: 0,
+            buffers: 0,
+            cached: 0,
+            free: 0,
+            inactive: 0,
+            total: 0,
+            used: 0,
+            used_percent: 0,
+        },
+    },
+    mounted() {
+        this.chart = echarts.init(this.$refs.chart);
+        this.chart.setOption(this.chartOptions);
+        this.startPolling();
+        this.fetchStaticInfo();
+        this.initLiveCharts();
+        this.connect();
+        this.ringChart = echarts.init(this.$refs.ringChart);
+        setInterval(this.fetchCluster, 5000);
+    },
+    methods: {
+        initLiveCharts() {
+            const lineChart = (ref, title, unit, names) => {
+                const chart = echarts.init(this.$refs[ref]);
+                chart.setOption({
+                    title: {text: title, left: "center"},
+                    tooltip: {trigger: "axis"},
+                    legend: {data: names, top: 25},
+                    grid: {top: 60},
+                    xAxis: {type: "time"},
+                    yAxis: {type: "value", axisLabel: {formatter: "{value} " + unit}},
+                    series: names.map(name => ({name: name, type: "line", showSymbol: false, data: []})),
+                });
+                return {chart: chart, series: names.map(() => [])};
+            };
+            this.liveCharts = {
+                ops: lineChart("opsChart", "吞吐", "次/秒", ["命令", "错误"]),
+                latency: lineChart("latencyChart", "延迟", "微秒", ["P50", "P90", "P99"]),
+                memory: lineChart("memoryChart", "内存", "MB", ["堆", "系统"]),
+            };
+        },
+        // 每个图保留最近 5 分钟的点
+        pushPoints(name, time, values) {
+            const c = this.liveCharts[name];
+            values.forEach((value, i) => {
+                c.series[i].push([time, value]);
+                if (c.series[i].length > 300) {
+                    c.series[i].shift();
+                }
+            });
+            c.chart.setOption({series: c.series.map(data => ({data: data}))});
+        },
+        connect() {
+            if (this.socket) {
+                this.socket.onclose = null;
+                this.socket.close();
+            }
+            const params = new URLSearchParams();
+            if (this.token) {
+                params.set("token", this.token);
+            }
+            const scheme = location.protocol === "https:" ? "wss://" : "ws://";
+            const socket = new WebSocket(scheme + location.host + "/live?" + params.toString());
+            socket.onopen = () => {
+                this.live.connected = true;
+                this.sendFilter();
+            };
+            socket.onmessage = event => this.onSample(JSON.parse(event.data));
+            socket.onclose = () => {
+                this.live.connected = false;
+                // 断开后重连
+                setTimeout(this.connect, 2000);
+            };
+            this.socket = socket;
+        },
+        // 请求带上令牌，basic 认证时浏览器自动携带账号
+        api(path, options = {}) {
+            if (this.token) {
+                options.headers = Object.assign({Authorization: "Bearer " + this.token}, options.headers);
+            }
+            return fetch(path, options);
+        },
+        onToken() {
+            this.connect();
+            this.fetchStaticInfo();
+            this.fetchCluster();
+        },
+        // 集群接口只在集群模式下存在
+        fetchCluster() {
+            this.api("/api/cluster")
+                .then(response => response.ok ? response.json() : null)
+                .then(view => {
+                    this.cluster = view;
+                    if (view) {
+                        this.$nextTick(() => this.renderRing(view));
+                    }
+                })
+                .catch(error => {
+                    console.error('Error fetching cluster:', error);
+                });
+        },
+        // 虚拟节点按其在环上的位置画在圆周上，同一节点同一颜色
+        renderRing(view) {
+            const byNode = {};
+            view.ring.forEach(point => {
+                (byNode[point.node] = byNode[point.node] || []).push([1, point.angle * 360]);
+            });
+            this.ringChart.resize();
+            this.ringChart.setOption({
+                tooltip: {formatter: params => params.seriesName},
+                legend: {data: Object.keys(byNode), top: 0},
+                polar: {radius: "70%"},
+                angleAxis: {type: "value", min: 0, max: 360, axisLabel: {show: false}},
+                radiusAxis: {min: 0, max: 1, show: false},
+                series: Object.keys(byNode).map(node => ({
+                    name: node,
+                    type: "scatter",
+                    coordinateSystem: "polar",
+                    symbolSize: 6,
+                    data: byNode[node],
+                })),
+            }, true);
+        },
+        nodeTagType(node) {
+            if (node.error || node.state === "fail") {
+                return "danger";
+            }
+            return node.state === "pfail" ? "warning" : "success";
+        },
+        clusterCommand(command, node) {
+            if (!node) {
+                return;
+            }
+            this.api("/api/cluster/" + command, {
+                method: "POST",
+                headers: {"Content-Type": "application/json"},
+                body: JSON.stringify({node: node}),
+            })
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        this.$message.error(data.error);
+                    } else {
+                        this.$message.success(command.toUpperCase() + " " + node);
+                    }
+                    this.fetchCluster();
+                });
+        },
+        sendFilter() {
+            if (!this.socket || this.socket.readyState !== WebSocket.OPEN) {
+                return;
+            }
+            const db = parseInt(this.filter.db, 10);
+            this.socket.send(JSON.stringify({
+                cmd: this.filter.cmd,
+                key: this.filter.key,
+                db: isNaN(db) ? null : db,
+            }));
+        },
+        onSample(sample) {
+            this.live.ops = sample.ops;
+            this.live.p99 = sample.p99;
+            this.live.clients = sample.clients;
+            this.pushPoints("ops", sample.time, [sample.ops, sample.errors]);
+            this.pushPoints("latency", sample.time, [sample.p50, sample.p90, sample.p99]);
+            this.pushPoints("memory", sample.time, [sample.heapAlloc / 1048576, sample.sys / 1048576]);
+            if (sample.feed) {
+                // 新命令在上，最多保留 500 条
+                this.feed = sample.feed.reverse().concat(this.feed).slice(0, 500);
+            }
+        },
+        formatTime(row) {
+            return new Date(row.time).toLocaleTimeString();
+        },
+        feedRowClass({row}) {
+            return row.error ? "feed-error" : "";
+        },
+        fetchData() {
+            this.api('/api/cpu-memory')
+                .then(response => response.json())
+                .then(data => {
+                    // 将获取到的数据添加到图表中
+                    this.chartOptions.xAxis.data.push(data.timestamp);
+                    this.chartOptions.series[0].data.push(data.cpuPercent);
+                    this.chartOptions.series[1].data.push(data.memPercent);
+
+                    this.chart.setOption(this.chartOptions);
+                })
+                .catch(error => {
+                    console.error('Error fetching data:', error);
+                });
+            this.api('/mem')
+                .then(response => response.json())
+                .then(data => {
+                    // 将获取到的数据存储到 memoryInfo 属性中
+                    this.memoryInfo.active = data.active;
+                    this.memoryInfo.buffers = data.buffers;
+                    this.memoryInfo.cached = data.cached;
+                    this.memoryInfo.free = data.free;
+                    this.memoryInfo.inactive = data.inactive;
+                    this.memoryInfo.total = data.total;
+                    this.memoryInfo.used = data.used;
+                    this.memoryInfo.used_percent = data.used_percent;
+                })
+                .catch(error => {
+                    console.error('Error fetching memory info:', error);
+                });
+        },
+        startPolling() {
+            setInterval(() => {
+                this.fetchData();
+            }, 2000); // 每隔 5 秒钟获取新数据
+        },
+        fetchStaticInfo() {
+            this.api('/cpu')
+                .then(response => response.json())
+                .then(data => {
+                    // 将获取到的数据存储到 cpuInfo 属性中
+                    this.cpuInfo.modelName = data.cpu0_modelName;
+                    this.cpuInfo.cores = data.cpu0_cores;
+                    this.cpuInfo.mhz = data.cpu0_mhz;
+                    this.cpuInfo.vendorID = data.cpu0_vendorID;
+                })
+                .catch(error => {
+                    console.error('Error fetching static info:', error);
+                });
+            this.api('/mem')
+                .then(response => response.json())
+                .then(data => {
+                    // 将获取到的数据存储到 memoryInfo 属性中
+                    this.memoryInfo.active = data.active;
+                    this.memoryInfo.buffers = data.buffers;
+                    this.memoryInfo.cached = data.cached;
+                    this.memoryInfo.free = data.free;
+                    this.memoryInfo.inactive = data.inactive;
+                    this.memoryInfo.total = data.total;
+                    this.memoryInfo.used = data.used;
+                    this.memoryInfo.used_percent = data.used_percent;
+                })
+                .catch(error => {
+                    console.error('Error fetching memory info:', error);
+                });
+        },
+    },
+});
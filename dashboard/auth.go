@@ -0,0 +1,88 @@
+package dashboard
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	logger "mygodis/log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	authToken = "token"
+	authBasic = "basic"
+	authNone  = "none"
+)
+
+// authMode returns dashboard-auth, token if it is not set or unknown
+func (d *Dashboard) authMode() string {
+	switch mode := strings.ToLower(d.props.DashboardAuth); mode {
+	case authBasic, authNone:
+		return mode
+	}
+	return authToken
+}
+
+// token returns the bearer token of the dashboard, requirepass if dashboard-token is not set
+func (d *Dashboard) token() string {
+	if d.props.DashboardToken != "" {
+		return d.props.DashboardToken
+	}
+	return d.props.RequirePass
+}
+
+// authenticate lets a request in if it carries the credentials of the dashboard. In token mode the page and its
+// assets are public so the browser can load them and ask for the token, which is taken from the token query
+// parameter too since browsers can not set headers on websockets.
+func (d *Dashboard) authenticate(ctx *gin.Context) {
+	switch d.authMode() {
+	case authNone:
+	case authBasic:
+		if d.props.DashboardUser == "" || d.props.DashboardPassword == "" {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "set dashboard-user and dashboard-password"})
+			return
+		}
+		user, password, ok := ctx.Request.BasicAuth()
+		if !ok || !equal(user, d.props.DashboardUser) || !equal(password, d.props.DashboardPassword) {
+			ctx.Header("WWW-Authenticate", `Basic realm="mygodis"`)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid user or password"})
+			return
+		}
+	default:
+		path := ctx.Request.URL.Path
+		if path == "/" || strings.HasPrefix(path, "/assets/") {
+			break
+		}
+		if d.token() == "" {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "set dashboard-token or requirepass"})
+			return
+		}
+		token := ctx.Query("token")
+		if header := ctx.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			token = strings.TrimPrefix(header, "Bearer ")
+		}
+		if !equal(token, d.token()) {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			return
+		}
+		if d.props.DashboardToken == "" {
+			// the token is requirepass, so the client has authenticated to the db too
+			ctx.Set(requirePassKey, true)
+		}
+	}
+	ctx.Next()
+}
+
+func equal(given, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// accessLog logs every request once it is served, the query is left out since it may carry the token
+func accessLog(ctx *gin.Context) {
+	start := time.Now()
+	ctx.Next()
+	logger.Info(fmt.Sprintf("dashboard %s %s %s %d %s", ctx.ClientIP(), ctx.Request.Method, ctx.Request.URL.Path,
+		ctx.Writer.Status(), time.Since(start)))
+}
@@ -0,0 +1,45 @@
+package dashboard
+
+import (
+	"github.com/gin-gonic/gin"
+	"mygodis/cluster"
+	cm "mygodis/common"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"net/http"
+)
+
+// ClusterNode is the cluster shown by a dashboard started in cluster mode
+type ClusterNode interface {
+	View() *cluster.View
+	Exec(connection cmi.Connection, args cm.CmdLine) resp.Reply
+}
+
+// WithCluster adds the topology of node and the controls to MEET and FORGET nodes
+func (d *Dashboard) WithCluster(node ClusterNode) *Dashboard {
+	d.cluster = node
+	api := d.engine.Group("/api/cluster")
+	api.GET("", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, d.cluster.View())
+	})
+	api.POST("/meet", func(ctx *gin.Context) {
+		d.clusterCommand(ctx, "MEET")
+	})
+	api.POST("/forget", func(ctx *gin.Context) {
+		d.clusterCommand(ctx, "FORGET")
+	})
+	return d
+}
+
+// clusterCommand runs CLUSTER sub with the node of the json body, an address or a node id
+func (d *Dashboard) clusterCommand(ctx *gin.Context, sub string) {
+	var req struct {
+		Node string `json:"node"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.Node == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "node is required"})
+		return
+	}
+	d.reply(ctx, d.cluster.Exec(d.connection(0), cmdutil.ToCmdLine("CLUSTER", sub, req.Node)))
+}
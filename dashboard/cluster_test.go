@@ -0,0 +1,54 @@
+package dashboard
+
+import (
+	"bytes"
+	"mygodis/cluster"
+	cm "mygodis/common"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/resp"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fakeNode answers every command with reply and records the last one
+type fakeNode struct {
+	view  *cluster.View
+	reply resp.Reply
+	last  string
+}
+
+func (n *fakeNode) View() *cluster.View {
+	return n.view
+}
+func (n *fakeNode) Exec(connection cmi.Connection, args cm.CmdLine) resp.Reply {
+	n.last = string(bytes.Join(args, []byte(" ")))
+	return n.reply
+}
+
+func TestDashboard_cluster(t *testing.T) {
+	d, _ := newKeyBrowser(t, "secret")
+	node := &fakeNode{
+		view:  &cluster.View{Self: "a:1", Nodes: []cluster.NodeView{{Addr: "a:1", Self: true, Keys: 3}}},
+		reply: resp.MakeOkReply(),
+	}
+	d.WithCluster(node)
+	var view cluster.View
+	if code := call(t, d, http.MethodGet, "/api/cluster", "", &view); code != http.StatusOK || view.Self != "a:1" || view.Nodes[0].Keys != 3 {
+		t.Errorf("unexpected view %d %+v", code, view)
+	}
+	var reply map[string]any
+	if code := call(t, d, http.MethodPost, "/api/cluster/meet", `{"node":"b:1"}`, &reply); code != http.StatusOK || reply["reply"] != "OK" {
+		t.Errorf("unexpected meet reply %d %v", code, reply)
+	}
+	if node.last != "CLUSTER MEET b:1" {
+		t.Errorf("except CLUSTER MEET b:1 but got %s", node.last)
+	}
+	node.reply = resp.MakeErrReply("ERR Unknown node c:1")
+	if code := call(t, d, http.MethodPost, "/api/cluster/forget", `{"node":"c:1"}`, &reply); code != http.StatusBadRequest || !strings.Contains(reply["error"].(string), "Unknown node") {
+		t.Errorf("unexpected forget reply %d %v", code, reply)
+	}
+	if code := call(t, d, http.MethodPost, "/api/cluster/forget", `{}`, nil); code != http.StatusBadRequest {
+		t.Errorf("except %d without a node but got %d", http.StatusBadRequest, code)
+	}
+}
@@ -1,50 +1,126 @@
 package dashboard
 
 import (
+	"context"
+	"embed"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/mem"
+	"html/template"
+	"io/fs"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/config"
+	"mygodis/lib/metrics"
+	logger "mygodis/log"
+	"net"
 	"net/http"
 	"time"
 )
 
+// shutdownTimeout is how long Close waits for the requests being served
+const shutdownTimeout = 5 * time.Second
+
+// assets are the page and the scripts of the dashboard, they are built into the binary
+//
+//go:embed assets
+var assets embed.FS
+
 type Dashboard struct {
 	enabled bool
 	addr    string
 	engine  *gin.Engine
+	server  *http.Server
+	// db is browsed by the key api, props tell its dbs and the password of the api
+	db    cmi.StandaloneDBEngine
+	props *config.ServerProperties
+	// live streams the samples of db, nil if db can not be monitored
+	live *live
+	// cluster is the node db belongs to in cluster mode
+	cluster ClusterNode
 }
 
-var DefaultDashboard *Dashboard = &Dashboard{
-	enabled: true,
-	addr:    "0.0.0.0:10088",
-	engine:  gin.Default(),
+// MakeDashboard builds the routes of a dashboard of db served on addr, requests are authenticated as props says
+func MakeDashboard(addr string, db cmi.StandaloneDBEngine, props *config.ServerProperties) *Dashboard {
+	gin.SetMode(gin.ReleaseMode)
+	d := &Dashboard{
+		enabled: true,
+		addr:    addr,
+		engine:  gin.New(),
+		db:      db,
+		props:   props,
+	}
+	d.server = &http.Server{Addr: addr, Handler: d.engine, ReadHeaderTimeout: 10 * time.Second}
+	if source, ok := db.(commandMonitor); ok {
+		d.live = newLive(source)
+	}
+	// ClientIP is the peer of the connection, headers set by the client are not trusted
+	_ = d.engine.SetTrustedProxies(nil)
+	d.engine.Use(gin.Recovery(), accessLog, d.authenticate)
+	d.engine.SetHTMLTemplate(template.Must(template.ParseFS(assets, "assets/dashboard.html")))
+	static, _ := fs.Sub(assets, "assets")
+	d.engine.StaticFS("/assets", http.FS(static))
+	d.routes()
+	d.keyRoutes()
+	d.gatewayRoutes()
+	return d
 }
 
-func (d *Dashboard) Start() {
-	err := d.engine.Run(d.addr)
+// Start listens on the address of the dashboard and serves until Close
+func (d *Dashboard) Start() error {
+	listener, err := net.Listen("tcp", d.addr)
 	if err != nil {
-		return
+		return err
 	}
+	logger.Info("dashboard listen on " + listener.Addr().String() + " with " + d.authMode() + " auth")
+	return d.Serve(listener)
 }
-func addGetHandler(path string, h func(ctx *gin.Context)) {
-	DefaultDashboard.engine.GET(path, h)
+
+// Serve serves on listener until Close, it returns nil once closed
+func (d *Dashboard) Serve(listener net.Listener) error {
+	err := d.server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
-func init() {
-	DefaultDashboard.engine.LoadHTMLFiles("dashboard.html")
-	addGetHandler("/cpu", func(ctx *gin.Context) {
+// Close stops the dashboard, the live streams end at once and the other requests have shutdownTimeout to finish
+func (d *Dashboard) Close() error {
+	if d.live != nil {
+		d.live.close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return d.server.Shutdown(ctx)
+}
+func (d *Dashboard) addGetHandler(path string, h func(ctx *gin.Context)) {
+	d.engine.GET(path, h)
+}
+
+func (d *Dashboard) routes() {
+	d.addGetHandler("/cpu", func(ctx *gin.Context) {
 		ctx.JSON(http.StatusOK, cpuInfo())
 	})
-	addGetHandler("/mem", func(ctx *gin.Context) {
+	d.addGetHandler("/mem", func(ctx *gin.Context) {
 		ctx.JSON(http.StatusOK, memoryInfo())
 	})
-	addGetHandler("/", func(ctx *gin.Context) {
+	// the metrics of the server in the prometheus text format
+	d.addGetHandler("/metrics", func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		ctx.Status(http.StatusOK)
+		if err := metrics.Default.WriteText(ctx.Writer); err != nil {
+			logger.Error("write metrics error: " + err.Error())
+		}
+	})
+	d.addGetHandler("/live", d.liveStream)
+	d.addGetHandler("/", func(ctx *gin.Context) {
 		ctx.HTML(http.StatusOK, "dashboard.html", gin.H{
 			"title": "dashboard",
 		})
 	})
-	addGetHandler("/api/cpu-memory", func(ctx *gin.Context) {
+	d.addGetHandler("/api/cpu-memory", func(ctx *gin.Context) {
 		cpuPercent, err := cpu.Percent(time.Second, false)
 		if err != nil {
 			ctx.JSON(500, gin.H{"error": fmt.Sprintf("Error getting CPU usage: %v", err)})
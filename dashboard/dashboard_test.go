@@ -0,0 +1,115 @@
+package dashboard
+
+import (
+	"github.com/gorilla/websocket"
+	"mygodis/config"
+	"mygodis/lib/metrics"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboard_metrics(t *testing.T) {
+	counter := metrics.NewCounterVec("dashboard_test_total", "Counted by the test")
+	counter.With().Inc()
+	metrics.Default.Register(counter)
+	defer metrics.Default.Unregister(counter)
+
+	d := MakeDashboard("127.0.0.1:0", nil, &config.ServerProperties{DashboardToken: "scrape"})
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape")
+	d.engine.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK || !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected response %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Body.String(), "dashboard_test_total 1\n") {
+		t.Errorf("except the counter in\n%s", recorder.Body.String())
+	}
+}
+
+// get requests target of d and returns the status, user and password are sent by basic auth if user is not empty
+func get(d *Dashboard, target, user, password string) int {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	recorder := httptest.NewRecorder()
+	d.engine.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+func TestDashboard_auth(t *testing.T) {
+	// token mode, the page and its assets are public and the token may come in the query
+	d := MakeDashboard("127.0.0.1:0", nil, &config.ServerProperties{RequirePass: "secret"})
+	for target, code := range map[string]int{
+		"/": http.StatusOK, "/assets/dashboard.js": http.StatusOK, "/metrics": http.StatusUnauthorized,
+		"/metrics?token=wrong": http.StatusUnauthorized, "/metrics?token=secret": http.StatusOK,
+	} {
+		if got := get(d, target, "", ""); got != code {
+			t.Errorf("token %s: except %d but got %d", target, code, got)
+		}
+	}
+	d = MakeDashboard("127.0.0.1:0", nil, &config.ServerProperties{RequirePass: "secret", DashboardToken: "other"})
+	if got := get(d, "/metrics?token=secret", "", ""); got != http.StatusUnauthorized {
+		t.Errorf("except dashboard-token to replace requirepass but got %d", got)
+	}
+
+	props := &config.ServerProperties{DashboardAuth: "basic", DashboardUser: "admin"}
+	d = MakeDashboard("127.0.0.1:0", nil, props)
+	if got := get(d, "/", "admin", ""); got != http.StatusForbidden {
+		t.Errorf("except %d without dashboard-password but got %d", http.StatusForbidden, got)
+	}
+	props.DashboardPassword = "pass"
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	d.engine.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnauthorized || !strings.HasPrefix(recorder.Header().Get("WWW-Authenticate"), "Basic") {
+		t.Errorf("except a basic challenge but got %d %v", recorder.Code, recorder.Header())
+	}
+	if get(d, "/metrics", "admin", "wrong") != http.StatusUnauthorized || get(d, "/metrics", "admin", "pass") != http.StatusOK {
+		t.Error("except only the password of admin to pass")
+	}
+
+	d = MakeDashboard("127.0.0.1:0", nil, &config.ServerProperties{DashboardAuth: "none"})
+	if got := get(d, "/metrics", "", ""); got != http.StatusOK {
+		t.Errorf("except no auth but got %d", got)
+	}
+}
+
+func TestDashboard_Close(t *testing.T) {
+	d, _ := newKeyBrowser(t, "secret")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- d.Serve(listener)
+	}()
+	addr := listener.Addr().String()
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/live?token=secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for err == nil {
+		_, _, err = conn.ReadMessage()
+	}
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("except the stream to be closed but got %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("except Serve to return nil but got %v", err)
+	}
+	if _, err := http.Get("http://" + addr + "/"); err == nil {
+		t.Error("except no more requests served")
+	}
+}
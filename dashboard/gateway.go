@@ -0,0 +1,269 @@
+package dashboard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"mygodis/clientc"
+	cm "mygodis/common"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/parse"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxGatewayCommands is the most commands a request may carry
+	maxGatewayCommands = 1000
+	// maxGatewayBody is the most bytes of a request body
+	maxGatewayBody = 8 << 20
+	// requirePassKey is set on the requests whose token is requirepass, their commands need no AUTH
+	requirePassKey = "requirepass"
+)
+
+var (
+	errEmptyCommand    = errors.New("empty command")
+	errInvalidBody     = errors.New("the body is neither the args of a command nor a batch of commands")
+	errInvalidArg      = errors.New("an arg is neither a string, a number nor a boolean")
+	errTooManyCommands = errors.New("more than " + strconv.Itoa(maxGatewayCommands) + " commands")
+)
+
+// gatewayConnection is the client of the commands of a request, its db and password live as long as the request
+type gatewayConnection struct {
+	*clientc.FakeConnection
+	remote string
+}
+
+func (c *gatewayConnection) Name() string {
+	return "http " + c.remote
+}
+
+// gatewayError is an error reply, Code is its first word like ERR, WRONGTYPE or MOVED
+type gatewayError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// gatewayRequest is the object form of a request, auth and db are run as AUTH and SELECT before the commands
+type gatewayRequest struct {
+	Auth     *string           `json:"auth"`
+	DB       *int              `json:"db"`
+	Commands []json.RawMessage `json:"commands"`
+}
+
+// gatewayRoutes serves POST /cmd, which runs the commands of clients not speaking RESP
+func (d *Dashboard) gatewayRoutes() {
+	d.engine.POST("/cmd", d.gateway)
+}
+
+// gateway runs the commands of the body one by one on a connection of its own. The body is the args of a command
+// like ["SET","k","v"], answered by {"result":...}, or a batch like [["SET","k","v"],["GET","k"]] or
+// {"auth":"pw","db":1,"commands":[...]}, answered by {"results":[...]} in order. A failed command answers
+// {"error":{"code","message"}} in place of its result, a single one with a bad request.
+func (d *Dashboard) gateway(ctx *gin.Context) {
+	if d.db == nil && d.cluster == nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": gatewayError{Code: "ERR", Message: "no db to run commands"}})
+		return
+	}
+	body, err := readBody(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": gatewayError{Code: "ERR", Message: err.Error()}})
+		return
+	}
+	lines, batch, req, err := parseGatewayBody(body)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": gatewayError{Code: "ERR", Message: err.Error()}})
+		return
+	}
+	connection := &gatewayConnection{FakeConnection: clientc.NewFakeConnection(), remote: ctx.ClientIP()}
+	if ctx.GetBool(requirePassKey) {
+		connection.SetPassword(d.props.RequirePass)
+	}
+	if req.Auth != nil {
+		if reply := d.gatewayExec(connection, cmdutil.ToCmdLine("AUTH", *req.Auth)); isErrorReply(reply) {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": replyToJSON(reply)})
+			return
+		}
+	}
+	if req.DB != nil {
+		if reply := d.gatewayExec(connection, cmdutil.ToCmdLine("SELECT", strconv.Itoa(*req.DB))); isErrorReply(reply) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": replyToJSON(reply)})
+			return
+		}
+	}
+	if !batch {
+		reply := d.gatewayExec(connection, lines[0])
+		if isErrorReply(reply) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": replyToJSON(reply)})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"result": replyToJSON(reply)})
+		return
+	}
+	results := make([]any, 0, len(lines))
+	for _, line := range lines {
+		if reply := d.gatewayExec(connection, line); isErrorReply(reply) {
+			results = append(results, gin.H{"error": replyToJSON(reply)})
+		} else {
+			results = append(results, replyToJSON(reply))
+		}
+	}
+	ctx.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// gatewayExec runs line on the cluster in cluster mode and on the db otherwise. The engine leaves authentication
+// to the client handler, so it is done here: only AUTH runs before the connection is authenticated.
+func (d *Dashboard) gatewayExec(connection cmi.Connection, line cm.CmdLine) resp.Reply {
+	name := strings.ToUpper(string(line[0]))
+	switch name {
+	case "SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE", "MONITOR":
+		return resp.MakeErrReply("ERR '" + strings.ToLower(name) + "' is not allowed over http")
+	}
+	if name != "AUTH" && d.props.RequirePass != "" && connection.GetPassword() != d.props.RequirePass {
+		return resp.MakeErrReply("NOAUTH Authentication required.")
+	}
+	if d.cluster != nil {
+		return d.cluster.Exec(connection, line)
+	}
+	return d.db.Exec(connection, line)
+}
+
+// readBody reads the body of the request, at most maxGatewayBody bytes
+func readBody(ctx *gin.Context) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxGatewayBody)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parseGatewayBody returns the commands of body and whether it is a batch
+func parseGatewayBody(body []byte) ([]cm.CmdLine, bool, *gatewayRequest, error) {
+	req := &gatewayRequest{}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, false, nil, errEmptyCommand
+	}
+	var items []json.RawMessage
+	switch body[0] {
+	case '{':
+		if err := json.Unmarshal(body, req); err != nil {
+			return nil, false, nil, err
+		}
+		items = req.Commands
+	case '[':
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, false, nil, err
+		}
+		// a command is an array of args, a batch an array of commands
+		if len(items) == 0 || len(items[0]) == 0 || items[0][0] != '[' {
+			line, err := parseArgs(body)
+			if err != nil {
+				return nil, false, nil, err
+			}
+			return []cm.CmdLine{line}, false, req, nil
+		}
+	default:
+		return nil, false, nil, errInvalidBody
+	}
+	if len(items) == 0 {
+		return nil, false, nil, errEmptyCommand
+	}
+	if len(items) > maxGatewayCommands {
+		return nil, false, nil, errTooManyCommands
+	}
+	lines := make([]cm.CmdLine, 0, len(items))
+	for _, item := range items {
+		line, err := parseArgs(item)
+		if err != nil {
+			return nil, false, nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, true, req, nil
+}
+
+// parseArgs reads the args of a command, numbers and booleans are taken as they are written
+func parseArgs(raw json.RawMessage) (cm.CmdLine, error) {
+	var args []json.RawMessage
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, errInvalidBody
+	}
+	if len(args) == 0 {
+		return nil, errEmptyCommand
+	}
+	line := make(cm.CmdLine, 0, len(args))
+	for _, arg := range args {
+		arg = bytes.TrimSpace(arg)
+		switch {
+		case len(arg) > 0 && arg[0] == '"':
+			var s string
+			if err := json.Unmarshal(arg, &s); err != nil {
+				return nil, err
+			}
+			line = append(line, []byte(s))
+		case len(arg) > 0 && (arg[0] == '-' || arg[0] >= '0' && arg[0] <= '9'), string(arg) == "true", string(arg) == "false":
+			line = append(line, arg)
+		default:
+			return nil, errInvalidArg
+		}
+	}
+	return line, nil
+}
+
+// replyToJSON converts reply to a value encoding/json writes: bulk and simple strings become strings, integers
+// numbers, arrays arrays, nulls null and errors a gatewayError. Replies of other types are read back from their
+// RESP bytes.
+func replyToJSON(reply resp.Reply) any {
+	switch reply := reply.(type) {
+	case nil, *resp.NullBulkReply, *resp.NoReply:
+		return nil
+	case resp.ErrorReply:
+		message := strings.TrimSpace(reply.Error())
+		code := message
+		if i := strings.IndexByte(message, ' '); i > 0 {
+			code = message[:i]
+		}
+		code = strings.ToUpper(code)
+		return gatewayError{Code: code, Message: message}
+	case *resp.IntReply:
+		return reply.Code
+	case *resp.SimpleStringReply:
+		return reply.SimpleString
+	case *resp.BulkReply:
+		if reply.Arg == nil {
+			return nil
+		}
+		return string(reply.Arg)
+	case *resp.MultiBulkReply:
+		values := make([]any, len(reply.Args))
+		for i, arg := range reply.Args {
+			if arg != nil {
+				values[i] = string(arg)
+			}
+		}
+		return values
+	case *resp.MultiRawReply:
+		values := make([]any, len(reply.Replies()))
+		for i, element := range reply.Replies() {
+			values[i] = replyToJSON(element)
+		}
+		return values
+	case *resp.EmptyMultiBulkReply:
+		return []any{}
+	}
+	parsed, err := parse.ParseBytes(reply.ToBytes())
+	if err != nil || len(parsed) == 0 {
+		return nil
+	}
+	return replyToJSON(parsed[0])
+}
+
+func isErrorReply(reply resp.Reply) bool {
+	_, ok := reply.(resp.ErrorReply)
+	return ok
+}
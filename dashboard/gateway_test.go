@@ -0,0 +1,97 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"mygodis/config"
+	"mygodis/db"
+	"mygodis/resp"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// post sends body to /cmd with the bearer token, none if token is empty
+func post(t *testing.T, d *Dashboard, token, body string) (int, map[string]any) {
+	req := httptest.NewRequest(http.MethodPost, "/cmd", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	d.engine.ServeHTTP(recorder, req)
+	var out map[string]any
+	if err := json.Unmarshal(recorder.Body.Bytes(), &out); err != nil {
+		t.Fatalf("%s: %v %s", body, err, recorder.Body.String())
+	}
+	return recorder.Code, out
+}
+
+func TestDashboard_gateway(t *testing.T) {
+	d, _ := newKeyBrowser(t, "secret")
+	if code, out := post(t, d, "secret", `["SET","k","v"]`); code != http.StatusOK || out["result"] != "OK" {
+		t.Errorf("unexpected set %d %v", code, out)
+	}
+	code, out := post(t, d, "secret", `[["GET","k"],["GET","none"],["RPUSH","l","a",2],["LRANGE","l",0,-1],["HGET","k","f"],["SELECT",1],["GET","k"]]`)
+	except := []any{"v", nil, 2.0, []any{"a", "2"}, map[string]any{"error": map[string]any{"code": "WRONGTYPE", "message": "WRONGTYPE Operation against a key holding the wrong kind of value"}}, "OK", nil}
+	if code != http.StatusOK || !reflect.DeepEqual(out["results"], except) {
+		t.Errorf("unexpected batch %d %v", code, out)
+	}
+	if code, out := post(t, d, "secret", `{"db":1,"commands":[["SET","k","one"],["GET","k"]]}`); code != http.StatusOK || !reflect.DeepEqual(out["results"], []any{"OK", "one"}) {
+		t.Errorf("unexpected batch on db 1 %d %v", code, out)
+	}
+	if code, out := post(t, d, "secret", `["HGET","k","f"]`); code != http.StatusBadRequest || out["error"].(map[string]any)["code"] != "WRONGTYPE" {
+		t.Errorf("unexpected error %d %v", code, out)
+	}
+	for _, body := range []string{``, `[]`, `[[]]`, `{"commands":[]}`, `[{"a":1}]`, `"GET"`, `[1,`} {
+		if code, _ := post(t, d, "secret", body); code != http.StatusBadRequest {
+			t.Errorf("except %d for %s but got %d", http.StatusBadRequest, body, code)
+		}
+	}
+	if code, out := post(t, d, "secret", `["SUBSCRIBE","c"]`); code != http.StatusBadRequest {
+		t.Errorf("except subscribe refused but got %d %v", code, out)
+	}
+}
+
+func TestDashboard_gatewayAuth(t *testing.T) {
+	// the dashboard token is not requirepass, so the commands need AUTH
+	props := &config.ServerProperties{Databases: 2, RequirePass: "pw", DashboardToken: "gate"}
+	server := db.NewStandaloneServer(props)
+	t.Cleanup(server.Close)
+	d := MakeDashboard("127.0.0.1:0", server, props)
+	if code, _ := post(t, d, "", `["PING"]`); code != http.StatusUnauthorized {
+		t.Errorf("except %d without a token but got %d", http.StatusUnauthorized, code)
+	}
+	if code, out := post(t, d, "gate", `["PING"]`); code != http.StatusBadRequest || out["error"].(map[string]any)["code"] != "NOAUTH" {
+		t.Errorf("except NOAUTH but got %d %v", code, out)
+	}
+	if code, _ := post(t, d, "gate", `{"auth":"wrong","commands":[["PING"]]}`); code != http.StatusUnauthorized {
+		t.Errorf("except %d for a wrong password but got %d", http.StatusUnauthorized, code)
+	}
+	if code, out := post(t, d, "gate", `{"auth":"pw","commands":[["PING"]]}`); code != http.StatusOK || !reflect.DeepEqual(out["results"], []any{"PONG"}) {
+		t.Errorf("unexpected reply %d %v", code, out)
+	}
+	if code, out := post(t, d, "gate", `[["AUTH","pw"],["SET","k","v"],["GET","k"]]`); code != http.StatusOK || !reflect.DeepEqual(out["results"], []any{"OK", "OK", "v"}) {
+		t.Errorf("unexpected reply %d %v", code, out)
+	}
+}
+
+func Test_replyToJSON(t *testing.T) {
+	for _, c := range []struct {
+		reply  resp.Reply
+		except any
+	}{
+		{resp.MakeNullBulkReply(), nil},
+		{resp.MakeEmptyMultiBulkReply(), []any{}},
+		{resp.MakeQueuedReply(), "QUEUED"},
+		{resp.MakeIntReply(-3), int64(-3)},
+		{resp.MakeMultiBulkReply([][]byte{[]byte("a"), nil}), []any{"a", nil}},
+		{resp.MakeMultiRawReply(resp.MakeIntReply(1), resp.MakeMultiBulkReply([][]byte{[]byte("b")})), []any{int64(1), []any{"b"}}},
+		{resp.MakeSyntaxErrReply(), gatewayError{Code: "ERR", Message: "Err syntax error"}},
+		{resp.MakeErrReply("MOVED 12 127.0.0.1:6380"), gatewayError{Code: "MOVED", Message: "MOVED 12 127.0.0.1:6380"}},
+	} {
+		if got := replyToJSON(c.reply); !reflect.DeepEqual(got, c.except) {
+			t.Errorf("except %#v but got %#v", c.except, got)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package dashboard
+
+import (
+	"github.com/gin-gonic/gin"
+	"mygodis/clientc"
+	cm "mygodis/common"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/datadriver/dict"
+	"mygodis/datadriver/list"
+	"mygodis/datadriver/set"
+	"mygodis/datadriver/sortedset"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"mygodis/util/match"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize   = 100
+	maxPageSize       = 1000
+	defaultStringPage = 4096
+	maxStringPage     = 1 << 20
+)
+
+// keyRoutes serves the key browser, reads go through the engine and writes through the commands, so the aof is kept
+func (d *Dashboard) keyRoutes() {
+	api := d.engine.Group("/api")
+	api.GET("/keys", d.scanKeys)
+	api.GET("/key", d.getKey)
+	api.PUT("/key", d.editKey)
+	api.DELETE("/key", d.deleteKey)
+	api.POST("/key/expire", d.expireKey)
+}
+
+// dbIndex reads the db query parameter, db 0 by default
+func (d *Dashboard) dbIndex(ctx *gin.Context) (int, bool) {
+	index, err := strconv.Atoi(ctx.DefaultQuery("db", "0"))
+	if err != nil || index < 0 || index >= d.props.Databases {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid db"})
+		return 0, false
+	}
+	return index, true
+}
+
+// intQuery reads a non negative query parameter, def if it is absent
+func intQuery(ctx *gin.Context, name string, def int) (int, bool) {
+	value, ok := ctx.GetQuery(name)
+	if !ok {
+		return def, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+		return 0, false
+	}
+	return n, true
+}
+
+// scanKeys returns a page of the keys matching pattern sorted by name, cursor is the offset of the next page and 0
+// after the last one
+func (d *Dashboard) scanKeys(ctx *gin.Context) {
+	index, ok := d.dbIndex(ctx)
+	if !ok {
+		return
+	}
+	cursor, ok := intQuery(ctx, "cursor", 0)
+	if !ok {
+		return
+	}
+	count, ok := intQuery(ctx, "count", defaultPageSize)
+	if !ok {
+		return
+	}
+	if count == 0 || count > maxPageSize {
+		count = maxPageSize
+	}
+	pattern := ctx.DefaultQuery("pattern", "*")
+	keys := make([]string, 0)
+	d.db.ForEach(index, func(key string, _ *cmi.DataEntity, _ time.Time) bool {
+		if match.MatchPattern(pattern, key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	sort.Strings(keys)
+	total := len(keys)
+	next := 0
+	if cursor >= total {
+		keys = keys[:0]
+	} else if cursor+count < total {
+		keys, next = keys[cursor:cursor+count], cursor+count
+	} else {
+		keys = keys[cursor:]
+	}
+	ctx.JSON(http.StatusOK, gin.H{"keys": keys, "cursor": next, "total": total})
+}
+
+// keyView describes a key and a page of its value
+type keyView struct {
+	Key  string `json:"key"`
+	DB   int    `json:"db"`
+	Type string `json:"type"`
+	// TTL is in milliseconds, -1 if the key does not expire
+	TTL int64 `json:"ttl"`
+	// Size is the bytes of a string and the elements of the other types
+	Size   int `json:"size"`
+	Offset int `json:"offset"`
+	Value  any `json:"value"`
+}
+type fieldValue struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+type memberScore struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+func (d *Dashboard) getKey(ctx *gin.Context) {
+	index, ok := d.dbIndex(ctx)
+	if !ok {
+		return
+	}
+	offset, ok := intQuery(ctx, "offset", 0)
+	if !ok {
+		return
+	}
+	limit, ok := intQuery(ctx, "limit", 0)
+	if !ok {
+		return
+	}
+	key := ctx.Query("key")
+	keys := []string{key}
+	d.db.RWLocks(index, nil, keys)
+	defer d.db.RWUnLocks(index, nil, keys)
+	entity, exists := d.db.GetEntity(index, key)
+	if !exists {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "no such key"})
+		return
+	}
+	view := &keyView{Key: key, DB: index, TTL: -1, Offset: offset}
+	if expiration := d.db.GetExpiration(index, key); !expiration.IsZero() {
+		view.TTL = expiration.Sub(d.now()).Milliseconds()
+	}
+	switch data := entity.Data.(type) {
+	case []byte:
+		view.Type, view.Size = "string", len(data)
+		start, stop := page(offset, limit, len(data), defaultStringPage, maxStringPage)
+		view.Value = string(data[start:stop])
+	case list.List:
+		view.Type, view.Size = "list", data.Len()
+		start, stop := page(offset, limit, data.Len(), defaultPageSize, maxPageSize)
+		values := make([]string, 0, stop-start)
+		for _, v := range data.Range(start, stop) {
+			values = append(values, toString(v))
+		}
+		view.Value = values
+	case dict.Dict:
+		view.Type, view.Size = "hash", data.Len()
+		fields := data.Keys()
+		sort.Strings(fields)
+		start, stop := page(offset, limit, len(fields), defaultPageSize, maxPageSize)
+		values := make([]fieldValue, 0, stop-start)
+		for _, field := range fields[start:stop] {
+			v, _ := data.Get(field)
+			values = append(values, fieldValue{Field: field, Value: toString(v)})
+		}
+		view.Value = values
+	case *set.Set:
+		view.Type, view.Size = "set", data.Len()
+		members := data.ToSlice()
+		sort.Strings(members)
+		start, stop := page(offset, limit, len(members), defaultPageSize, maxPageSize)
+		view.Value = members[start:stop]
+	case *sortedset.ZSet:
+		view.Type, view.Size = "zset", int(data.Len())
+		start, stop := page(offset, limit, int(data.Len()), defaultPageSize, maxPageSize)
+		values := make([]memberScore, 0, stop-start)
+		if start < stop {
+			for _, element := range data.Range(int64(start), int64(stop), false) {
+				values = append(values, memberScore{Member: element.Member, Score: element.Score})
+			}
+		}
+		view.Value = values
+	default:
+		view.Type = "unknown"
+	}
+	ctx.JSON(http.StatusOK, view)
+}
+
+// now reads the clock of the server, which may be virtual in tests
+func (d *Dashboard) now() time.Time {
+	if clock, ok := d.db.(interface{ Now() time.Time }); ok {
+		return clock.Now()
+	}
+	return time.Now()
+}
+
+// page bounds the elements [offset, offset+limit) by size, limit 0 takes def and limit is at most max
+func page(offset, limit, size, def, max int) (int, int) {
+	if limit == 0 {
+		limit = def
+	}
+	if limit > max {
+		limit = max
+	}
+	if offset > size {
+		offset = size
+	}
+	if offset+limit > size {
+		return offset, size
+	}
+	return offset, offset + limit
+}
+func toString(v any) string {
+	switch value := v.(type) {
+	case []byte:
+		return string(value)
+	case string:
+		return value
+	}
+	return ""
+}
+
+// editRequest changes one element of a key, the fields used depend on Type
+type editRequest struct {
+	// Type is string, hash, list, set or zset, a new key gets this type
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	Field  string `json:"field"`
+	Member string `json:"member"`
+	// Index sets an element of a list, the value is appended if it is absent
+	Index *int     `json:"index"`
+	Score *float64 `json:"score"`
+}
+
+// editKey writes a string, a hash field, a list element or a set or zset member by the command doing it
+func (d *Dashboard) editKey(ctx *gin.Context) {
+	index, ok := d.dbIndex(ctx)
+	if !ok {
+		return
+	}
+	var req editRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	key := ctx.Query("key")
+	var line cm.CmdLine
+	switch req.Type {
+	case "string":
+		line = cmdutil.ToCmdLine("SET", key, req.Value)
+	case "hash":
+		line = cmdutil.ToCmdLine("HSET", key, req.Field, req.Value)
+	case "list":
+		if req.Index != nil {
+			line = cmdutil.ToCmdLine("LSET", key, strconv.Itoa(*req.Index), req.Value)
+		} else {
+			line = cmdutil.ToCmdLine("RPUSH", key, req.Value)
+		}
+	case "set":
+		line = cmdutil.ToCmdLine("SADD", key, req.Member)
+	case "zset":
+		if req.Score == nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "score is required"})
+			return
+		}
+		line = cmdutil.ToCmdLine("ZADD", key, strconv.FormatFloat(*req.Score, 'f', -1, 64), req.Member)
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "unknown type " + req.Type})
+		return
+	}
+	d.exec(ctx, index, line)
+}
+
+// deleteKey deletes the key, or only the field of a hash or the member of a set or zset if one is given
+func (d *Dashboard) deleteKey(ctx *gin.Context) {
+	index, ok := d.dbIndex(ctx)
+	if !ok {
+		return
+	}
+	key := ctx.Query("key")
+	if field, ok := ctx.GetQuery("field"); ok {
+		d.exec(ctx, index, cmdutil.ToCmdLine("HDEL", key, field))
+		return
+	}
+	if member, ok := ctx.GetQuery("member"); ok {
+		entity, exists := d.db.GetEntity(index, key)
+		if exists {
+			if _, isZSet := entity.Data.(*sortedset.ZSet); isZSet {
+				d.exec(ctx, index, cmdutil.ToCmdLine("ZREM", key, member))
+				return
+			}
+		}
+		d.exec(ctx, index, cmdutil.ToCmdLine("SREM", key, member))
+		return
+	}
+	d.exec(ctx, index, cmdutil.ToCmdLine("DEL", key))
+}
+
+// expireKey sets the ttl of a key in milliseconds, a negative ttl removes it
+func (d *Dashboard) expireKey(ctx *gin.Context) {
+	index, ok := d.dbIndex(ctx)
+	if !ok {
+		return
+	}
+	var req struct {
+		TTL *int64 `json:"ttl"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.TTL == nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "ttl is required"})
+		return
+	}
+	key := ctx.Query("key")
+	if *req.TTL < 0 {
+		d.exec(ctx, index, cmdutil.ToCmdLine("PERSIST", key))
+		return
+	}
+	d.exec(ctx, index, cmdutil.ToCmdLine("PEXPIRE", key, strconv.FormatInt(*req.TTL, 10)))
+}
+
+// exec runs line on db index like a client would and answers with its reply
+func (d *Dashboard) exec(ctx *gin.Context, index int, line cm.CmdLine) {
+	d.reply(ctx, d.db.Exec(d.connection(index), line))
+}
+
+// connection returns an authenticated client of db index
+func (d *Dashboard) connection(index int) cmi.Connection {
+	connection := clientc.NewFakeConnection()
+	connection.SetPassword(d.props.RequirePass)
+	connection.SelectDB(index)
+	return connection
+}
+
+// reply answers with the reply of a command, an error reply is a bad request
+func (d *Dashboard) reply(ctx *gin.Context, reply resp.Reply) {
+	switch reply := reply.(type) {
+	case resp.ErrorReply:
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": reply.Error()})
+	case *resp.IntReply:
+		ctx.JSON(http.StatusOK, gin.H{"reply": reply.Code})
+	default:
+		ctx.JSON(http.StatusOK, gin.H{"reply": strings.TrimSpace(strings.TrimLeft(string(reply.ToBytes()), "+"))})
+	}
+}
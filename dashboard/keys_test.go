@@ -0,0 +1,152 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"mygodis/clientc"
+	"mygodis/config"
+	"mygodis/db"
+	"mygodis/util/cmdutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newKeyBrowser(t *testing.T, password string) (*Dashboard, *db.StandaloneServer) {
+	props := &config.ServerProperties{Databases: 2, RequirePass: password}
+	server := db.NewStandaloneServer(props)
+	t.Cleanup(server.Close)
+	return MakeDashboard("127.0.0.1:0", server, props), server
+}
+
+// call sends an authenticated request and decodes the json answer into out
+func call(t *testing.T, d *Dashboard, method, target, body string, out any) int {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	d.engine.ServeHTTP(recorder, req)
+	if out != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v %s", method, target, err, recorder.Body.String())
+		}
+	}
+	return recorder.Code
+}
+
+func TestDashboard_keysAuth(t *testing.T) {
+	d, _ := newKeyBrowser(t, "")
+	if code := call(t, d, http.MethodGet, "/api/keys", "", nil); code != http.StatusForbidden {
+		t.Errorf("except %d without requirepass but got %d", http.StatusForbidden, code)
+	}
+	d, _ = newKeyBrowser(t, "other")
+	if code := call(t, d, http.MethodGet, "/api/keys", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("except %d for a wrong token but got %d", http.StatusUnauthorized, code)
+	}
+}
+
+func TestDashboard_keys(t *testing.T) {
+	d, server := newKeyBrowser(t, "secret")
+	conn := clientc.NewFakeConnection()
+	for _, line := range [][]string{
+		{"SET", "user:1", "alice"}, {"SET", "user:2", "bob"}, {"SET", "other", "x"},
+		{"RPUSH", "list", "a", "b", "c"}, {"HSET", "hash", "f", "v"}, {"SADD", "set", "m2", "m1"},
+	} {
+		server.Exec(conn, cmdutil.ToCmdLine(line...))
+	}
+
+	var scan struct {
+		Keys   []string `json:"keys"`
+		Cursor int      `json:"cursor"`
+		Total  int      `json:"total"`
+	}
+	call(t, d, http.MethodGet, "/api/keys?pattern=user:*&count=1", "", &scan)
+	if len(scan.Keys) != 1 || scan.Keys[0] != "user:1" || scan.Cursor != 1 || scan.Total != 2 {
+		t.Errorf("unexpected first page %+v", scan)
+	}
+	call(t, d, http.MethodGet, "/api/keys?pattern=user:*&count=1&cursor=1", "", &scan)
+	if len(scan.Keys) != 1 || scan.Keys[0] != "user:2" || scan.Cursor != 0 {
+		t.Errorf("unexpected last page %+v", scan)
+	}
+	if code := call(t, d, http.MethodGet, "/api/keys?db=2", "", nil); code != http.StatusBadRequest {
+		t.Errorf("except %d for a db out of range but got %d", http.StatusBadRequest, code)
+	}
+
+	var view keyView
+	call(t, d, http.MethodGet, "/api/key?key=list&offset=1&limit=5", "", &view)
+	if view.Type != "list" || view.Size != 3 || view.TTL != -1 || len(view.Value.([]any)) != 2 || view.Value.([]any)[0] != "b" {
+		t.Errorf("unexpected list %+v", view)
+	}
+	call(t, d, http.MethodGet, "/api/key?key=set", "", &view)
+	if view.Type != "set" || view.Value.([]any)[0] != "m1" {
+		t.Errorf("unexpected set %+v", view)
+	}
+	if code := call(t, d, http.MethodGet, "/api/key?key=missing", "", nil); code != http.StatusNotFound {
+		t.Errorf("except %d for a missing key but got %d", http.StatusNotFound, code)
+	}
+
+	// writes go through the commands
+	call(t, d, http.MethodPut, "/api/key?key=hash", `{"type":"hash","field":"g","value":"w"}`, nil)
+	call(t, d, http.MethodPut, "/api/key?key=user:1", `{"type":"string","value":"carol"}`, nil)
+	call(t, d, http.MethodGet, "/api/key?key=user:1", "", &view)
+	if view.Value != "carol" {
+		t.Errorf("except carol but got %+v", view)
+	}
+	var reply struct {
+		Reply any    `json:"reply"`
+		Error string `json:"error"`
+	}
+	if code := call(t, d, http.MethodPut, "/api/key?key=list", `{"type":"list","index":10,"value":"x"}`, &reply); code != http.StatusBadRequest || reply.Error == "" {
+		t.Errorf("except the error of the command but got %d %+v", code, reply)
+	}
+	call(t, d, http.MethodPost, "/api/key/expire?key=user:2", `{"ttl":60000}`, nil)
+	call(t, d, http.MethodGet, "/api/key?key=user:2", "", &view)
+	if view.TTL <= 0 || view.TTL > 60000 {
+		t.Errorf("except a ttl within a minute but got %d", view.TTL)
+	}
+	call(t, d, http.MethodDelete, "/api/key?key=hash&field=f", "", nil)
+	call(t, d, http.MethodGet, "/api/key?key=hash", "", &view)
+	if view.Size != 1 {
+		t.Errorf("except one field left but got %+v", view)
+	}
+	call(t, d, http.MethodDelete, "/api/key?key=other", "", &reply)
+	if reply.Reply != float64(1) {
+		t.Errorf("except 1 deleted key but got %+v", reply)
+	}
+	if _, ok := server.GetEntity(0, "other"); ok {
+		t.Error("except other to be deleted")
+	}
+}
+
+func TestDashboard_zset(t *testing.T) {
+	d, server := newKeyBrowser(t, "secret")
+	var reply struct {
+		Reply any    `json:"reply"`
+		Error string `json:"error"`
+	}
+	for _, body := range []string{`{"type":"zset","member":"b","score":2}`, `{"type":"zset","member":"a","score":1.5}`} {
+		if code := call(t, d, http.MethodPut, "/api/key?key=zset", body, &reply); code != http.StatusOK || reply.Error != "" {
+			t.Fatalf("except the member added but got %d %+v", code, reply)
+		}
+	}
+	if code := call(t, d, http.MethodPut, "/api/key?key=zset", `{"type":"zset","member":"c"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("except %d without a score but got %d", http.StatusBadRequest, code)
+	}
+	var view struct {
+		Type  string        `json:"type"`
+		Size  int           `json:"size"`
+		Value []memberScore `json:"value"`
+	}
+	call(t, d, http.MethodGet, "/api/key?key=zset", "", &view)
+	if view.Type != "zset" || view.Size != 2 || view.Value[0] != (memberScore{Member: "a", Score: 1.5}) {
+		t.Errorf("unexpected zset %+v", view)
+	}
+	call(t, d, http.MethodDelete, "/api/key?key=zset&member=a", "", &reply)
+	if reply.Reply != float64(1) {
+		t.Errorf("except 1 removed member but got %+v", reply)
+	}
+	call(t, d, http.MethodDelete, "/api/key?key=zset&member=b", "", nil)
+	if _, ok := server.GetEntity(0, "zset"); ok {
+		t.Error("except the emptied zset to be deleted")
+	}
+}
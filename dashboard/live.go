@@ -0,0 +1,383 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"math"
+	"math/rand"
+	"mygodis/db"
+	"mygodis/util/match"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// monitorBuffer events wait between the commands and the sampler, more are dropped
+	monitorBuffer = 4096
+	// feedKept is the number of latest events of an interval kept for the feed
+	feedKept = 1024
+	// maxFeed is the number of feed entries sent to a browser per sample
+	maxFeed = 100
+	// maxLatencies bounds the latencies of an interval, a uniform sample is kept beyond
+	maxLatencies = 1 << 14
+	// viewerQueue samples wait for a slow browser, more are dropped
+	viewerQueue = 4
+	maxArgs     = 16
+	maxArgLen   = 64
+	writeWait   = 5 * time.Second
+)
+
+// liveInterval is the time between two samples
+var liveInterval = time.Second
+
+// commandMonitor is an engine whose commands can be watched
+type commandMonitor interface {
+	Monitor(size int) *db.Monitor
+	ClientCount() int
+}
+
+// live samples the commands of the server every interval while a browser watches and pushes the samples to them.
+// Commands only ever try to hand an event over, so neither the sampler nor a browser can slow them down.
+type live struct {
+	source  commandMonitor
+	mu      sync.Mutex
+	viewers map[*viewer]struct{}
+	stop    chan struct{}
+	// done is closed when the dashboard stops, it ends every stream
+	done   chan struct{}
+	closed bool
+}
+
+func newLive(source commandMonitor) *live {
+	return &live{source: source, viewers: make(map[*viewer]struct{}), done: make(chan struct{})}
+}
+
+// viewer is a browser watching
+type viewer struct {
+	send   chan []byte
+	mu     sync.Mutex
+	filter feedFilter
+}
+
+// feedFilter selects the commands of the feed, empty patterns and a nil DB match everything
+type feedFilter struct {
+	Cmd string `json:"cmd"`
+	Key string `json:"key"`
+	DB  *int   `json:"db"`
+}
+
+// liveSample is pushed to the browsers every interval, latencies are in microseconds
+type liveSample struct {
+	Time       int64   `json:"time"`
+	Ops        float64 `json:"ops"`
+	Errors     float64 `json:"errors"`
+	P50        float64 `json:"p50"`
+	P90        float64 `json:"p90"`
+	P99        float64 `json:"p99"`
+	Max        float64 `json:"max"`
+	HeapAlloc  uint64  `json:"heapAlloc"`
+	Sys        uint64  `json:"sys"`
+	Goroutines int     `json:"goroutines"`
+	Clients    int     `json:"clients"`
+	// Dropped events count in Ops but are missing from the latencies and the feed
+	Dropped uint64      `json:"dropped"`
+	Feed    []feedEntry `json:"feed,omitempty"`
+}
+
+// feedEntry is a command of the feed, Duration is in microseconds
+type feedEntry struct {
+	Time     int64   `json:"time"`
+	Client   string  `json:"client"`
+	DB       int     `json:"db"`
+	Command  string  `json:"command"`
+	Duration float64 `json:"duration"`
+	Error    bool    `json:"error"`
+}
+
+// join adds v, the first viewer starts monitoring the server. It fails once the streams are closed.
+func (l *live) join(v *viewer) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.viewers[v] = struct{}{}
+	if len(l.viewers) == 1 {
+		l.stop = make(chan struct{})
+		go l.run(l.source.Monitor(monitorBuffer), l.stop)
+	}
+	return true
+}
+
+// leave removes v, the last viewer stops monitoring the server
+func (l *live) leave(v *viewer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.viewers[v]; !ok {
+		return
+	}
+	delete(l.viewers, v)
+	if len(l.viewers) == 0 {
+		close(l.stop)
+	}
+}
+
+// close ends every stream and refuses new ones
+func (l *live) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.done)
+	}
+}
+
+func (l *live) run(monitor *db.Monitor, stop chan struct{}) {
+	defer monitor.Stop()
+	interval := liveInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	w := &window{}
+	var dropped uint64
+	for {
+		select {
+		case <-stop:
+			return
+		case event := <-monitor.C:
+			w.add(event)
+		case now := <-ticker.C:
+			total := monitor.Dropped()
+			sample := w.sample(now, interval, total-dropped)
+			sample.Clients = l.source.ClientCount()
+			dropped = total
+			l.broadcast(sample, w.events())
+			w.reset()
+		}
+	}
+}
+
+// broadcast sends sample to every viewer with the feed it filters, a viewer whose queue is full misses it
+func (l *live) broadcast(sample *liveSample, events []db.CommandEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for v := range l.viewers {
+		s := *sample
+		s.Feed = v.filtered(events)
+		msg, err := json.Marshal(&s)
+		if err != nil {
+			continue
+		}
+		select {
+		case v.send <- msg:
+		default:
+		}
+	}
+}
+
+// window collects the events of an interval
+type window struct {
+	ops       int
+	errors    int
+	seen      int64
+	latencies []time.Duration
+	feed      []db.CommandEvent
+	next      int
+}
+
+func (w *window) add(event db.CommandEvent) {
+	w.ops++
+	if event.Err {
+		w.errors++
+	}
+	w.seen++
+	if len(w.latencies) < maxLatencies {
+		w.latencies = append(w.latencies, event.Duration)
+	} else if i := rand.Int63n(w.seen); i < maxLatencies {
+		w.latencies[i] = event.Duration
+	}
+	if len(w.feed) < feedKept {
+		w.feed = append(w.feed, event)
+	} else {
+		w.feed[w.next] = event
+		w.next = (w.next + 1) % feedKept
+	}
+}
+
+// events returns the kept events oldest first
+func (w *window) events() []db.CommandEvent {
+	return append(append([]db.CommandEvent(nil), w.feed[w.next:]...), w.feed[:w.next]...)
+}
+
+func (w *window) reset() {
+	*w = window{latencies: w.latencies[:0], feed: w.feed[:0]}
+}
+
+// sample summarizes the window of interval, dropped events were executed but not seen
+func (w *window) sample(now time.Time, interval time.Duration, dropped uint64) *liveSample {
+	seconds := interval.Seconds()
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	s := &liveSample{
+		Time:       now.UnixMilli(),
+		Ops:        float64(uint64(w.ops)+dropped) / seconds,
+		Errors:     float64(w.errors) / seconds,
+		HeapAlloc:  memStats.HeapAlloc,
+		Sys:        memStats.Sys,
+		Goroutines: runtime.NumGoroutine(),
+		Dropped:    dropped,
+	}
+	if len(w.latencies) > 0 {
+		sort.Slice(w.latencies, func(i, j int) bool {
+			return w.latencies[i] < w.latencies[j]
+		})
+		s.P50 = percentile(w.latencies, 0.5)
+		s.P90 = percentile(w.latencies, 0.9)
+		s.P99 = percentile(w.latencies, 0.99)
+		s.Max = micros(w.latencies[len(w.latencies)-1])
+	}
+	return s
+}
+
+// percentile returns the p quantile of the sorted latencies in microseconds
+func percentile(sorted []time.Duration, p float64) float64 {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return micros(sorted[i])
+}
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+// filtered returns the latest maxFeed events matching the filter of v
+func (v *viewer) filtered(events []db.CommandEvent) []feedEntry {
+	v.mu.Lock()
+	filter := v.filter
+	v.mu.Unlock()
+	entries := make([]feedEntry, 0)
+	for i := len(events) - 1; i >= 0 && len(entries) < maxFeed; i-- {
+		if event := events[i]; filter.match(event) {
+			entries = append(entries, toFeedEntry(event))
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+func (v *viewer) setFilter(filter feedFilter) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.filter = filter
+}
+
+func (f *feedFilter) match(event db.CommandEvent) bool {
+	if f.DB != nil && *f.DB != event.DB {
+		return false
+	}
+	if f.Cmd != "" && !match.MatchPattern(strings.ToUpper(f.Cmd), strings.ToUpper(string(event.Args[0]))) {
+		return false
+	}
+	if f.Key != "" && (len(event.Args) < 2 || !match.MatchPattern(f.Key, string(event.Args[1]))) {
+		return false
+	}
+	return true
+}
+
+// toFeedEntry formats the command of event, long commands are cut and passwords hidden
+func toFeedEntry(event db.CommandEvent) feedEntry {
+	args := event.Args
+	parts := make([]string, 0, len(args))
+	for i, arg := range args {
+		if i == maxArgs {
+			parts = append(parts, "...("+strconv.Itoa(len(args)-maxArgs)+" more)")
+			break
+		}
+		if i > 0 && strings.EqualFold(string(args[0]), "AUTH") {
+			parts = append(parts, "(redacted)")
+			continue
+		}
+		s := string(arg)
+		if len(s) > maxArgLen {
+			s = s[:maxArgLen] + "..."
+		}
+		parts = append(parts, strconv.Quote(s))
+	}
+	return feedEntry{
+		Time:     event.Time.UnixMilli(),
+		Client:   event.Client,
+		DB:       event.DB,
+		Command:  strings.Join(parts, " "),
+		Duration: micros(event.Duration),
+		Error:    event.Err,
+	}
+}
+
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 4096}
+
+// liveStream pushes a sample every interval over a websocket. The cmd, key and db query parameters filter the feed
+// of commands, a json feedFilter sent by the browser replaces them.
+func (d *Dashboard) liveStream(ctx *gin.Context) {
+	if d.live == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "the server can not be monitored"})
+		return
+	}
+	filter := feedFilter{Cmd: ctx.Query("cmd"), Key: ctx.Query("key")}
+	if value, ok := ctx.GetQuery("db"); ok {
+		index, err := strconv.Atoi(value)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid db"})
+			return
+		}
+		filter.DB = &index
+	}
+	v := &viewer{send: make(chan []byte, viewerQueue), filter: filter}
+	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if !d.live.join(v) {
+		return
+	}
+	defer d.live.leave(v)
+	closed := make(chan struct{})
+	go v.readFilters(conn, closed)
+	for {
+		select {
+		case <-closed:
+			return
+		case <-d.live.done:
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(writeWait))
+			return
+		case msg := <-v.send:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readFilters applies the filters sent by the browser until the connection closes
+func (v *viewer) readFilters(conn *websocket.Conn, closed chan struct{}) {
+	defer close(closed)
+	conn.SetReadLimit(4096)
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var filter feedFilter
+		if json.Unmarshal(msg, &filter) == nil {
+			v.setFilter(filter)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package dashboard
+
+import (
+	"github.com/gorilla/websocket"
+	"mygodis/clientc"
+	"mygodis/db"
+	"mygodis/util/cmdutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextSample execs line until a sample of conn satisfies ok
+func nextSample(t *testing.T, conn *websocket.Conn, server *db.StandaloneServer, line []string, ok func(*liveSample) bool) *liveSample {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		server.Exec(clientc.NewFakeConnection(), cmdutil.ToCmdLine(line...))
+		var sample liveSample
+		_ = conn.SetReadDeadline(deadline)
+		if err := conn.ReadJSON(&sample); err != nil {
+			t.Fatal(err)
+		}
+		if ok(&sample) {
+			return &sample
+		}
+	}
+	t.Fatal("timeout waiting for a sample")
+	return nil
+}
+
+func TestDashboard_live(t *testing.T) {
+	defer func(interval time.Duration) {
+		liveInterval = interval
+	}(liveInterval)
+	liveInterval = 50 * time.Millisecond
+	d, server := newKeyBrowser(t, "secret")
+	httpServer := httptest.NewServer(d.engine)
+	defer httpServer.Close()
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/live"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?token=secret&cmd=set&key=user:*", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sample := nextSample(t, conn, server, []string{"SET", "user:1", "alice"}, func(s *liveSample) bool {
+		return len(s.Feed) > 0
+	})
+	if entry := sample.Feed[0]; entry.Command != `"SET" "user:1" "alice"` || entry.Client != "fake" || entry.Error {
+		t.Errorf("unexpected feed entry %+v", entry)
+	}
+	if sample.Ops <= 0 || sample.P99 < sample.P50 || sample.Max < sample.P99 || sample.HeapAlloc == 0 {
+		t.Errorf("unexpected sample %+v", sample)
+	}
+	// commands out of the filter are counted but not fed
+	nextSample(t, conn, server, []string{"GET", "user:1"}, func(s *liveSample) bool {
+		return s.Ops > 0 && len(s.Feed) == 0
+	})
+	if err := conn.WriteJSON(feedFilter{Cmd: "get"}); err != nil {
+		t.Fatal(err)
+	}
+	nextSample(t, conn, server, []string{"GET", "user:1"}, func(s *liveSample) bool {
+		return len(s.Feed) > 0 && strings.HasPrefix(s.Feed[0].Command, `"GET"`)
+	})
+
+	// without the token there is no stream at all
+	if _, response, err := websocket.DefaultDialer.Dial(url, nil); err == nil || response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("except %d without the token but got %v", http.StatusUnauthorized, err)
+	}
+}
+
+func TestDashboard_liveFeedEntry(t *testing.T) {
+	entry := toFeedEntry(db.CommandEvent{Args: cmdutil.ToCmdLine("auth", "secret")})
+	if entry.Command != `"auth" (redacted)` {
+		t.Errorf("except the password hidden but got %s", entry.Command)
+	}
+	args := []string{"RPUSH", "list", strings.Repeat("x", maxArgLen+1)}
+	for len(args) < maxArgs+2 {
+		args = append(args, "v")
+	}
+	entry = toFeedEntry(db.CommandEvent{Args: cmdutil.ToCmdLine(args...)})
+	if !strings.Contains(entry.Command, strings.Repeat("x", maxArgLen)+`..."`) || !strings.HasSuffix(entry.Command, "...(2 more)") {
+		t.Errorf("except a cut command but got %s", entry.Command)
+	}
+}
@@ -27,7 +27,7 @@ type ConcurrentDict struct {
 func (d *ConcurrentDict) Get(key string) (val any, exists bool) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
-	find := d.dictFind(key)
+	find := d.dictLookup(key)
 	if find == nil {
 		return nil, false
 	}
@@ -256,6 +256,11 @@ func (d *ConcurrentDict) dictFind(key any) *dictEntry {
 	if d.reHashIndex != -1 {
 		d.dictRehash(1)
 	}
+	return d.dictLookup(key)
+}
+
+// dictLookup finds key without moving any bucket, so it is safe under the read lock
+func (d *ConcurrentDict) dictLookup(key any) *dictEntry {
 	hash := dictHashFunction(key)
 	for table := 0; table <= 1; table++ {
 		ht := &d.ht[table]
@@ -428,4 +433,6 @@ func (d *ConcurrentDict) clear() {
 		sizemask: dictMinSize - 1,
 		used:     0,
 	}
+	// entries being rehashed are in the second table
+	d.ht[1] = dictht{}
 }
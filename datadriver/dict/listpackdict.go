@@ -0,0 +1,192 @@
+package dict
+
+import (
+	"math/rand"
+)
+
+// ListpackLimits are the most entries and the longest field or value a ListpackDict keeps in a slice
+type ListpackLimits struct {
+	Entries int
+	Value   int
+}
+
+type listpackEntry struct {
+	key string
+	val any
+}
+
+// ListpackDict keeps its entries in a slice in insertion order, like the listpack of redis, which costs far less
+// than a hash table for a few short entries. Once limits are exceeded it is upgraded to a ConcurrentDict for good.
+// It is not safe for concurrent use while it is a slice, the key lock of its owner guards it.
+type ListpackDict struct {
+	limits  *ListpackLimits
+	entries []listpackEntry
+	table   Dict
+}
+
+func NewListpackDict(limits *ListpackLimits) *ListpackDict {
+	return &ListpackDict{limits: limits}
+}
+
+// Encoding returns listpack while the entries are in a slice and hashtable after the upgrade
+func (d *ListpackDict) Encoding() string {
+	if d.table != nil {
+		return "hashtable"
+	}
+	return "listpack"
+}
+
+func (d *ListpackDict) indexOf(key string) int {
+	for i := range d.entries {
+		if d.entries[i].key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// fits reports whether key and val are short enough for the slice, values which are not strings never are
+func (d *ListpackDict) fits(key string, val any) bool {
+	if len(key) > d.limits.Value {
+		return false
+	}
+	switch val := val.(type) {
+	case nil:
+		return true
+	case string:
+		return len(val) <= d.limits.Value
+	case []byte:
+		return len(val) <= d.limits.Value
+	}
+	return false
+}
+
+func (d *ListpackDict) upgrade() {
+	d.table = NewConcurrentDict()
+	for _, entry := range d.entries {
+		d.table.Put(entry.key, entry.val)
+	}
+	d.entries = nil
+}
+
+func (d *ListpackDict) Get(key string) (val any, exists bool) {
+	if d.table != nil {
+		return d.table.Get(key)
+	}
+	if i := d.indexOf(key); i >= 0 {
+		return d.entries[i].val, true
+	}
+	return nil, false
+}
+
+func (d *ListpackDict) Len() int {
+	if d.table != nil {
+		return d.table.Len()
+	}
+	return len(d.entries)
+}
+
+func (d *ListpackDict) Put(key string, val any) (result int) {
+	if d.table == nil {
+		i := d.indexOf(key)
+		switch {
+		case !d.fits(key, val):
+		case i >= 0:
+			d.entries[i].val = val
+			return 0
+		case len(d.entries) < d.limits.Entries:
+			d.entries = append(d.entries, listpackEntry{key: key, val: val})
+			return 1
+		}
+		d.upgrade()
+	}
+	return d.table.Put(key, val)
+}
+
+func (d *ListpackDict) PutIfAbsent(key string, val any) (result int) {
+	if _, ok := d.Get(key); ok {
+		return 0
+	}
+	return d.Put(key, val)
+}
+
+func (d *ListpackDict) PutIfExists(key string, val any) (result int) {
+	if _, ok := d.Get(key); !ok {
+		return 0
+	}
+	d.Put(key, val)
+	return 1
+}
+
+func (d *ListpackDict) Remove(key string) (val any, result int) {
+	if d.table != nil {
+		return d.table.Remove(key)
+	}
+	i := d.indexOf(key)
+	if i < 0 {
+		return nil, 0
+	}
+	val = d.entries[i].val
+	d.entries = append(d.entries[:i], d.entries[i+1:]...)
+	return val, 1
+}
+
+func (d *ListpackDict) ForEach(consumer Consumer) {
+	if d.table != nil {
+		d.table.ForEach(consumer)
+		return
+	}
+	for _, entry := range d.entries {
+		if !consumer(entry.key, entry.val) {
+			break
+		}
+	}
+}
+
+func (d *ListpackDict) Keys() []string {
+	if d.table != nil {
+		return d.table.Keys()
+	}
+	keys := make([]string, len(d.entries))
+	for i, entry := range d.entries {
+		keys[i] = entry.key
+	}
+	return keys
+}
+
+func (d *ListpackDict) RandomKeys(limit int) []string {
+	if d.table != nil {
+		return d.table.RandomKeys(limit)
+	}
+	keys := make([]string, limit)
+	if len(d.entries) == 0 {
+		return keys
+	}
+	for i := range keys {
+		keys[i] = d.entries[rand.Intn(len(d.entries))].key
+	}
+	return keys
+}
+
+func (d *ListpackDict) RandomDistinctKeys(limit int) []string {
+	if d.table != nil {
+		return d.table.RandomDistinctKeys(limit)
+	}
+	if limit > len(d.entries) {
+		limit = len(d.entries)
+	}
+	keys := make([]string, 0, limit)
+	for _, i := range rand.Perm(len(d.entries))[:limit] {
+		keys = append(keys, d.entries[i].key)
+	}
+	return keys
+}
+
+// Clear empties the dict, an upgraded one stays a hash table
+func (d *ListpackDict) Clear() {
+	if d.table != nil {
+		d.table.Clear()
+		return
+	}
+	d.entries = nil
+}
@@ -0,0 +1,45 @@
+package dict
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListpackDict(t *testing.T) {
+	d := NewListpackDict(&ListpackLimits{Entries: 3, Value: 8})
+	d.Put("a", "1")
+	d.Put("b", "2")
+	if d.Put("a", "3") != 0 || d.Len() != 2 || d.Encoding() != "listpack" {
+		t.Fatalf("except 2 entries in a listpack but got %d in %s", d.Len(), d.Encoding())
+	}
+	if !reflect.DeepEqual(d.Keys(), []string{"a", "b"}) {
+		t.Errorf("except the keys in insertion order but got %v", d.Keys())
+	}
+	if val, ok := d.Get("a"); !ok || val != "3" {
+		t.Errorf("except a to be 3 but got %v", val)
+	}
+	if _, n := d.Remove("b"); n != 1 || d.Len() != 1 {
+		t.Errorf("except b removed")
+	}
+	if keys := d.RandomDistinctKeys(5); !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Errorf("except a as the only distinct key but got %v", keys)
+	}
+	// a long value upgrades the dict for good
+	d.Put("long", strings.Repeat("x", 9))
+	if d.Encoding() != "hashtable" || d.Len() != 2 {
+		t.Fatalf("except 2 entries in a hashtable but got %d in %s", d.Len(), d.Encoding())
+	}
+	d.Remove("long")
+	if val, ok := d.Get("a"); !ok || val != "3" || d.Encoding() != "hashtable" {
+		t.Errorf("except a kept in the hashtable but got %v in %s", val, d.Encoding())
+	}
+
+	d = NewListpackDict(&ListpackLimits{Entries: 3, Value: 8})
+	for _, key := range []string{"a", "b", "c", "d"} {
+		d.Put(key, key)
+	}
+	if d.Encoding() != "hashtable" || d.Len() != 4 {
+		t.Errorf("except 4 entries in a hashtable but got %d in %s", d.Len(), d.Encoding())
+	}
+}
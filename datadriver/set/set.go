@@ -1,9 +1,29 @@
 package set
 
-import "mygodis/datadriver/dict"
+import (
+	"math/rand"
+	"mygodis/datadriver/dict"
+	"sort"
+	"strconv"
+)
 
+// Limits are the most members a compact set keeps in an intset or a listpack and the longest member of a listpack
+type Limits struct {
+	IntsetEntries   int
+	ListpackEntries int
+	ListpackValue   int
+}
+
+// Set is a hash table, or for a compact one made by MakeCompactSet an intset while all its members are integers
+// and a listpack while it is small. A compact set is upgraded to the next encoding once its limits are exceeded
+// and never goes back.
 type Set struct {
 	dict dict.Dict
+	// ints are the sorted members of an intset
+	ints []int64
+	// members are the members of a listpack in insertion order
+	members []string
+	limits  *Limits
 }
 
 func MakeSet(members ...string) *Set {
@@ -13,24 +33,172 @@ func MakeSet(members ...string) *Set {
 	}
 	return set
 }
+
+// MakeCompactSet returns an empty intset following limits with members added
+func MakeCompactSet(limits *Limits, members ...string) *Set {
+	set := &Set{limits: limits}
+	for _, member := range members {
+		set.Add(member)
+	}
+	return set
+}
+
+// empty returns an empty set encoded like a new s
+func (s *Set) empty() *Set {
+	if s.limits != nil {
+		return MakeCompactSet(s.limits)
+	}
+	return MakeSet()
+}
+
+// Encoding returns intset, listpack or hashtable
+func (s *Set) Encoding() string {
+	switch {
+	case s.dict != nil:
+		return "hashtable"
+	case s.members != nil:
+		return "listpack"
+	}
+	return "intset"
+}
+
+// intMember returns the integer of elem if it is written the way strconv writes it back
+func intMember(elem string) (int64, bool) {
+	if len(elem) == 0 || len(elem) > 20 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(elem, 10, 64)
+	if err != nil || strconv.FormatInt(v, 10) != elem {
+		return 0, false
+	}
+	return v, true
+}
+
+func (s *Set) searchInt(v int64) (int, bool) {
+	i := sort.Search(len(s.ints), func(i int) bool { return s.ints[i] >= v })
+	return i, i < len(s.ints) && s.ints[i] == v
+}
+
+func (s *Set) indexOf(elem string) int {
+	for i, member := range s.members {
+		if member == elem {
+			return i
+		}
+	}
+	return -1
+}
+
+// grow leaves the intset or the listpack for the encoding which can take one more member as long as longest
+func (s *Set) grow(longest int) {
+	size := s.Len() + 1
+	if s.dict == nil && s.members == nil {
+		for _, v := range s.ints {
+			if n := len(strconv.FormatInt(v, 10)); n > longest {
+				longest = n
+			}
+		}
+	}
+	if s.dict == nil && size <= s.limits.ListpackEntries && longest <= s.limits.ListpackValue {
+		if s.members == nil {
+			s.members = make([]string, 0, size)
+			for _, v := range s.ints {
+				s.members = append(s.members, strconv.FormatInt(v, 10))
+			}
+			s.ints = nil
+		}
+		return
+	}
+	table := dict.NewSimpleDict(size)
+	s.ForEach(func(elem string) bool {
+		table.Put(elem, nil)
+		return true
+	})
+	s.dict, s.ints, s.members = table, nil, nil
+}
+
 func (s *Set) Add(elem string) int {
-	return s.dict.Put(elem, nil)
+	switch {
+	case s.dict != nil:
+		return s.dict.Put(elem, nil)
+	case s.members != nil:
+		if s.indexOf(elem) >= 0 {
+			return 0
+		}
+		if len(s.members) >= s.limits.ListpackEntries || len(elem) > s.limits.ListpackValue {
+			s.grow(len(elem))
+			return s.Add(elem)
+		}
+		s.members = append(s.members, elem)
+		return 1
+	}
+	v, ok := intMember(elem)
+	if ok {
+		i, found := s.searchInt(v)
+		if found {
+			return 0
+		}
+		if len(s.ints) < s.limits.IntsetEntries {
+			s.ints = append(s.ints, 0)
+			copy(s.ints[i+1:], s.ints[i:])
+			s.ints[i] = v
+			return 1
+		}
+	}
+	s.grow(len(elem))
+	return s.Add(elem)
 }
 func (s *Set) Remove(elem string) int {
-	_, ret := s.dict.Remove(elem)
-	return ret
+	switch {
+	case s.dict != nil:
+		_, ret := s.dict.Remove(elem)
+		return ret
+	case s.members != nil:
+		i := s.indexOf(elem)
+		if i < 0 {
+			return 0
+		}
+		s.members = append(s.members[:i], s.members[i+1:]...)
+		return 1
+	}
+	v, ok := intMember(elem)
+	if !ok {
+		return 0
+	}
+	i, found := s.searchInt(v)
+	if !found {
+		return 0
+	}
+	s.ints = append(s.ints[:i], s.ints[i+1:]...)
+	return 1
 }
 func (s *Set) Has(elem string) bool {
-	_, exists := s.dict.Get(elem)
-	return exists
+	switch {
+	case s.dict != nil:
+		_, exists := s.dict.Get(elem)
+		return exists
+	case s.members != nil:
+		return s.indexOf(elem) >= 0
+	}
+	v, ok := intMember(elem)
+	if !ok {
+		return false
+	}
+	_, found := s.searchInt(v)
+	return found
 }
 func (s *Set) Len() int {
-	return s.dict.Len()
+	switch {
+	case s.dict != nil:
+		return s.dict.Len()
+	case s.members != nil:
+		return len(s.members)
+	}
+	return len(s.ints)
 }
 func (s *Set) ToSlice() []string {
 	slice := make([]string, s.Len())
 	i := 0
-	s.dict.ForEach(func(key string, val interface{}) bool {
+	s.ForEach(func(key string) bool {
 		if i < len(slice) {
 			slice[i] = key
 		} else {
@@ -42,9 +210,24 @@ func (s *Set) ToSlice() []string {
 	return slice
 }
 func (s *Set) ForEach(consumer func(elem string) bool) {
-	s.dict.ForEach(func(key string, val interface{}) bool {
-		return consumer(key)
-	})
+	switch {
+	case s.dict != nil:
+		s.dict.ForEach(func(key string, val interface{}) bool {
+			return consumer(key)
+		})
+	case s.members != nil:
+		for _, member := range s.members {
+			if !consumer(member) {
+				return
+			}
+		}
+	default:
+		for _, v := range s.ints {
+			if !consumer(strconv.FormatInt(v, 10)) {
+				return
+			}
+		}
+	}
 }
 func (s *Set) InsertSet(another *Set) {
 	another.ForEach(func(elem string) bool {
@@ -73,7 +256,7 @@ func (s *Set) IsSubset(another *Set) bool {
 	return ret
 }
 func (s *Set) Union(another *Set) *Set {
-	union := MakeSet()
+	union := s.empty()
 	s.ForEach(func(elem string) bool {
 		union.Add(elem)
 		return true
@@ -85,7 +268,7 @@ func (s *Set) Union(another *Set) *Set {
 	return union
 }
 func (s *Set) Diff(another *Set) *Set {
-	diff := MakeSet()
+	diff := s.empty()
 	s.ForEach(func(elem string) bool {
 		if !another.Has(elem) {
 			diff.Add(elem)
@@ -95,7 +278,7 @@ func (s *Set) Diff(another *Set) *Set {
 	return diff
 }
 func (s *Set) Inter(another *Set) *Set {
-	inter := MakeSet()
+	inter := s.empty()
 	s.ForEach(func(elem string) bool {
 		if another.Has(elem) {
 			inter.Add(elem)
@@ -105,8 +288,36 @@ func (s *Set) Inter(another *Set) *Set {
 	return inter
 }
 func (s *Set) RandomMembers(limit int) []string {
-	return s.dict.RandomKeys(limit)
+	if s.dict != nil {
+		return s.dict.RandomKeys(limit)
+	}
+	members := make([]string, limit)
+	if s.Len() == 0 {
+		return members
+	}
+	for i := range members {
+		members[i] = s.member(rand.Intn(s.Len()))
+	}
+	return members
 }
 func (s *Set) RandomDistinctMembers(limit int) []string {
-	return s.dict.RandomDistinctKeys(limit)
+	if s.dict != nil {
+		return s.dict.RandomDistinctKeys(limit)
+	}
+	if limit > s.Len() {
+		limit = s.Len()
+	}
+	members := make([]string, 0, limit)
+	for _, i := range rand.Perm(s.Len())[:limit] {
+		members = append(members, s.member(i))
+	}
+	return members
+}
+
+// member returns the i-th member of an intset or a listpack
+func (s *Set) member(i int) string {
+	if s.members != nil {
+		return s.members[i]
+	}
+	return strconv.FormatInt(s.ints[i], 10)
 }
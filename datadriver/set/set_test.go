@@ -1,6 +1,7 @@
 package set
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -12,3 +13,43 @@ func TestSet_RandomMembers(t *testing.T) {
 	}
 
 }
+
+func TestMakeCompactSet(t *testing.T) {
+	limits := &Limits{IntsetEntries: 3, ListpackEntries: 4, ListpackValue: 8}
+	set := MakeCompactSet(limits, "3", "1", "2", "1")
+	if set.Encoding() != "intset" || set.Len() != 3 {
+		t.Fatalf("except 3 members in an intset but got %d in %s", set.Len(), set.Encoding())
+	}
+	if !reflect.DeepEqual(set.ToSlice(), []string{"1", "2", "3"}) {
+		t.Errorf("except the integers in order but got %v", set.ToSlice())
+	}
+	// 01 is not written like an integer
+	if set.Has("01") || set.Remove("01") != 0 || set.Add("01") != 1 || set.Encoding() != "listpack" {
+		t.Errorf("except 01 to make a listpack but got %s", set.Encoding())
+	}
+	if !set.Has("2") || !set.Has("01") || set.Remove("2") != 1 || set.Len() != 3 {
+		t.Errorf("except 2 removed from %v", set.ToSlice())
+	}
+	set.Add("a")
+	set.Add("b")
+	if set.Encoding() != "hashtable" || set.Len() != 5 || !set.Has("3") {
+		t.Errorf("except 5 members in a hashtable but got %v in %s", set.ToSlice(), set.Encoding())
+	}
+
+	// too many integers go to a listpack if they fit in it and to a hashtable otherwise
+	set = MakeCompactSet(limits, "1", "2", "3", "4")
+	if set.Encoding() != "listpack" {
+		t.Errorf("except a listpack but got %s", set.Encoding())
+	}
+	set = MakeCompactSet(limits, "1", "2", "3", "123456789")
+	if set.Encoding() != "hashtable" {
+		t.Errorf("except a hashtable but got %s", set.Encoding())
+	}
+	union := MakeCompactSet(limits, "1").Union(MakeCompactSet(limits, "2"))
+	if union.Encoding() != "intset" || union.Len() != 2 {
+		t.Errorf("except the union in an intset but got %v in %s", union.ToSlice(), union.Encoding())
+	}
+	if members := MakeCompactSet(limits, "1", "2").RandomDistinctMembers(3); len(members) != 2 {
+		t.Errorf("except 2 distinct members but got %v", members)
+	}
+}
@@ -5,9 +5,20 @@ import (
 	"strconv"
 )
 
+// Limits are the most members a compact zset keeps in a listpack and its longest member
+type Limits struct {
+	ListpackEntries int
+	ListpackValue   int
+}
+
+// ZSet is a skiplist with a dict, or for a compact one made by MakeCompactZSet a listpack of elements sorted like
+// the skiplist while it is small. A listpack is upgraded once limits are exceeded and never goes back.
 type ZSet struct {
 	dict map[string]*Element
 	zsl  *zskiplist
+	// elements are the members of a listpack sorted by score and member
+	elements []*Element
+	limits   *Limits
 }
 
 func MakeZSet() *ZSet {
@@ -17,12 +28,91 @@ func MakeZSet() *ZSet {
 	}
 }
 
+// MakeCompactZSet returns an empty listpack following limits
+func MakeCompactZSet(limits *Limits) *ZSet {
+	return &ZSet{limits: limits, elements: make([]*Element, 0)}
+}
+
+// empty returns an empty zset encoded like a new zSet
+func (zSet *ZSet) empty() *ZSet {
+	if zSet.limits != nil {
+		return MakeCompactZSet(zSet.limits)
+	}
+	return MakeZSet()
+}
+
+// Encoding returns listpack or skiplist
+func (zSet *ZSet) Encoding() string {
+	if zSet.zsl == nil {
+		return "listpack"
+	}
+	return "skiplist"
+}
+
+func elementLess(score float64, member string, element *Element) bool {
+	return score < element.Score || score == element.Score && member < element.Member
+}
+
+func (zSet *ZSet) indexOf(member string) int {
+	for i, element := range zSet.elements {
+		if element.Member == member {
+			return i
+		}
+	}
+	return -1
+}
+
+// expanded returns the skiplist of a listpack, a skiplist is returned as it is
+func (zSet *ZSet) expanded() *ZSet {
+	if zSet.zsl != nil {
+		return zSet
+	}
+	full := MakeZSet()
+	for _, element := range zSet.elements {
+		full.Add(element.Member, element.Score)
+	}
+	return full
+}
+
+// withSkiplist runs fn on the skiplist of zSet, a listpack is expanded for fn and packed again afterwards since
+// it is small anyway
+func (zSet *ZSet) withSkiplist(fn func(full *ZSet)) {
+	full := zSet.expanded()
+	fn(full)
+	if full == zSet {
+		return
+	}
+	zSet.elements = zSet.elements[:0]
+	full.ForEach(0, full.Len(), false, func(element *Element) bool {
+		zSet.elements = append(zSet.elements, element)
+		return true
+	})
+}
+
+func (zSet *ZSet) upgrade() {
+	full := zSet.expanded()
+	zSet.dict, zSet.zsl, zSet.elements = full.dict, full.zsl, nil
+}
+
 type zSetWithWeight struct {
 	weight float64
 	zSet   *ZSet
 }
 
 func (zSet *ZSet) Add(member string, score float64) bool {
+	if zSet.zsl == nil {
+		if i := zSet.indexOf(member); i >= 0 {
+			zSet.elements = append(zSet.elements[:i], zSet.elements[i+1:]...)
+		} else if len(zSet.elements) >= zSet.limits.ListpackEntries || len(member) > zSet.limits.ListpackValue {
+			zSet.upgrade()
+			return zSet.Add(member, score)
+		}
+		i := sort.Search(len(zSet.elements), func(i int) bool { return elementLess(score, member, zSet.elements[i]) })
+		zSet.elements = append(zSet.elements, nil)
+		copy(zSet.elements[i+1:], zSet.elements[i:])
+		zSet.elements[i] = &Element{Member: member, Score: score}
+		return true
+	}
 	element, ok := zSet.dict[member]
 	zSet.dict[member] = &Element{
 		Member: member,
@@ -38,9 +128,18 @@ func (zSet *ZSet) Add(member string, score float64) bool {
 	return zSet.zsl.insert(score, member) != nil
 }
 func (zSet *ZSet) Len() int64 {
+	if zSet.zsl == nil {
+		return int64(len(zSet.elements))
+	}
 	return int64(len(zSet.dict))
 }
 func (zSet *ZSet) Get(member string) (element *Element, ok bool) {
+	if zSet.zsl == nil {
+		if i := zSet.indexOf(member); i >= 0 {
+			return zSet.elements[i], true
+		}
+		return nil, false
+	}
 	element, ok = zSet.dict[member]
 	if !ok {
 		return nil, false
@@ -48,6 +147,14 @@ func (zSet *ZSet) Get(member string) (element *Element, ok bool) {
 	return element, true
 }
 func (zSet *ZSet) Remove(member string) bool {
+	if zSet.zsl == nil {
+		i := zSet.indexOf(member)
+		if i < 0 {
+			return false
+		}
+		zSet.elements = append(zSet.elements[:i], zSet.elements[i+1:]...)
+		return true
+	}
 	v, ok := zSet.dict[member]
 	if ok {
 		zSet.zsl.delete(v.Score, member)
@@ -57,6 +164,9 @@ func (zSet *ZSet) Remove(member string) bool {
 	return false
 }
 func (zSet *ZSet) getIndex(member string, desc bool) int64 {
+	if zSet.zsl == nil {
+		return zSet.expanded().getIndex(member, desc)
+	}
 	elem, ok := zSet.dict[member]
 	if !ok {
 		return -1
@@ -69,6 +179,10 @@ func (zSet *ZSet) getIndex(member string, desc bool) int64 {
 }
 func (zSet *ZSet) ForEach(start int64, stop int64, desc bool, consumer func(element *Element) bool) {
 	size := zSet.Len()
+	if start == 0 && stop == 0 {
+		// nothing to visit, an empty zset has no index to start from
+		return
+	}
 	if start < 0 || start >= size {
 		panic("start index out of range [0, size) but got " + strconv.FormatInt(start, 10))
 	}
@@ -78,6 +192,18 @@ func (zSet *ZSet) ForEach(start int64, stop int64, desc bool, consumer func(elem
 	if start > stop {
 		panic("start index must less than stop index but got start " + strconv.FormatInt(start, 10) + " and stop " + strconv.FormatInt(stop, 10))
 	}
+	if zSet.zsl == nil {
+		for i := start; i < stop; i++ {
+			element := zSet.elements[i]
+			if desc {
+				element = zSet.elements[size-1-i]
+			}
+			if !consumer(&Element{Member: element.Member, Score: element.Score}) {
+				break
+			}
+		}
+		return
+	}
 	var zNode *zskiplistNode
 	if desc {
 		zNode = zSet.zsl.tail
@@ -117,7 +243,7 @@ func (zSet *ZSet) Range(start, end int64, desc bool) (result []*Element) {
 	return result
 }
 func (zSet *ZSet) Count(min, max *ScoreBorder) int64 {
-	return zSet.zsl.count(min, max)
+	return zSet.expanded().zsl.count(min, max)
 }
 func (zSet *ZSet) ForeachByScore(min, max *ScoreBorder, offset, limit int64, desc bool, consumer func(element *Element) bool) {
 
@@ -134,7 +260,11 @@ func (zSet *ZSet) RangeByScore(min, max *ScoreBorder, offset, limit int64, desc
 	})
 	return result
 }
-func (zSet *ZSet) RemoveByScore(min, max *ScoreBorder) int64 {
+func (zSet *ZSet) RemoveByScore(min, max *ScoreBorder) (removed int64) {
+	if zSet.zsl == nil {
+		zSet.withSkiplist(func(full *ZSet) { removed = full.RemoveByScore(min, max) })
+		return removed
+	}
 	elements := zSet.zsl.reMoveRangeByBorder(min, max, zSet.Len())
 	for _, v := range elements {
 		delete(zSet.dict, v.Member)
@@ -142,10 +272,14 @@ func (zSet *ZSet) RemoveByScore(min, max *ScoreBorder) int64 {
 	return int64(len(elements))
 
 }
-func (zSet *ZSet) PopMin(count int64) []*Element {
+func (zSet *ZSet) PopMin(count int64) (popped []*Element) {
 	if count <= 0 {
 		return nil
 	}
+	if zSet.zsl == nil {
+		zSet.withSkiplist(func(full *ZSet) { popped = full.PopMin(count) })
+		return popped
+	}
 	result := make([]*Element, 0, count)
 	elements := zSet.zsl.removeRangeByIndex(0, count)
 	for _, v := range elements {
@@ -154,10 +288,14 @@ func (zSet *ZSet) PopMin(count int64) []*Element {
 	}
 	return result
 }
-func (zSet *ZSet) PopMax(count int64) []*Element {
+func (zSet *ZSet) PopMax(count int64) (popped []*Element) {
 	if count <= 0 {
 		return nil
 	}
+	if zSet.zsl == nil {
+		zSet.withSkiplist(func(full *ZSet) { popped = full.PopMax(count) })
+		return popped
+	}
 	result := make([]*Element, 0, count)
 	elements := zSet.zsl.removeRangeByIndex(int64(int(zSet.Len()-count)), int64(int(zSet.Len())))
 	for _, v := range elements {
@@ -173,6 +311,11 @@ func (zSet *ZSet) RemoveByIndex(start, stop int64) int64 {
 	if start > stop {
 		return 0
 	}
+	if zSet.zsl == nil {
+		var removed int64
+		zSet.withSkiplist(func(full *ZSet) { removed = full.RemoveByIndex(start, stop) })
+		return removed
+	}
 	result := zSet.zsl.removeRangeByIndex(start, stop)
 	for _, v := range result {
 		delete(zSet.dict, v.Member)
@@ -180,7 +323,7 @@ func (zSet *ZSet) RemoveByIndex(start, stop int64) int64 {
 	return int64(len(result))
 }
 func (zSet *ZSet) clone() *ZSet {
-	result := MakeZSet()
+	result := zSet.empty()
 	zSet.ForEach(0, zSet.Len(), false, func(element *Element) bool {
 		result.Add(element.Member, element.Score)
 		return true
@@ -226,12 +369,18 @@ func (zSet *ZSet) Diff(sets ...*ZSet) (result *ZSet) {
 	return diffSets(zsww)
 }
 func (zSet *ZSet) Rank(member string) (int64, bool) {
+	if zSet.zsl == nil {
+		return zSet.expanded().Rank(member)
+	}
 	if element, ok := zSet.Get(member); ok {
 		return zSet.zsl.getIndex(member, element.Score), true
 	}
 	return -1, false
 }
 func (zSet *ZSet) LexCount(min string, max string) int64 {
+	if zSet.zsl == nil {
+		return zSet.expanded().LexCount(min, max)
+	}
 
 	maxE, _ := zSet.Get(max)
 	minE, _ := zSet.Get(min)
@@ -262,12 +411,13 @@ func unionSets(aggregate string, sets []*zSetWithWeight) (result *ZSet) {
 	sort.Slice(sets, func(i, j int) bool {
 		return sets[i].zSet.Len() < sets[j].zSet.Len()
 	})
-	result = sets[0].zSet.clone()
-	for i := 1; i < len(sets); i++ {
+	result = sets[0].zSet.empty()
+	for i := 0; i < len(sets); i++ {
 		setWithWeight := sets[i]
 		setWithWeight.zSet.ForEach(0, setWithWeight.zSet.Len(), false, func(element *Element) bool {
 			if member, ok := result.Get(element.Member); ok {
-				member.Score = destScore(member.Score, element.Score, setWithWeight.weight, aggregate)
+				// Add keeps the skiplist or the listpack in order, setting the score would not
+				result.Add(element.Member, destScore(member.Score, element.Score, setWithWeight.weight, aggregate))
 			} else {
 				result.Add(element.Member, element.Score*setWithWeight.weight)
 			}
@@ -277,7 +427,7 @@ func unionSets(aggregate string, sets []*zSetWithWeight) (result *ZSet) {
 	return result
 }
 func interSets(aggregate string, sets []*zSetWithWeight) (result *ZSet) {
-	result = MakeZSet()
+	result = sets[0].zSet.empty()
 	// 优先使用最小的集合
 	sort.Slice(sets, func(i, j int) bool {
 		return sets[i].zSet.Len() < sets[j].zSet.Len()
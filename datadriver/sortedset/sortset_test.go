@@ -198,3 +198,61 @@ func TestZSet_getIndex(t *testing.T) {
 	loadDataSet()
 	fmt.Println(set.getIndex("elem0", false))
 }
+
+func TestMakeCompactZSet(t *testing.T) {
+	limits := &Limits{ListpackEntries: 10, ListpackValue: 8}
+	compact, full := MakeCompactZSet(limits), MakeZSet()
+	for i, member := range []string{"e", "d", "c", "b", "a", "f"} {
+		compact.Add(member, float64(i%3))
+		full.Add(member, float64(i%3))
+	}
+	compact.Add("e", 5)
+	full.Add("e", 5)
+	if compact.Encoding() != "listpack" || full.Encoding() != "skiplist" {
+		t.Fatalf("except a listpack and a skiplist but got %s and %s", compact.Encoding(), full.Encoding())
+	}
+	// the listpack answers like the skiplist
+	if got, except := compact.Range(0, compact.Len(), true), full.Range(0, full.Len(), true); !reflect.DeepEqual(got, except) {
+		t.Errorf("except %v but got %v", except, got)
+	}
+	rank, _ := compact.Rank("c")
+	exceptRank, _ := full.Rank("c")
+	if rank != exceptRank {
+		t.Errorf("except rank %d but got %d", exceptRank, rank)
+	}
+	border := &ScoreBorder{Value: 1}
+	if got, except := compact.Count(border, positiveInfBorder), full.Count(border, positiveInfBorder); got != except {
+		t.Errorf("except count %d but got %d", except, got)
+	}
+	if got, except := compact.PopMin(2), full.PopMin(2); !reflect.DeepEqual(got, except) {
+		t.Errorf("except to pop %v but got %v", except, got)
+	}
+	if got, except := compact.Range(0, compact.Len(), false), full.Range(0, full.Len(), false); !reflect.DeepEqual(got, except) || compact.Encoding() != "listpack" {
+		t.Errorf("except %v left in a listpack but got %v in %s", except, got, compact.Encoding())
+	}
+	union := MakeCompactZSet(limits).Union("SUM", []float64{1, 1}, compact, compact)
+	if element, _ := union.Get("e"); union.Encoding() != "listpack" || element.Score != 10 {
+		t.Errorf("except e summed in a listpack but got %v in %s", element, union.Encoding())
+	}
+
+	compact.Add("toolongmember", 1)
+	if compact.Encoding() != "skiplist" || compact.Len() != full.Len()+1 {
+		t.Fatalf("except %d members in a skiplist but got %d in %s", full.Len()+1, compact.Len(), compact.Encoding())
+	}
+	if element, ok := compact.Get("e"); !ok || element.Score != 5 {
+		t.Errorf("except e kept with 5 but got %v", element)
+	}
+}
+
+func TestZSet_UnionEmpty(t *testing.T) {
+	limits := &Limits{ListpackEntries: 4, ListpackValue: 8}
+	set := MakeCompactZSet(limits)
+	set.Add("a", 1)
+	union := MakeCompactZSet(limits).Union("SUM", []float64{2, 1}, set, MakeCompactZSet(limits))
+	if element, ok := union.Get("a"); !ok || element.Score != 2 {
+		t.Errorf("except a weighted 2 but got %v", element)
+	}
+	if inter := MakeZSet().Inter("SUM", []float64{1, 1}, set, MakeZSet()); inter.Len() != 0 {
+		t.Errorf("except an empty intersection but got %d members", inter.Len())
+	}
+}
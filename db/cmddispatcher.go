@@ -10,6 +10,8 @@ var cmdContainer = make(map[string]*Command)
 const (
 	Write = iota
 	ReadOnly
+	// NoTouch commands do not count as an access of their keys, like OBJECT
+	NoTouch
 )
 
 type Command struct {
@@ -35,6 +37,37 @@ func RegisterCommand(name string, executor ExecFunc, prepare PreFunc, rollback U
 		flags:    flags,
 	}
 }
+
+// lockAllKeys is read by a command whose keys are only known once it runs, like SORT BY and GET, the db locks every key
+// for it. It is never a key of the db, GetRelatedKeys leaves it out.
+const lockAllKeys = "\x00*"
+
+// GetRelatedKeys returns the keys written and read by line, ok is false if the command is unknown or has no keys
+func GetRelatedKeys(line cm.CmdLine) (writeKeys []string, readKeys []string, ok bool) {
+	writeKeys, readKeys, ok = GetLockKeys(line)
+	for i, key := range readKeys {
+		if key == lockAllKeys {
+			readKeys = append(readKeys[:i:i], readKeys[i+1:]...)
+			break
+		}
+	}
+	return writeKeys, readKeys, ok
+}
+
+// GetLockKeys returns the keys to lock for line, like GetRelatedKeys but with the signal to lock every key
+func GetLockKeys(line cm.CmdLine) (writeKeys []string, readKeys []string, ok bool) {
+	command, exists := GetCommand(line)
+	if !exists || command.prepare == nil || !validateArity(command.arity, line) {
+		return nil, nil, false
+	}
+	writeKeys, readKeys = command.prepare(line[1:])
+	return writeKeys, readKeys, true
+}
+
+// IsReadOnlyCommand returns whether line is a known command which never writes
+func IsReadOnlyCommand(line cm.CmdLine) bool {
+	return isReadOnly(strings.ToUpper(string(line[0])))
+}
 func isReadOnly(name string) bool {
 	cmd := cmdContainer[name]
 	if cmd == nil {
@@ -42,3 +75,8 @@ func isReadOnly(name string) bool {
 	}
 	return cmd.flags&ReadOnly > 0
 }
+
+// touches returns whether the command counts as an access of its keys
+func (c *Command) touches() bool {
+	return c.flags&NoTouch == 0
+}
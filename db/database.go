@@ -6,6 +6,7 @@ import (
 	cm "mygodis/common"
 	"mygodis/common/commoninterface"
 	"mygodis/datadriver/dict"
+	"mygodis/lib/clock"
 	"mygodis/lib/delay"
 	"mygodis/lib/sync/lockermap"
 	logger "mygodis/log"
@@ -22,15 +23,31 @@ const (
 	lockerSize   = 1024
 )
 
+// versionLogicalBits is the room left under the milliseconds of a version for the writes of the same millisecond
+const versionLogicalBits = 16
+
+// tombstoneTTL is how long a replicated db keeps the version of a removed key
+const tombstoneTTL = 10 * time.Minute
+
 type DataBaseImpl struct {
-	index          int
-	data           dict.Dict
-	ttlMap         dict.Dict
-	versionMap     dict.Dict
+	index      int
+	data       dict.Dict
+	ttlMap     dict.Dict
+	versionMap dict.Dict
+	// access holds the *keyAccess of the keys, read by OBJECT IDLETIME and FREQ
+	access         dict.Dict
 	addAof         func(cm.CmdLine)
 	insertCallback commoninterface.KeyEventCallback
 	deleteCallback commoninterface.KeyEventCallback
 	locker         *lockermap.LockerMap
+	// timer runs the expirations, the shared time wheel of package delay if nil
+	timer *delay.TimeWheel
+	// clock tells when keys expire, the wall clock if nil
+	clock clock.Clock
+	// encodings are the thresholds of the compact hashes, sets and zsets, the defaults if nil
+	encodings *encodingLimits
+	// tombstones tells how long the version of a removed key is kept, it goes with the key if nil or 0
+	tombstones func() time.Duration
 }
 
 // Dump used for testing
@@ -66,6 +83,7 @@ func NewDB() *DataBaseImpl {
 		data:       dict.NewConcurrentDict(),
 		ttlMap:     dict.NewConcurrentDict(),
 		versionMap: dict.NewConcurrentDict(),
+		access:     dict.NewConcurrentDict(),
 		locker:     lockermap.NewLockerMap(lockerSize),
 		addAof:     func(line cm.CmdLine) {},
 	}
@@ -76,12 +94,13 @@ func newBasicDB() *DataBaseImpl {
 		data:       dict.NewConcurrentDict(),
 		ttlMap:     dict.NewSimpleDict(ttlDictSize),
 		versionMap: dict.NewSimpleDict(dataDictSize),
+		access:     dict.NewSimpleDict(dataDictSize),
 		addAof:     func(line cm.CmdLine) {},
 	}
 	return db
 }
 func (dbi *DataBaseImpl) Exec(c commoninterface.Connection, cmd cm.CmdLine) (reply resp.Reply) {
-	s := strings.ToLower(string(cmd[0]))
+	s := strings.ToUpper(string(cmd[0]))
 	switch s {
 	case "MULTI": //开启事务
 		if len(cmd) != 1 {
@@ -103,9 +122,14 @@ func (dbi *DataBaseImpl) Exec(c commoninterface.Connection, cmd cm.CmdLine) (rep
 			return resp.MakeArgNumErrReply(s)
 		}
 		return Watch(dbi, c, cmd)
+	case "UNWATCH": //取消监视
+		if len(cmd) != 1 {
+			return resp.MakeArgNumErrReply(s)
+		}
+		return UnWatch(c)
 	}
 	if c != nil && c.InMultiState() {
-		EnQueue(c, cmd)
+		return EnQueue(c, cmd)
 	}
 	reply = dbi.ExecNormal(cmd)
 	return reply
@@ -143,18 +167,22 @@ func (dbi *DataBaseImpl) PutAbsent(key string, dataEntity *commoninterface.DataE
 func (dbi *DataBaseImpl) DeleteEntity(key string) int {
 	val, r := dbi.data.Remove(key)
 	dbi.ttlMap.Remove(key)
+	dbi.access.Remove(key)
 
 	if deleteCb := dbi.deleteCallback; r > 0 && deleteCb != nil {
 		deleteCb(dbi.index, key, val.(*commoninterface.DataEntity))
 	}
 	return r
 }
+
+// Remove deletes key, replicated dbs keep its version for a while so a deleted key is still newer than the copies
+// written before
 func (dbi *DataBaseImpl) Remove(key string) int {
 	val, result := dbi.data.Remove(key)
 	dbi.ttlMap.Remove(key)
-	dbi.versionMap.Remove(key)
-	taskKey := expireTaskKey(key)
-	delay.Cancel(taskKey)
+	dbi.access.Remove(key)
+	dbi.cancel(expireTaskKey(key))
+	dbi.removeVersion(key)
 	if deleteCb := dbi.deleteCallback; deleteCb != nil {
 		if result > 0 {
 			deleteCb(dbi.index, key, val.(*commoninterface.DataEntity))
@@ -162,66 +190,128 @@ func (dbi *DataBaseImpl) Remove(key string) int {
 	}
 	return result
 }
+
+// dropKey removes key and its version, the key was handed to the nodes now holding it and leaves no tombstone
+func (dbi *DataBaseImpl) dropKey(key string) {
+	dbi.Remove(key)
+	dbi.versionMap.Remove(key)
+	dbi.addAof(cmdutil.ToCmdLine("DEL", key))
+}
+
+// removeVersion drops the version of a removed key, or turns it into a tombstone dropped once tombstones elapsed
+// unless the key was written again meanwhile
+func (dbi *DataBaseImpl) removeVersion(key string) {
+	var ttl time.Duration
+	if dbi.tombstones != nil {
+		ttl = dbi.tombstones()
+	}
+	if ttl <= 0 {
+		dbi.versionMap.Remove(key)
+		return
+	}
+	dbi.at(dbi.now().Add(ttl), tombstoneTaskKey(key), func() {
+		dbi.RWLocks([]string{key}, nil)
+		defer dbi.RWUnLocks([]string{key}, nil)
+		if _, exists := dbi.data.Get(key); !exists {
+			dbi.versionMap.Remove(key)
+		}
+	})
+}
 func (dbi *DataBaseImpl) RemoveBatch(keys ...string) int {
 	var count int
 	for _, key := range keys {
 		_, result := dbi.data.Remove(key)
+		dbi.access.Remove(key)
 		count += result
 	}
 	return count
 
 }
 func (dbi *DataBaseImpl) Flush() {
+	dbi.clear()
+	dbi.addAof(cmdutil.ToCmdLine("flushdb"))
+}
+
+// clear drops every key in place, so connections which selected dbi keep using it
+func (dbi *DataBaseImpl) clear() {
 	dbi.data.Clear()
 	dbi.ttlMap.Clear()
 	dbi.versionMap.Clear()
-	dbi.addAof(cmdutil.ToCmdLine("flushdb"))
+	dbi.access.Clear()
 }
 func (dbi *DataBaseImpl) Expire(key string, ttl time.Time) {
 	dbi.ttlMap.Put(key, ttl)
-	taskKey := expireTaskKey(key)
-	delay.At(ttl, taskKey, func() {
+	dbi.at(ttl, expireTaskKey(key), func() {
 		_, exists := dbi.data.Get(key)
 		if !exists {
 			logger.Warn("expire key not exists", "key", key)
 			return
 		}
+		// the key may have got another ttl meanwhile
+		if expireAt, ok := dbi.ttlMap.Get(key); !ok || dbi.now().Before(expireAt.(time.Time)) {
+			return
+		}
 		dbi.Remove(key)
+		expiredKeys.With().Inc()
 	})
 	dbi.addAof(aof.ExpireToCmd(key, ttl).Args)
 }
 func (dbi *DataBaseImpl) Persist(key string) {
 	dbi.ttlMap.Remove(key)
-	taskKey := expireTaskKey(key)
-	delay.Cancel(taskKey)
+	dbi.cancel(expireTaskKey(key))
 	dbi.addAof(cmdutil.ToCmdLine("persist", key))
 }
+func (dbi *DataBaseImpl) at(at time.Time, key string, job func()) {
+	if dbi.timer == nil {
+		delay.At(at, key, job)
+		return
+	}
+	dbi.timer.Add(key, at, job)
+}
+func (dbi *DataBaseImpl) cancel(key string) {
+	if dbi.timer == nil {
+		delay.Cancel(key)
+		return
+	}
+	dbi.timer.Remove(key)
+}
+func (dbi *DataBaseImpl) now() time.Time {
+	if dbi.clock == nil {
+		return time.Now()
+	}
+	return dbi.clock.Now()
+}
 func (dbi *DataBaseImpl) IsExpire(key string) bool {
 	expireTime, exists := dbi.ttlMap.Get(key)
 	if !exists {
 		return false
 	}
-	if time.Now().After(expireTime.(time.Time)) {
+	if dbi.now().After(expireTime.(time.Time)) {
 		dbi.Remove(key)
+		expiredKeys.With().Inc()
 		return true
 	}
 	return true
 }
-func (dbi *DataBaseImpl) GetVersion(key string) (version uint32, ok bool) {
+func (dbi *DataBaseImpl) GetVersion(key string) (version uint64, ok bool) {
 	val, ok := dbi.versionMap.Get(key)
 	if ok {
-		version = val.(uint32)
+		version = val.(uint64)
 	}
 	return
 }
+
+// SetVersion bumps the versions of keys. A version is the wall clock in milliseconds shifted by versionLogicalBits
+// plus a counter of the writes within the same millisecond, so versions keep growing across restarts and AOF
+// rewrites, which lose the counters, and the versions of different nodes compare
 func (dbi *DataBaseImpl) SetVersion(key ...string) {
+	floor := uint64(dbi.now().UnixMilli()) << versionLogicalBits
 	for _, k := range key {
-		val, ok := dbi.versionMap.Get(k)
-		if ok {
-			dbi.versionMap.Put(k, val.(uint32)+1)
-		} else {
-			dbi.versionMap.Put(k, 1)
+		version := floor
+		if val, ok := dbi.versionMap.Get(k); ok && val.(uint64) >= version {
+			version = val.(uint64) + 1
 		}
+		dbi.versionMap.Put(k, version)
 	}
 }
 func (dbi *DataBaseImpl) ForEach(f func(key string, entity *commoninterface.DataEntity, expireTime time.Time) bool) {
@@ -233,30 +323,81 @@ func (dbi *DataBaseImpl) ForEach(f func(key string, entity *commoninterface.Data
 	})
 }
 func (dbi *DataBaseImpl) RWLocks(writeKeys []string, readKeys []string) {
+	if dbi.locker == nil {
+		return
+	}
+	if locksAll(readKeys) {
+		dbi.locker.RWLockAll(writeKeys)
+		return
+	}
 	dbi.locker.RWLockBatch(writeKeys, readKeys)
 }
 func (dbi *DataBaseImpl) RWUnLocks(writeKeys []string, readKeys []string) {
+	if dbi.locker == nil {
+		return
+	}
+	if locksAll(readKeys) {
+		dbi.locker.URWLockAll(writeKeys)
+		return
+	}
 	dbi.locker.URWLockBatch(writeKeys, readKeys)
 }
+func locksAll(readKeys []string) bool {
+	for _, key := range readKeys {
+		if key == lockAllKeys {
+			return true
+		}
+	}
+	return false
+}
+
+// ExecNormal locks the keys of line then executes it
 func (dbi *DataBaseImpl) ExecNormal(line cm.CmdLine) resp.Reply {
 	command, b := GetCommand(line)
 	reply := validateCommand(command, b, line)
 	if reply != nil {
 		return reply
 	}
-	return command.executor(dbi, line[1:])
+	if command.prepare == nil {
+		return command.executor(dbi, line[1:])
+	}
+	wkeys, rkeys := command.prepare(line[1:])
+	defer dbi.RWUnLocks(wkeys, rkeys)
+	dbi.RWLocks(wkeys, rkeys)
+	dbi.SetVersion(wkeys...)
+	reply = command.executor(dbi, line[1:])
+	dbi.touchKeys(command, wkeys, rkeys)
+	return reply
 }
+
+// ExecWithLock executes line whose keys are already locked by the caller
 func (dbi *DataBaseImpl) ExecWithLock(line cm.CmdLine) resp.Reply {
 	command, b := GetCommand(line)
 	reply := validateCommand(command, b, line)
 	if reply != nil {
 		return reply
 	}
-	wkeys, rkeys := command.prepare(line)
-	defer dbi.RWUnLocks(wkeys, rkeys)
-	dbi.RWLocks(wkeys, rkeys)
+	if command.prepare == nil {
+		return command.executor(dbi, line[1:])
+	}
+	wkeys, rkeys := command.prepare(line[1:])
 	dbi.SetVersion(wkeys...)
-	return command.executor(dbi, line)
+	reply = command.executor(dbi, line[1:])
+	dbi.touchKeys(command, wkeys, rkeys)
+	return reply
+}
+
+// touchKeys records the access of the keys of a command which ran, the keys it removed are skipped
+func (dbi *DataBaseImpl) touchKeys(command *Command, writeKeys, readKeys []string) {
+	if !command.touches() {
+		return
+	}
+	for _, key := range writeKeys {
+		dbi.touch(key)
+	}
+	for _, key := range readKeys {
+		dbi.touch(key)
+	}
 }
 func validateArity(arity int, cmdArgs cm.CmdLine) bool {
 	argNum := len(cmdArgs)
@@ -268,6 +409,9 @@ func validateArity(arity int, cmdArgs cm.CmdLine) bool {
 func expireTaskKey(key string) string {
 	return "expire:" + key
 }
+func tombstoneTaskKey(key string) string {
+	return "tombstone:" + key
+}
 func validateCommand(command *Command, b bool, line cm.CmdLine) resp.Reply {
 	if !b {
 		return resp.MakeErrReply("ERR unknown command " + string(line[0]))
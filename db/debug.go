@@ -0,0 +1,7 @@
+//go:build debug
+
+package db
+
+func init() {
+	debugCommands = true
+}
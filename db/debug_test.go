@@ -0,0 +1,64 @@
+package db
+
+import (
+	"mygodis/clientc"
+	"mygodis/config"
+	"mygodis/lib/clock"
+	"mygodis/lib/delay"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"testing"
+	"time"
+)
+
+func init() {
+	// tests run the servers on a virtual clock like the debug build does
+	debugCommands = true
+}
+
+// newVirtualDB returns a db with a time wheel and a virtual clock of its own, fastForward moves both
+func newVirtualDB(t *testing.T) (*DataBaseImpl, func(time.Duration)) {
+	c := clock.NewVirtual()
+	db := NewDB()
+	db.clock = c
+	db.timer = delay.NewTimeWheelWithClock(c)
+	db.timer.Start()
+	t.Cleanup(db.timer.Stop)
+	return db, func(d time.Duration) {
+		c.Advance(d)
+		db.timer.RunDue()
+	}
+}
+
+func TestDebug_fastForward(t *testing.T) {
+	server := NewStandaloneServer(&config.ServerProperties{Databases: 2})
+	defer server.Close()
+	conn := clientc.NewFakeConnection()
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "short", "v", "EX", "10"))
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "long", "v", "EX", "3600"))
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "forever", "v"))
+	if reply := server.Exec(conn, cmdutil.ToCmdLine("DEBUG", "FASTFORWARD", "10000")); string(reply.ToBytes()) != "+OK\r\n" {
+		t.Fatalf("except OK but got %s", reply.ToBytes())
+	}
+	if _, ok := server.GetEntity(0, "short"); ok {
+		t.Error("except short to expire")
+	}
+	if reply, ok := server.Exec(conn, cmdutil.ToCmdLine("TTL", "long")).(*resp.IntReply); !ok || reply.Code < 3589 || reply.Code > 3590 {
+		t.Errorf("except a ttl of 3590 but got %v", reply)
+	}
+	server.Exec(conn, cmdutil.ToCmdLine("DEBUG", "FASTFORWARD", "3590000"))
+	if _, ok := server.GetEntity(0, "long"); ok {
+		t.Error("except long to expire")
+	}
+	if _, ok := server.GetEntity(0, "forever"); !ok {
+		t.Error("except forever to stay")
+	}
+	if _, ok := server.Exec(conn, cmdutil.ToCmdLine("DEBUG", "FASTFORWARD", "-1")).(resp.ErrorReply); !ok {
+		t.Error("except an error for a negative time")
+	}
+	real := NewStandaloneServerWithClock(&config.ServerProperties{Databases: 1}, clock.Real)
+	defer real.Close()
+	if _, ok := real.Exec(conn, cmdutil.ToCmdLine("DEBUG", "FASTFORWARD", "1")).(resp.ErrorReply); !ok {
+		t.Error("except an error for the wall clock")
+	}
+}
@@ -0,0 +1,328 @@
+package db
+
+import (
+	"bytes"
+	rdbparse "github.com/hdt3213/rdb/parser"
+	"io"
+	"math"
+	"mygodis/aof"
+	cm "mygodis/common"
+	"mygodis/common/commoninterface"
+	"mygodis/datadriver/list"
+	"mygodis/parse"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrateDefaultTimeout is how long MIGRATE waits for the target when its timeout is not positive
+const migrateDefaultTimeout = time.Second
+
+// entityOfDump reads back a payload of DUMP as the value it would be if written in db
+func (db *DataBaseImpl) entityOfDump(payload []byte) (*commoninterface.DataEntity, error) {
+	obj, err := aof.ParseDump(payload)
+	if err != nil {
+		return nil, err
+	}
+	// lists are kept as linked lists by the list commands
+	if listObj, ok := obj.(*rdbparse.ListObject); ok {
+		linkedList := list.NewLikedList()
+		for _, v := range listObj.Values {
+			linkedList.Add(v)
+		}
+		return &commoninterface.DataEntity{Data: linkedList}, nil
+	}
+	entity := db.entityOf(obj)
+	if entity == nil {
+		return nil, aof.ErrDumpPayload
+	}
+	return entity, nil
+}
+
+// execDump runs DUMP key, it answers the serialized value of key or null if it does not exist
+func execDump(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
+	entity, ok := db.GetEntity(string(args[0]))
+	if !ok {
+		return resp.MakeNullBulkReply()
+	}
+	payload, err := aof.DumpEntity(entity)
+	if err != nil {
+		return resp.MakeErrReply("ERR " + err.Error())
+	}
+	return resp.MakeBulkReply(payload)
+}
+
+// execRestore runs RESTORE key ttl payload [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]. The ttl is in
+// milliseconds, a unix time with ABSTTL, and 0 keeps the key for ever.
+func execRestore(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return resp.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return resp.MakeErrReply("ERR Invalid TTL value, must be >= 0")
+	}
+	replace, absTTL := false, false
+	idle, freq := int64(-1), int64(-1)
+	for i := 3; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		switch {
+		case option == "REPLACE":
+			replace = true
+		case option == "ABSTTL":
+			absTTL = true
+		case option == "IDLETIME" && i+1 < len(args) && freq < 0:
+			i++
+			idle, err = strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return resp.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if idle < 0 {
+				return resp.MakeErrReply("ERR Invalid IDLETIME value, must be >= 0")
+			}
+		case option == "FREQ" && i+1 < len(args) && idle < 0:
+			i++
+			freq, err = strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return resp.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if freq < 0 || freq > math.MaxUint8 {
+				return resp.MakeErrReply("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+		default:
+			return resp.MakeSyntaxErrReply()
+		}
+	}
+	_, exists := db.GetEntity(key)
+	if exists && !replace {
+		return resp.MakeErrReply("BUSYKEY Target key name already exists.")
+	}
+	entity, err := db.entityOfDump(args[2])
+	if err != nil {
+		return resp.MakeErrReply("ERR " + err.Error())
+	}
+	var expireAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireAt = time.UnixMilli(ttl)
+		} else {
+			expireAt = db.now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+	}
+	if exists {
+		db.Remove(key)
+		db.addAof(cmdutil.ToCmdLine("del", key))
+	}
+	// a key restored already expired is not added
+	if !expireAt.IsZero() && !expireAt.After(db.now()) {
+		return resp.MakeOkReply()
+	}
+	db.PutEntity(key, entity)
+	db.addAof(aof.EntityToCmd(key, entity).Args)
+	if !expireAt.IsZero() {
+		expire(db, key, expireAt)
+	}
+	switch {
+	case idle >= 0:
+		db.setAccess(key, time.Duration(idle)*time.Second, lfuInitVal)
+	case freq >= 0:
+		db.setAccess(key, 0, uint32(freq))
+	default:
+		db.setAccess(key, 0, lfuInitVal)
+	}
+	return resp.MakeOkReply()
+}
+
+// migrateKeys returns the keys of MIGRATE host port key|"" db timeout [COPY] [REPLACE] [AUTH password]
+// [AUTH2 username password] [KEYS key ...], those after KEYS if key is empty
+func migrateKeys(args cm.CmdLine) []string {
+	if len(args) < 5 {
+		return nil
+	}
+	if len(args[2]) > 0 {
+		return []string{string(args[2])}
+	}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "AUTH":
+			i++
+		case "AUTH2":
+			i += 2
+		case "KEYS":
+			keys := make([]string, 0, len(args)-i-1)
+			for _, key := range args[i+1:] {
+				keys = append(keys, string(key))
+			}
+			return keys
+		}
+	}
+	return nil
+}
+
+// prepareMigrate writes the keys migrated, they are only read if COPY keeps them
+func prepareMigrate(args cm.CmdLine) ([]string, []string) {
+	if len(args) < 5 {
+		return nil, nil
+	}
+	keys := migrateKeys(args)
+	for _, arg := range args[5:] {
+		if strings.EqualFold(string(arg), "KEYS") {
+			break
+		}
+		if strings.EqualFold(string(arg), "COPY") {
+			return nil, keys
+		}
+	}
+	return keys, nil
+}
+
+// migrateExchange writes cmds to the instance at addr in one go and reads their replies, all within wait
+func migrateExchange(addr string, wait time.Duration, cmds []cm.CmdLine) ([]resp.Reply, error) {
+	conn, err := net.DialTimeout("tcp", addr, wait)
+	if err != nil {
+		return nil, err
+	}
+	payloads := parse.Parse(conn)
+	defer func() {
+		_ = conn.Close()
+		// the parser ends once it has reported the closed connection
+		for range payloads {
+		}
+	}()
+	_ = conn.SetDeadline(time.Now().Add(wait))
+	var buf bytes.Buffer
+	for _, cmd := range cmds {
+		buf.Write(resp.MakeMultiBulkReply(cmd).ToBytes())
+	}
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	replies := make([]resp.Reply, 0, len(cmds))
+	for payload := range payloads {
+		if payload.Err != nil {
+			return nil, payload.Err
+		}
+		if replies = append(replies, payload.Data); len(replies) == len(cmds) {
+			return replies, nil
+		}
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+// execMigrate runs MIGRATE, which restores the keys on the target with their ttl and deletes those restored
+// unless COPY is given. The keys stay locked while the target is waited for at most timeout milliseconds.
+func execMigrate(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
+	addr := net.JoinHostPort(string(args[0]), string(args[1]))
+	dbIndex, err := strconv.Atoi(string(args[3]))
+	if err != nil {
+		return resp.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeout, err := strconv.ParseInt(string(args[4]), 10, 64)
+	if err != nil {
+		return resp.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	copyKeys, replace := false, false
+	var auth cm.CmdLine
+	hasKeys := false
+	for i := 5; i < len(args) && !hasKeys; i++ {
+		switch option := strings.ToUpper(string(args[i])); {
+		case option == "COPY":
+			copyKeys = true
+		case option == "REPLACE":
+			replace = true
+		case option == "AUTH" && i+1 < len(args):
+			auth = cm.CmdLine{[]byte("AUTH"), args[i+1]}
+			i++
+		case option == "AUTH2" && i+2 < len(args):
+			auth = cm.CmdLine{[]byte("AUTH"), args[i+1], args[i+2]}
+			i += 2
+		case option == "KEYS":
+			if len(args[2]) > 0 {
+				return resp.MakeErrReply("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			hasKeys = true
+		default:
+			return resp.MakeSyntaxErrReply()
+		}
+	}
+
+	// the keys which exist with their remaining ttl and payload
+	var keys []string
+	restores := make([]cm.CmdLine, 0)
+	for _, key := range migrateKeys(args) {
+		entity, ok := db.GetEntity(key)
+		if !ok {
+			continue
+		}
+		ttl := int64(0)
+		if expireAt, ok := db.ttlMap.Get(key); ok {
+			if ttl = int64(expireAt.(time.Time).Sub(db.now()) / time.Millisecond); ttl < 1 {
+				ttl = 1
+			}
+		}
+		payload, err := aof.DumpEntity(entity)
+		if err != nil {
+			return resp.MakeErrReply("ERR " + err.Error())
+		}
+		restore := cm.CmdLine{[]byte("RESTORE"), []byte(key), []byte(strconv.FormatInt(ttl, 10)), payload}
+		if replace {
+			restore = append(restore, []byte("REPLACE"))
+		}
+		keys = append(keys, key)
+		restores = append(restores, restore)
+	}
+	if len(keys) == 0 {
+		return resp.MakeSimpleStringReply("NOKEY")
+	}
+
+	wait := time.Duration(timeout) * time.Millisecond
+	if wait <= 0 {
+		wait = migrateDefaultTimeout
+	}
+	cmds := make([]cm.CmdLine, 0, len(restores)+2)
+	if auth != nil {
+		cmds = append(cmds, auth)
+	}
+	cmds = append(cmds, cmdutil.ToCmdLine("SELECT", strconv.Itoa(dbIndex)))
+	cmds = append(cmds, restores...)
+	replies, err := migrateExchange(addr, wait, cmds)
+	if err != nil {
+		return resp.MakeErrReply("IOERR error or timeout reading to target instance")
+	}
+	// AUTH and SELECT must succeed for any key to be restored
+	prelude := len(replies) - len(restores)
+	for _, reply := range replies[:prelude] {
+		if errReply, ok := reply.(resp.ErrorReply); ok {
+			return resp.MakeErrReply("ERR Target instance replied with error: " + errReply.Error())
+		}
+	}
+	var failed error
+	migrated := make([]string, 0, len(keys))
+	for i, reply := range replies[prelude:] {
+		if errReply, ok := reply.(resp.ErrorReply); ok {
+			if failed == nil {
+				failed = errReply
+			}
+			continue
+		}
+		migrated = append(migrated, keys[i])
+	}
+	if !copyKeys && len(migrated) > 0 {
+		db.RemoveBatch(migrated...)
+		db.addAof(cmdutil.ToCmdLine(append([]string{"del"}, migrated...)...))
+	}
+	if failed != nil {
+		return resp.MakeErrReply("ERR Target instance replied with error: " + failed.Error())
+	}
+	return resp.MakeOkReply()
+}
+
+func init() {
+	RegisterCommand("DUMP", execDump, readFirstKey, nil, 2, ReadOnly)
+	RegisterCommand("RESTORE", execRestore, writeFirstKey, rollbackFirstKey, -4, Write|NoTouch)
+	RegisterCommand("MIGRATE", execMigrate, prepareMigrate, nil, -6, Write)
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"mygodis/clientc"
+	"mygodis/config"
+	"mygodis/parse"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// serve answers the RESP commands sent to the returned address with server
+func serve(t *testing.T, server *StandaloneServer) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				client := clientc.NewFakeConnection()
+				for payload := range parse.Parse(conn) {
+					line, ok := payload.Data.(*resp.MultiBulkReply)
+					if payload.Err != nil || !ok {
+						return
+					}
+					if _, err := conn.Write(server.Exec(client, line.Args).ToBytes()); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestDumpRestore(t *testing.T) {
+	server := NewStandaloneServer(&config.ServerProperties{Databases: 1})
+	defer server.Close()
+	conn := clientc.NewFakeConnection()
+	exec := func(args ...string) resp.Reply {
+		return server.Exec(conn, cmdutil.ToCmdLine(args...))
+	}
+	exec("SET", "string", "value")
+	exec("RPUSH", "list", "a", "b", "c")
+	exec("HSET", "hash", "f", "v")
+	exec("SADD", "ints", "1", "2")
+	exec("SADD", "set", "a", "b")
+	exec("ZADD", "zset", "1.5", "m")
+	for _, key := range []string{"string", "list", "hash", "ints", "set", "zset"} {
+		dump, ok := exec("DUMP", key).(*resp.BulkReply)
+		if !ok {
+			t.Fatalf("except the payload of %s", key)
+		}
+		restored := key + ".restored"
+		if reply := exec("RESTORE", restored, "0", string(dump.Arg)); string(reply.ToBytes()) != "+OK\r\n" {
+			t.Fatalf("except %s restored but got %q", key, reply.ToBytes())
+		}
+		entity, _ := server.selectDB(0).GetEntity(key)
+		copied, _ := server.selectDB(0).GetEntity(restored)
+		if encodingOf(copied.Data) != encodingOf(entity.Data) || !reflect.DeepEqual(contents(copied.Data), contents(entity.Data)) {
+			t.Errorf("except %s restored as %s but got %s", key, encodingOf(entity.Data), encodingOf(copied.Data))
+		}
+	}
+	if got := exec("LRANGE", "list.restored", "0", "-1"); string(got.ToBytes()) != "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n" {
+		t.Errorf("except the restored list to be usable but got %q", got.ToBytes())
+	}
+	if got := exec("DUMP", "none"); string(got.ToBytes()) != "$-1\r\n" {
+		t.Errorf("except null for a missing key but got %q", got.ToBytes())
+	}
+
+	payload := string(exec("DUMP", "string").(*resp.BulkReply).Arg)
+	for _, c := range []struct {
+		args   []string
+		except string
+	}{
+		{[]string{"RESTORE", "string", "0", payload}, "-BUSYKEY Target key name already exists.\r\n"},
+		{[]string{"RESTORE", "string", "0", payload[:len(payload)-1] + "x", "REPLACE"}, "-ERR DUMP payload version or checksum are wrong\r\n"},
+		{[]string{"RESTORE", "new", "-1", payload}, "-ERR Invalid TTL value, must be >= 0\r\n"},
+		{[]string{"RESTORE", "new", "0", payload, "IDLETIME", "1", "FREQ", "1"}, "-Err syntax error\r\n"},
+		{[]string{"RESTORE", "new", "0", payload, "FREQ", "256"}, "-ERR Invalid FREQ value, must be >= 0 and <= 255\r\n"},
+		{[]string{"RESTORE", "string", "0", payload, "REPLACE"}, "+OK\r\n"},
+		{[]string{"RESTORE", "past", "1", payload, "ABSTTL"}, "+OK\r\n"},
+		{[]string{"RESTORE", "ttl", "5000", payload}, "+OK\r\n"},
+		{[]string{"RESTORE", "idle", "0", payload, "IDLETIME", "100"}, "+OK\r\n"},
+		{[]string{"RESTORE", "freq", "0", payload, "FREQ", "42"}, "+OK\r\n"},
+	} {
+		if got := exec(c.args...); string(got.ToBytes()) != c.except {
+			t.Errorf("except %q for %v but got %q", c.except, c.args[:2], got.ToBytes())
+		}
+	}
+	if got := exec("EXISTS", "past"); string(got.ToBytes()) != ":0\r\n" {
+		t.Errorf("except a key restored expired to be skipped but got %q", got.ToBytes())
+	}
+	if got := exec("PTTL", "ttl").(*resp.IntReply); got.Code <= 4000 || got.Code > 5000 {
+		t.Errorf("except ttl to expire in 5s but got %d", got.Code)
+	}
+	if got := exec("OBJECT", "IDLETIME", "idle").(*resp.IntReply); got.Code != 100 {
+		t.Errorf("except idle for 100s but got %d", got.Code)
+	}
+	if got := exec("OBJECT", "FREQ", "freq").(*resp.IntReply); got.Code != 42 {
+		t.Errorf("except freq 42 but got %d", got.Code)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	source := NewStandaloneServer(&config.ServerProperties{Databases: 2})
+	defer source.Close()
+	target := NewStandaloneServer(&config.ServerProperties{Databases: 2, RequirePass: "pw"})
+	defer target.Close()
+	host, port, _ := net.SplitHostPort(serve(t, target))
+	conn, targetConn := clientc.NewFakeConnection(), clientc.NewFakeConnection()
+	targetConn.SelectDB(1)
+	exec := func(args ...string) string {
+		return string(source.Exec(conn, cmdutil.ToCmdLine(args...)).ToBytes())
+	}
+	for i := 0; i < 3; i++ {
+		exec("SET", "k"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+	}
+	exec("PEXPIRE", "k0", "60000")
+
+	if got := exec("MIGRATE", host, port, "k0", "1", "1000", "AUTH", "wrong"); got[0] != '-' || exec("EXISTS", "k0") != ":1\r\n" {
+		t.Errorf("except a wrong password to keep k0 but got %q", got)
+	}
+	if got := exec("MIGRATE", host, port, "k0", "1", "1000", "AUTH", "pw"); got != "+OK\r\n" {
+		t.Fatalf("except k0 migrated but got %q", got)
+	}
+	if exec("EXISTS", "k0") != ":0\r\n" {
+		t.Error("except k0 deleted once migrated")
+	}
+	if got := target.Exec(targetConn, cmdutil.ToCmdLine("PTTL", "k0")).(*resp.IntReply); got.Code <= 0 || got.Code > 60000 {
+		t.Errorf("except the ttl migrated with k0 but got %d", got.Code)
+	}
+	if got := exec("MIGRATE", host, port, "", "1", "1000", "COPY", "AUTH", "pw", "KEYS", "k1", "k2", "none"); got != "+OK\r\n" {
+		t.Fatalf("except k1 and k2 copied but got %q", got)
+	}
+	if exec("EXISTS", "k1", "k2") != ":2\r\n" {
+		t.Error("except COPY to keep the keys")
+	}
+	if got := exec("MIGRATE", host, port, "k1", "1", "1000", "AUTH", "pw"); got[0] != '-' || exec("EXISTS", "k1") != ":1\r\n" {
+		t.Errorf("except BUSYKEY to keep k1 but got %q", got)
+	}
+	exec("SET", "k1", "changed")
+	if got := exec("MIGRATE", host, port, "k1", "1", "1000", "REPLACE", "AUTH", "pw"); got != "+OK\r\n" {
+		t.Errorf("except k1 replaced but got %q", got)
+	}
+	if got := target.Exec(targetConn, cmdutil.ToCmdLine("GET", "k1")); string(got.ToBytes()) != "$7\r\nchanged\r\n" {
+		t.Errorf("except k1 replaced on the target but got %q", got.ToBytes())
+	}
+	if got := exec("MIGRATE", host, port, "none", "1", "1000"); got != "+NOKEY\r\n" {
+		t.Errorf("except NOKEY but got %q", got)
+	}
+	if got := exec("MIGRATE", host, port, "k2", "1", "1000", "KEYS", "k2"); got[0] != '-' {
+		t.Errorf("except KEYS with a key to fail but got %q", got)
+	}
+	if got := exec("MIGRATE", "127.0.0.1", "1", "k2", "0", "100"); got[:6] != "-IOERR" {
+		t.Errorf("except an io error but got %q", got)
+	}
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"mygodis/config"
+	"mygodis/datadriver/dict"
+	"mygodis/datadriver/set"
+	"mygodis/datadriver/sortedset"
+)
+
+// encodingLimits are the thresholds of the compact encodings of the hashes, sets and zsets of a db
+type encodingLimits struct {
+	hash dict.ListpackLimits
+	set  set.Limits
+	zset sortedset.Limits
+}
+
+var defaultEncodingLimits = &encodingLimits{
+	hash: dict.ListpackLimits{Entries: 128, Value: 64},
+	set:  set.Limits{IntsetEntries: 512, ListpackEntries: 128, ListpackValue: 64},
+	zset: sortedset.Limits{ListpackEntries: 128, ListpackValue: 64},
+}
+
+// makeEncodingLimits reads the thresholds of props, the default of those which are not set
+func makeEncodingLimits(props *config.ServerProperties) *encodingLimits {
+	or := func(value, def int) int {
+		if value == 0 {
+			return def
+		}
+		return value
+	}
+	def := defaultEncodingLimits
+	return &encodingLimits{
+		hash: dict.ListpackLimits{
+			Entries: or(props.HashMaxListpackEntries, def.hash.Entries),
+			Value:   or(props.HashMaxListpackValue, def.hash.Value),
+		},
+		set: set.Limits{
+			IntsetEntries:   or(props.SetMaxIntsetEntries, def.set.IntsetEntries),
+			ListpackEntries: or(props.SetMaxListpackEntries, def.set.ListpackEntries),
+			ListpackValue:   or(props.SetMaxListpackValue, def.set.ListpackValue),
+		},
+		zset: sortedset.Limits{
+			ListpackEntries: or(props.ZSetMaxListpackEntries, def.zset.ListpackEntries),
+			ListpackValue:   or(props.ZSetMaxListpackValue, def.zset.ListpackValue),
+		},
+	}
+}
+
+func (dbi *DataBaseImpl) limits() *encodingLimits {
+	if dbi.encodings == nil {
+		return defaultEncodingLimits
+	}
+	return dbi.encodings
+}
+
+// makeHash returns an empty hash, a listpack until it outgrows the limits of the db
+func (dbi *DataBaseImpl) makeHash() dict.Dict {
+	return dict.NewListpackDict(&dbi.limits().hash)
+}
+
+// makeSet returns a set of members, an intset or a listpack while it fits the limits of the db
+func (dbi *DataBaseImpl) makeSet(members ...string) *set.Set {
+	return set.MakeCompactSet(&dbi.limits().set, members...)
+}
+
+// makeZSet returns an empty zset, a listpack until it outgrows the limits of the db
+func (dbi *DataBaseImpl) makeZSet() *sortedset.ZSet {
+	return sortedset.MakeCompactZSet(&dbi.limits().zset)
+}
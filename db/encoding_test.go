@@ -0,0 +1,170 @@
+package db
+
+import (
+	"bytes"
+	"github.com/hdt3213/rdb/core"
+	parse "github.com/hdt3213/rdb/parser"
+	"mygodis/aof"
+	"mygodis/clientc"
+	"mygodis/common/commoninterface"
+	"mygodis/config"
+	"mygodis/datadriver/dict"
+	"mygodis/datadriver/set"
+	"mygodis/datadriver/sortedset"
+	"mygodis/util/cmdutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// contents returns the fields, members or elements of a hash, set or zset with their values
+func contents(data any) map[string]string {
+	result := make(map[string]string)
+	switch data := data.(type) {
+	case dict.Dict:
+		data.ForEach(func(field string, val any) bool {
+			result[field] = val.(string)
+			return true
+		})
+	case *set.Set:
+		data.ForEach(func(member string) bool {
+			result[member] = ""
+			return true
+		})
+	case *sortedset.ZSet:
+		data.ForEach(0, data.Len(), false, func(element *sortedset.Element) bool {
+			result[element.Member] = strconv.FormatFloat(element.Score, 'f', -1, 64)
+			return true
+		})
+	}
+	return result
+}
+
+func TestEncodingConversion(t *testing.T) {
+	props := &config.ServerProperties{
+		Databases:              1,
+		HashMaxListpackEntries: 2,
+		HashMaxListpackValue:   8,
+		SetMaxIntsetEntries:    2,
+		SetMaxListpackEntries:  3,
+		ZSetMaxListpackEntries: -1,
+	}
+	server := NewStandaloneServer(props)
+	defer server.Close()
+	conn := clientc.NewFakeConnection()
+	db := server.selectDB(0)
+	encoding := func(key string) string {
+		entity, _ := db.GetEntity(key)
+		return encodingOf(entity.Data)
+	}
+	for _, c := range []struct {
+		cmd    []string
+		key    string
+		except string
+	}{
+		{[]string{"HSET", "hash", "a", "1"}, "hash", "listpack"},
+		{[]string{"HSET", "hash", "b", "2"}, "hash", "listpack"},
+		{[]string{"HSET", "hash", "c", "3"}, "hash", "hashtable"},
+		{[]string{"HSET", "long", "a", strings.Repeat("x", 9)}, "long", "hashtable"},
+		{[]string{"SADD", "set", "1", "2"}, "set", "intset"},
+		{[]string{"SADD", "set", "a"}, "set", "listpack"},
+		{[]string{"SADD", "set", "b"}, "set", "hashtable"},
+		{[]string{"SADD", "ints", "1", "2", "3"}, "ints", "listpack"},
+	} {
+		server.Exec(conn, cmdutil.ToCmdLine(c.cmd...))
+		if got := encoding(c.key); got != c.except {
+			t.Errorf("except %s encoded as %s after %v but got %s", c.key, c.except, c.cmd, got)
+		}
+	}
+	if hash, _ := db.GetEntity("hash"); !reflect.DeepEqual(contents(hash.Data), map[string]string{"a": "1", "b": "2", "c": "3"}) {
+		t.Errorf("except the fields kept by the upgrade but got %v", contents(hash.Data))
+	}
+	if set, _ := db.GetEntity("set"); !reflect.DeepEqual(contents(set.Data), map[string]string{"1": "", "2": "", "a": "", "b": ""}) {
+		t.Errorf("except the members kept by the upgrades but got %v", contents(set.Data))
+	}
+	// a negative threshold leaves no zset in a listpack
+	if zset := db.makeZSet(); zset.Add("a", 1) && zset.Encoding() != "skiplist" {
+		t.Errorf("except a skiplist but got %s", zset.Encoding())
+	}
+}
+
+func TestEncodingPersistence(t *testing.T) {
+	server := NewStandaloneServer(&config.ServerProperties{Databases: 1})
+	defer server.Close()
+	db := server.selectDB(0)
+	values := map[string]any{}
+	for _, n := range []int{3, 300} {
+		hash, ints, members, zset := db.makeHash(), db.makeSet(), db.makeSet(), db.makeZSet()
+		for i := 0; i < n; i++ {
+			member := strconv.Itoa(i)
+			hash.Put("f"+member, member)
+			ints.Add(member)
+			members.Add("m" + member)
+			zset.Add("m"+member, float64(i)/2)
+		}
+		for name, data := range map[string]any{"hash": hash, "ints": ints, "members": members, "zset": zset} {
+			values[name+strconv.Itoa(n)] = data
+		}
+	}
+
+	// aof replays the commands marshaled from the values
+	replica := NewStandaloneServer(&config.ServerProperties{Databases: 1})
+	defer replica.Close()
+	conn := clientc.NewFakeConnection()
+	for key, data := range values {
+		cmd := aof.EntityToCmd(key, commoninterface.DataEntityWithData(data))
+		replica.Exec(conn, cmd.Args)
+		entity, ok := replica.selectDB(0).GetEntity(key)
+		if !ok || encodingOf(entity.Data) != encodingOf(data) || !reflect.DeepEqual(contents(entity.Data), contents(data)) {
+			t.Errorf("except %s to be replayed from aof", key)
+		}
+	}
+
+	// rdb reads the values back with the same encodings
+	var buf bytes.Buffer
+	encoder := core.NewEncoder(&buf)
+	if err := encoder.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.WriteDBHeader(0, uint64(len(values)), 0); err != nil {
+		t.Fatal(err)
+	}
+	for key, data := range values {
+		if err := aof.WriteEntity(encoder, key, commoninterface.DataEntityWithData(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.WriteEnd(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := 0
+	err := core.NewDecoder(&buf).Parse(func(obj parse.RedisObject) bool {
+		loaded++
+		data := values[obj.GetKey()]
+		entity := db.entityOf(obj)
+		if entity == nil || encodingOf(entity.Data) != encodingOf(data) || !reflect.DeepEqual(contents(entity.Data), contents(data)) {
+			t.Errorf("except %s to be read back from rdb", obj.GetKey())
+		}
+		return true
+	})
+	if err != nil || loaded != len(values) {
+		t.Errorf("except %d values read back but got %d and %v", len(values), loaded, err)
+	}
+}
+
+func TestMakeAuxiliaryServer(t *testing.T) {
+	props := &config.ServerProperties{Databases: 2, ZSetMaxListpackEntries: 1}
+	defer func(old *config.ServerProperties) { config.Properties = old }(config.Properties)
+	config.Properties = &config.ServerProperties{Databases: 1}
+	aux := MakeAuxiliaryServer(props)
+	if len(aux.Dbs) != 2 {
+		t.Fatalf("except the dbs of props but got %d", len(aux.Dbs))
+	}
+	zset := aux.selectDB(1).makeZSet()
+	zset.Add("a", 1)
+	zset.Add("b", 2)
+	if zset.Encoding() != "skiplist" {
+		t.Errorf("except the limits of props but got %s", zset.Encoding())
+	}
+}
@@ -23,7 +23,7 @@ func (db *DataBaseImpl) getAsHash(key string) (dict.Dict, resp.ErrorReply) {
 func (db *DataBaseImpl) getOrCreateAsHash(key string) (result dict.Dict, isNew bool) {
 	d, _ := db.getAsHash(key)
 	if d == nil {
-		d = dict.NewConcurrentDict()
+		d = db.makeHash()
 		return d, true
 	}
 	return d, false
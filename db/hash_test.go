@@ -177,11 +177,12 @@ func Test_execHGetAll(t *testing.T) {
 				db:   dbWithHData(dbWithHData(NewDB(), "key", "field", "value"), "key", "field1", "value1"),
 				args: common.CmdLine{[]byte("key")},
 			},
+			// a small hash is a listpack keeping the fields in insertion order
 			want: resp.MakeMultiBulkReply([][]byte{
-				[]byte("field1"),
-				[]byte("value1"),
 				[]byte("field"),
 				[]byte("value"),
+				[]byte("field1"),
+				[]byte("value1"),
 			}),
 		},
 	}
@@ -45,9 +45,27 @@ func execExists(db *DataBaseImpl, cmd cm.CmdLine) resp.Reply {
 	return resp.MakeIntReply(int64(count))
 }
 func execFlushDB(db *DataBaseImpl, line cm.CmdLine) resp.Reply {
+	if len(line) > 1 || len(line) == 1 && !isFlushMode(string(line[0])) {
+		return resp.MakeErrReply("ERR syntax error")
+	}
 	db.Flush()
 	return resp.MakeOkReply()
 }
+
+// isFlushMode returns whether arg is the ASYNC or SYNC option of FLUSHDB and FLUSHALL
+func isFlushMode(arg string) bool {
+	return strings.EqualFold(arg, "ASYNC") || strings.EqualFold(arg, "SYNC")
+}
+func execDBSize(db *DataBaseImpl, line cm.CmdLine) resp.Reply {
+	return resp.MakeIntReply(int64(db.data.Len()))
+}
+func execRandomKey(db *DataBaseImpl, line cm.CmdLine) resp.Reply {
+	keys := db.data.RandomKeys(1)
+	if len(keys) == 0 {
+		return resp.MakeNullBulkReply()
+	}
+	return resp.MakeBulkReply([]byte(keys[0]))
+}
 func execType(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	if len(args) != 1 {
 		return resp.MakeErrReply("wrong number of arguments for 'type' command")
@@ -61,7 +79,7 @@ func execType(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 		return resp.MakeBulkReply([]byte("string"))
 	case list.List:
 		return resp.MakeBulkReply([]byte("list"))
-	case dict.ConcurrentDict:
+	case dict.Dict:
 		return resp.MakeBulkReply([]byte("hash"))
 	case *set.Set:
 		return resp.MakeBulkReply([]byte("set"))
@@ -136,7 +154,7 @@ func execExpire(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	if !ok {
 		return resp.MakeIntReply(0)
 	}
-	expireAt := time.Now().Add(ttl)
+	expireAt := db.now().Add(ttl)
 	return expire(db, key, expireAt)
 }
 func execExpireAt(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
@@ -163,7 +181,7 @@ func execPExpire(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	if !ok {
 		return resp.MakeIntReply(0)
 	}
-	expireAt := time.Now().Add(ttl)
+	expireAt := db.now().Add(ttl)
 	return expire(db, key, expireAt)
 }
 func execPExpireAt(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
@@ -188,7 +206,7 @@ func execTTL(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	if !ok {
 		return resp.MakeIntReply(-1)
 	}
-	return resp.MakeIntReply(int64(ttl.(time.Time).Sub(time.Now()) / time.Second))
+	return resp.MakeIntReply(int64(ttl.(time.Time).Sub(db.now()) / time.Second))
 }
 func execPTTL(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	key := string(args[0])
@@ -199,7 +217,7 @@ func execPTTL(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	if !ok {
 		return resp.MakeIntReply(-1)
 	}
-	return resp.MakeIntReply(int64(ttl.(time.Time).Sub(time.Now()) / time.Millisecond))
+	return resp.MakeIntReply(int64(ttl.(time.Time).Sub(db.now()) / time.Millisecond))
 }
 func execPersist(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	key := string(args[0])
@@ -283,10 +301,12 @@ func toTTLcmd(db *DataBaseImpl, key string) *resp.MultiBulkReply {
 	expireAt := val.(time.Time)
 	return resp.MakeMultiBulkReply(cmdutil.ToCmdLine("expireat", key, strconv.FormatInt(expireAt.Unix()/1e6, 10)))
 }
+
+// prepareRename writes both keys as src is removed
 func prepareRename(args cm.CmdLine) ([]string, []string) {
 	src := string(args[0])
 	dest := string(args[1])
-	return []string{dest}, []string{src}
+	return []string{src, dest}, nil
 }
 func undoDeleteCommands(db *DataBaseImpl, line cm.CmdLine) []cm.CmdLine {
 	keys := make([]string, 0, len(line))
@@ -305,12 +325,12 @@ func undoExpireCommands(db *DataBaseImpl, line cm.CmdLine) []cm.CmdLine {
 	return []cm.CmdLine{toTTLcmd(db, key).Args}
 }
 func init() {
-	RegisterCommand("EXISTS", execExists, readFirstKey, nil, -2, ReadOnly)
+	RegisterCommand("EXISTS", execExists, readAllKeys, nil, -2, ReadOnly)
 	RegisterCommand("TTL", execTTL, readFirstKey, nil, 2, ReadOnly)
 	RegisterCommand("PTTL", execPTTL, readFirstKey, nil, 2, ReadOnly)
 	RegisterCommand("TYPR", execType, readFirstKey, nil, 2, ReadOnly)
 	RegisterCommand("KEYS", execKeys, nil, nil, 2, ReadOnly)
-	RegisterCommand("DEL", execDelete, writeFirstKey, undoDeleteCommands, -2, Write)
+	RegisterCommand("DEL", execDelete, writeAllKeys, undoDeleteCommands, -2, Write)
 	RegisterCommand("EXPIRE", execExpire, writeFirstKey, undoExpireCommands, 3, Write)
 	RegisterCommand("EXPIREAT", execExpireAt, writeFirstKey, undoExpireCommands, 3, Write)
 	RegisterCommand("PEXPIRE", execPExpire, writeFirstKey, undoExpireCommands, 3, Write)
@@ -318,5 +338,7 @@ func init() {
 	RegisterCommand("PERSIST", execPersist, writeFirstKey, nil, 2, Write)
 	RegisterCommand("RENAME", execRename, prepareRename, undoRenameCommands, 3, Write)
 	RegisterCommand("RENAMENX", execRenameNx, prepareRename, undoRenameCommands, 3, Write)
-	RegisterCommand("FLUSHDB", execFlushDB, nil, nil, 1, Write)
+	RegisterCommand("FLUSHDB", execFlushDB, nil, nil, -1, Write)
+	RegisterCommand("DBSIZE", execDBSize, nil, nil, 1, ReadOnly)
+	RegisterCommand("RANDOMKEY", execRandomKey, nil, nil, 1, ReadOnly)
 }
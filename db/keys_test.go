@@ -4,8 +4,10 @@ import (
 	"container/list"
 	"fmt"
 	"math/rand"
+	"mygodis/clientc"
 	"mygodis/common"
 	"mygodis/common/commoninterface"
+	"mygodis/config"
 	"mygodis/datadriver/dict"
 	"mygodis/datadriver/set"
 	"mygodis/datadriver/sortedset"
@@ -143,7 +145,7 @@ func Test_execExists(t *testing.T) {
 }
 
 func Test_execExpire(t *testing.T) {
-	db := NewDB()
+	db, fastForward := newVirtualDB(t)
 	expires := make(map[string]int64)
 	for i := int64(0); i < 10; i++ {
 		expires[fmt.Sprintf("%d", i)] = i * 2
@@ -159,19 +161,23 @@ func Test_execExpire(t *testing.T) {
 			dump(db)
 		}
 	}
-
-	select {
-	case <-time.After(time.Second * 30):
-		dump(db)
+	fastForward(9 * time.Second)
+	for key, expire := range expires {
+		if _, exists := db.data.Get(key); exists != (expire > 9) {
+			t.Errorf("key %s expiring in %ds exists %v after 9s", key, expire, exists)
+		}
+	}
+	fastForward(10 * time.Second)
+	if db.data.Len() != 0 {
+		t.Errorf("except every key to expire but got %d", db.data.Len())
 	}
-
 }
 
 func Test_execExpireAt(t *testing.T) {
-	db := NewDB()
+	db, fastForward := newVirtualDB(t)
 	expires := make(map[string]int64)
 	for i := int64(0); i < 10; i++ {
-		expires[fmt.Sprintf("%d", i)] = time.Now().Add(time.Second * 2).Unix()
+		expires[fmt.Sprintf("%d", i)] = db.now().Add(time.Second * 2).Unix()
 	}
 	for i := int64(0); i < 10; i++ {
 		db.PutEntity(fmt.Sprintf("%d", i), &commoninterface.DataEntity{Data: i})
@@ -182,12 +188,10 @@ func Test_execExpireAt(t *testing.T) {
 			t.Errorf("except %v but got %v", resp.MakeIntReply(1), got)
 		}
 	}
-
-	select {
-	case <-time.After(time.Second * 25):
-		dump(db)
+	fastForward(3 * time.Second)
+	if db.data.Len() != 0 {
+		t.Errorf("except every key to expire but got %d", db.data.Len())
 	}
-
 }
 
 func Test_execFlushDB(t *testing.T) {
@@ -202,7 +206,7 @@ func Test_execFlushDB(t *testing.T) {
 }
 
 func Test_execPExpire(t *testing.T) {
-	db := NewDB()
+	db, fastForward := newVirtualDB(t)
 	expires := make(map[string]int64)
 	for i := int64(0); i < 10; i++ {
 		expires[fmt.Sprintf("%d", i)] = i * 2000
@@ -215,18 +219,23 @@ func Test_execPExpire(t *testing.T) {
 			t.Errorf("except %v but got %v", resp.MakeIntReply(1), got)
 		}
 	}
-	select {
-	case <-time.After(time.Second * 30):
-		dump(db)
-
+	fastForward(9 * time.Second)
+	for key, expire := range expires {
+		if _, exists := db.data.Get(key); exists != (expire > 9000) {
+			t.Errorf("key %s expiring in %dms exists %v after 9s", key, expire, exists)
+		}
+	}
+	fastForward(10 * time.Second)
+	if db.data.Len() != 0 {
+		t.Errorf("except every key to expire but got %d", db.data.Len())
 	}
 }
 
 func Test_execPExpireAt(t *testing.T) {
-	db := NewDB()
+	db, fastForward := newVirtualDB(t)
 	expires := make(map[string]int64)
 	for i := int64(0); i < 10; i++ {
-		expires[fmt.Sprintf("%d", i)] = time.Now().Add(time.Second * time.Duration(i+1)).UnixMilli()
+		expires[fmt.Sprintf("%d", i)] = db.now().Add(time.Second * time.Duration(i+1)).UnixMilli()
 	}
 	for i := int64(0); i < 10; i++ {
 		db.PutEntity(fmt.Sprintf("%d", i), &commoninterface.DataEntity{Data: i})
@@ -236,32 +245,52 @@ func Test_execPExpireAt(t *testing.T) {
 			t.Errorf("except %v but got %v", resp.MakeIntReply(1), got)
 		}
 	}
-	time.Sleep(time.Second * 30)
+	fastForward(5*time.Second + 500*time.Millisecond)
+	if db.data.Len() != 5 {
+		t.Errorf("except 5 keys left but got %d", db.data.Len())
+	}
+	fastForward(5 * time.Second)
+	if db.data.Len() != 0 {
+		t.Errorf("except every key to expire but got %d", db.data.Len())
+	}
 	dump(db)
 }
 
 func Test_execPTTL(t *testing.T) {
-	db := NewDB()
+	db, fastForward := newVirtualDB(t)
 	expires := make(map[string]int64)
 	for i := int64(0); i < 10; i++ {
-		expires[fmt.Sprintf("%d", i)] = time.Now().Add(time.Second * time.Duration(i+1)).UnixMilli()
+		expires[fmt.Sprintf("%d", i)] = db.now().Add(time.Second * time.Duration(i+1)).UnixMilli()
 	}
 	for i := int64(0); i < 10; i++ {
 		db.PutEntity(fmt.Sprintf("%d", i), &commoninterface.DataEntity{Data: i})
 	}
-	for key, _ := range expires {
-		pttl := execPTTL(db, cmdutil.ToCmdLine(key))
-		fmt.Println(string(pttl.ToBytes()))
+	for key := range expires {
+		if got := execPTTL(db, cmdutil.ToCmdLine(key)); !reflect.DeepEqual(got, resp.MakeIntReply(-1)) {
+			t.Errorf("except %v but got %v", resp.MakeIntReply(-1), got)
+		}
+		execPExpireAt(db, cmdutil.ToCmdLine(key, strconv.FormatInt(expires[key], 10)))
+	}
+	fastForward(500 * time.Millisecond)
+	for key, expire := range expires {
+		left := expire - db.now().UnixMilli()
+		pttl, ok := execPTTL(db, cmdutil.ToCmdLine(key)).(*resp.IntReply)
+		if !ok || pttl.Code > left || pttl.Code < left-10 {
+			t.Errorf("except a pttl of %d but got %v", left, pttl)
+		}
+	}
+	fastForward(10 * time.Second)
+	if got := execPTTL(db, cmdutil.ToCmdLine("0")); !reflect.DeepEqual(got, resp.MakeIntReply(-2)) {
+		t.Errorf("except %v but got %v", resp.MakeIntReply(-2), got)
 	}
-	time.Sleep(time.Second * 20)
 	dump(db)
 }
 
 func Test_execPersist(t *testing.T) {
-	db := NewDB()
+	db, fastForward := newVirtualDB(t)
 	expires := make(map[string]int64)
 	for i := int64(0); i < 10; i++ {
-		expires[fmt.Sprintf("%d", i)] = time.Now().Add(time.Second * time.Duration(i+1)).UnixMilli()
+		expires[fmt.Sprintf("%d", i)] = db.now().Add(time.Second * time.Duration(i+1)).UnixMilli()
 	}
 	for i := int64(0); i < 10; i++ {
 		db.PutEntity(fmt.Sprintf("%d", i), &commoninterface.DataEntity{Data: i})
@@ -271,12 +300,15 @@ func Test_execPersist(t *testing.T) {
 			t.Errorf("except %v but got %v", resp.MakeIntReply(1), got)
 		}
 	}
-	for key, _ := range expires {
+	for key := range expires {
 		if got := execPersist(db, cmdutil.ToCmdLine(key)); !reflect.DeepEqual(got, resp.MakeIntReply(1)) {
 			t.Errorf("except %v but got %v", resp.MakeIntReply(1), got)
 		}
 	}
-	time.Sleep(time.Second * 20)
+	fastForward(20 * time.Second)
+	if db.data.Len() != 10 {
+		t.Errorf("except the persisted keys to stay but got %d", db.data.Len())
+	}
 	dump(db)
 }
 
@@ -321,22 +353,28 @@ func Test_execRenameNx(t *testing.T) {
 }
 
 func Test_execTTL(t *testing.T) {
-	db := NewDB()
+	db, fastForward := newVirtualDB(t)
 	expires := make(map[string]int64)
 	for i := int64(0); i < 10; i++ {
-		expires[fmt.Sprintf("%d", i)] = time.Now().Add(time.Second * time.Duration(i+1)).Unix()
+		expires[fmt.Sprintf("%d", i)] = db.now().Add(time.Second * time.Duration(i+1)).Unix()
 	}
 	for i := int64(0); i < 10; i++ {
 		db.PutEntity(fmt.Sprintf("%d", i), &commoninterface.DataEntity{Data: i})
 	}
-	for key, _ := range expires {
+	for key := range expires {
 		execExpireAt(db, cmdutil.ToCmdLine(key, strconv.FormatInt(expires[key], 10)))
 	}
-	for key, _ := range expires {
-		ttl := execTTL(db, cmdutil.ToCmdLine(key))
-		fmt.Println(string(ttl.ToBytes()))
+	for key, expire := range expires {
+		left := expire - db.now().Unix()
+		ttl, ok := execTTL(db, cmdutil.ToCmdLine(key)).(*resp.IntReply)
+		if !ok || ttl.Code > left || ttl.Code < left-1 {
+			t.Errorf("except a ttl of %d but got %v", left, ttl)
+		}
+	}
+	fastForward(20 * time.Second)
+	if db.data.Len() != 0 {
+		t.Errorf("except every key to expire but got %d", db.data.Len())
 	}
-	time.Sleep(time.Second * 20)
 	dump(db)
 }
 
@@ -349,3 +387,26 @@ func Test_execType(t *testing.T) {
 		fmt.Println(string(reply.ToBytes()))
 	}
 }
+
+func TestFlushAll(t *testing.T) {
+	server := NewStandaloneServer(&config.ServerProperties{Databases: 2})
+	defer server.Close()
+	conn := clientc.NewFakeConnection()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			server.Exec(conn, cmdutil.ToCmdLine("SET", "k", strconv.Itoa(i)))
+		}
+	}()
+	server.Exec(clientc.NewFakeConnection(), cmdutil.ToCmdLine("FLUSHALL"))
+	<-done
+	server.Exec(conn, cmdutil.ToCmdLine("FLUSHALL"))
+	if got := string(server.Exec(conn, cmdutil.ToCmdLine("EXISTS", "k")).ToBytes()); got != ":0\r\n" {
+		t.Errorf("except every key flushed but got %q", got)
+	}
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "k", "v"))
+	if got := string(server.Exec(conn, cmdutil.ToCmdLine("GET", "k")).ToBytes()); got != "$1\r\nv\r\n" {
+		t.Errorf("except the flushed db usable but got %q", got)
+	}
+}
@@ -108,7 +108,7 @@ func execLPush(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	key := string(args[0])
 	list, isCreated := getOrCreateList(db, key)
 	for i := 1; i < len(args); i++ {
-		list.Add(args[i])
+		pushFront(list, args[i])
 	}
 	if isCreated {
 		db.PutEntity(key, &commoninterface.DataEntity{Data: list})
@@ -117,6 +117,15 @@ func execLPush(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	return resp.MakeIntReply(int64(list.Len()))
 }
 
+// pushFront puts val at the head of l, Insert cannot add to an empty list
+func pushFront(l list.List, val any) {
+	if l.Len() == 0 {
+		l.Add(val)
+		return
+	}
+	l.Insert(0, val)
+}
+
 func execLPushX(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	if len(args) != 2 {
 		return resp.MakeErrReply("wrong number of arguments for 'lpushx' command")
@@ -129,7 +138,7 @@ func execLPushX(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	if list == nil {
 		return resp.MakeIntReply(0)
 	}
-	list.Add(args[1])
+	pushFront(list, args[1])
 	db.addAof(cmdutil.ToCmdLineWithBytes("lpushx", args...))
 	return resp.MakeIntReply(int64(list.Len()))
 }
@@ -266,7 +275,7 @@ func execRPopLPush(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	}
 	dstList, isCreated := getOrCreateList(db, dstKey)
 	val := srcList.Remove(srcList.Len() - 1)
-	dstList.Add(val)
+	pushFront(dstList, val)
 	if isCreated {
 		db.PutEntity(dstKey, &commoninterface.DataEntity{Data: dstList})
 	}
@@ -0,0 +1,359 @@
+package db
+
+import (
+	"fmt"
+	cm "mygodis/common"
+	"mygodis/common/commoninterface"
+	"mygodis/datadriver/dict"
+	"mygodis/datadriver/list"
+	"mygodis/datadriver/set"
+	"mygodis/datadriver/sortedset"
+	"mygodis/resp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// the sizes of the go values the data is made of on 64 bit platforms
+const (
+	pointerSize   = 8
+	stringHeader  = 16
+	sliceHeader   = 24
+	interfaceSize = 16
+	// mapEntrySize is the share of a go map entry of a string key and an interface value: its slots, its tophash
+	// and the room left by the average load of a bucket
+	mapEntrySize = 48
+	// dictEntrySize is a ConcurrentDict entry: key, value and next, plus its slot in the table
+	dictEntrySize = 2*interfaceSize + 2*pointerSize
+	// listNodeSize is a LinkedList node: value, prev and next
+	listNodeSize = interfaceSize + 2*pointerSize
+	// quickListPageSize is a QuickList page: its list element, the boxed slice and the values it has room for
+	quickListPageSize = 3*pointerSize + interfaceSize + sliceHeader + list.PAGE_SIZE*interfaceSize
+	// skiplistNodeSize is a skiplist node with 4/3 levels on average, its Element and the dict entry pointing to it
+	skiplistNodeSize = 2*pointerSize + sliceHeader + 4*(pointerSize+8)/3 + stringHeader + 8 + mapEntrySize
+	// listpackEntrySize is the field and the value of a ListpackDict entry
+	listpackEntrySize = stringHeader + interfaceSize
+	// intsetEntrySize is a member of an intset
+	intsetEntrySize = 8
+	// zsetListpackEntrySize is an element of a zset listpack and the pointer to it
+	zsetListpackEntrySize = pointerSize + stringHeader + 8
+	// entitySize is the DataEntity holding a value
+	entitySize = interfaceSize
+	// ttlEntrySize is the entry of a key in the ttl dict and its boxed time.Time
+	ttlEntrySize = dictEntrySize + 24
+	// accessEntrySize is the entry of a key in the access dict and its keyAccess
+	accessEntrySize = dictEntrySize + 16
+	// memoryUsageSamples is how many elements of a collection MEMORY USAGE looks at by default
+	memoryUsageSamples = 5
+)
+
+// keyUsage estimates the bytes taken by key and its value, samples elements of a collection are looked at and the
+// others are taken to be of their average size, all of them if samples is 0
+func keyUsage(key string, entity *commoninterface.DataEntity, samples int) int64 {
+	size := int64(dictEntrySize + stringHeader + len(key) + pointerSize + entitySize)
+	return size + valueSize(entity.Data, samples)
+}
+
+// valueSize estimates the bytes taken by data
+func valueSize(data any, samples int) int64 {
+	switch data := data.(type) {
+	case []byte:
+		return int64(sliceHeader + cap(data))
+	case *list.QuickList:
+		pages := (data.Len() + list.PAGE_SIZE - 1) / list.PAGE_SIZE
+		return int64(pages*quickListPageSize) + sampleList(data, samples)
+	case *list.LinkedList:
+		return int64(data.Len()*listNodeSize) + sampleList(data, samples)
+	case *dict.ConcurrentDict:
+		// the table has a slot for every entry at least
+		return int64(data.Len()*(dictEntrySize+pointerSize)) + sampleDict(data, samples)
+	case *dict.SimpleDict:
+		return int64(data.Len()*mapEntrySize) + sampleDict(data, samples)
+	case *dict.ListpackDict:
+		if data.Encoding() == "listpack" {
+			return int64(sliceHeader+data.Len()*listpackEntrySize) + sampleDict(data, samples)
+		}
+		return int64(data.Len()*(dictEntrySize+pointerSize)) + sampleDict(data, samples)
+	case *set.Set:
+		entrySize := mapEntrySize
+		switch data.Encoding() {
+		case "intset":
+			return int64(sliceHeader + data.Len()*intsetEntrySize)
+		case "listpack":
+			entrySize = stringHeader
+		}
+		return int64(data.Len()*entrySize) + extrapolate(data.Len(), samples, func(visit func(int64) bool) {
+			data.ForEach(func(member string) bool {
+				return visit(int64(len(member)))
+			})
+		})
+	case *sortedset.ZSet:
+		n := int(data.Len())
+		nodeSize := skiplistNodeSize
+		if data.Encoding() == "listpack" {
+			nodeSize = zsetListpackEntrySize
+		}
+		return int64(n*nodeSize) + extrapolate(n, samples, func(visit func(int64) bool) {
+			data.ForEach(0, int64(n), false, func(element *sortedset.Element) bool {
+				return visit(int64(len(element.Member)))
+			})
+		})
+	}
+	return interfaceSize
+}
+
+// elementSize estimates the bytes an element of a collection points to
+func elementSize(value any) int64 {
+	switch value := value.(type) {
+	case []byte:
+		return int64(sliceHeader + cap(value))
+	case string:
+		return int64(stringHeader + len(value))
+	}
+	return 0
+}
+
+// iterableList is what sampleList needs of a list, QuickList is not a complete list.List
+type iterableList interface {
+	Len() int
+	ForEach(consumer list.Consumer)
+}
+
+func sampleList(l iterableList, samples int) int64 {
+	return extrapolate(l.Len(), samples, func(visit func(int64) bool) {
+		l.ForEach(func(i int, value any) bool {
+			return visit(elementSize(value))
+		})
+	})
+}
+func sampleDict(d dict.Dict, samples int) int64 {
+	return extrapolate(d.Len(), samples, func(visit func(int64) bool) {
+		d.ForEach(func(field string, value any) bool {
+			return visit(int64(len(field)) + elementSize(value))
+		})
+	})
+}
+
+// extrapolate returns the size of n elements from the sizes of the first samples ones forEach visits, the sizes
+// of all of them if samples is 0
+func extrapolate(n, samples int, forEach func(visit func(size int64) bool)) int64 {
+	if n == 0 {
+		return 0
+	}
+	var sum int64
+	count := 0
+	forEach(func(size int64) bool {
+		sum += size
+		count++
+		return samples == 0 || count < samples
+	})
+	if count == 0 {
+		return 0
+	}
+	return sum * int64(n) / int64(count)
+}
+
+// prepareMemory reads the key of MEMORY USAGE
+func prepareMemory(args cm.CmdLine) ([]string, []string) {
+	if len(args) < 2 || !strings.EqualFold(string(args[0]), "USAGE") {
+		return nil, nil
+	}
+	return nil, []string{string(args[1])}
+}
+
+// execMemory runs MEMORY USAGE key [SAMPLES count], the other subcommands are about the whole server
+func execMemory(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
+	if !strings.EqualFold(string(args[0]), "USAGE") {
+		return resp.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try MEMORY HELP.")
+	}
+	if len(args) != 2 && len(args) != 4 {
+		return resp.MakeErrReply("ERR unknown subcommand or wrong number of arguments for 'usage'")
+	}
+	samples := memoryUsageSamples
+	if len(args) == 4 {
+		n, err := strconv.Atoi(string(args[3]))
+		if !strings.EqualFold(string(args[2]), "SAMPLES") {
+			return resp.MakeSyntaxErrReply()
+		}
+		if err != nil || n < 0 {
+			return resp.MakeErrReply("ERR value is out of range, must be positive")
+		}
+		samples = n
+	}
+	key := string(args[1])
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return resp.MakeNullBulkReply()
+	}
+	return resp.MakeIntReply(keyUsage(key, entity, samples))
+}
+
+// dbMemory is what a db takes, the overheads are the entries of its dicts
+type dbMemory struct {
+	index    int
+	keys     int
+	expires  int
+	main     int64
+	ttl      int64
+	access   int64
+	dataset  int64
+	overhead int64
+}
+
+// measure estimates the memory of every key, each is read locked while it is looked at
+func (dbi *DataBaseImpl) measure() dbMemory {
+	m := dbMemory{keys: dbi.data.Len(), expires: dbi.ttlMap.Len()}
+	m.main = int64(m.keys * (dictEntrySize + pointerSize + entitySize))
+	m.ttl = int64(m.expires * ttlEntrySize)
+	m.access = int64(dbi.access.Len() * accessEntrySize)
+	m.overhead = m.main + m.ttl + m.access
+	for _, key := range dbi.data.Keys() {
+		keys := []string{key}
+		dbi.RWLocks(nil, keys)
+		if entity, ok := dbi.GetEntity(key); ok {
+			m.dataset += int64(stringHeader+len(key)) + valueSize(entity.Data, memoryUsageSamples)
+		}
+		dbi.RWUnLocks(nil, keys)
+	}
+	return m
+}
+
+// serverMemory is the memory of the server, as the go runtime and the estimates of the dbs tell
+type serverMemory struct {
+	runtime.MemStats
+	clients int
+	dbs     []dbMemory
+	keys    int
+	dataset int64
+	// runtime is what the go runtime takes for itself besides the heap, keyOverhead what the dicts
+	// take for the keys
+	runtime     int64
+	keyOverhead int64
+}
+
+func (d *StandaloneServer) measureMemory() *serverMemory {
+	m := &serverMemory{clients: d.ClientCount()}
+	runtime.ReadMemStats(&m.MemStats)
+	m.runtime = int64(m.StackSys + m.MSpanSys + m.MCacheSys + m.GCSys + m.BuckHashSys + m.OtherSys)
+	for i := range d.Dbs {
+		dbMem := d.selectDB(i).measure()
+		dbMem.index = i
+		if dbMem.keys == 0 && dbMem.access == 0 {
+			continue
+		}
+		m.dbs = append(m.dbs, dbMem)
+		m.keys += dbMem.keys
+		m.dataset += dbMem.dataset
+		m.keyOverhead += dbMem.overhead
+	}
+	return m
+}
+
+// fragmentation is the heap in use over the heap allocated
+func (m *serverMemory) fragmentation() float64 {
+	if m.HeapAlloc == 0 {
+		return 0
+	}
+	return float64(m.HeapInuse) / float64(m.HeapAlloc)
+}
+
+// Memory runs the MEMORY subcommands about the whole server: STATS, DOCTOR and HELP
+func Memory(d *StandaloneServer, args cm.CmdLine) resp.Reply {
+	if len(args) == 0 {
+		return resp.MakeArgNumErrReply("memory")
+	}
+	switch strings.ToUpper(string(args[0])) {
+	case "STATS":
+		if len(args) != 1 {
+			return resp.MakeErrReply("ERR unknown subcommand or wrong number of arguments for 'stats'")
+		}
+		return memoryStats(d.measureMemory())
+	case "DOCTOR":
+		if len(args) != 1 {
+			return resp.MakeErrReply("ERR unknown subcommand or wrong number of arguments for 'doctor'")
+		}
+		return resp.MakeBulkReply([]byte(memoryDoctor(d.measureMemory())))
+	case "HELP":
+		return resp.MakeMultiBulkReply([][]byte{
+			[]byte("MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:"),
+			[]byte("DOCTOR"), []byte("    Return memory problems reports."),
+			[]byte("STATS"), []byte("    Return information about the memory usage of the server."),
+			[]byte("USAGE <key> [SAMPLES <count>]"),
+			[]byte("    Return memory in bytes used by <key> and its value. Nested values are sampled up to <count> times (default: 5, 0 means sample all)."),
+		})
+	}
+	return resp.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try MEMORY HELP.")
+}
+
+// memoryStats lists the fields of MEMORY STATS, names followed by their values
+func memoryStats(m *serverMemory) resp.Reply {
+	replies := make([]resp.Reply, 0, 32)
+	field := func(name string, value resp.Reply) {
+		replies = append(replies, resp.MakeBulkReply([]byte(name)), value)
+	}
+	intField := func(name string, value int64) {
+		field(name, resp.MakeIntReply(value))
+	}
+	intField("total.allocated", int64(m.Alloc))
+	intField("allocator.heap-inuse", int64(m.HeapInuse))
+	intField("allocator.heap-idle", int64(m.HeapIdle-m.HeapReleased))
+	intField("allocator.stack-inuse", int64(m.StackInuse))
+	intField("allocator.sys", int64(m.Sys))
+	intField("overhead.runtime", m.runtime)
+	intField("clients.normal", int64(m.clients))
+	for _, dbMem := range m.dbs {
+		field("db."+strconv.Itoa(dbMem.index), resp.MakeMultiRawReply(
+			resp.MakeBulkReply([]byte("keys")), resp.MakeIntReply(int64(dbMem.keys)),
+			resp.MakeBulkReply([]byte("expires")), resp.MakeIntReply(int64(dbMem.expires)),
+			resp.MakeBulkReply([]byte("overhead.hashtable.main")), resp.MakeIntReply(dbMem.main),
+			resp.MakeBulkReply([]byte("overhead.hashtable.expires")), resp.MakeIntReply(dbMem.ttl),
+			resp.MakeBulkReply([]byte("overhead.access")), resp.MakeIntReply(dbMem.access),
+			resp.MakeBulkReply([]byte("dataset.bytes")), resp.MakeIntReply(dbMem.dataset),
+		))
+	}
+	intField("overhead.total", m.runtime+m.keyOverhead)
+	intField("keys.count", int64(m.keys))
+	bytesPerKey := int64(0)
+	if m.keys > 0 {
+		bytesPerKey = (m.dataset + m.keyOverhead) / int64(m.keys)
+	}
+	intField("keys.bytes-per-key", bytesPerKey)
+	intField("dataset.bytes", m.dataset)
+	percentage := 0.0
+	if m.Alloc > 0 {
+		percentage = float64(m.dataset) * 100 / float64(m.Alloc)
+	}
+	field("dataset.percentage", resp.MakeBulkReply([]byte(strconv.FormatFloat(percentage, 'f', 2, 64))))
+	field("fragmentation", resp.MakeBulkReply([]byte(strconv.FormatFloat(m.fragmentation(), 'f', 2, 64))))
+	return resp.MakeMultiRawReply(replies...)
+}
+
+// doctorMinHeap is the heap below which fragmentation and idle memory are not worth a word
+const doctorMinHeap = 64 << 20
+
+// memoryDoctor reports the problems MEMORY STATS shows, in words
+func memoryDoctor(m *serverMemory) string {
+	if m.keys < 10 {
+		return "This instance holds less than 10 keys, there is not much to say about its memory."
+	}
+	var issues []string
+	if m.fragmentation() > 1.4 && m.HeapInuse-m.HeapAlloc > doctorMinHeap {
+		issues = append(issues, fmt.Sprintf("* High fragmentation: the heap in use is %.2f times what is allocated, "+
+			"the spans of freed values are partly empty. It usually goes down as the runtime reuses them.", m.fragmentation()))
+	}
+	if idle := m.HeapIdle - m.HeapReleased; idle > m.HeapAlloc && idle > doctorMinHeap {
+		issues = append(issues, fmt.Sprintf("* Idle heap: the runtime keeps %d MB freed but not yet returned to the "+
+			"system, e.g. after a large delete. Setting GOMEMLIMIT makes it return memory sooner.", idle>>20))
+	}
+	if m.keyOverhead > m.dataset {
+		issues = append(issues, fmt.Sprintf("* High overhead: the bookkeeping of the keys takes %d bytes for %d bytes "+
+			"of data, the dataset is made of many small keys. Grouping them into hashes saves memory.", m.keyOverhead, m.dataset))
+	}
+	if len(issues) == 0 {
+		return "I could not find any memory issue in this instance."
+	}
+	return "The following issues were found:\n\n" + strings.Join(issues, "\n\n") + "\n"
+}
+func init() {
+	RegisterCommand("MEMORY", execMemory, prepareMemory, nil, -2, ReadOnly|NoTouch)
+}
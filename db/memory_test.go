@@ -0,0 +1,77 @@
+package db
+
+import (
+	"mygodis/clientc"
+	"mygodis/config"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	server := NewStandaloneServer(&config.ServerProperties{Databases: 2})
+	defer server.Close()
+	conn := clientc.NewFakeConnection()
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "small", "v"))
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "big", strings.Repeat("x", 1000)))
+	for i := 0; i < 100; i++ {
+		member := strconv.Itoa(i)
+		server.Exec(conn, cmdutil.ToCmdLine("RPUSH", "list", member))
+		server.Exec(conn, cmdutil.ToCmdLine("HSET", "hash", member, member))
+		server.Exec(conn, cmdutil.ToCmdLine("SADD", "set", "m"+member))
+		server.Exec(conn, cmdutil.ToCmdLine("ZADD", "zset", strconv.Itoa(i), member))
+	}
+	usage := func(args ...string) int64 {
+		reply, ok := server.Exec(conn, cmdutil.ToCmdLine(append([]string{"MEMORY", "USAGE"}, args...)...)).(*resp.IntReply)
+		if !ok {
+			t.Fatalf("except the usage of %v", args)
+		}
+		return reply.Code
+	}
+	small, big := usage("small"), usage("big")
+	if big-small < 999 {
+		t.Errorf("except big to take 999 more bytes than small but got %d and %d", small, big)
+	}
+	for _, key := range []string{"list", "hash", "set", "zset"} {
+		if n := usage(key, "SAMPLES", "0"); n < 100*10 {
+			t.Errorf("except %s of 100 elements to take more than 1000 bytes but got %d", key, n)
+		}
+	}
+	if reply := server.Exec(conn, cmdutil.ToCmdLine("MEMORY", "USAGE", "none")); string(reply.ToBytes()) != "$-1\r\n" {
+		t.Errorf("except null for a missing key but got %q", reply.ToBytes())
+	}
+	if _, ok := server.Exec(conn, cmdutil.ToCmdLine("MEMORY", "USAGE", "small", "SAMPLES", "-1")).(resp.ErrorReply); !ok {
+		t.Error("except an error for negative samples")
+	}
+
+	stats, ok := server.Exec(conn, cmdutil.ToCmdLine("MEMORY", "STATS")).(*resp.MultiRawReply)
+	if !ok {
+		t.Fatalf("except the stats as an array")
+	}
+	fields := make(map[string]resp.Reply)
+	replies := stats.Replies()
+	for i := 0; i+1 < len(replies); i += 2 {
+		fields[string(replies[i].(*resp.BulkReply).Arg)] = replies[i+1]
+	}
+	if keys, ok := fields["keys.count"].(*resp.IntReply); !ok || keys.Code != 6 {
+		t.Errorf("except 6 keys but got %v", fields["keys.count"])
+	}
+	if _, ok := fields["db.1"]; ok {
+		t.Error("except no stats of the empty db 1")
+	}
+	db0, ok := fields["db.0"].(*resp.MultiRawReply)
+	if !ok || len(db0.Replies()) != 12 {
+		t.Fatalf("except the stats of db 0 but got %v", fields["db.0"])
+	}
+	if dataset, ok := fields["dataset.bytes"].(*resp.IntReply); !ok || dataset.Code < big {
+		t.Errorf("except the dataset to hold big but got %v", fields["dataset.bytes"])
+	}
+	if doctor, ok := server.Exec(conn, cmdutil.ToCmdLine("MEMORY", "DOCTOR")).(*resp.BulkReply); !ok || len(doctor.Arg) == 0 {
+		t.Errorf("except a report but got %v", doctor)
+	}
+	if _, ok := server.Exec(conn, cmdutil.ToCmdLine("MEMORY", "NOSUCH")).(resp.ErrorReply); !ok {
+		t.Error("except an error for an unknown subcommand")
+	}
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"mygodis/lib/metrics"
+	"strconv"
+	"strings"
+)
+
+var (
+	commandCalls    = metrics.NewCounterVec("mygodis_commands_total", "Commands executed", "cmd")
+	commandErrors   = metrics.NewCounterVec("mygodis_command_errors_total", "Commands answered with an error", "cmd")
+	commandDuration = metrics.NewHistogramVec("mygodis_command_duration_seconds", "Time spent executing commands", metrics.LatencyBuckets, "cmd")
+	expiredKeys     = metrics.NewCounterVec("mygodis_expired_keys_total", "Keys removed because their ttl passed")
+	// no eviction policy removes keys yet, the counter is exposed so dashboards need no change once one does
+	evictedKeys = metrics.NewCounterVec("mygodis_evicted_keys_total", "Keys evicted to free memory")
+)
+
+func init() {
+	metrics.Default.Register(commandCalls, commandErrors, commandDuration, expiredKeys, evictedKeys)
+}
+
+// serverCommands are the commands handled outside of the command table
+var serverCommands = map[string]bool{
+	"PING": true, "AUTH": true, "SELECT": true, "INFO": true, "SUBSCRIBE": true, "UNSUBSCRIBE": true, "PUBLISH": true,
+	"FLUSHALL": true, "DEBUG": true, "MULTI": true, "EXEC": true, "DISCARD": true, "WATCH": true, "UNWATCH": true,
+}
+
+// metricCommand returns the label of cmdName, unknown names share one label so clients can not grow the metrics
+func metricCommand(cmdName string) string {
+	if _, ok := cmdContainer[cmdName]; ok || serverCommands[cmdName] {
+		return strings.ToLower(cmdName)
+	}
+	return "unknown"
+}
+
+// Collect writes the gauges of the server: connected clients, keys and expires per db and the aof size
+func (d *StandaloneServer) Collect(w *metrics.Writer) {
+	w.Family("mygodis_connected_clients", "Clients connected", "gauge")
+	w.Sample("mygodis_connected_clients", float64(d.ClientCount()))
+	w.Family("mygodis_db_keys", "Keys of a db", "gauge")
+	for i := range d.Dbs {
+		keys, _ := d.GetDBSize(i)
+		w.Sample("mygodis_db_keys", float64(keys), "db", strconv.Itoa(i))
+	}
+	w.Family("mygodis_db_expires", "Keys with a ttl of a db", "gauge")
+	for i := range d.Dbs {
+		_, expires := d.GetDBSize(i)
+		w.Sample("mygodis_db_expires", float64(expires), "db", strconv.Itoa(i))
+	}
+	if d.persister != nil {
+		w.Family("mygodis_aof_size_bytes", "Size of the aof file", "gauge")
+		w.Sample("mygodis_aof_size_bytes", float64(d.persister.AofSize()))
+	}
+}
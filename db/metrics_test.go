@@ -0,0 +1,54 @@
+package db
+
+import (
+	"mygodis/clientc"
+	"mygodis/config"
+	"mygodis/lib/metrics"
+	"mygodis/util/cmdutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStandaloneServer_metrics(t *testing.T) {
+	server := NewStandaloneServer(&config.ServerProperties{Databases: 2})
+	defer server.Close()
+	conn := clientc.NewFakeConnection()
+	sets, errs := commandCalls.With("set").Value(), commandErrors.With("incr").Value()
+	unknown, expired := commandCalls.With("unknown").Value(), expiredKeys.With().Value()
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "a", "x"))
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "b", "1", "EX", "10"))
+	server.Exec(conn, cmdutil.ToCmdLine("INCR", "a"))
+	server.Exec(conn, cmdutil.ToCmdLine("NOSUCHCOMMAND"))
+	if got := commandCalls.With("set").Value() - sets; got != 2 {
+		t.Errorf("except 2 sets but got %d", got)
+	}
+	if got := commandErrors.With("incr").Value() - errs; got != 1 {
+		t.Errorf("except 1 incr error but got %d", got)
+	}
+	if got := commandCalls.With("unknown").Value() - unknown; got != 1 {
+		t.Errorf("except 1 unknown command but got %d", got)
+	}
+	if commandDuration.With("set").Count() < 2 {
+		t.Error("except the latency of the sets")
+	}
+
+	r := metrics.NewRegistry()
+	r.Register(server)
+	var out strings.Builder
+	if err := r.WriteText(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{`mygodis_db_keys{db="0"} 2`, `mygodis_db_expires{db="0"} 1`, `mygodis_db_keys{db="1"} 0`} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("except %s in\n%s", line, out.String())
+		}
+	}
+	if err := server.FastForward(11 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// keys of other tests may expire meanwhile
+	if got := expiredKeys.With().Value() - expired; got < 1 {
+		t.Errorf("except the expired key counted but got %d", got)
+	}
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	cm "mygodis/common"
+	"mygodis/common/commoninterface"
+	"mygodis/resp"
+	"sync/atomic"
+	"time"
+)
+
+// CommandEvent describes a command executed by the server, Args must not be modified
+type CommandEvent struct {
+	Time     time.Time
+	Client   string
+	DB       int
+	Args     cm.CmdLine
+	Duration time.Duration
+	Err      bool
+}
+
+// Monitor receives the commands executed by a server from C, see StandaloneServer.Monitor
+type Monitor struct {
+	C       <-chan CommandEvent
+	c       chan CommandEvent
+	dropped atomic.Uint64
+	server  *StandaloneServer
+}
+
+// Dropped returns the events lost so far because C was full
+func (m *Monitor) Dropped() uint64 {
+	return m.dropped.Load()
+}
+
+// Stop stops the events, C is not closed since a command may still be sending to it
+func (m *Monitor) Stop() {
+	m.server.monitorsMu.Lock()
+	defer m.server.monitorsMu.Unlock()
+	current := m.server.loadMonitors()
+	monitors := make([]*Monitor, 0, len(current))
+	for _, monitor := range current {
+		if monitor != m {
+			monitors = append(monitors, monitor)
+		}
+	}
+	m.server.monitors.Store(&monitors)
+}
+
+func (d *StandaloneServer) loadMonitors() []*Monitor {
+	if list := d.monitors.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+// Monitor returns a monitor of the commands executed from now on buffering size events. An event is dropped when
+// the buffer is full, so a slow reader never holds up a command.
+func (d *StandaloneServer) Monitor(size int) *Monitor {
+	c := make(chan CommandEvent, size)
+	monitor := &Monitor{C: c, c: c, server: d}
+	d.monitorsMu.Lock()
+	defer d.monitorsMu.Unlock()
+	monitors := append(append([]*Monitor(nil), d.loadMonitors()...), monitor)
+	d.monitors.Store(&monitors)
+	return monitor
+}
+
+// notifyMonitors hands the command to the monitors, it costs nothing while nobody monitors
+func (d *StandaloneServer) notifyMonitors(connection commoninterface.Connection, cmd cm.CmdLine, start time.Time, reply resp.Reply) {
+	monitors := d.loadMonitors()
+	if len(monitors) == 0 {
+		return
+	}
+	_, isErr := reply.(resp.ErrorReply)
+	event := CommandEvent{
+		Time:     start,
+		Client:   connection.Name(),
+		DB:       connection.GetDBIndex(),
+		Args:     cmd,
+		Duration: time.Since(start),
+		Err:      isErr,
+	}
+	for _, monitor := range monitors {
+		select {
+		case monitor.c <- event:
+		default:
+			monitor.dropped.Add(1)
+		}
+	}
+}
+
+// ClientCount returns the clients connected
+func (d *StandaloneServer) ClientCount() int {
+	clients := 0
+	d.activeConn.Range(func(key, value any) bool {
+		clients++
+		return true
+	})
+	return clients
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"mygodis/clientc"
+	"mygodis/config"
+	"mygodis/util/cmdutil"
+	"testing"
+)
+
+func TestStandaloneServer_Monitor(t *testing.T) {
+	server := NewStandaloneServer(&config.ServerProperties{Databases: 2})
+	defer server.Close()
+	conn := clientc.NewFakeConnection()
+	monitor := server.Monitor(2)
+	conn.SelectDB(1)
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "a", "x"))
+	server.Exec(conn, cmdutil.ToCmdLine("INCR", "a"))
+	event := <-monitor.C
+	if event.DB != 1 || string(event.Args[0]) != "SET" || event.Err || event.Client != "fake" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if event = <-monitor.C; string(event.Args[0]) != "INCR" || !event.Err {
+		t.Errorf("except the failed INCR but got %+v", event)
+	}
+
+	// nobody reads the monitor, the commands go on and the events are dropped
+	for i := 0; i < 100; i++ {
+		server.Exec(conn, cmdutil.ToCmdLine("SET", "a", "x"))
+	}
+	if dropped := monitor.Dropped(); dropped != 98 {
+		t.Errorf("except 98 dropped events but got %d", dropped)
+	}
+	monitor.Stop()
+	<-monitor.C
+	<-monitor.C
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "a", "x"))
+	if len(monitor.C) != 0 || monitor.Dropped() != 98 {
+		t.Error("except no event after Stop")
+	}
+}
@@ -0,0 +1,178 @@
+package db
+
+import (
+	"math"
+	"math/rand"
+	cm "mygodis/common"
+	"mygodis/datadriver/dict"
+	"mygodis/datadriver/list"
+	"mygodis/datadriver/set"
+	"mygodis/datadriver/sortedset"
+	"mygodis/resp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// lfuInitVal is the counter of a key accessed once, so new keys are not the first ones to go
+	lfuInitVal = 5
+	// lfuLogFactor makes the counter logarithmic, about a million accesses saturate it
+	lfuLogFactor = 10
+	// lfuDecayTime is how long it takes the counter of a key not accessed to decrease by one
+	lfuDecayTime = time.Minute
+	// embstrMaxLen is the longest string redis keeps with its header
+	embstrMaxLen = 44
+)
+
+// keyAccess is when a key was accessed last and how often, kept apart from the entity so writes replacing the
+// entity keep it
+type keyAccess struct {
+	at   atomic.Int64
+	freq atomic.Uint32
+}
+
+// touch records an access of key at now, keys which do not exist are left alone
+func (dbi *DataBaseImpl) touch(key string) {
+	if _, ok := dbi.data.Get(key); !ok {
+		return
+	}
+	now := dbi.now()
+	val, ok := dbi.access.Get(key)
+	if !ok {
+		access := &keyAccess{}
+		access.at.Store(now.UnixNano())
+		access.freq.Store(lfuInitVal)
+		if dbi.access.PutIfAbsent(key, access) > 0 {
+			return
+		}
+		val, _ = dbi.access.Get(key)
+	}
+	access := val.(*keyAccess)
+	freq := lfuIncr(access.decayed(now))
+	access.freq.Store(freq)
+	access.at.Store(now.UnixNano())
+}
+
+// setAccess records key as accessed idle ago with the counter freq, like RESTORE IDLETIME and FREQ ask
+func (dbi *DataBaseImpl) setAccess(key string, idle time.Duration, freq uint32) {
+	access := &keyAccess{}
+	access.at.Store(dbi.now().Add(-idle).UnixNano())
+	access.freq.Store(freq)
+	dbi.access.Put(key, access)
+}
+
+// decayed returns the counter less one for every lfuDecayTime passed since the last access
+func (a *keyAccess) decayed(now time.Time) uint32 {
+	freq := a.freq.Load()
+	periods := now.Sub(time.Unix(0, a.at.Load())) / lfuDecayTime
+	if periods <= 0 {
+		return freq
+	}
+	if int64(periods) >= int64(freq) {
+		return 0
+	}
+	return freq - uint32(periods)
+}
+
+// lfuIncr increments freq with a probability falling as it grows, it saturates at 255
+func lfuIncr(freq uint32) uint32 {
+	if freq >= math.MaxUint8 {
+		return freq
+	}
+	base := 0.0
+	if freq > lfuInitVal {
+		base = float64(freq - lfuInitVal)
+	}
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		return freq + 1
+	}
+	return freq
+}
+
+// keyAccessOf returns the idle time and the counter of key, a key never touched is as new as now
+func (dbi *DataBaseImpl) keyAccessOf(key string) (time.Duration, uint32) {
+	val, ok := dbi.access.Get(key)
+	if !ok {
+		return 0, lfuInitVal
+	}
+	access := val.(*keyAccess)
+	now := dbi.now()
+	return now.Sub(time.Unix(0, access.at.Load())), access.decayed(now)
+}
+
+// encodingOf names how data is kept like OBJECT ENCODING does
+func encodingOf(data any) string {
+	switch data := data.(type) {
+	case interface{ Encoding() string }:
+		return data.Encoding()
+	case []byte:
+		if len(data) <= 20 {
+			if _, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+				return "int"
+			}
+		}
+		if len(data) <= embstrMaxLen {
+			return "embstr"
+		}
+		return "raw"
+	case *list.QuickList:
+		return "quicklist"
+	case *list.LinkedList:
+		return "linkedlist"
+	case dict.Dict, *set.Set:
+		return "hashtable"
+	case *sortedset.ZSet:
+		return "skiplist"
+	}
+	return "unknown"
+}
+
+// prepareObject reads the key of the subcommands taking one
+func prepareObject(args cm.CmdLine) ([]string, []string) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+	return nil, []string{string(args[1])}
+}
+
+// execObject runs OBJECT ENCODING|IDLETIME|FREQ|REFCOUNT key, which do not count as an access of key. FREQ is
+// answered whatever the eviction policy since there is none to choose yet.
+func execObject(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
+	sub := strings.ToUpper(string(args[0]))
+	if sub == "HELP" {
+		return resp.MakeMultiBulkReply([][]byte{
+			[]byte("OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:"),
+			[]byte("ENCODING <key>"), []byte("    Return the kind of internal representation used in order to store the value associated with a <key>."),
+			[]byte("FREQ <key>"), []byte("    Return the access frequency index of the <key>."),
+			[]byte("IDLETIME <key>"), []byte("    Return the idle time of the <key>, that is the approximated number of seconds elapsed since the last access to the key."),
+			[]byte("REFCOUNT <key>"), []byte("    Return the number of references of the value associated with the specified <key>."),
+		})
+	}
+	if len(args) != 2 {
+		return resp.MakeErrReply("ERR unknown subcommand or wrong number of arguments for '" + string(args[0]) + "'")
+	}
+	key := string(args[1])
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return resp.MakeNullBulkReply()
+	}
+	switch sub {
+	case "ENCODING":
+		return resp.MakeBulkReply([]byte(encodingOf(entity.Data)))
+	case "IDLETIME":
+		idle, _ := db.keyAccessOf(key)
+		return resp.MakeIntReply(int64(idle / time.Second))
+	case "FREQ":
+		_, freq := db.keyAccessOf(key)
+		return resp.MakeIntReply(int64(freq))
+	case "REFCOUNT":
+		// values are never shared
+		return resp.MakeIntReply(1)
+	}
+	return resp.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try OBJECT HELP.")
+}
+func init() {
+	RegisterCommand("OBJECT", execObject, prepareObject, nil, -2, ReadOnly|NoTouch)
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"mygodis/clientc"
+	"mygodis/common/commoninterface"
+	"mygodis/config"
+	"mygodis/datadriver/sortedset"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"strings"
+	"testing"
+)
+
+func TestObject(t *testing.T) {
+	server := NewStandaloneServer(&config.ServerProperties{Databases: 2})
+	defer server.Close()
+	conn := clientc.NewFakeConnection()
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "int", "12"))
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "short", "hello"))
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "long", strings.Repeat("x", 45)))
+	server.Exec(conn, cmdutil.ToCmdLine("RPUSH", "list", "a"))
+	server.Exec(conn, cmdutil.ToCmdLine("HSET", "hash", "f", "v"))
+	server.Exec(conn, cmdutil.ToCmdLine("SADD", "set", "m"))
+	server.Exec(conn, cmdutil.ToCmdLine("SADD", "ints", "1", "2"))
+	// a zset made without the limits of a db is a skiplist whatever its size
+	zset := sortedset.MakeZSet()
+	zset.Add("m", 1)
+	server.selectDB(0).PutEntity("zset", commoninterface.DataEntityWithData(zset))
+	for key, except := range map[string]string{
+		"int": "int", "short": "embstr", "long": "raw", "list": "linkedlist", "hash": "listpack", "set": "listpack",
+		"ints": "intset", "zset": "skiplist",
+	} {
+		if reply := server.Exec(conn, cmdutil.ToCmdLine("OBJECT", "ENCODING", key)); string(reply.ToBytes()) != string(resp.MakeBulkReply([]byte(except)).ToBytes()) {
+			t.Errorf("except %s encoded as %s but got %q", key, except, reply.ToBytes())
+		}
+	}
+	if reply := server.Exec(conn, cmdutil.ToCmdLine("OBJECT", "ENCODING", "none")); string(reply.ToBytes()) != "$-1\r\n" {
+		t.Errorf("except null for a missing key but got %q", reply.ToBytes())
+	}
+
+	server.Exec(conn, cmdutil.ToCmdLine("DEBUG", "FASTFORWARD", "90000"))
+	if reply := server.Exec(conn, cmdutil.ToCmdLine("OBJECT", "IDLETIME", "short")).(*resp.IntReply); reply.Code != 90 {
+		t.Errorf("except short idle for 90s but got %d", reply.Code)
+	}
+	// OBJECT does not count as an access but GET does
+	if reply := server.Exec(conn, cmdutil.ToCmdLine("OBJECT", "IDLETIME", "short")).(*resp.IntReply); reply.Code != 90 {
+		t.Errorf("except OBJECT to leave the idle time but got %d", reply.Code)
+	}
+	server.Exec(conn, cmdutil.ToCmdLine("GET", "short"))
+	if reply := server.Exec(conn, cmdutil.ToCmdLine("OBJECT", "IDLETIME", "short")).(*resp.IntReply); reply.Code != 0 {
+		t.Errorf("except short accessed now but got %d", reply.Code)
+	}
+
+	before := server.Exec(conn, cmdutil.ToCmdLine("OBJECT", "FREQ", "int")).(*resp.IntReply).Code
+	for i := 0; i < 1000; i++ {
+		server.Exec(conn, cmdutil.ToCmdLine("GET", "int"))
+	}
+	after := server.Exec(conn, cmdutil.ToCmdLine("OBJECT", "FREQ", "int")).(*resp.IntReply).Code
+	if after <= before || after > 255 {
+		t.Errorf("except the counter to grow from %d but got %d", before, after)
+	}
+	// the counter decays by one a minute
+	server.Exec(conn, cmdutil.ToCmdLine("DEBUG", "FASTFORWARD", "180000"))
+	if reply := server.Exec(conn, cmdutil.ToCmdLine("OBJECT", "FREQ", "int")).(*resp.IntReply); reply.Code != after-3 {
+		t.Errorf("except %d after 3 minutes but got %d", after-3, reply.Code)
+	}
+	if reply := server.Exec(conn, cmdutil.ToCmdLine("OBJECT", "REFCOUNT", "int")).(*resp.IntReply); reply.Code != 1 {
+		t.Errorf("except refcount 1 but got %d", reply.Code)
+	}
+	if _, ok := server.Exec(conn, cmdutil.ToCmdLine("OBJECT", "NOSUCH", "int")).(resp.ErrorReply); !ok {
+		t.Error("except an error for an unknown subcommand")
+	}
+
+	// the access is forgotten with the key
+	server.Exec(conn, cmdutil.ToCmdLine("DEL", "int"))
+	server.Exec(conn, cmdutil.ToCmdLine("FLUSHDB"))
+	if n := server.selectDB(0).access.Len(); n != 0 {
+		t.Errorf("except no access left but got %d", n)
+	}
+}
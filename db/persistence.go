@@ -8,14 +8,12 @@ import (
 	"mygodis/common"
 	cmi "mygodis/common/commoninterface"
 	"mygodis/config"
-	"mygodis/datadriver/dict"
 	"mygodis/datadriver/list"
-	"mygodis/datadriver/sortedset"
 	"os"
 )
 
 func (stdDBM *StandaloneServer) loadRDBFile() (err error) {
-	rdbFile, err := os.Open(config.Properties.RDBFilename)
+	rdbFile, err := os.Open(stdDBM.props.RDBFilename)
 	if err != nil {
 		return fmt.Errorf("open rdb file failed " + err.Error())
 	}
@@ -38,50 +36,7 @@ func (stdDBM *StandaloneServer) selectDB(index int) (db *DataBaseImpl) {
 func (stdDBM *StandaloneServer) loadRDB(dec *core.Decoder) (err error) {
 	return dec.Parse(func(obj parse.RedisObject) bool {
 		db := stdDBM.selectDB(obj.GetDBIndex())
-		var entity *cmi.DataEntity
-		switch obj.GetType() {
-		case parse.StringType:
-			str := obj.(*parse.StringObject)
-			entity = &cmi.DataEntity{
-				Data: str.Value,
-			}
-		case parse.ListType:
-			listObj := obj.(*parse.ListObject)
-			list := list.NewQuickList()
-			for _, v := range listObj.Values {
-				list.Add(v)
-			}
-			entity = &cmi.DataEntity{
-				Data: list,
-			}
-		case parse.HashType:
-			hashObj := obj.(*parse.HashObject)
-			hash := dict.NewSimpleDict(8)
-			for k, v := range hashObj.Hash {
-				hash.Put(k, v)
-			}
-			entity = &cmi.DataEntity{
-				Data: hash,
-			}
-		case parse.SetType:
-			setObj := obj.(*parse.SetObject)
-			set := dict.NewSimpleDict(8)
-			for _, v := range setObj.Members {
-				set.Put(string(v), nil)
-			}
-			entity = &cmi.DataEntity{
-				Data: set,
-			}
-		case parse.ZSetType:
-			zsetObj := obj.(*parse.ZSetObject)
-			zset := sortedset.MakeZSet()
-			for _, v := range zsetObj.Entries {
-				zset.Add(v.Member, v.Score)
-			}
-			entity = &cmi.DataEntity{
-				Data: zset,
-			}
-		}
+		entity := db.entityOf(obj)
 		if entity != nil {
 			db.PutEntity(obj.GetKey(), entity)
 			if obj.GetExpiration() != nil {
@@ -92,6 +47,54 @@ func (stdDBM *StandaloneServer) loadRDB(dec *core.Decoder) (err error) {
 		return true
 	})
 }
+
+// entityOf converts an object read from rdb to the value kept in db, nil for types which are not supported
+func (db *DataBaseImpl) entityOf(obj parse.RedisObject) (entity *cmi.DataEntity) {
+	switch obj.GetType() {
+	case parse.StringType:
+		str := obj.(*parse.StringObject)
+		entity = &cmi.DataEntity{
+			Data: str.Value,
+		}
+	case parse.ListType:
+		listObj := obj.(*parse.ListObject)
+		list := list.NewQuickList()
+		for _, v := range listObj.Values {
+			list.Add(v)
+		}
+		entity = &cmi.DataEntity{
+			Data: list,
+		}
+	case parse.HashType:
+		hashObj := obj.(*parse.HashObject)
+		hash := db.makeHash()
+		for k, v := range hashObj.Hash {
+			hash.Put(k, string(v))
+		}
+		entity = &cmi.DataEntity{
+			Data: hash,
+		}
+	case parse.SetType:
+		setObj := obj.(*parse.SetObject)
+		set := db.makeSet()
+		for _, v := range setObj.Members {
+			set.Add(string(v))
+		}
+		entity = &cmi.DataEntity{
+			Data: set,
+		}
+	case parse.ZSetType:
+		zsetObj := obj.(*parse.ZSetObject)
+		zset := db.makeZSet()
+		for _, v := range zsetObj.Entries {
+			zset.Add(v.Member, v.Score)
+		}
+		entity = &cmi.DataEntity{
+			Data: zset,
+		}
+	}
+	return entity
+}
 func (stdDBM *StandaloneServer) AddAof(dbIndex int, line common.CmdLine) {
 	if stdDBM.persister != nil {
 		stdDBM.persister.SaveCmd(dbIndex, line)
@@ -102,22 +105,28 @@ func (stdDBM *StandaloneServer) bindPersister(persister *aof.Persister) {
 	for _, db := range stdDBM.Dbs {
 		baseImpl := db.(*DataBaseImpl)
 		baseImpl.addAof = func(cmdLine common.CmdLine) {
-			if config.Properties.AppendOnly {
+			if stdDBM.props.AppendOnly {
 				stdDBM.persister.SaveCmd(baseImpl.index, cmdLine)
 			}
 		}
 	}
 }
-func MakeAuxiliaryServer() *StandaloneServer {
-	std := &StandaloneServer{}
-	std.Dbs = make([]any, config.Properties.Databases)
+
+// MakeAuxiliaryServer returns the scratch server an aof is rewritten in, it encodes like the server owning props
+func MakeAuxiliaryServer(props *config.ServerProperties) *StandaloneServer {
+	std := &StandaloneServer{props: props}
+	std.Dbs = make([]any, props.Databases)
 	for i := range std.Dbs {
-		std.Dbs[i] = newBasicDB()
+		db := newBasicDB()
+		db.encodings = makeEncodingLimits(props)
+		std.Dbs[i] = db
 	}
 	return std
 }
-func NewPersister(db cmi.StandaloneDBEngine, aofFileName string, load bool, fsync int8) (*aof.Persister, error) {
+
+// NewPersister opens the aof of db, whose props are those of the server owning db
+func NewPersister(db cmi.StandaloneDBEngine, props *config.ServerProperties, aofFileName string, load bool, fsync int8) (*aof.Persister, error) {
 	return aof.NewPersister(db, aofFileName, load, fsync, func() cmi.StandaloneDBEngine {
-		return MakeAuxiliaryServer()
+		return MakeAuxiliaryServer(props)
 	})
 }
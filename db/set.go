@@ -24,7 +24,7 @@ func (db *DataBaseImpl) getOrCreateSet(key string) (result *set.Set, isNew bool)
 	entity, exists := db.GetEntity(key)
 	if !exists {
 		entity = new(commoninterface.DataEntity)
-		entity.Data = set.MakeSet()
+		entity.Data = db.makeSet()
 
 		return entity.Data.(*set.Set), true
 	}
@@ -373,9 +373,9 @@ func execSUnionStore(db *DataBaseImpl, args cm.CmdLine) (reply resp.Reply) {
 	if len(args) < 3 {
 		return resp.MakeErrReply("wrong number of arguments for 'sunionstore' command")
 	}
-	dest, isNew := getOrCreateList(db, string(args[0]))
-	src, _ := db.getAsSet(string(args[1]))
-	for _, arg := range args[2:] {
+	destKey := string(args[0])
+	result := db.makeSet()
+	for _, arg := range args[1:] {
 		key := string(arg)
 		set, err := db.getAsSet(key)
 		if err != nil {
@@ -384,22 +384,13 @@ func execSUnionStore(db *DataBaseImpl, args cm.CmdLine) (reply resp.Reply) {
 		if set == nil {
 			continue
 		}
-		src = src.Union(set)
-	}
-	if src == nil {
-		return resp.MakeIntReply(0)
-	}
-	slice := src.ToSlice()
-	for i := 0; i < len(slice); i++ {
-		dest.Add(slice[i])
-	}
-	if isNew {
-		db.PutEntity(string(args[0]), &commoninterface.DataEntity{
-			Data: dest,
-		})
+		result = result.Union(set)
 	}
+	db.PutEntity(destKey, &commoninterface.DataEntity{
+		Data: result,
+	})
 	db.addAof(cmdutil.ToCmdLineWithBytes("sunionstore", args...))
-	return resp.MakeIntReply(int64(len(slice)))
+	return resp.MakeIntReply(int64(result.Len()))
 }
 
 // TODO sscan
@@ -435,11 +426,11 @@ func init() {
 	RegisterCommand("SRANDMEMBER", execSRandMember, readFirstKey, nil, 2, ReadOnly)
 	RegisterCommand("SUNION", execSUnion, readAllKeys, nil, -3, ReadOnly)
 	RegisterCommand("SADD", execSAdd, writeFirstKey, undoSAddCommands, -3, Write)
-	RegisterCommand("SDIFFSTORE", execSDiffStore, writeFirstKey, rollbackFirstKey, -3, Write)
-	RegisterCommand("SINTERSTORE", execSInterStore, writeFirstKey, rollbackFirstKey, -3, Write)
-	RegisterCommand("SMOVE", execSMove, writeFirstKey, undoSMoveCommands, 3, Write)
+	RegisterCommand("SDIFFSTORE", execSDiffStore, prepareSetCalculateStore, rollbackFirstKey, -3, Write)
+	RegisterCommand("SINTERSTORE", execSInterStore, prepareSetCalculateStore, rollbackFirstKey, -3, Write)
+	RegisterCommand("SMOVE", execSMove, preparePopPush, undoSMoveCommands, 4, Write)
 	RegisterCommand("SPOP", execSPop, writeFirstKey, rollbackFirstKey, 2, Write)
 	RegisterCommand("SREM", execSRem, writeFirstKey, undoSRemCommands, -2, Write)
-	RegisterCommand("SUNIONSTORE", execSUnionStore, writeFirstKey, rollbackFirstKey, -3, Write)
+	RegisterCommand("SUNIONSTORE", execSUnionStore, prepareSetCalculateStore, rollbackFirstKey, -3, Write)
 
 }
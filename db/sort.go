@@ -0,0 +1,320 @@
+package db
+
+import (
+	"bytes"
+	cm "mygodis/common"
+	"mygodis/datadriver/dict"
+	"mygodis/datadriver/list"
+	"mygodis/datadriver/set"
+	"mygodis/datadriver/sortedset"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sortPolicy is what the options of SORT key [BY pattern] [LIMIT offset count] [GET pattern ...] [ASC|DESC] [ALPHA]
+// [STORE destination] ask for
+type sortPolicy struct {
+	by       string
+	dontSort bool
+	gets     []string
+	offset   int
+	count    int
+	desc     bool
+	alpha    bool
+	store    string
+}
+
+// sortItem is an element to sort with its weight
+type sortItem struct {
+	elem   string
+	weight []byte
+	score  float64
+}
+
+// parseSortPolicy reads the options after the key, STORE is refused if readOnly
+func parseSortPolicy(args cm.CmdLine, readOnly bool) (*sortPolicy, resp.ErrorReply) {
+	policy := &sortPolicy{count: -1}
+	for i := 1; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		switch {
+		case option == "ASC":
+			policy.desc = false
+		case option == "DESC":
+			policy.desc = true
+		case option == "ALPHA":
+			policy.alpha = true
+		case option == "BY" && i+1 < len(args):
+			i++
+			policy.by = string(args[i])
+			// a pattern without * derives the same key for every element, so there is nothing to sort by
+			policy.dontSort = !strings.Contains(policy.by, "*")
+		case option == "LIMIT" && i+2 < len(args):
+			offset, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return nil, resp.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			count, err := strconv.Atoi(string(args[i+2]))
+			if err != nil {
+				return nil, resp.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			policy.offset, policy.count = offset, count
+			i += 2
+		case option == "GET" && i+1 < len(args):
+			i++
+			policy.gets = append(policy.gets, string(args[i]))
+		case option == "STORE" && i+1 < len(args) && !readOnly:
+			i++
+			policy.store = string(args[i])
+		default:
+			return nil, resp.MakeSyntaxErrReply()
+		}
+	}
+	return policy, nil
+}
+
+// splitSortPattern returns the key a pattern derives for elem and the hash field after -> if any. ok is false for a
+// pattern without *, which derives no key.
+func splitSortPattern(pattern, elem string) (key, field string, ok bool) {
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return "", "", false
+	}
+	end := len(pattern)
+	if arrow := strings.Index(pattern[star+1:], "->"); arrow >= 0 && star+1+arrow+2 < len(pattern) {
+		end = star + 1 + arrow
+		field = pattern[end+2:]
+	}
+	return pattern[:star] + elem + pattern[star+1:end], field, true
+}
+
+// lookupSortPattern returns the value pattern points to for elem: elem itself for #, the string at the key derived or
+// the field of the hash at it. Missing keys, fields and values of other types are nil.
+func (db *DataBaseImpl) lookupSortPattern(pattern, elem string) []byte {
+	if pattern == "#" {
+		return []byte(elem)
+	}
+	key, field, ok := splitSortPattern(pattern, elem)
+	if !ok {
+		return nil
+	}
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return nil
+	}
+	if field == "" {
+		val, _ := entity.Data.([]byte)
+		return val
+	}
+	hash, ok := entity.Data.(dict.Dict)
+	if !ok {
+		return nil
+	}
+	switch val, _ := hash.Get(field); val := val.(type) {
+	case string:
+		return []byte(val)
+	case []byte:
+		return val
+	}
+	return nil
+}
+
+// sortElements returns the elements of the list, set or zset at key, in the order they are kept, and the type of key
+func (db *DataBaseImpl) sortElements(key string) ([]string, string, resp.ErrorReply) {
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return nil, "none", nil
+	}
+	switch data := entity.Data.(type) {
+	case list.List:
+		elems := make([]string, 0, data.Len())
+		data.ForEach(func(i int, v any) bool {
+			switch v := v.(type) {
+			case []byte:
+				elems = append(elems, string(v))
+			case string:
+				elems = append(elems, v)
+			}
+			return true
+		})
+		return elems, "list", nil
+	case *set.Set:
+		return data.ToSlice(), "set", nil
+	case *sortedset.ZSet:
+		elems := make([]string, 0, data.Len())
+		for _, element := range data.Range(0, data.Len(), false) {
+			elems = append(elems, element.Member)
+		}
+		return elems, "zset", nil
+	}
+	return nil, "", &resp.WrongTypeErrReply{}
+}
+
+// execSort runs SORT, which sorts the elements of a list, set or zset by their value or by the weights BY derives
+// from them, and answers or stores the elements or the values GET derives from them
+func execSort(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
+	return sortBy(db, args, false)
+}
+
+// execSortRO runs SORT_RO, SORT without STORE
+func execSortRO(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
+	return sortBy(db, args, true)
+}
+
+func sortBy(db *DataBaseImpl, args cm.CmdLine, readOnly bool) resp.Reply {
+	policy, errReply := parseSortPolicy(args, readOnly)
+	if errReply != nil {
+		return errReply
+	}
+	elems, kind, errReply := db.sortElements(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	// the order of a set is random, it is sorted anyway for a result which is stored
+	if policy.dontSort && kind == "set" && policy.store != "" {
+		policy.dontSort, policy.alpha, policy.by = false, true, ""
+	}
+	// a zset is already sorted, by score
+	if policy.dontSort && kind == "zset" && policy.desc {
+		for i, j := 0, len(elems)-1; i < j; i, j = i+1, j-1 {
+			elems[i], elems[j] = elems[j], elems[i]
+		}
+	}
+
+	items := make([]*sortItem, len(elems))
+	for i, elem := range elems {
+		items[i] = &sortItem{elem: elem, weight: []byte(elem)}
+		if policy.dontSort {
+			continue
+		}
+		if policy.by != "" {
+			items[i].weight = db.lookupSortPattern(policy.by, elem)
+		}
+		if policy.alpha || items[i].weight == nil {
+			continue
+		}
+		score, err := strconv.ParseFloat(string(items[i].weight), 64)
+		if err != nil {
+			return resp.MakeErrReply("ERR One or more scores can't be converted into double")
+		}
+		items[i].score = score
+	}
+	if !policy.dontSort {
+		sort.SliceStable(items, func(i, j int) bool {
+			cmp := compareSortItems(items[i], items[j], policy)
+			if policy.desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		})
+	}
+
+	start := policy.offset
+	if start < 0 {
+		start = 0
+	}
+	if start > len(items) {
+		start = len(items)
+	}
+	end := len(items)
+	if policy.count >= 0 && start+policy.count < end {
+		end = start + policy.count
+	}
+	items = items[start:end]
+
+	result := make([][]byte, 0, len(items)*len(policy.gets)+len(items))
+	for _, item := range items {
+		if len(policy.gets) == 0 {
+			result = append(result, []byte(item.elem))
+			continue
+		}
+		for _, pattern := range policy.gets {
+			result = append(result, db.lookupSortPattern(pattern, item.elem))
+		}
+	}
+	if policy.store == "" {
+		return resp.MakeMultiBulkReply(result)
+	}
+	return storeSorted(db, policy.store, result)
+}
+
+// compareSortItems compares the weights of a and b, elements with the same weight are compared as strings so that the
+// order never depends on the order they are kept in
+func compareSortItems(a, b *sortItem, policy *sortPolicy) int {
+	if policy.alpha {
+		// a missing weight is the smallest one
+		switch {
+		case a.weight == nil && b.weight == nil:
+		case a.weight == nil:
+			return -1
+		case b.weight == nil:
+			return 1
+		default:
+			if cmp := bytes.Compare(a.weight, b.weight); cmp != 0 {
+				return cmp
+			}
+		}
+	} else {
+		switch {
+		case a.score < b.score:
+			return -1
+		case a.score > b.score:
+			return 1
+		}
+	}
+	return strings.Compare(a.elem, b.elem)
+}
+
+// storeSorted replaces dest with a list of values, missing values being empty strings, or deletes it if there is none
+func storeSorted(db *DataBaseImpl, dest string, values [][]byte) resp.Reply {
+	db.Remove(dest)
+	db.addAof(cmdutil.ToCmdLine("del", dest))
+	if len(values) == 0 {
+		return resp.MakeIntReply(0)
+	}
+	stored, _ := getOrCreateList(db, dest)
+	line := make(cm.CmdLine, 0, len(values)+2)
+	line = append(line, []byte("rpush"), []byte(dest))
+	for _, val := range values {
+		if val == nil {
+			val = []byte{}
+		}
+		stored.Add(val)
+		line = append(line, val)
+	}
+	db.addAof(line)
+	return resp.MakeIntReply(int64(len(values)))
+}
+
+// prepareSort reads the key and the keys BY and GET patterns derive from it, and writes the STORE destination. A
+// pattern stands for the keys it derives, which are only known once the elements are read, so the pattern itself is
+// returned for a cluster to route, it must share the slot of the key through a hash tag, along with lockAllKeys.
+func prepareSort(args cm.CmdLine) ([]string, []string) {
+	readKeys := []string{string(args[0])}
+	var writeKeys []string
+	for i := 1; i+1 < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "BY", "GET":
+			i++
+			if key, _, ok := splitSortPattern(string(args[i]), "*"); ok {
+				readKeys = append(readKeys, key)
+			}
+		case "LIMIT":
+			i += 2
+		case "STORE":
+			i++
+			writeKeys = append(writeKeys, string(args[i]))
+		}
+	}
+	if len(readKeys) > 1 {
+		readKeys = append(readKeys, lockAllKeys)
+	}
+	return writeKeys, readKeys
+}
+
+func init() {
+	RegisterCommand("SORT", execSort, prepareSort, nil, -2, Write)
+	RegisterCommand("SORT_RO", execSortRO, prepareSort, nil, -2, ReadOnly)
+}
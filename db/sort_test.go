@@ -0,0 +1,142 @@
+package db
+
+import (
+	"mygodis/clientc"
+	"mygodis/common/commoninterface"
+	"mygodis/config"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSort(t *testing.T) {
+	server := NewStandaloneServer(&config.ServerProperties{Databases: 1})
+	defer server.Close()
+	conn := clientc.NewFakeConnection()
+	exec := func(args ...string) string {
+		return string(server.Exec(conn, cmdutil.ToCmdLine(args...)).ToBytes())
+	}
+	exec("RPUSH", "list", "3", "1", "10", "2")
+	exec("SADD", "set", "b", "c", "a")
+	zset := server.selectDB(0).makeZSet()
+	zset.Add("x", 3)
+	zset.Add("y", 1)
+	zset.Add("z", 2)
+	server.selectDB(0).PutEntity("zset", commoninterface.DataEntityWithData(zset))
+	for _, user := range []struct{ id, name, age, weight string }{
+		{"1", "ann", "30", "20"}, {"2", "bob", "25", "30"}, {"3", "cid", "40", "10"},
+	} {
+		exec("HMSET", "user:"+user.id, "name", user.name, "age", user.age)
+		exec("SET", "weight_"+user.id, user.weight)
+	}
+	exec("RPUSH", "ids", "1", "2", "3")
+
+	bulks := func(values ...string) string {
+		reply := make([][]byte, len(values))
+		for i, v := range values {
+			if v != "nil" {
+				reply[i] = []byte(v)
+			}
+		}
+		return string(resp.MakeMultiBulkReply(reply).ToBytes())
+	}
+	for _, c := range []struct {
+		args   string
+		except string
+	}{
+		{"SORT list", bulks("1", "2", "3", "10")},
+		{"SORT list DESC", bulks("10", "3", "2", "1")},
+		{"SORT list ALPHA", bulks("1", "10", "2", "3")},
+		{"SORT list LIMIT 1 2", bulks("2", "3")},
+		{"SORT list LIMIT 3 -1", bulks("10")},
+		{"SORT list LIMIT 5 1", bulks()},
+		{"SORT set ALPHA DESC", bulks("c", "b", "a")},
+		{"SORT set", "-ERR One or more scores can't be converted into double\r\n"},
+		{"SORT zset ALPHA", bulks("x", "y", "z")},
+		{"SORT zset BY nosort", bulks("y", "z", "x")},
+		{"SORT zset BY nosort DESC LIMIT 0 2", bulks("x", "z")},
+		{"SORT ids BY weight_*", bulks("3", "1", "2")},
+		{"SORT ids BY user:*->age DESC", bulks("3", "1", "2")},
+		{"SORT ids BY user:*->name ALPHA GET # GET user:*->name", bulks("1", "ann", "2", "bob", "3", "cid")},
+		{"SORT ids BY nosort GET weight_* GET user:*->missing GET constant", bulks("20", "nil", "nil", "30", "nil", "nil", "10", "nil", "nil")},
+		{"SORT ids BY missing_*", bulks("1", "2", "3")},
+		{"SORT_RO ids BY weight_* DESC", bulks("2", "1", "3")},
+		{"SORT none", bulks()},
+		{"SORT user:1", "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{"SORT list LIMIT 1", "-Err syntax error\r\n"},
+		{"SORT list LIMIT a 1", "-ERR value is not an integer or out of range\r\n"},
+		{"SORT_RO list STORE dest", "-Err syntax error\r\n"},
+	} {
+		if got := exec(strings.Fields(c.args)...); got != c.except {
+			t.Errorf("except %q for %s but got %q", c.except, c.args, got)
+		}
+	}
+
+	if got := exec("SORT", "ids", "BY", "weight_*", "GET", "user:*->name", "GET", "missing_*", "STORE", "dest"); got != ":6\r\n" {
+		t.Fatalf("except 6 values stored but got %q", got)
+	}
+	if got := exec("LRANGE", "dest", "0", "-1"); got != bulks("cid", "", "ann", "", "bob", "") {
+		t.Errorf("unexpected list stored %q", got)
+	}
+	// a set stored without sorting is sorted anyway
+	exec("SORT", "set", "BY", "nosort", "STORE", "dest")
+	if got := exec("LRANGE", "dest", "0", "-1"); got != bulks("a", "b", "c") {
+		t.Errorf("except the set stored in order but got %q", got)
+	}
+	if got := exec("SORT", "none", "STORE", "dest"); got != ":0\r\n" || exec("EXISTS", "dest") != ":0\r\n" {
+		t.Errorf("except an empty result to delete dest but got %q", got)
+	}
+}
+
+func TestPrepareSort(t *testing.T) {
+	writeKeys, readKeys := prepareSort(cmdutil.ToCmdLine("ids", "BY", "weight_*", "LIMIT", "0", "1",
+		"GET", "#", "GET", "user:*->name", "GET", "constant", "STORE", "dest"))
+	if !reflect.DeepEqual(writeKeys, []string{"dest"}) ||
+		!reflect.DeepEqual(readKeys, []string{"ids", "weight_*", "user:*", lockAllKeys}) {
+		t.Errorf("unexpected keys %v %v", writeKeys, readKeys)
+	}
+	line := cmdutil.ToCmdLine("SORT", "ids", "BY", "weight_*")
+	if _, readKeys, _ = GetRelatedKeys(line); !reflect.DeepEqual(readKeys, []string{"ids", "weight_*"}) {
+		t.Errorf("except the related keys to leave out the lock signal but got %v", readKeys)
+	}
+	if writeKeys, readKeys = prepareSort(cmdutil.ToCmdLine("ids", "BY", "nosort")); writeKeys != nil || len(readKeys) != 1 {
+		t.Errorf("except nosort to read only the key but got %v %v", writeKeys, readKeys)
+	}
+}
+
+func TestSort_locks(t *testing.T) {
+	db := NewDB()
+	locked := func(write, read []string) bool {
+		done := make(chan struct{})
+		go func() {
+			db.RWLocks(write, read)
+			db.RWUnLocks(write, read)
+			close(done)
+		}()
+		select {
+		case <-done:
+			return false
+		case <-time.After(100 * time.Millisecond):
+			return true
+		}
+	}
+	// a key holding * is only a key, writing it leaves the other keys free
+	db.RWLocks([]string{"a*b"}, nil)
+	if locked([]string{"other"}, nil) {
+		t.Errorf("except SET a*b to lock only its own key")
+	}
+	db.RWUnLocks([]string{"a*b"}, nil)
+
+	writeKeys, readKeys, _ := GetLockKeys(cmdutil.ToCmdLine("SORT", "ids", "BY", "weight_*", "STORE", "dest"))
+	db.RWLocks(writeKeys, readKeys)
+	if locked(nil, []string{"weight_1"}) {
+		t.Errorf("except SORT BY to lock the keys its pattern derives for reading only")
+	}
+	if !locked([]string{"weight_1"}, nil) {
+		t.Errorf("except SORT BY to lock the keys its pattern derives")
+	}
+	db.RWUnLocks(writeKeys, readKeys)
+}
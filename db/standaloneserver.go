@@ -6,8 +6,12 @@ import (
 	cm "mygodis/common"
 	"mygodis/common/commoninterface"
 	"mygodis/config"
+	"mygodis/lib/clock"
+	"mygodis/lib/delay"
+	"mygodis/lib/pubsub"
 	"mygodis/util/cmdutil"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	//"mygodis/db/cmd"
@@ -21,10 +25,16 @@ import (
 type StandaloneServer struct {
 	Dbs        []any
 	activeConn *sync.Map
-	//TODO add pubsub
-	//hub pubsub.Hub
-	persister *aof.Persister
-	role      uint32
+	hub        *pubsub.Hub
+	persister  *aof.Persister
+	role       uint32
+	// props, timer and clock belong to this server, so several servers can run in one process
+	props *config.ServerProperties
+	timer *delay.TimeWheel
+	clock clock.Clock
+	// monitors is copied on write under monitorsMu, so commands read it without a lock
+	monitorsMu sync.Mutex
+	monitors   atomic.Pointer[[]*Monitor]
 	//TODO add replication
 	//hooks
 	insertCallBack commoninterface.KeyEventCallback
@@ -40,7 +50,7 @@ func (d *StandaloneServer) RemoveClient(connection commoninterface.Connection) {
 func (d *StandaloneServer) ExecWithLock(connection commoninterface.Connection, args cm.CmdLine) (reply resp.Reply) {
 	return d.selectDB(connection.GetDBIndex()).ExecWithLock(args)
 }
-func (d *StandaloneServer) ExecMulti(connection commoninterface.Connection, watching map[string]uint32, cmdLines []cm.CmdLine) (reply resp.Reply) {
+func (d *StandaloneServer) ExecMulti(connection commoninterface.Connection, watching map[string]uint64, cmdLines []cm.CmdLine) (reply resp.Reply) {
 	return ExecMulti(d.selectDB(connection.GetDBIndex()), connection, watching, cmdLines)
 }
 func (d *StandaloneServer) GetUndoLogs(dbIndex int, cmd cm.CmdLine) []cm.CmdLine {
@@ -48,6 +58,82 @@ func (d *StandaloneServer) GetUndoLogs(dbIndex int, cmd cm.CmdLine) []cm.CmdLine
 	return GetUndoLogs(d.selectDB(dbIndex), cmd)
 }
 
+// GetVersion returns the version of key which is bumped by every write, 0 if key was never written
+func (d *StandaloneServer) GetVersion(dbIndex int, key string) uint64 {
+	version, _ := d.selectDB(dbIndex).GetVersion(key)
+	return version
+}
+
+// DumpKey returns the version of key and the commands rebuilding it, the key is read locked meanwhile
+func (d *StandaloneServer) DumpKey(dbIndex int, key string) (uint64, []cm.CmdLine) {
+	db := d.selectDB(dbIndex)
+	db.RWLocks(nil, []string{key})
+	defer db.RWUnLocks(nil, []string{key})
+	version, _ := db.GetVersion(key)
+	return version, RestoreCmdLines(db, key)
+}
+
+// DryRun executes cmdLines on a copy of the keys they touch and returns the first error reply, nil if none fails.
+// The keys must be locked by the caller, dbIndex itself is left untouched
+func (d *StandaloneServer) DryRun(dbIndex int, cmdLines []cm.CmdLine) resp.Reply {
+	db := d.selectDB(dbIndex)
+	scratch := NewDB()
+	copied := make(map[string]struct{})
+	for _, line := range cmdLines {
+		writeKeys, readKeys, _ := GetRelatedKeys(line)
+		for _, key := range append(writeKeys, readKeys...) {
+			if _, ok := copied[key]; ok {
+				continue
+			}
+			copied[key] = struct{}{}
+			for _, restore := range RestoreCmdLines(db, key) {
+				scratch.ExecNormal(restore)
+			}
+		}
+	}
+	for _, line := range cmdLines {
+		if reply := scratch.ExecNormal(line); resp.IsErrorReply(reply) {
+			return reply
+		}
+	}
+	return nil
+}
+
+// ApplyVersion rebuilds key with cmdLines and gives it version, nothing changes if the local copy is as new
+func (d *StandaloneServer) ApplyVersion(dbIndex int, key string, version uint64, cmdLines []cm.CmdLine) bool {
+	db := d.selectDB(dbIndex)
+	db.RWLocks([]string{key}, nil)
+	defer db.RWUnLocks([]string{key}, nil)
+	if current, _ := db.GetVersion(key); current >= version {
+		return false
+	}
+	for _, line := range cmdLines {
+		db.ExecWithLock(line)
+	}
+	db.versionMap.Put(key, version)
+	return true
+}
+
+// DropKey forgets key together with its version, as if it was never written to this node
+func (d *StandaloneServer) DropKey(dbIndex int, key string) {
+	db := d.selectDB(dbIndex)
+	db.RWLocks([]string{key}, nil)
+	defer db.RWUnLocks([]string{key}, nil)
+	db.dropKey(key)
+}
+
+// DropKeyAt removes key only if it still has version, it returns false if the key was written meanwhile
+func (d *StandaloneServer) DropKeyAt(dbIndex int, key string, version uint64) bool {
+	db := d.selectDB(dbIndex)
+	db.RWLocks([]string{key}, nil)
+	defer db.RWUnLocks([]string{key}, nil)
+	if current, _ := db.GetVersion(key); current != version {
+		return false
+	}
+	db.dropKey(key)
+	return true
+}
+
 func (d *StandaloneServer) ForEach(dbIndex int, cb func(key string, data *commoninterface.DataEntity, expiration time.Time) bool) {
 	d.selectDB(dbIndex).ForEach(cb)
 }
@@ -108,7 +194,7 @@ func (d *StandaloneServer) GetDbInfo(infoType cm.InfoType) []cm.DBInfo {
 		infos = append(infos, cm.DBInfo{InfoKey: "version", InfoValue: "0.0.1"})
 		infos = append(infos, cm.DBInfo{InfoKey: "mode", InfoValue: "standalone"})
 		infos = append(infos, cm.DBInfo{InfoKey: "arch_bits", InfoValue: "64"})
-		infos = append(infos, cm.DBInfo{InfoKey: "tcp_port", InfoValue: fmt.Sprintf("%d", config.Properties.Port)})
+		infos = append(infos, cm.DBInfo{InfoKey: "tcp_port", InfoValue: fmt.Sprintf("%d", d.props.Port)})
 		infos = append(infos, cm.DBInfo{InfoKey: "process_id", InfoValue: fmt.Sprintf("%d", os.Getpid())})
 		return infos
 	case cm.MEMORY_INFO:
@@ -141,17 +227,30 @@ func (d *StandaloneServer) GetDbInfo(infoType cm.InfoType) []cm.DBInfo {
 	}
 	return nil
 }
+
+// FlushAll empties every db in place, replacing them would race with the connections reading them
 func (d *StandaloneServer) FlushAll() resp.Reply {
 	for md := range d.Dbs {
-		dbi := NewDB()
-		dbi.index = md
-		d.Dbs[md] = dbi
+		d.selectDB(md).clear()
 	}
 	d.AddAof(0, cmdutil.ToCmdLine("flushall"))
 	return resp.MakeOkReply()
-
 }
 func (d *StandaloneServer) Exec(connection commoninterface.Connection, cmd cm.CmdLine) (reply resp.Reply) {
+	start := time.Now()
+	// deferred before the recover below, so it sees the reply of a panic too
+	defer func() {
+		if len(cmd) == 0 {
+			return
+		}
+		label := metricCommand(strings.ToUpper(string(cmd[0])))
+		commandDuration.With(label).Since(start)
+		commandCalls.With(label).Inc()
+		if _, isErr := reply.(resp.ErrorReply); isErr {
+			commandErrors.With(label).Inc()
+		}
+		d.notifyMonitors(connection, cmd, start, reply)
+	}()
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Warn("server error", r)
@@ -163,26 +262,37 @@ func (d *StandaloneServer) Exec(connection commoninterface.Connection, cmd cm.Cm
 	case "PING":
 		return Ping()
 	case "AUTH":
-		return Auth(connection, cmd[1:])
+		return Auth(d, connection, cmd[1:])
 	//case "slaveof":
 	//TODO  return systemcd.SlaveOf(connection, cmd)
 	case "SELECT":
 		return Select(d, connection, cmd[1:])
 	case "INFO":
 		return Info(connection, d, cmd)
-	//case "subscribe":
-	//TODO  return systemcd.Subscribe(connection, cmd)
-	//case "unsubscribe":
-	//TODO  return systemcd.Unsubscribe(connection, cmd)
-	//case "publish":
-	//TODO  return systemcd.Publish(connection, cmd)
+	case "MEMORY":
+		// USAGE reads a key of the selected db, the other subcommands are about the whole server
+		if len(cmd) < 2 || !strings.EqualFold(string(cmd[1]), "USAGE") {
+			return Memory(d, cmd[1:])
+		}
+		return d.selectDB(connection.GetDBIndex()).Exec(connection, cmd)
+	case "DEBUG":
+		if !debugCommands {
+			return resp.MakeErrReply("ERR unknown command '" + string(cmd[0]) + "'")
+		}
+		return Debug(d, cmd[1:])
+	case "SUBSCRIBE", "UNSUBSCRIBE", "PUBLISH":
+		return d.hub.Exec(connection, cmd)
 	//case "psubscribe":
 	//TODO  return systemcd.PSubscribe(connection, cmd)
 	//case "punsubscribe":
 	//TODO  return systemcd.PUnsubscribe(connection, cmd)
 	//case "pubsub":
 	//TODO  return systemcd.PubSub(connection, cmd)
-	case "flushall":
+	case "FLUSHALL":
+		// the dbs are swapped at once, so ASYNC and SYNC behave the same
+		if len(cmd) > 2 || len(cmd) == 2 && !isFlushMode(string(cmd[1])) {
+			return resp.MakeErrReply("ERR syntax error")
+		}
 		return d.FlushAll()
 	//case "rewriteaof":
 	//TODO  return systemcd.RewriteAOF(connection, cmd)
@@ -203,29 +313,49 @@ func (d *StandaloneServer) Exec(connection commoninterface.Connection, cmd cm.Cm
 	}
 }
 func (d *StandaloneServer) AfterClientClose(connection commoninterface.Connection) {
+	d.hub.UnsubscribeAll(connection)
 	name := connection.Name()
 	logger.Info("client close", name)
 }
 func (d *StandaloneServer) Close() {
-	d.persister.Close()
-
+	if d.persister != nil {
+		d.persister.Close()
+	}
+	d.timer.Stop()
 }
 func MakeStandaloneServer() *StandaloneServer {
-	databaseCount := config.Properties.Databases
+	return NewStandaloneServer(config.Properties)
+}
+
+// NewStandaloneServer returns a server configured by props with a time wheel of its own, Close stops it. Test
+// builds run it on a virtual clock moved by DEBUG FASTFORWARD.
+func NewStandaloneServer(props *config.ServerProperties) *StandaloneServer {
+	var c clock.Clock = clock.Real
+	if debugCommands {
+		c = clock.NewVirtual()
+	}
+	return NewStandaloneServerWithClock(props, c)
+}
+
+// NewStandaloneServerWithClock returns a server whose expirations follow c
+func NewStandaloneServerWithClock(props *config.ServerProperties, c clock.Clock) *StandaloneServer {
+	databaseCount := props.Databases
 	manager := &StandaloneServer{
 		Dbs:        make([]any, databaseCount),
 		activeConn: new(sync.Map),
+		props:      props,
+		timer:      delay.NewTimeWheelWithClock(c),
+		clock:      c,
 	}
+	manager.timer.Start()
 	for md := range manager.Dbs {
-		dbi := NewDB()
-		dbi.index = md
-		manager.Dbs[md] = dbi
+		manager.Dbs[md] = manager.newDB(md)
 	}
-	//TODO 添加发布订阅
-	appendOnly := config.Properties.AppendOnly
+	manager.hub = pubsub.MakeHub()
+	appendOnly := props.AppendOnly
 	if appendOnly {
 		fsync := aof.Always
-		switch config.Properties.AppendFsync {
+		switch props.AppendFsync {
 		case "always":
 			fsync = aof.Always
 		case "everysec":
@@ -233,13 +363,14 @@ func MakeStandaloneServer() *StandaloneServer {
 		case "no":
 			fsync = aof.No
 		}
-		aofPersister, err := NewPersister(manager, config.Properties.AppendFilename, true, fsync)
+		aofPersister, err := NewPersister(manager, props, props.AppendFilename, true, fsync)
 		if err != nil {
 			logger.Fatal("open aofPersister file error: ", err)
 		}
+		aofPersister.SetClock(c)
 		manager.bindPersister(aofPersister)
 	}
-	if config.Properties.RDBFilename != "" {
+	if props.RDBFilename != "" {
 		err := manager.loadRDBFile()
 		if err != nil {
 			logger.Error("load rdb file error: ", err)
@@ -248,3 +379,18 @@ func MakeStandaloneServer() *StandaloneServer {
 	//TODO 添加主从复制
 	return manager
 }
+func (d *StandaloneServer) newDB(index int) *DataBaseImpl {
+	dbi := NewDB()
+	dbi.index = index
+	dbi.timer = d.timer
+	dbi.clock = d.clock
+	dbi.encodings = makeEncodingLimits(d.props)
+	dbi.tombstones = func() time.Duration {
+		// the factor is read on every removal, a cluster may be configured after its dbs are made
+		if d.props.ReplicationFactor > 1 {
+			return tombstoneTTL
+		}
+		return 0
+	}
+	return dbi
+}
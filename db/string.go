@@ -32,6 +32,8 @@ type setPolicy struct {
 	expirePolicy uint8
 	get          bool
 	expireTime   time.Time
+	// now is the time relative expirations start from
+	now time.Time
 }
 
 func (db *DataBaseImpl) getAsString(key string) ([]byte, resp.ErrorReply) {
@@ -84,13 +86,13 @@ func execGetEx(db *DataBaseImpl, args cm.CmdLine) (res resp.Reply) {
 		if err != nil {
 			return resp.MakeSyntaxErrReply()
 		}
-		expireTime = time.Now().Add(time.Duration(expireSecond) * time.Second)
+		expireTime = db.now().Add(time.Duration(expireSecond) * time.Second)
 	case "PX":
 		expireMillisecond, err := strconv.Atoi(string(args[2]))
 		if err != nil {
 			return resp.MakeSyntaxErrReply()
 		}
-		expireTime = time.Now().Add(time.Duration(expireMillisecond) * time.Millisecond)
+		expireTime = db.now().Add(time.Duration(expireMillisecond) * time.Millisecond)
 
 	case "EXAT":
 		expireSecond, err := strconv.Atoi(string(args[2]))
@@ -123,6 +125,7 @@ func execSet(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 		expirePolicy: noEx,
 		get:          false,
 		keepTTL:      false,
+		now:          db.now(),
 	}
 	key := string(args[0])
 	value := args[1]
@@ -137,7 +140,7 @@ func execSet(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 		if parseErr != nil {
 			return resp.MakeErrReply(parseErr.Error())
 		}
-		if policy.expireTime.Before(time.Now()) && policy.expirePolicy != noEx {
+		if policy.expireTime.Before(policy.now) && policy.expirePolicy != noEx {
 			return resp.MakeNullBulkReply()
 		} else {
 			expireTime = policy.expireTime
@@ -212,7 +215,7 @@ func parseSet(args cm.CmdLine, policy *setPolicy) error {
 		if err != nil {
 			return err
 		}
-		policy.expireTime = time.Now().Add(time.Duration(second) * time.Second)
+		policy.expireTime = policy.now.Add(time.Duration(second) * time.Second)
 		return parseSet(args[2:], policy)
 	case "PX":
 		if policy.keepTTL || policy.expirePolicy != noEx {
@@ -224,7 +227,7 @@ func parseSet(args cm.CmdLine, policy *setPolicy) error {
 		if err != nil {
 			return err
 		}
-		policy.expireTime = time.Now().Add(time.Duration(millisecond) * time.Millisecond)
+		policy.expireTime = policy.now.Add(time.Duration(millisecond) * time.Millisecond)
 		return parseSet(args[2:], policy)
 	case "EXAT":
 		if policy.keepTTL || policy.expirePolicy != noEx {
@@ -283,7 +286,7 @@ func execSetEx(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	if err != nil {
 		return resp.MakeErrReply(err.Error())
 	}
-	expireTime := time.Now().Add(time.Duration(expireSecond) * time.Second)
+	expireTime := db.now().Add(time.Duration(expireSecond) * time.Second)
 	db.PutEntity(key, data)
 	db.addAof(cmdutil.ToCmdLineWithBytes("setex", args...))
 	db.Expire(key, expireTime)
@@ -301,7 +304,7 @@ func execPSetEx(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	if err != nil {
 		return resp.MakeErrReply(err.Error())
 	}
-	expireTime := time.Now().Add(time.Duration(expireMillisecond) * time.Millisecond)
+	expireTime := db.now().Add(time.Duration(expireMillisecond) * time.Millisecond)
 	db.PutEntity(key, data)
 	db.Expire(key, expireTime)
 	db.addAof(cmdutil.ToCmdLine("set", key, string(value)))
@@ -800,8 +803,8 @@ func undoBitOpCommands(db *DataBaseImpl, args cm.CmdLine) []cm.CmdLine {
 	return rollbackGivenKeys(db, string(key))
 }
 func undoMSetCommands(db *DataBaseImpl, args cm.CmdLine) []cm.CmdLine {
-	keys := make([]string, 0, len(args)-1)
-	for i := 1; args[i] != nil; i += 1 {
+	keys := make([]string, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
 		keys = append(keys, string(args[i]))
 	}
 	return rollbackGivenKeys(db, keys...)
@@ -815,13 +818,13 @@ func init() {
 	RegisterCommand("STRLEN", execStrLen, readFirstKey, nil, 2, ReadOnly)
 	RegisterCommand("GETRANGE", execGetRange, readFirstKey, nil, 4, ReadOnly)
 	RegisterCommand("SETNX", execSetNx, writeFirstKey, rollbackFirstKey, 3, Write)
-	RegisterCommand("MSETNX", execMSetNx, writeAllKeys, undoMSetCommands, -3, Write)
+	RegisterCommand("MSETNX", execMSetNx, prepareMSet, undoMSetCommands, -3, Write)
 	RegisterCommand("PSETEX", execPSetEx, writeFirstKey, rollbackFirstKey, 4, Write)
 	RegisterCommand("SETEX", execSetEx, writeFirstKey, rollbackFirstKey, 4, Write)
 	RegisterCommand("SET", execSet, writeFirstKey, rollbackFirstKey, -3, Write)
 	RegisterCommand("GETSET", execGetSet, writeFirstKey, rollbackFirstKey, 3, Write)
 	RegisterCommand("GETDEL", execGetDel, writeFirstKey, rollbackFirstKey, 2, Write)
-	RegisterCommand("MSET", execMSet, writeAllKeys, undoMSetCommands, -3, Write)
+	RegisterCommand("MSET", execMSet, prepareMSet, undoMSetCommands, -3, Write)
 	RegisterCommand("APPEND", execAppend, writeFirstKey, rollbackFirstKey, 3, Write)
 	RegisterCommand("SETRANGE", execSetRange, writeFirstKey, rollbackFirstKey, 4, Write)
 	RegisterCommand("INCR", execIncr, writeFirstKey, rollbackFirstKey, 2, Write)
@@ -830,6 +833,6 @@ func init() {
 	RegisterCommand("DECR", execDecr, writeFirstKey, rollbackFirstKey, 2, Write)
 	RegisterCommand("DECRBY", execDecrBy, writeFirstKey, rollbackFirstKey, 3, Write)
 	RegisterCommand("SETBIT", execSetBit, writeFirstKey, undoSetBitCommands, 4, Write)
-	RegisterCommand("BITOP", execBitOp, writeFirstKey, undoBitOpCommands, -4, Write)
+	RegisterCommand("BITOP", execBitOp, prepareBitOp, undoBitOpCommands, -4, Write)
 
 }
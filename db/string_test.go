@@ -17,7 +17,7 @@ func Test_execGetEx(t *testing.T) {
 		db   *DataBaseImpl
 		args common.CmdLine
 	}
-	db := NewDB()
+	db, fastForward := newVirtualDB(t)
 	db.PutEntity("key", &commoninterface.DataEntity{
 		Data: []byte("OK"),
 	})
@@ -104,7 +104,11 @@ func Test_execGetEx(t *testing.T) {
 			}
 		})
 	}
-	time.Sleep(11 * time.Second)
+	// the key was persisted at last
+	fastForward(11 * time.Second)
+	if _, ok := db.GetEntity("key"); !ok {
+		t.Error("except the persisted key to stay")
+	}
 }
 
 func Test_parseSet(t *testing.T) {
@@ -1588,7 +1592,8 @@ func Test_execMSetNx(t *testing.T) {
 }
 
 func Test_execPSetEx(t *testing.T) {
-	db := dbWithData(NewDB(), "key", "1")
+	db, fastForward := newVirtualDB(t)
+	dbWithData(db, "key", "1")
 	if asString, _ := db.getAsString("key"); string(asString) != "1" {
 		t.Errorf("db.getAsString(\"key\") = %v, want %v", asString, "1")
 	}
@@ -1600,7 +1605,7 @@ func Test_execPSetEx(t *testing.T) {
 	if asString, _ := db.getAsString("key"); string(asString) != "2" {
 		t.Errorf("db.getAsString(\"key\") = %v, want %v", string(asString), "2")
 	}
-	time.Sleep(5 * time.Second)
+	fastForward(5 * time.Second)
 	if asString, _ := db.getAsString("key"); asString != nil {
 		t.Errorf("db.getAsString(\"key\") = %v, want %v", asString, nil)
 	}
@@ -1623,7 +1628,8 @@ func Test_execSetBit(t *testing.T) {
 }
 
 func Test_execSetEx(t *testing.T) {
-	db := dbWithData(NewDB(), "key", "1")
+	db, fastForward := newVirtualDB(t)
+	dbWithData(db, "key", "1")
 	if asString, _ := db.getAsString("key"); string(asString) != "1" {
 		t.Errorf("db.getAsString(\"key\") = %v, want %v", asString, "1")
 	}
@@ -1635,7 +1641,7 @@ func Test_execSetEx(t *testing.T) {
 	if asString, _ := db.getAsString("key"); string(asString) != "2" {
 		t.Errorf("db.getAsString(\"key\") = %v, want %v", string(asString), "2")
 	}
-	time.Sleep(5 * time.Second)
+	fastForward(5 * time.Second)
 	if asString, _ := db.getAsString("key"); asString != nil {
 		t.Errorf("db.getAsString(\"key\") = %v, want %v", asString, nil)
 	}
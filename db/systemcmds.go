@@ -1,41 +1,47 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 	"mygodis/common"
 	"mygodis/common/commoninterface"
-	"mygodis/config"
+	"mygodis/lib/clock"
 	"mygodis/resp"
 	"mygodis/util/cmdutil"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// debugCommands enables DEBUG, it is only set by test builds
+var debugCommands = false
+
 func Ping() resp.Reply {
 	return resp.MakePongReply()
 }
-func Auth(c commoninterface.Connection, cmd common.CmdLine) resp.Reply {
+func Auth(d *StandaloneServer, c commoninterface.Connection, cmd common.CmdLine) resp.Reply {
 	if len(cmd) != 1 {
 		return resp.MakeErrReply("ERR wrong number of arguments for 'auth' command")
 	}
-	if config.Properties.RequirePass == "" {
+	if d.props.RequirePass == "" {
 		return resp.MakeErrReply("ERR Client sent AUTH, but no password is set")
 	}
 	passwd := string(cmd[0])
 	c.SetPassword(passwd)
-	if config.Properties.RequirePass != passwd {
+	if d.props.RequirePass != passwd {
 		return resp.MakeErrReply("ERR invalid password")
 	}
 	return resp.MakeOkReply()
 }
-func isAuthenticated(c commoninterface.Connection) bool {
-	if config.Properties.RequirePass == "" {
+func isAuthenticated(d *StandaloneServer, c commoninterface.Connection) bool {
+	if d.props.RequirePass == "" {
 		return true
 	}
-	return c.GetPassword() == config.Properties.RequirePass
+	return c.GetPassword() == d.props.RequirePass
 }
 func Select(d *StandaloneServer, connection commoninterface.Connection, cmd common.CmdLine) resp.Reply {
-	if !isAuthenticated(connection) {
+	if !isAuthenticated(d, connection) {
 		return resp.MakeErrReply("NOAUTH Authentication required.")
 	}
 	if len(cmd) != 1 {
@@ -46,14 +52,54 @@ func Select(d *StandaloneServer, connection commoninterface.Connection, cmd comm
 	if err != nil {
 		return resp.MakeErrReply("ERR value is not an integer ")
 	}
-	if dbIndex < 0 || dbIndex >= config.Properties.Databases {
+	if dbIndex < 0 || dbIndex >= len(d.Dbs) {
 		return resp.MakeErrReply("ERR value is  out of range")
 	}
+	connection.SelectDB(dbIndex)
 	d.AddAof(dbIndex, cmdutil.ToCmdLineWithName("select", s))
 	return resp.MakeOkReply()
 }
+
+// Debug runs the DEBUG subcommands of test builds, FASTFORWARD <ms> moves the clock of the server forward
+func Debug(d *StandaloneServer, cmd common.CmdLine) resp.Reply {
+	if len(cmd) == 0 {
+		return resp.MakeErrReply("ERR wrong number of arguments for 'debug' command")
+	}
+	switch strings.ToUpper(string(cmd[0])) {
+	case "FASTFORWARD":
+		if len(cmd) != 2 {
+			return resp.MakeErrReply("ERR wrong number of arguments for 'debug fastforward' command")
+		}
+		ms, err := strconv.ParseInt(string(cmd[1]), 10, 64)
+		if err != nil || ms < 0 {
+			return resp.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		if err := d.FastForward(time.Duration(ms) * time.Millisecond); err != nil {
+			return resp.MakeErrReply("ERR " + err.Error())
+		}
+		return resp.MakeOkReply()
+	}
+	return resp.MakeErrReply("ERR unknown subcommand '" + string(cmd[0]) + "'")
+}
+
+// FastForward moves the virtual clock of the server forward by duration and expires the keys due meanwhile before
+// it returns
+func (d *StandaloneServer) FastForward(duration time.Duration) error {
+	virtual, ok := d.clock.(*clock.Virtual)
+	if !ok {
+		return errors.New("the clock of the server is not virtual")
+	}
+	virtual.Advance(duration)
+	d.timer.RunDue()
+	return nil
+}
+
+// Now returns the time of the clock of the server
+func (d *StandaloneServer) Now() time.Time {
+	return d.clock.Now()
+}
 func Info(connection commoninterface.Connection, d *StandaloneServer, cmd common.CmdLine) resp.Reply {
-	if !isAuthenticated(connection) {
+	if !isAuthenticated(d, connection) {
 		return resp.MakeErrReply("NOAUTH Authentication required.")
 	}
 	if len(cmd) == 2 {
@@ -73,6 +119,8 @@ func Info(connection commoninterface.Connection, d *StandaloneServer, cmd common
 			return resp.MakeMultiBulkReply(PersistenceInfo(d))
 		case "cpu":
 			return resp.MakeMultiBulkReply(CpuInfo(d))
+		case "keyspace":
+			return resp.MakeMultiBulkReply(KeyspaceInfo(d))
 		}
 	}
 	return AllInfo(d)
@@ -80,22 +128,17 @@ func Info(connection commoninterface.Connection, d *StandaloneServer, cmd common
 
 func ClientInfo(d *StandaloneServer) [][]byte {
 	results := make([][]byte, 0)
-	clients := 0
-	d.activeConn.Range(func(key, value any) bool {
-		clients++
-		return true
-	})
 	results = append(results, []byte("# Clients:"))
-	results = append(results, []byte(fmt.Sprintf("connected_clients:%d", clients)))
-	results = append(results, []byte(fmt.Sprintf("maxclients:%d", config.Properties.MaxClients)))
+	results = append(results, []byte(fmt.Sprintf("connected_clients:%d", d.ClientCount())))
+	results = append(results, []byte(fmt.Sprintf("maxclients:%d", d.props.MaxClients)))
 	return results
 }
 func ServerInfo(d *StandaloneServer) [][]byte {
 	results := make([][]byte, 0)
 	results = append(results, []byte("# Server:"))
-	results = append(results, []byte(fmt.Sprintf("server_addr:%s:%d", config.Properties.Bind, config.Properties.Port)))
-	results = append(results, []byte(fmt.Sprintf("datacenter_id:%d", config.Properties.DataCenterId)))
-	results = append(results, []byte(fmt.Sprintf("worker_id:%d", config.Properties.WorkerId)))
+	results = append(results, []byte(fmt.Sprintf("server_addr:%s:%d", d.props.Bind, d.props.Port)))
+	results = append(results, []byte(fmt.Sprintf("datacenter_id:%d", d.props.DataCenterId)))
+	results = append(results, []byte(fmt.Sprintf("worker_id:%d", d.props.WorkerId)))
 	return results
 }
 func MemoryInfo(d *StandaloneServer) [][]byte {
@@ -110,9 +153,11 @@ func MemoryInfo(d *StandaloneServer) [][]byte {
 func PersistenceInfo(d *StandaloneServer) [][]byte {
 	results := make([][]byte, 0)
 	results = append(results, []byte("# Persistence:"))
-	results = append(results, []byte(fmt.Sprintf("aof_enabled:%t", config.Properties.AppendOnly)))
-	results = append(results, []byte(fmt.Sprintf("aof_file:%s", config.Properties.AppendFilename)))
-	results = append(results, []byte(fmt.Sprintf("aof_size:%d", d.persister.AofSize())))
+	results = append(results, []byte(fmt.Sprintf("aof_enabled:%t", d.props.AppendOnly)))
+	results = append(results, []byte(fmt.Sprintf("aof_file:%s", d.props.AppendFilename)))
+	if d.persister != nil {
+		results = append(results, []byte(fmt.Sprintf("aof_size:%d", d.persister.AofSize())))
+	}
 	return results
 }
 func CpuInfo(d *StandaloneServer) [][]byte {
@@ -122,6 +167,19 @@ func CpuInfo(d *StandaloneServer) [][]byte {
 	results = append(results, []byte(fmt.Sprintf("num_cpu:%d", numCPU)))
 	return results
 }
+
+// KeyspaceInfo lists the keys and the keys with ttl of every non empty db
+func KeyspaceInfo(d *StandaloneServer) [][]byte {
+	results := make([][]byte, 0)
+	results = append(results, []byte("# Keyspace:"))
+	for i := range d.Dbs {
+		keys, expires := d.GetDBSize(i)
+		if keys > 0 {
+			results = append(results, []byte(fmt.Sprintf("db%d:keys=%d,expires=%d", i, keys, expires)))
+		}
+	}
+	return results
+}
 func AllInfo(d *StandaloneServer) resp.Reply {
 	results := make([][]byte, 0)
 	results = append(results, ServerInfo(d)...)
@@ -129,5 +187,6 @@ func AllInfo(d *StandaloneServer) resp.Reply {
 	results = append(results, MemoryInfo(d)...)
 	results = append(results, PersistenceInfo(d)...)
 	results = append(results, CpuInfo(d)...)
+	results = append(results, KeyspaceInfo(d)...)
 	return resp.MakeMultiBulkReply(results)
 }
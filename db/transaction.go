@@ -28,16 +28,21 @@ func Watch(db *DataBaseImpl, c commoninterface.Connection, cmd cm.CmdLine) (repl
 	}
 	watching := c.GetWatching()
 	for _, key := range cmd[1:] {
-		if _, ok := db.GetEntity(string(key)); ok {
-			watching[string(key)], _ = db.GetVersion(string(key))
-		}
+		watching[string(key)], _ = db.GetVersion(string(key))
+	}
+	return resp.MakeOkReply()
+}
+func UnWatch(c commoninterface.Connection) resp.Reply {
+	watching := c.GetWatching()
+	for key := range watching {
+		delete(watching, key)
 	}
 	return resp.MakeOkReply()
 }
 func watchChanged(db *DataBaseImpl, c commoninterface.Connection) bool {
 	watching := c.GetWatching()
 	for key, version := range watching {
-		if v, ok := db.GetVersion(key); ok && v != version {
+		if v, _ := db.GetVersion(key); v != version {
 			return true
 		}
 	}
@@ -47,13 +52,18 @@ func EnQueue(c commoninterface.Connection, cmdLine [][]byte) (reply resp.Reply)
 	if !c.InMultiState() {
 		return resp.MakeMultiErrReply()
 	}
-	cmdName := strings.ToLower(string(cmdLine[0]))
+	cmdName := strings.ToUpper(string(cmdLine[0]))
 	cmd, ok := cmdContainer[cmdName]
 	if !ok {
 		e := resp.MakeErrReply("ERR unknown command '" + cmdName + "'")
 		c.AddTxError(e)
 		return e
 	}
+	if !validateArity(cmd.arity, cmdLine) {
+		e := resp.MakeArgNumErrReply(cmdName)
+		c.AddTxError(e)
+		return e
+	}
 	if cmd.prepare == nil {
 		e := resp.MakeErrReply("ERR command '" + cmdName + "' cannot be used in MULTI")
 		c.AddTxError(e)
@@ -74,7 +84,7 @@ func execMulti(dbi *DataBaseImpl, c commoninterface.Connection) resp.Reply {
 	return ExecMulti(dbi, c, c.GetWatching(), cmdLines)
 
 }
-func ExecMulti(dbi *DataBaseImpl, c commoninterface.Connection, watching map[string]uint32, cmdLines []cm.CmdLine) resp.Reply {
+func ExecMulti(dbi *DataBaseImpl, c commoninterface.Connection, watching map[string]uint64, cmdLines []cm.CmdLine) resp.Reply {
 	if watchChanged(dbi, c) {
 		return resp.MakeEmptyMultiBulkReply()
 	}
@@ -82,10 +92,10 @@ func ExecMulti(dbi *DataBaseImpl, c commoninterface.Connection, watching map[str
 	wkeys := make([]string, 0)
 	rkeys := make([]string, 0)
 	for _, cmdLine := range cmdLines {
-		cmdName := strings.ToLower(string(cmdLine[0]))
-		cmd, _ := cmdContainer[cmdName]
-		if cmd.prepare != nil {
-			wkey, rkey := cmd.prepare(cmdLine)
+		cmdName := strings.ToUpper(string(cmdLine[0]))
+		cmd, ok := cmdContainer[cmdName]
+		if ok && cmd.prepare != nil {
+			wkey, rkey := cmd.prepare(cmdLine[1:])
 			wkeys = append(wkeys, wkey...)
 			rkeys = append(rkeys, rkey...)
 		}
@@ -125,14 +135,22 @@ func ExecMulti(dbi *DataBaseImpl, c commoninterface.Connection, watching map[str
 		}
 		return resp.MakeErrReply("ERR EXECABORT Transaction discarded because of previous errors.")
 	}
-	dbi.SetVersion(wkeys...)
 	return resp.MakeMultiRawReply(replies...)
 }
+
+// GetUndoLogs returns the commands reverting line, keys written by commands without undo function are restored as a whole
 func GetUndoLogs(dbi *DataBaseImpl, line cm.CmdLine) []cm.CmdLine {
-	cmdName := strings.ToLower(string(line[0]))
-	cmd, _ := cmdContainer[cmdName]
-	if cmd.undo == nil {
+	cmdName := strings.ToUpper(string(line[0]))
+	cmd, ok := cmdContainer[cmdName]
+	if !ok || !validateArity(cmd.arity, line) {
+		return nil
+	}
+	if cmd.undo != nil {
+		return cmd.undo(dbi, line[1:])
+	}
+	if cmd.prepare == nil {
 		return nil
 	}
-	return cmd.undo(dbi, line)
+	writeKeys, _ := cmd.prepare(line[1:])
+	return rollbackGivenKeys(dbi, writeKeys...)
 }
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"mygodis/clientc"
+	cm "mygodis/common"
+	"mygodis/common/commoninterface"
+	"mygodis/config"
+	"mygodis/resp"
+	"mygodis/util/cmdutil"
+	"testing"
+	"time"
+)
+
+func TestExecMulti(t *testing.T) {
+	db := NewDB()
+	conn := clientc.NewFakeConnection()
+	db.Exec(conn, cmdutil.ToCmdLine("WATCH", "counter"))
+	db.Exec(conn, cmdutil.ToCmdLine("MULTI"))
+	if got := string(db.Exec(conn, cmdutil.ToCmdLine("INCR", "counter")).ToBytes()); got != "+QUEUED\r\n" {
+		t.Fatalf("except queued but got %s", got)
+	}
+	db.Exec(conn, cmdutil.ToCmdLine("MSET", "a", "1", "b", "2"))
+	if got := string(db.Exec(conn, cmdutil.ToCmdLine("EXEC")).ToBytes()); got != "*2\r\n:1\r\n+OK\r\n" {
+		t.Fatalf("unexpected exec reply %q", got)
+	}
+	db.Exec(conn, cmdutil.ToCmdLine("WATCH", "counter"))
+	db.Exec(clientc.NewFakeConnection(), cmdutil.ToCmdLine("INCR", "counter"))
+	db.Exec(conn, cmdutil.ToCmdLine("MULTI"))
+	db.Exec(conn, cmdutil.ToCmdLine("SET", "a", "3"))
+	db.Exec(conn, cmdutil.ToCmdLine("EXEC"))
+	if got := string(db.Exec(conn, cmdutil.ToCmdLine("GET", "a")).ToBytes()); got != "$1\r\n1\r\n" {
+		t.Errorf("except exec aborted by watched key but got %q", got)
+	}
+	undo := GetUndoLogs(db, cmdutil.ToCmdLine("MSET", "a", "4", "c", "5"))
+	restored := make(map[string]bool)
+	for _, line := range undo {
+		restored[string(line[1])] = true
+	}
+	if !restored["a"] || !restored["c"] {
+		t.Errorf("except undo logs of both keys but got %q", undo)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	server := NewStandaloneServer(&config.ServerProperties{Databases: 1})
+	defer server.Close()
+	conn := clientc.NewFakeConnection()
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "a", "1"))
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "s", "x"))
+	ok := []cm.CmdLine{cmdutil.ToCmdLine("INCR", "a"), cmdutil.ToCmdLine("SADD", "t", "x")}
+	if reply := server.DryRun(0, ok); reply != nil {
+		t.Errorf("except no error but got %s", reply.ToBytes())
+	}
+	bad := []cm.CmdLine{cmdutil.ToCmdLine("INCR", "a"), cmdutil.ToCmdLine("SADD", "s", "x")}
+	if reply := server.DryRun(0, bad); reply == nil || !resp.IsErrorReply(reply) {
+		t.Errorf("except the SADD on a string to fail")
+	}
+	if got := string(server.Exec(conn, cmdutil.ToCmdLine("GET", "a")).ToBytes()); got != "$1\r\n1\r\n" {
+		t.Errorf("except the db untouched but got %q", got)
+	}
+	if got := string(server.Exec(conn, cmdutil.ToCmdLine("EXISTS", "t")).ToBytes()); got != ":0\r\n" {
+		t.Errorf("except the db untouched but got %q", got)
+	}
+}
+
+func TestDropKeyAt(t *testing.T) {
+	server := NewStandaloneServer(&config.ServerProperties{Databases: 1})
+	defer server.Close()
+	conn := clientc.NewFakeConnection()
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "a", "1"))
+	pushed := server.GetVersion(0, "a")
+	// a write arriving after the copy was pushed
+	server.Exec(conn, cmdutil.ToCmdLine("SET", "a", "2"))
+	if server.DropKeyAt(0, "a", pushed) {
+		t.Fatalf("except a key written since the push kept")
+	}
+	if got := string(server.Exec(conn, cmdutil.ToCmdLine("GET", "a")).ToBytes()); got != "$1\r\n2\r\n" {
+		t.Errorf("except the later write kept but got %q", got)
+	}
+	if !server.DropKeyAt(0, "a", server.GetVersion(0, "a")) {
+		t.Errorf("except the key dropped at its version")
+	}
+	if got := string(server.Exec(conn, cmdutil.ToCmdLine("EXISTS", "a")).ToBytes()); got != ":0\r\n" {
+		t.Errorf("except the key dropped but got %q", got)
+	}
+}
+
+func TestSetVersion(t *testing.T) {
+	db, fastForward := newVirtualDB(t)
+	var last uint64
+	for i := 0; i < 3; i++ {
+		db.SetVersion("k")
+		version, _ := db.GetVersion("k")
+		if version <= last {
+			t.Fatalf("except versions to grow but got %d after %d", version, last)
+		}
+		last = version
+	}
+	// a restart loses the versions, the clock keeps the new ones above the old ones
+	db.versionMap.Clear()
+	fastForward(time.Millisecond)
+	db.SetVersion("k")
+	if version, _ := db.GetVersion("k"); version <= last {
+		t.Errorf("except version above %d after the restart but got %d", last, version)
+	}
+}
+
+func TestRemove_tombstones(t *testing.T) {
+	db, fastForward := newVirtualDB(t)
+	db.PutEntity("k", &commoninterface.DataEntity{Data: []byte("v")})
+	db.SetVersion("k")
+	db.Remove("k")
+	if _, ok := db.GetVersion("k"); ok {
+		t.Errorf("except the version removed with the key without replication")
+	}
+
+	db.tombstones = func() time.Duration { return tombstoneTTL }
+	db.PutEntity("k", &commoninterface.DataEntity{Data: []byte("v")})
+	db.SetVersion("k")
+	db.Remove("k")
+	if _, ok := db.GetVersion("k"); !ok {
+		t.Fatalf("except a tombstone kept for the removed key")
+	}
+	fastForward(tombstoneTTL)
+	if _, ok := db.GetVersion("k"); ok {
+		t.Errorf("except the tombstone dropped once it elapsed")
+	}
+}
@@ -31,6 +31,21 @@ func readAllKeys(args cm.CmdLine) (writeKeys []string, readKeys []string) {
 	}
 	return nil, keys
 }
+func prepareMSet(args cm.CmdLine) (writeKeys []string, readKeys []string) {
+	keys := make([]string, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		keys = append(keys, string(args[i]))
+	}
+	return keys, nil
+}
+func prepareBitOp(args cm.CmdLine) (writeKeys []string, readKeys []string) {
+	dest := string(args[1])
+	keys := make([]string, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		keys = append(keys, string(arg))
+	}
+	return []string{dest}, keys
+}
 func noPrepare() (writeKeys []string, readKeys []string) {
 	return nil, nil
 }
@@ -56,6 +71,11 @@ func rollbackGivenKeys(db *DataBaseImpl, keys ...string) []cm.CmdLine {
 	}
 	return undoCmdLines
 }
+
+// RestoreCmdLines returns the commands rebuilding keys as they are in db now, missing keys are deleted
+func RestoreCmdLines(db *DataBaseImpl, keys ...string) []cm.CmdLine {
+	return rollbackGivenKeys(db, keys...)
+}
 func rollbackHashFields(db *DataBaseImpl, key string, fields ...string) []cm.CmdLine {
 	var undoCmdLines []cm.CmdLine
 	hash, errorReply := db.getAsHash(key)
@@ -109,6 +129,20 @@ func prepareSetCalculateStore(args cm.CmdLine) ([]string, []string) {
 	}
 	return []string{dest}, keys
 }
+
+// prepareZSetCalculateStore writes dest and reads the numkeys keys following it
+func prepareZSetCalculateStore(args cm.CmdLine) ([]string, []string) {
+	dest := string(args[0])
+	numKeys, err := strconv.Atoi(string(args[1]))
+	if err != nil || numKeys < 0 || len(args) < 2+numKeys {
+		return []string{dest}, nil
+	}
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[2+i])
+	}
+	return []string{dest}, keys
+}
 func rollbackSetMember(db *DataBaseImpl, key string, members ...string) []cm.CmdLine {
 	var undoCmdLines []cm.CmdLine
 	set, errorReply := db.getAsSet(key)
@@ -116,7 +150,7 @@ func rollbackSetMember(db *DataBaseImpl, key string, members ...string) []cm.Cmd
 		return nil
 	}
 	if set == nil {
-		undoCmdLines = append(undoCmdLines,
+		return append(undoCmdLines,
 			cmdutil.ToCmdLine("DEL", key),
 		)
 	}
@@ -140,7 +174,7 @@ func rollbackZsetMember(db *DataBaseImpl, key string, members ...string) []cm.Cm
 		return nil
 	}
 	if zset == nil {
-		undoCmdLines = append(undoCmdLines,
+		return append(undoCmdLines,
 			cmdutil.ToCmdLine("DEL", key),
 		)
 	}
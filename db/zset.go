@@ -5,8 +5,10 @@ import (
 	"mygodis/common/commoninterface"
 	"mygodis/datadriver/sortedset"
 	"mygodis/resp"
+	"mygodis/util/cmdutil"
 	to "mygodis/util/ternaryoperator"
 	"strconv"
+	"strings"
 )
 
 type zRangePolicy struct {
@@ -25,51 +27,73 @@ type zSetPolicy struct {
 	withScores bool
 }
 
+// parsePolicy reads numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX] [WITHSCORES], a
+// missing key is read as an empty zset
 func parsePolicy(db *DataBaseImpl, args cm.CmdLine, policy *zSetPolicy) resp.ErrorReply {
 	if len(args) == 0 {
-		return nil
+		return &resp.SyntaxErrReply{}
+	}
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return resp.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys < 1 {
+		return resp.MakeErrReply("ERR at least 1 input key is needed")
+	}
+	if len(args) < 1+numKeys {
+		return &resp.SyntaxErrReply{}
 	}
-	if policy.weights == nil && policy.zsets == nil {
-		if numKeys, err := strconv.Atoi(string(args[0])); err == nil {
-			policy.zsets = make([]*sortedset.ZSet, numKeys)
+	policy.zsets = make([]*sortedset.ZSet, numKeys)
+	policy.weights = make([]float64, numKeys)
+	for i := 0; i < numKeys; i++ {
+		zset, errReply := db.getAsZSet(string(args[1+i]))
+		if errReply != nil {
+			return errReply
+		}
+		if zset == nil {
+			zset = db.makeZSet()
+		}
+		policy.zsets[i] = zset
+		policy.weights[i] = 1
+	}
+	for rest := args[1+numKeys:]; len(rest) > 0; {
+		switch strings.ToUpper(string(rest[0])) {
+		case "WEIGHTS":
+			if len(rest) < 1+numKeys {
+				return &resp.SyntaxErrReply{}
+			}
 			for i := 0; i < numKeys; i++ {
-				zset, err := db.getAsZSet(string(args[1+i]))
+				weight, err := strconv.ParseFloat(string(rest[1+i]), 64)
 				if err != nil {
-					return err
+					return resp.MakeErrReply("ERR weight value is not a float")
 				}
-				policy.zsets[i] = zset
+				policy.weights[i] = weight
 			}
-			policy.weights = make([]float64, numKeys)
-			for i := 0; i < numKeys; i++ {
-				policy.weights[i] = 1
+			rest = rest[1+numKeys:]
+		case "AGGREGATE":
+			if len(rest) < 2 {
+				return &resp.SyntaxErrReply{}
 			}
-			return parsePolicy(db, args[1+numKeys:], policy)
-		} else {
-			flag := string(args[0])
-			switch flag {
-			case "WEIGHTS":
-				for i := 0; i < len(policy.weights); i++ {
-					weight, err := strconv.ParseFloat(string(args[1+i]), 64)
-					if err != nil {
-						return &resp.SyntaxErrReply{}
-					}
-					policy.weights[i] = weight
-				}
-				return parsePolicy(db, args[1+len(policy.weights):], policy)
-			case "AGGREGATE":
-				policy.aggregate = string(args[1])
-				return parsePolicy(db, args[2:], policy)
-			case "LIMIT":
-				limit, err := strconv.Atoi(string(args[1]))
-				if err != nil {
-					return &resp.SyntaxErrReply{}
-				}
-				policy.limit = limit
-				return parsePolicy(db, args[2:], policy)
-			case "WITHSCORES":
-				policy.withScores = true
-				return parsePolicy(db, args[1:], policy)
+			policy.aggregate = strings.ToUpper(string(rest[1]))
+			if policy.aggregate != "SUM" && policy.aggregate != "MIN" && policy.aggregate != "MAX" {
+				return &resp.SyntaxErrReply{}
+			}
+			rest = rest[2:]
+		case "LIMIT":
+			if len(rest) < 2 {
+				return &resp.SyntaxErrReply{}
 			}
+			limit, err := strconv.Atoi(string(rest[1]))
+			if err != nil {
+				return &resp.SyntaxErrReply{}
+			}
+			policy.limit = limit
+			rest = rest[2:]
+		case "WITHSCORES":
+			policy.withScores = true
+			rest = rest[1:]
+		default:
+			return &resp.SyntaxErrReply{}
 		}
 	}
 	return nil
@@ -88,7 +112,7 @@ func (db *DataBaseImpl) getAsZSet(key string) (*sortedset.ZSet, resp.ErrorReply)
 func (db *DataBaseImpl) getOrCreateZSet(key string) (z *sortedset.ZSet, isNew bool) {
 	entity, exists := db.GetEntity(key)
 	if !exists {
-		z = sortedset.MakeZSet()
+		z = db.makeZSet()
 		return z, true
 	}
 	zset, ok := entity.Data.(*sortedset.ZSet)
@@ -122,6 +146,7 @@ func execZAdd(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 		data.Data = zset
 		db.PutEntity(key, data)
 	}
+	db.addAof(cmdutil.ToCmdLineWithBytes("zadd", args...))
 	return resp.MakeIntReply(int64(added))
 }
 func execZCard(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
@@ -152,19 +177,19 @@ func execZIncrBy(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 		return &resp.SyntaxErrReply{}
 	}
 	member := string(args[2])
-	element, ok := zset.Get(member)
-
-	if ok {
-		element.Score += delta
-	} else {
-		zset.Add(member, delta)
+	score := delta
+	if element, ok := zset.Get(member); ok {
+		score += element.Score
 	}
+	// Add moves the member to its new place, changing the score of the element would not
+	zset.Add(member, score)
 	if isNew {
 		data := new(commoninterface.DataEntity)
 		data.Data = zset
 		db.PutEntity(key, data)
 	}
-	return resp.MakeBulkReply([]byte(strconv.FormatFloat(element.Score, 'f', -1, 64)))
+	db.addAof(cmdutil.ToCmdLineWithBytes("zincrby", args...))
+	return resp.MakeBulkReply([]byte(strconv.FormatFloat(score, 'f', -1, 64)))
 }
 func execZInter(db *DataBaseImpl, args cm.CmdLine) (result resp.Reply) {
 	defer func() {
@@ -177,7 +202,7 @@ func execZInter(db *DataBaseImpl, args cm.CmdLine) (result resp.Reply) {
 	if err := parsePolicy(db, args, policy); err != nil {
 		return err
 	}
-	resultSet := policy.zsets[0].Inter(policy.aggregate, policy.weights, policy.zsets[1:]...)
+	resultSet := db.makeZSet().Inter(policy.aggregate, policy.weights, policy.zsets...)
 	bytes := make([][]byte, 0, to.Which(policy.withScores, resultSet.Len()*2, resultSet.Len()))
 	resultSet.ForEach(0, resultSet.Len(), false, func(element *sortedset.Element) bool {
 		bytes = to.Which(policy.withScores, append(bytes, []byte(element.Member), []byte(strconv.FormatFloat(element.Score, 'f', -1, 64))), append(bytes, []byte(element.Member)))
@@ -186,25 +211,14 @@ func execZInter(db *DataBaseImpl, args cm.CmdLine) (result resp.Reply) {
 	return resp.MakeMultiBulkReply(bytes)
 }
 func execZInterStore(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
-	defer func() {
-		if r := recover(); r != nil {
-			return
-		}
-	}()
 	policy := new(zSetPolicy)
 	policy.destKey = string(args[0])
 	if err := parsePolicy(db, args[1:], policy); err != nil {
 		return err
 	}
-	resultSet := policy.zsets[0].Inter(policy.aggregate, policy.weights, policy.zsets[1:]...)
-	bytes := make([][]byte, 0, to.Which(policy.withScores, resultSet.Len()*2, resultSet.Len()))
-	resultSet.ForEach(0, resultSet.Len(), false, func(element *sortedset.Element) bool {
-		bytes = to.Which(policy.withScores, append(bytes, []byte(element.Member), []byte(strconv.FormatFloat(element.Score, 'f', -1, 64))), append(bytes, []byte(element.Member)))
-		return true
-	})
-	data := new(commoninterface.DataEntity)
-	data.Data = resultSet
-	db.PutEntity(policy.destKey, data)
+	resultSet := db.makeZSet().Inter(policy.aggregate, policy.weights, policy.zsets...)
+	db.storeZSet(policy.destKey, resultSet)
+	db.addAof(cmdutil.ToCmdLineWithBytes("zinterstore", args...))
 	return resp.MakeIntReply(resultSet.Len())
 }
 func execZUnion(db *DataBaseImpl, args cm.CmdLine) (result resp.Reply) {
@@ -218,7 +232,7 @@ func execZUnion(db *DataBaseImpl, args cm.CmdLine) (result resp.Reply) {
 	if err := parsePolicy(db, args, policy); err != nil {
 		return err
 	}
-	resultSet := policy.zsets[0].Union(policy.aggregate, policy.weights, policy.zsets[1:]...)
+	resultSet := db.makeZSet().Union(policy.aggregate, policy.weights, policy.zsets...)
 	bytes := make([][]byte, 0, to.Which(policy.withScores, resultSet.Len()*2, resultSet.Len()))
 	resultSet.ForEach(0, resultSet.Len(), false, func(element *sortedset.Element) bool {
 		bytes = to.Which(policy.withScores, append(bytes, []byte(element.Member), []byte(strconv.FormatFloat(element.Score, 'f', -1, 64))), append(bytes, []byte(element.Member)))
@@ -226,29 +240,26 @@ func execZUnion(db *DataBaseImpl, args cm.CmdLine) (result resp.Reply) {
 	})
 	return resp.MakeMultiBulkReply(bytes)
 }
-func execZUnionStore(db *DataBaseImpl, args cm.CmdLine) (result resp.Reply) {
-	defer func() {
-		if r := recover(); r != nil {
-			result = &resp.SyntaxErrReply{}
-			return
-		}
-	}()
+func execZUnionStore(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	policy := new(zSetPolicy)
 	policy.destKey = string(args[0])
 	if err := parsePolicy(db, args[1:], policy); err != nil {
 		return err
 	}
-	resultSet := policy.zsets[0].Union(policy.aggregate, policy.weights, policy.zsets[1:]...)
-	bytes := make([][]byte, 0, to.Which(policy.withScores, resultSet.Len()*2, resultSet.Len()))
-	resultSet.ForEach(0, resultSet.Len(), false, func(element *sortedset.Element) bool {
-		bytes = to.Which(policy.withScores, append(bytes, []byte(element.Member), []byte(strconv.FormatFloat(element.Score, 'f', -1, 64))), append(bytes, []byte(element.Member)))
-		return true
-	})
-	data := new(commoninterface.DataEntity)
-	data.Data = resultSet
-	db.PutEntity(policy.destKey, data)
+	resultSet := db.makeZSet().Union(policy.aggregate, policy.weights, policy.zsets...)
+	db.storeZSet(policy.destKey, resultSet)
+	db.addAof(cmdutil.ToCmdLineWithBytes("zunionstore", args...))
 	return resp.MakeIntReply(resultSet.Len())
 }
+
+// storeZSet puts result at dest, an empty result deletes dest
+func (db *DataBaseImpl) storeZSet(dest string, result *sortedset.ZSet) {
+	if result.Len() == 0 {
+		db.Remove(dest)
+		return
+	}
+	db.PutEntity(dest, &commoninterface.DataEntity{Data: result})
+}
 func execZDiff(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	defer func() {
 		if r := recover(); r != nil {
@@ -259,7 +270,7 @@ func execZDiff(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	if err := parsePolicy(db, args, policy); err != nil {
 		return err
 	}
-	resultSet := policy.zsets[0].Diff(policy.zsets[1:]...)
+	resultSet := db.makeZSet().Diff(policy.zsets...)
 	bytes := make([][]byte, 0, to.Which(policy.withScores, resultSet.Len()*2, resultSet.Len()))
 	resultSet.ForEach(0, resultSet.Len(), false, func(element *sortedset.Element) bool {
 		bytes = to.Which(policy.withScores, append(bytes, []byte(element.Member), []byte(strconv.FormatFloat(element.Score, 'f', -1, 64))), append(bytes, []byte(element.Member)))
@@ -278,7 +289,7 @@ func execZDiffStore(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	if err := parsePolicy(db, args[1:], policy); err != nil {
 		return err
 	}
-	resultSet := policy.zsets[0].Diff(policy.zsets[1:]...)
+	resultSet := db.makeZSet().Diff(policy.zsets...)
 	bytes := make([][]byte, 0, to.Which(policy.withScores, resultSet.Len()*2, resultSet.Len()))
 	resultSet.ForEach(0, resultSet.Len(), false, func(element *sortedset.Element) bool {
 		bytes = to.Which(policy.withScores, append(bytes, []byte(element.Member), []byte(strconv.FormatFloat(element.Score, 'f', -1, 64))), append(bytes, []byte(element.Member)))
@@ -301,12 +312,15 @@ func execZInterCard(db *DataBaseImpl, args cm.CmdLine) (result resp.Reply) {
 		return err
 	}
 	//TODO 优化
-	resultSet := policy.zsets[0].Inter(policy.aggregate, policy.weights, policy.zsets[1:]...)
+	resultSet := db.makeZSet().Inter(policy.aggregate, policy.weights, policy.zsets...)
 	return resp.MakeIntReply(to.Which(policy.withScores, resultSet.Len()*2, resultSet.Len()))
 }
 func execZScore(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	key := string(args[0])
-	zset, _ := db.getAsZSet(key)
+	zset, errReply := db.getAsZSet(key)
+	if errReply != nil {
+		return errReply
+	}
 	if zset == nil {
 		return resp.MakeNullBulkReply()
 	}
@@ -415,30 +429,47 @@ func execZRem(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 			count++
 		}
 	}
+	if zset.Len() == 0 {
+		db.Remove(key)
+	}
+	db.addAof(cmdutil.ToCmdLineWithBytes("zrem", args...))
 	return resp.MakeIntReply(int64(count))
 }
 func execZRank(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	key := string(args[0])
 
-	zset, _ := db.getAsZSet(key)
+	zset, errReply := db.getAsZSet(key)
+	if errReply != nil {
+		return errReply
+	}
 	if zset == nil {
 		return resp.MakeNullBulkReply()
 	}
 	member := string(args[1])
 	rank, ok := zset.Rank(member)
-	element, _ := zset.Get(member)
-	score := element.Score
 	if !ok {
 		return resp.MakeNullBulkReply()
 	}
-	if string(args[len(args)-1]) == "WITHSCORES" {
-		return resp.MakeMultiBulkReply([][]byte{[]byte(strconv.FormatInt(rank, 10)), []byte(strconv.FormatFloat(score, 'f', -1, 64))})
+	return rankReply(zset, member, rank, args)
+}
+
+// rankReply answers ZRANK and ZREVRANK, with the score of member for WITHSCORES
+func rankReply(zset *sortedset.ZSet, member string, rank int64, args cm.CmdLine) resp.Reply {
+	if len(args) > 3 || len(args) == 3 && !strings.EqualFold(string(args[2]), "WITHSCORES") {
+		return &resp.SyntaxErrReply{}
+	}
+	if len(args) == 3 {
+		element, _ := zset.Get(member)
+		return resp.MakeMultiBulkReply([][]byte{[]byte(strconv.FormatInt(rank, 10)), []byte(strconv.FormatFloat(element.Score, 'f', -1, 64))})
 	}
 	return resp.MakeIntReply(rank)
 }
 func execZCount(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	key := string(args[0])
-	zset, _ := db.getAsZSet(key)
+	zset, errReply := db.getAsZSet(key)
+	if errReply != nil {
+		return errReply
+	}
 	if zset == nil {
 		return resp.MakeIntReply(0)
 	}
@@ -454,21 +485,19 @@ func execZCount(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 }
 func execZRevRank(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	key := string(args[0])
-	zset, _ := db.getAsZSet(key)
+	zset, errReply := db.getAsZSet(key)
+	if errReply != nil {
+		return errReply
+	}
 	if zset == nil {
 		return resp.MakeNullBulkReply()
 	}
 	member := string(args[1])
 	rank, ok := zset.Rank(member)
-	element, _ := zset.Get(member)
-	score := element.Score
 	if !ok {
 		return resp.MakeNullBulkReply()
 	}
-	if string(args[len(args)-1]) == "WITHSCORES" {
-		return resp.MakeMultiBulkReply([][]byte{[]byte(strconv.FormatInt(rank, 10)), []byte(strconv.FormatFloat(score, 'f', -1, 64))})
-	}
-	return resp.MakeIntReply(rank)
+	return rankReply(zset, member, zset.Len()-1-rank, args)
 }
 func execZLexCount(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	key := string(args[0])
@@ -481,32 +510,20 @@ func execZLexCount(db *DataBaseImpl, args cm.CmdLine) resp.Reply {
 	return resp.MakeIntReply(zset.LexCount(min, max))
 }
 func undoZAddCommands(db *DataBaseImpl, args cm.CmdLine) []cm.CmdLine {
-	key := string(args[0])
-	zset, _ := db.getAsZSet(key)
-	if zset == nil {
-		return nil
-	}
-	zsetMembers := getZsetMember(args[1:])
-	return rollbackZsetMember(db, key, zsetMembers...)
+	return rollbackZsetMember(db, string(args[0]), getZsetMember(args[1:])...)
 }
 func undoZRemCommands(db *DataBaseImpl, args cm.CmdLine) []cm.CmdLine {
-	key := string(args[0])
-	zset, _ := db.getAsZSet(key)
-	if zset == nil {
-		return nil
+	members := make([]string, len(args)-1)
+	for i := 1; i < len(args); i++ {
+		members[i-1] = string(args[i])
 	}
-	zsetMembers := getZsetMember(args[1:])
-	return rollbackZsetMember(db, key, zsetMembers...)
+	return rollbackZsetMember(db, string(args[0]), members...)
 }
 func undoZIncrByCommands(db *DataBaseImpl, args cm.CmdLine) []cm.CmdLine {
-	key := string(args[0])
-	zset, _ := db.getAsZSet(key)
-	if zset == nil {
-		return nil
-	}
-	zsetMembers := getZsetMember(args[1:])
-	return rollbackZsetMember(db, key, zsetMembers...)
+	return rollbackZsetMember(db, string(args[0]), getZsetMember(args[1:])...)
 }
+
+// getZsetMember returns the members of score member pairs
 func getZsetMember(args cm.CmdLine) []string {
 	var members []string
 	for i := 1; i < len(args); i += 2 {
@@ -515,25 +532,26 @@ func getZsetMember(args cm.CmdLine) []string {
 	return members
 }
 
-// todo support zset
 func init() {
+	RegisterCommand("ZCARD", execZCard, readFirstKey, nil, 2, ReadOnly)
+	RegisterCommand("ZCOUNT", execZCount, readFirstKey, nil, 4, ReadOnly)
+	RegisterCommand("ZRANK", execZRank, readFirstKey, nil, -3, ReadOnly)
+	RegisterCommand("ZREVRANK", execZRevRank, readFirstKey, nil, -3, ReadOnly)
+	RegisterCommand("ZSCORE", execZScore, readFirstKey, nil, 3, ReadOnly)
+
+	RegisterCommand("ZADD", execZAdd, writeFirstKey, undoZAddCommands, -4, Write)
+	RegisterCommand("ZINCRBY", execZIncrBy, writeFirstKey, undoZIncrByCommands, 4, Write)
+	RegisterCommand("ZINTERSTORE", execZInterStore, prepareZSetCalculateStore, rollbackFirstKey, -4, Write)
+	RegisterCommand("ZREM", execZRem, writeFirstKey, undoZRemCommands, -3, Write)
+	RegisterCommand("ZUNIONSTORE", execZUnionStore, prepareZSetCalculateStore, rollbackFirstKey, -4, Write)
+
+	// todo the range, lex and diff commands
 	//RegisterCommand("zlexcount", execZLexCount, readFirstKey, nil, 3, ReadOnly)
 	//RegisterCommand("zrange", execZRange, readFirstKey, nil, -3, ReadOnly)
-	//RegisterCommand("zcard", execZCard, readFirstKey, nil, 1, ReadOnly)
-	//RegisterCommand("zcount", execZCount, readFirstKey, nil, 3, ReadOnly)
-	//RegisterCommand("zrank", execZRank, readFirstKey, nil, 2, ReadOnly)
-	//RegisterCommand("zrevrank", execZRevRank, readFirstKey, nil, 2, ReadOnly)
 	//RegisterCommand("zinter", execZInter, readFirstKey, nil, -3, ReadOnly)
 	//RegisterCommand("zunion", execZUnion, readFirstKey, nil, -3, ReadOnly)
 	//RegisterCommand("zdiff", execZDiff, readFirstKey, nil, -3, ReadOnly)
 	//RegisterCommand("zintercard", execZInterCard, readFirstKey, nil, -3, ReadOnly)
-	//RegisterCommand("zscore", execZScore, readFirstKey, nil, 2, ReadOnly)
-	//
-	//RegisterCommand("zadd", execZAdd, writeFirstKey, undoZAddCommands, -2, Write)
-	//RegisterCommand("zincrby", execZIncrBy, writeFirstKey, undoZIncrByCommands, 3, Write)
-	//RegisterCommand("zrem", execZRem, writeFirstKey, undoZRemCommands, -2, Write)
-	//RegisterCommand("zinterstore", execZInterStore, writeFirstKey, rollbackFirstKey, -3, Write)
-	//RegisterCommand("zunionstore", execZUnionStore, writeFirstKey, rollbackFirstKey, -3, Write)
 	//RegisterCommand("zdiffstore", execZDiffStore, writeFirstKey, rollbackFirstKey, -3, Write)
 	//RegisterCommand("zrangestore", execZRangeStore, writeFirstKey, rollbackFirstKey, -3, Write)
 }
@@ -1,9 +1,12 @@
 package db
 
 import (
+	"mygodis/clientc"
 	"mygodis/common"
 	"mygodis/common/commoninterface"
+	"mygodis/config"
 	"mygodis/resp"
+	"mygodis/util/cmdutil"
 	"reflect"
 	"testing"
 )
@@ -227,7 +230,22 @@ func Test_execZIncrBy(t *testing.T) {
 		args args
 		want resp.Reply
 	}{
-		// TODO: Add test cases.
+		{
+			name: "zincrby a new member",
+			args: args{
+				db:   NewDB(),
+				args: common.CmdLine{[]byte("zset"), []byte("2.5"), []byte("a")},
+			},
+			want: resp.MakeBulkReply([]byte("2.5")),
+		},
+		{
+			name: "zincrby moves the member",
+			args: args{
+				db:   newDataLoader().load("zset", 1, "a").load("zset", 2, "b").db,
+				args: common.CmdLine{[]byte("zset"), []byte("2"), []byte("a")},
+			},
+			want: resp.MakeBulkReply([]byte("3")),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -290,7 +308,30 @@ func Test_execZInterStore(t *testing.T) {
 		args args
 		want resp.Reply
 	}{
-		// TODO: Add test cases.
+		{
+			name: "zinterstore with weights",
+			args: args{
+				db:   newDataLoader().load("a", 1, "x").load("a", 2, "y").load("b", 3, "y").db,
+				args: common.CmdLine{[]byte("dest"), []byte("2"), []byte("a"), []byte("b"), []byte("WEIGHTS"), []byte("1"), []byte("2")},
+			},
+			want: resp.MakeIntReply(1),
+		},
+		{
+			name: "zinterstore with a missing key",
+			args: args{
+				db:   newDataLoader().load("a", 1, "x").load("dest", 1, "x").db,
+				args: common.CmdLine{[]byte("dest"), []byte("2"), []byte("a"), []byte("missing")},
+			},
+			want: resp.MakeIntReply(0),
+		},
+		{
+			name: "zinterstore without keys",
+			args: args{
+				db:   NewDB(),
+				args: common.CmdLine{[]byte("dest"), []byte("0")},
+			},
+			want: resp.MakeErrReply("ERR at least 1 input key is needed"),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -374,7 +415,30 @@ func Test_execZRank(t *testing.T) {
 		args args
 		want resp.Reply
 	}{
-		// TODO: Add test cases.
+		{
+			name: "zrank",
+			args: args{
+				db:   newDataLoader().load("zset", 1, "a").load("zset", 2, "b").db,
+				args: common.CmdLine{[]byte("zset"), []byte("b")},
+			},
+			want: resp.MakeIntReply(1),
+		},
+		{
+			name: "zrank withscores",
+			args: args{
+				db:   newDataLoader().load("zset", 1, "a").load("zset", 2, "b").db,
+				args: common.CmdLine{[]byte("zset"), []byte("a"), []byte("withscores")},
+			},
+			want: resp.MakeMultiBulkReply([][]byte{[]byte("0"), []byte("1")}),
+		},
+		{
+			name: "zrank of a missing member",
+			args: args{
+				db:   newDataLoader().load("zset", 1, "a").db,
+				args: common.CmdLine{[]byte("zset"), []byte("c")},
+			},
+			want: resp.MakeNullBulkReply(),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -395,7 +459,22 @@ func Test_execZRem(t *testing.T) {
 		args args
 		want resp.Reply
 	}{
-		// TODO: Add test cases.
+		{
+			name: "zrem members",
+			args: args{
+				db:   newDataLoader().load("zset", 1, "a").load("zset", 2, "b").load("zset", 3, "c").db,
+				args: common.CmdLine{[]byte("zset"), []byte("a"), []byte("b"), []byte("d")},
+			},
+			want: resp.MakeIntReply(2),
+		},
+		{
+			name: "zrem from a missing key",
+			args: args{
+				db:   NewDB(),
+				args: common.CmdLine{[]byte("zset"), []byte("a")},
+			},
+			want: resp.MakeIntReply(0),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -416,7 +495,14 @@ func Test_execZRevRank(t *testing.T) {
 		args args
 		want resp.Reply
 	}{
-		// TODO: Add test cases.
+		{
+			name: "zrevrank",
+			args: args{
+				db:   newDataLoader().load("zset", 1, "a").load("zset", 2, "b").load("zset", 3, "c").db,
+				args: common.CmdLine{[]byte("zset"), []byte("a")},
+			},
+			want: resp.MakeIntReply(2),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -437,7 +523,22 @@ func Test_execZScore(t *testing.T) {
 		args args
 		want resp.Reply
 	}{
-		// TODO: Add test cases.
+		{
+			name: "zscore",
+			args: args{
+				db:   newDataLoader().load("zset", 1.5, "a").db,
+				args: common.CmdLine{[]byte("zset"), []byte("a")},
+			},
+			want: resp.MakeBulkReply([]byte("1.5")),
+		},
+		{
+			name: "zscore of a missing member",
+			args: args{
+				db:   newDataLoader().load("zset", 1.5, "a").db,
+				args: common.CmdLine{[]byte("zset"), []byte("b")},
+			},
+			want: resp.MakeNullBulkReply(),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -479,7 +580,30 @@ func Test_execZUnionStore(t *testing.T) {
 		args       args
 		wantResult resp.Reply
 	}{
-		// TODO: Add test cases.
+		{
+			name: "zunionstore",
+			args: args{
+				db:   newDataLoader().load("a", 1, "x").load("a", 2, "y").load("b", 3, "y").load("b", 4, "z").db,
+				args: common.CmdLine{[]byte("dest"), []byte("2"), []byte("a"), []byte("b"), []byte("AGGREGATE"), []byte("max")},
+			},
+			wantResult: resp.MakeIntReply(3),
+		},
+		{
+			name: "zunionstore with a missing key",
+			args: args{
+				db:   newDataLoader().load("a", 1, "x").db,
+				args: common.CmdLine{[]byte("dest"), []byte("2"), []byte("a"), []byte("missing")},
+			},
+			wantResult: resp.MakeIntReply(1),
+		},
+		{
+			name: "zunionstore with an unknown aggregate",
+			args: args{
+				db:   newDataLoader().load("a", 1, "x").db,
+				args: common.CmdLine{[]byte("dest"), []byte("1"), []byte("a"), []byte("AGGREGATE"), []byte("avg")},
+			},
+			wantResult: &resp.SyntaxErrReply{},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -499,7 +623,13 @@ func Test_getZsetMember(t *testing.T) {
 		args args
 		want []string
 	}{
-		// TODO: Add test cases.
+		{
+			name: "members of score member pairs",
+			args: args{
+				args: common.CmdLine{[]byte("1"), []byte("a"), []byte("2"), []byte("b")},
+			},
+			want: []string{"a", "b"},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -509,3 +639,60 @@ func Test_getZsetMember(t *testing.T) {
 		})
 	}
 }
+
+func TestZSetCommands(t *testing.T) {
+	server := NewStandaloneServer(&config.ServerProperties{Databases: 1})
+	defer server.Close()
+	conn := clientc.NewFakeConnection()
+	exec := func(args ...string) string {
+		return string(server.Exec(conn, cmdutil.ToCmdLine(args...)).ToBytes())
+	}
+	exec("ZADD", "a", "1", "x", "2", "y")
+	exec("ZADD", "b", "3", "y", "4", "z")
+	if got := exec("ZUNIONSTORE", "dest", "2", "a", "b", "WEIGHTS", "2", "1"); got != ":3\r\n" {
+		t.Fatalf("except :3 but got %q", got)
+	}
+	for member, score := range map[string]string{"x": "2", "y": "7", "z": "4"} {
+		if got := exec("ZSCORE", "dest", member); got != "$1\r\n"+score+"\r\n" {
+			t.Errorf("except %s scored %s but got %q", member, score, got)
+		}
+	}
+	if got := exec("ZINTERSTORE", "dest", "2", "a", "b", "AGGREGATE", "MIN"); got != ":1\r\n" {
+		t.Fatalf("except :1 but got %q", got)
+	}
+	if got := exec("ZSCORE", "dest", "y"); got != "$1\r\n2\r\n" {
+		t.Errorf("except y scored 2 but got %q", got)
+	}
+	if got := exec("ZINTERSTORE", "dest", "2", "a", "missing"); got != ":0\r\n" {
+		t.Fatalf("except :0 but got %q", got)
+	}
+	if got := exec("EXISTS", "dest"); got != ":0\r\n" {
+		t.Errorf("except an empty result to delete dest but got %q", got)
+	}
+	if got := exec("ZREM", "a", "x", "y"); got != ":2\r\n" {
+		t.Fatalf("except :2 but got %q", got)
+	}
+	if got := exec("EXISTS", "a"); got != ":0\r\n" {
+		t.Errorf("except an emptied zset to be deleted but got %q", got)
+	}
+	if got := exec("ZADD", "b", "1"); got != "-ERR wrong number of arguments for 'ZADD' command\r\n" {
+		t.Errorf("unexpected reply %q", got)
+	}
+}
+
+func TestZSetUndo(t *testing.T) {
+	db := newDataLoader().load("zset", 1, "a").db
+	undo := GetUndoLogs(db, cmdutil.ToCmdLine("ZREM", "zset", "a", "b"))
+	want := []common.CmdLine{cmdutil.ToCmdLine("ZADD", "zset", "1", "a"), cmdutil.ToCmdLine("ZREM", "zset", "b")}
+	if !reflect.DeepEqual(undo, want) {
+		t.Errorf("except %q but got %q", want, undo)
+	}
+	undo = GetUndoLogs(db, cmdutil.ToCmdLine("ZINCRBY", "new", "1", "a"))
+	if want := []common.CmdLine{cmdutil.ToCmdLine("DEL", "new")}; !reflect.DeepEqual(undo, want) {
+		t.Errorf("except %q but got %q", want, undo)
+	}
+	undo = GetUndoLogs(db, cmdutil.ToCmdLine("ZUNIONSTORE", "new", "1", "zset"))
+	if want := []common.CmdLine{cmdutil.ToCmdLine("DEL", "new")}; !reflect.DeepEqual(undo, want) {
+		t.Errorf("except %q but got %q", want, undo)
+	}
+}
@@ -0,0 +1,245 @@
+// Package embedded runs a standalone mygodis server inside the process, e.g. for tests. Every Server has its own
+// config, dbs and time wheel, so several servers can run in parallel.
+package embedded
+
+import (
+	"context"
+	"fmt"
+	"mygodis/clientc"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/config"
+	"mygodis/db"
+	"mygodis/lib/clock"
+	"mygodis/resp"
+	"mygodis/server"
+	"mygodis/util/cmdutil"
+	"net"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Options configures a Server, zero values take the defaults
+type Options struct {
+	// Addr is the address listened on, a free loopback port by default
+	Addr string
+	// Databases is the number of dbs, 16 by default
+	Databases int
+}
+
+// Server is a mygodis server listening on a port of its own. Its clock is virtual, FastForward expires keys without
+// waiting.
+type Server struct {
+	*DB
+	listener net.Listener
+	handler  *server.Handler
+	db       *db.StandaloneServer
+}
+
+// NewServer starts a server, it serves until Close
+func NewServer(opts *Options) (*Server, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	props := &config.ServerProperties{
+		Bind:      "127.0.0.1",
+		Databases: opts.Databases,
+	}
+	if props.Databases <= 0 {
+		props.Databases = 16
+	}
+	addr := opts.Addr
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	props.Port = listener.Addr().(*net.TCPAddr).Port
+	s := &Server{
+		listener: listener,
+		db:       db.NewStandaloneServerWithClock(props, clock.NewVirtual()),
+	}
+	s.handler = server.NewHandler(s.db)
+	s.DB = s.Select(0)
+	go s.serve()
+	return s, nil
+}
+
+// RunT starts a server closed at the end of the test
+func RunT(t testing.TB) *Server {
+	s, err := NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handler.Handle(context.Background(), conn)
+	}
+}
+
+// Addr returns the address clients connect to
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops listening, closes the connections and stops the timers of the server
+func (s *Server) Close() {
+	_ = s.listener.Close()
+	_ = s.handler.Close()
+}
+
+// FastForward moves the clock of the server forward by d and expires the keys due meanwhile
+func (s *Server) FastForward(d time.Duration) {
+	_ = s.db.FastForward(d)
+}
+
+// Select returns the helpers of db index
+func (s *Server) Select(index int) *DB {
+	return &DB{server: s.db, index: index}
+}
+
+// DB inspects and seeds one db directly, without a connection. The helpers of Server use db 0.
+type DB struct {
+	server *db.StandaloneServer
+	index  int
+}
+
+// Do executes a command on the db and returns its reply
+func (d *DB) Do(args ...string) resp.Reply {
+	connection := clientc.NewFakeConnection()
+	connection.SelectDB(d.index)
+	return d.server.Exec(connection, cmdutil.ToCmdLine(args...))
+}
+
+// do executes a command and turns an error reply into an error
+func (d *DB) do(args ...string) (resp.Reply, error) {
+	reply := d.Do(args...)
+	if errReply, ok := reply.(resp.ErrorReply); ok {
+		return nil, fmt.Errorf("%s: %s", args[0], errReply.Error())
+	}
+	return reply, nil
+}
+
+// Set sets the string value of key
+func (d *DB) Set(key, value string) error {
+	_, err := d.do("SET", key, value)
+	return err
+}
+
+// Get returns the string value of key, false if key does not exist
+func (d *DB) Get(key string) (string, bool) {
+	if bulk, ok := d.Do("GET", key).(*resp.BulkReply); ok && bulk.Arg != nil {
+		return string(bulk.Arg), true
+	}
+	return "", false
+}
+
+// SetTTL makes key expire after ttl
+func (d *DB) SetTTL(key string, ttl time.Duration) error {
+	_, err := d.do("PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// TTL returns the time to live of key, 0 if key has none or does not exist
+func (d *DB) TTL(key string) time.Duration {
+	expiration := d.server.GetExpiration(d.index, key)
+	if expiration.IsZero() || !d.Exists(key) {
+		return 0
+	}
+	return expiration.Sub(d.server.Now())
+}
+
+// Exists reports whether key exists
+func (d *DB) Exists(key string) bool {
+	_, ok := d.server.GetEntity(d.index, key)
+	return ok
+}
+
+// Del deletes key and reports whether it existed
+func (d *DB) Del(key string) bool {
+	reply, ok := d.Do("DEL", key).(*resp.IntReply)
+	return ok && reply.Code > 0
+}
+
+// Keys returns the keys of the db sorted
+func (d *DB) Keys() []string {
+	keys := make([]string, 0)
+	d.server.ForEach(d.index, func(key string, _ *cmi.DataEntity, _ time.Time) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// HSet sets field of the hash key
+func (d *DB) HSet(key, field, value string) error {
+	_, err := d.do("HSET", key, field, value)
+	return err
+}
+
+// HGet returns field of the hash key, false if it does not exist
+func (d *DB) HGet(key, field string) (string, bool) {
+	if bulk, ok := d.Do("HGET", key, field).(*resp.BulkReply); ok && bulk.Arg != nil {
+		return string(bulk.Arg), true
+	}
+	return "", false
+}
+
+// Push appends values to the list key
+func (d *DB) Push(key string, values ...string) error {
+	_, err := d.do(append([]string{"RPUSH", key}, values...)...)
+	return err
+}
+
+// List returns the elements of the list key
+func (d *DB) List(key string) ([]string, error) {
+	reply, err := d.do("LRANGE", key, "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	return toStrings(reply), nil
+}
+
+// SetAdd adds members to the set key
+func (d *DB) SetAdd(key string, members ...string) error {
+	_, err := d.do(append([]string{"SADD", key}, members...)...)
+	return err
+}
+
+// Members returns the members of the set key sorted
+func (d *DB) Members(key string) ([]string, error) {
+	reply, err := d.do("SMEMBERS", key)
+	if err != nil {
+		return nil, err
+	}
+	members := toStrings(reply)
+	sort.Strings(members)
+	return members, nil
+}
+
+// FlushDB removes every key of the db
+func (d *DB) FlushDB() {
+	d.Do("FLUSHDB")
+}
+
+// toStrings reads the elements of an array reply
+func toStrings(reply resp.Reply) []string {
+	values := make([]string, 0)
+	if multi, ok := reply.(*resp.MultiBulkReply); ok {
+		for _, arg := range multi.Args {
+			values = append(values, string(arg))
+		}
+	}
+	return values
+}
@@ -0,0 +1,129 @@
+package embedded
+
+import (
+	"fmt"
+	"mygodis/client"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServer_parallel(t *testing.T) {
+	for i := 0; i < 4; i++ {
+		i := i
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			t.Parallel()
+			s := RunT(t)
+			value := fmt.Sprint("value", i)
+			if err := s.Set("key", value); err != nil {
+				t.Fatal(err)
+			}
+			c := client.New(&client.Options{Addr: s.Addr()})
+			defer c.Close()
+			if got, err := c.Get("key"); err != nil || got != value {
+				t.Fatalf("except %s but got %s %v", value, got, err)
+			}
+			if err := c.Set("other", "written by client"); err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := s.Get("other"); !ok || got != "written by client" {
+				t.Errorf("except the write of the client but got %s %v", got, ok)
+			}
+			if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key", "other"}) {
+				t.Errorf("unexpected keys %v", keys)
+			}
+		})
+	}
+}
+
+func TestServer_helpers(t *testing.T) {
+	s := RunT(t)
+	if err := s.Push("list", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if values, err := s.List("list"); err != nil || !reflect.DeepEqual(values, []string{"a", "b"}) {
+		t.Errorf("except [a b] but got %v %v", values, err)
+	}
+	if err := s.SetAdd("set", "y", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if members, err := s.Members("set"); err != nil || !reflect.DeepEqual(members, []string{"x", "y"}) {
+		t.Errorf("except [x y] but got %v %v", members, err)
+	}
+	if err := s.HSet("hash", "f", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := s.HGet("hash", "f"); !ok || v != "v" {
+		t.Errorf("except v but got %s %v", v, ok)
+	}
+	if _, err := s.do("HSET", "hash", "f"); err == nil {
+		t.Error("except an error for a wrong number of arguments")
+	}
+
+	// dbs are apart and SELECT of a client reaches the same db as Select
+	if err := s.Select(3).Set("key", "in 3"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("key") {
+		t.Error("except key only in db 3")
+	}
+	c := client.New(&client.Options{Addr: s.Addr(), DB: 3})
+	defer c.Close()
+	if v, err := c.Get("key"); err != nil || v != "in 3" {
+		t.Errorf("except in 3 but got %s %v", v, err)
+	}
+
+	if err := s.Set("ttl", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTTL("ttl", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := s.TTL("ttl"); ttl <= 0 || ttl > 50*time.Millisecond {
+		t.Errorf("unexpected ttl %v", ttl)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Exists("ttl") {
+		if time.Now().After(deadline) {
+			t.Fatal("except ttl to expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// a virtual hour passes at once
+	if err := s.Set("hour", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTTL("hour", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	s.FastForward(59 * time.Minute)
+	if ttl := s.TTL("hour"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("except a minute left but got %v", ttl)
+	}
+	s.FastForward(time.Minute)
+	if s.Exists("hour") {
+		t.Error("except hour to expire")
+	}
+	if !s.Del("list") || s.Del("list") {
+		t.Error("except Del to report the key once")
+	}
+}
+
+func TestServer_Close(t *testing.T) {
+	s, err := NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := client.New(&client.Options{Addr: s.Addr(), DialTimeout: time.Second})
+	defer c.Close()
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if err := c.Ping(); err == nil {
+		t.Error("except the connection to be closed")
+	}
+	if err := client.New(&client.Options{Addr: s.Addr(), DialTimeout: time.Second}).Ping(); err == nil {
+		t.Error("except no more connections")
+	}
+}
@@ -0,0 +1,40 @@
+// Package clock abstracts the time read by expirations, so tests can move it forward instead of sleeping
+package clock
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the current time
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Real is the wall clock
+var Real Clock = realClock{}
+
+// Virtual is the wall clock moved forward by Advance, it is safe for concurrent use
+type Virtual struct {
+	offset int64
+}
+
+func NewVirtual() *Virtual {
+	return &Virtual{}
+}
+func (v *Virtual) Now() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&v.offset)))
+}
+
+// Advance moves the clock forward by d, a negative d is ignored since time never goes back
+func (v *Virtual) Advance(d time.Duration) {
+	if d > 0 {
+		atomic.AddInt64(&v.offset, int64(d))
+	}
+}
@@ -0,0 +1,19 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVirtual_Advance(t *testing.T) {
+	v := NewVirtual()
+	before := v.Now()
+	v.Advance(time.Hour)
+	v.Advance(-time.Hour)
+	if got := v.Now().Sub(before); got < time.Hour || got > time.Hour+time.Second {
+		t.Errorf("except the clock an hour ahead but got %v", got)
+	}
+	if Real.Now().After(v.Now()) {
+		t.Error("except the virtual clock ahead of the real one")
+	}
+}
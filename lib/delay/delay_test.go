@@ -2,6 +2,7 @@ package delay
 
 import (
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -37,7 +38,7 @@ func TestDelay(t *testing.T) {
 }
 
 func TestAt(t *testing.T) {
-	execCount := 0
+	var execCount int32
 	stop := make(chan struct{})
 	tests := []time.Duration{
 		//1 * time.Second,
@@ -54,8 +55,7 @@ func TestAt(t *testing.T) {
 	for _, d := range tests {
 		t.Run(d.String(), func(t *testing.T) {
 			At(time.Now().Add(d), d.String(), func() {
-				execCount++
-				fmt.Println("execCount->", execCount)
+				fmt.Println("execCount->", atomic.AddInt32(&execCount, 1))
 			})
 		})
 	}
@@ -64,7 +64,7 @@ func TestAt(t *testing.T) {
 	})
 	select {
 	case <-stop:
-		fmt.Println("execCount:", execCount)
+		fmt.Println("execCount:", atomic.LoadInt32(&execCount))
 	}
 
 }
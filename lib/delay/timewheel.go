@@ -3,6 +3,8 @@ package delay
 import (
 	"container/list"
 	"fmt"
+	"mygodis/lib/clock"
+	"sort"
 	"sync"
 	"time"
 )
@@ -40,7 +42,10 @@ type TimeWheel struct {
 	ticker        *time.Ticker
 	removeC       chan string
 	stopC         chan struct{}
+	stopOnce      sync.Once
+	dueC          chan chan []*task
 	taskLocations map[string]*taskLocation
+	clock         clock.Clock
 }
 
 func doJob(t *task) {
@@ -53,8 +58,10 @@ func doJob(t *task) {
 }
 
 func (tw *TimeWheel) add(t *task) {
-	milliseconds := t.expireAt.Sub(time.Now()).Milliseconds()
-	for _, w := range tw.wheels {
+	// a task added again replaces the former one
+	tw.remove(t.key)
+	milliseconds := t.expireAt.Sub(tw.clock.Now()).Milliseconds()
+	for _, w := range tw.wheels[:len(tw.wheels)-1] {
 		if milliseconds > w.maxDuration.Milliseconds() {
 			t.currentLevel++
 		} else {
@@ -65,7 +72,14 @@ func (tw *TimeWheel) add(t *task) {
 }
 
 func (tw *TimeWheel) addTaskToWheel(t *task, wheel *Wheel) {
-	slot := (t.expireAt.UnixMilli() - time.Now().UnixMilli()) / wheel.interval.Milliseconds()
+	slot := (t.expireAt.UnixMilli() - tw.clock.Now().UnixMilli()) / wheel.interval.Milliseconds()
+	if slot < 1 {
+		// the current slot was handled already, the next one is the earliest
+		slot = 1
+	} else if slot >= wheel.slotsNum {
+		// a full round would land on the current slot again
+		slot = wheel.slotsNum - 1
+	}
 	position := (wheel.current + slot) % wheel.slotsNum
 	wheel.slots[position].bucketLock.Lock()
 	elem := wheel.slots[position].list.PushBack(t)
@@ -80,36 +94,20 @@ func (tw *TimeWheel) handleTick() {
 	for _, w := range tw.wheels {
 		w.current = (w.current + 1) % w.slotsNum
 		bucket := w.slots[w.current]
-		if bucket.list.Len() == 0 {
-			continue
-		}
-		front := bucket.list.Front()
-		if front != nil {
-			tk := front.Value.(*task)
-			if tk.currentLevel == 0 || tk.expireAt.UnixMilli() <= time.Now().UnixMilli() {
-				for front != nil {
-					t := front.Value.(*task)
-					if t.expireAt.UnixMilli() <= time.Now().UnixMilli() {
-						doJob(t)
-						next := front.Next()
-						bucket.list.Remove(front)
-						front = next
-						delete(tw.taskLocations, t.key)
-					} else {
-						break
-					}
-				}
-			} else {
-				nextWheel := tw.wheels[tk.currentLevel-1]
-				nextSlot := (tk.expireAt.UnixMilli() - time.Now().UnixMilli()) / nextWheel.interval.Milliseconds()
-				nextPosition := (w.current + nextSlot) % nextWheel.slotsNum
-				currentSlot := tw.taskLocations[tk.key].slot
-				currentBucket := w.slots[currentSlot]
-				nextWheel.slots[nextPosition].list.PushBackList(currentBucket.list)
-				currentBucket.list.Init()
-				tw.taskLocations[tk.key].slot = nextPosition
-				tk.currentLevel--
+		// jobs compare the time at full precision, so a job run within the millisecond before its time would find
+		// itself early
+		now := tw.clock.Now()
+		for e := bucket.list.Front(); e != nil; e = bucket.list.Front() {
+			t := bucket.list.Remove(e).(*task)
+			delete(tw.taskLocations, t.key)
+			if !t.expireAt.After(now) {
+				// a job may call Remove or Add, which wait for this goroutine
+				go doJob(t)
+				continue
 			}
+			// a task of a coarser wheel or a tick ahead of its time moves to a finer slot, each keeps its own location
+			t.currentLevel = 0
+			tw.add(t)
 		}
 		if w.current == 0 {
 			continue
@@ -118,11 +116,11 @@ func (tw *TimeWheel) handleTick() {
 	}
 }
 
-func (tw *TimeWheel) stop() {
-	tw.ticker.Stop()
-	close(tw.addC)
-	close(tw.removeC)
-	close(tw.stopC)
+// Stop stops the ticks, the tasks left never run
+func (tw *TimeWheel) Stop() {
+	tw.stopOnce.Do(func() {
+		close(tw.stopC)
+	})
 }
 
 func NewWheel(interval time.Duration, slotsNum int64, name string) *Wheel {
@@ -144,13 +142,20 @@ func NewWheel(interval time.Duration, slotsNum int64, name string) *Wheel {
 }
 
 func NewTimeWheel() *TimeWheel {
+	return NewTimeWheelWithClock(clock.Real)
+}
+
+// NewTimeWheelWithClock returns a time wheel reading the time of c, the ticks still follow the wall clock
+func NewTimeWheelWithClock(c clock.Clock) *TimeWheel {
 	t := &TimeWheel{
-		ticker:        time.NewTicker(1 * time.Millisecond),
+		ticker:        time.NewTicker(10 * time.Millisecond),
 		wheels:        make([]*Wheel, 4),
 		addC:          make(chan *task),
 		removeC:       make(chan string),
 		stopC:         make(chan struct{}),
+		dueC:          make(chan chan []*task),
 		taskLocations: map[string]*taskLocation{},
+		clock:         c,
 	}
 	t.wheels[0] = NewWheel(10*time.Millisecond, 100, "ms")
 	t.wheels[1] = NewWheel(time.Second, 60, "s")
@@ -160,14 +165,20 @@ func NewTimeWheel() *TimeWheel {
 }
 
 func (tw *TimeWheel) Remove(key string) {
-	tw.removeC <- key
+	select {
+	case tw.removeC <- key:
+	case <-tw.stopC:
+	}
 }
 
 func (tw *TimeWheel) Add(key string, expireAt time.Time, job func()) {
-	tw.addC <- &task{
+	select {
+	case tw.addC <- &task{
 		key:      key,
 		expireAt: expireAt,
 		job:      job,
+	}:
+	case <-tw.stopC:
 	}
 }
 
@@ -181,14 +192,61 @@ func (tw *TimeWheel) Start() {
 				tw.add(t)
 			case key := <-tw.removeC:
 				tw.remove(key)
+			case result := <-tw.dueC:
+				result <- tw.takeDue()
 			case <-tw.stopC:
-				tw.stop()
+				tw.ticker.Stop()
 				return
 			}
 		}
 	}()
 }
 
+// RunDue runs the jobs due by the clock right away in the calling goroutine, in the order of their time, and places
+// the other tasks again by the clock. It is meant for a clock moved forward, whose tasks would wait in slots the
+// ticks reach much later.
+func (tw *TimeWheel) RunDue() {
+	result := make(chan []*task, 1)
+	select {
+	case tw.dueC <- result:
+	case <-tw.stopC:
+		return
+	}
+	for _, t := range <-result {
+		doJob(t)
+	}
+}
+
+// takeDue removes the due tasks and places the others again by the current time
+func (tw *TimeWheel) takeDue() []*task {
+	now := tw.clock.Now()
+	var due, left []*task
+	for _, w := range tw.wheels {
+		for _, b := range w.slots {
+			b.bucketLock.Lock()
+			for e := b.list.Front(); e != nil; e = e.Next() {
+				t := e.Value.(*task)
+				if !t.expireAt.After(now) {
+					due = append(due, t)
+				} else {
+					left = append(left, t)
+				}
+			}
+			b.list.Init()
+			b.bucketLock.Unlock()
+		}
+	}
+	tw.taskLocations = map[string]*taskLocation{}
+	for _, t := range left {
+		t.currentLevel = 0
+		tw.add(t)
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].expireAt.Before(due[j].expireAt)
+	})
+	return due
+}
+
 func (tw *TimeWheel) remove(key string) {
 	if location, ok := tw.taskLocations[key]; ok {
 		wheel := tw.wheels[location.elem.Value.(*task).currentLevel]
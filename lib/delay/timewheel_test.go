@@ -1,24 +1,117 @@
 package delay
 
 import (
+	"mygodis/lib/clock"
 	"testing"
 	"time"
 )
 
-func FuzzTimeWheel_getPositionAndCircle(f *testing.F) {
+func FuzzTimeWheel_add(f *testing.F) {
 	f.Add(int64(995757456748547))
+	f.Add(int64(-1))
+	f.Add(int64(999))
 	f.Fuzz(func(t *testing.T, delay int64) {
-		tw := NewTimeWheel(time.Second, 8)
+		tw := NewTimeWheel()
+		defer tw.ticker.Stop()
 		tk := &task{
-			delay: time.Duration(delay),
+			key:      "key",
+			expireAt: time.Now().Add(time.Duration(delay) * time.Millisecond),
 		}
-		p, c := tw.getPositionAndCircle(tk)
-		if p < 0 || p > 7 {
-			t.Errorf("position out of range: %d", p)
+		tw.add(tk)
+		if tk.currentLevel < 0 || tk.currentLevel >= len(tw.wheels) {
+			t.Fatalf("level out of range: %d", tk.currentLevel)
 		}
-		if c < 0 {
-			t.Errorf("circle out of range: %d", c)
+		location, ok := tw.taskLocations["key"]
+		if !ok {
+			t.Fatal("except the location of the task")
+		}
+		if location.slot < 0 || location.slot >= tw.wheels[tk.currentLevel].slotsNum {
+			t.Errorf("slot out of range: %d", location.slot)
+		}
+		tw.remove("key")
+		if _, ok := tw.taskLocations["key"]; ok {
+			t.Error("except the task removed")
 		}
 	})
+}
 
+func TestTimeWheel_RunDue(t *testing.T) {
+	c := clock.NewVirtual()
+	tw := NewTimeWheelWithClock(c)
+	tw.Start()
+	defer tw.Stop()
+	var fired []string
+	now := c.Now()
+	tw.Add("hour", now.Add(time.Hour), func() { fired = append(fired, "hour") })
+	tw.Add("minute", now.Add(time.Minute), func() { fired = append(fired, "minute") })
+	day := make(chan struct{})
+	tw.Add("day", now.Add(20*time.Hour), func() { close(day) })
+	tw.Add("cancelled", now.Add(time.Minute), func() { fired = append(fired, "cancelled") })
+	tw.Remove("cancelled")
+
+	c.Advance(2 * time.Hour)
+	tw.RunDue()
+	if len(fired) != 2 || fired[0] != "minute" || fired[1] != "hour" {
+		t.Fatalf("except minute and hour in order but got %v", fired)
+	}
+	tw.RunDue()
+	if len(fired) != 2 {
+		t.Fatalf("except a job to run once but got %v", fired)
+	}
+	// the tasks left are placed again by the new time, so the ticks run them once they are due
+	c.Advance(18*time.Hour - 50*time.Millisecond)
+	tw.RunDue()
+	select {
+	case <-day:
+	case <-time.After(2 * time.Second):
+		t.Fatal("except the ticks to run the last job")
+	}
+}
+
+func TestTimeWheel_cascade(t *testing.T) {
+	c := clock.NewVirtual()
+	tw := NewTimeWheelWithClock(c)
+	tw.ticker.Stop()
+	fired := make(chan string, 3)
+	now := c.Now()
+	// the three tasks share a slot of the seconds wheel and move to the milliseconds wheel together
+	for _, tk := range []struct {
+		name  string
+		delay time.Duration
+	}{{"a", 1500 * time.Millisecond}, {"b", 1900 * time.Millisecond}, {"c", 1700 * time.Millisecond}} {
+		name := tk.name
+		tw.add(&task{key: name, expireAt: now.Add(tk.delay), job: func() { fired <- name }})
+	}
+	for tick := 1; tick <= 200; tick++ {
+		c.Advance(10 * time.Millisecond)
+		tw.handleTick()
+		if tick == 100 {
+			// every task keeps a location of its own once moved
+			for key, location := range tw.taskLocations {
+				if tk := location.elem.Value.(*task); tk.key != key || tk.currentLevel != 0 {
+					t.Fatalf("location of %s points at %s of level %d", key, tk.key, tk.currentLevel)
+				}
+			}
+		}
+		if tick == 160 {
+			tw.remove("c")
+		}
+	}
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-fired:
+			got[name] = true
+		case <-time.After(time.Second):
+			t.Fatalf("except a and b fired but got %v", got)
+		}
+	}
+	if !got["a"] || !got["b"] {
+		t.Errorf("except a and b fired but got %v", got)
+	}
+	select {
+	case name := <-fired:
+		t.Errorf("except %s removed before its time", name)
+	case <-time.After(50 * time.Millisecond):
+	}
 }
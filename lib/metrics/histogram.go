@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds in seconds of the latency histograms, from 100µs to 1s
+var LatencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Histogram counts observations by the buckets they fall in
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sumBits uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + value)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+// Since observes the seconds passed since start
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+}
+
+// HistogramVec is a family of histograms with the same buckets told apart by their labels
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+// NewHistogramVec returns a family of histograms, buckets must be sorted
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{vec: newVec(name, help, labels), buckets: buckets}
+}
+
+// With returns the histogram of the label values, it is created on first use
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.child(values, func() any { return newHistogram(v.buckets) }).(*Histogram)
+}
+func (v *HistogramVec) Collect(w *Writer) {
+	w.Family(v.name, v.help, "histogram")
+	v.each(func(labels []string, child any) {
+		h := child.(*Histogram)
+		count := h.Count()
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			w.Sample(v.name+"_bucket", float64(cumulative), append(labels, "le", formatFloat(bound))...)
+		}
+		if count < cumulative {
+			// observations made while writing
+			count = cumulative
+		}
+		w.Sample(v.name+"_bucket", float64(count), append(labels, "le", "+Inf")...)
+		w.Sample(v.name+"_sum", h.Sum(), labels...)
+		w.Sample(v.name+"_count", float64(count), labels...)
+	})
+}
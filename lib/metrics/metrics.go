@@ -0,0 +1,219 @@
+// Package metrics keeps counters, gauges and histograms and writes them in the text format scraped by prometheus
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Collector writes metric families, it is asked on every scrape
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// CollectorFunc adapts a function to a Collector
+type CollectorFunc func(w *Writer)
+
+func (f CollectorFunc) Collect(w *Writer) {
+	f(w)
+}
+
+// Registry is the set of collectors written by one scrape, in the order they were registered
+type Registry struct {
+	mu         sync.RWMutex
+	collectors []Collector
+}
+
+// Default is the registry of the metrics of the process, the instrumented packages register there
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+func (r *Registry) Register(collectors ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collectors...)
+}
+
+// Unregister removes c, it is compared by identity so c must be a comparable value
+func (r *Registry) Unregister(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, registered := range r.collectors {
+		if registered == c {
+			r.collectors = append(r.collectors[:i:i], r.collectors[i+1:]...)
+			return
+		}
+	}
+}
+
+// WriteText writes every metric of the registry in the prometheus text format
+func (r *Registry) WriteText(out io.Writer) error {
+	r.mu.RLock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.RUnlock()
+	w := &Writer{w: bufio.NewWriter(out)}
+	for _, c := range collectors {
+		c.Collect(w)
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// Writer writes families and their samples in the prometheus text format
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *Writer) write(s ...string) {
+	for _, part := range s {
+		if w.err != nil {
+			return
+		}
+		_, w.err = w.w.WriteString(part)
+	}
+}
+
+// Family starts a metric family, kind is counter, gauge or histogram
+func (w *Writer) Family(name, help, kind string) {
+	w.write("# HELP ", name, " ", escape(help, false), "\n# TYPE ", name, " ", kind, "\n")
+}
+
+// Sample writes one value of a family, labels are names and values in turn
+func (w *Writer) Sample(name string, value float64, labels ...string) {
+	w.write(name)
+	if len(labels) > 0 {
+		w.write("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.write(",")
+			}
+			w.write(labels[i], `="`, escape(labels[i+1], true), `"`)
+		}
+		w.write("}")
+	}
+	w.write(" ", formatFloat(value), "\n")
+}
+
+func escape(s string, quoted bool) string {
+	if quoted {
+		return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+	}
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// labelPairs zips label names and values into the pairs of Writer.Sample
+func labelPairs(names, values []string) []string {
+	pairs := make([]string, 0, 2*len(names))
+	for i, name := range names {
+		pairs = append(pairs, name, values[i])
+	}
+	return pairs
+}
+
+// vec keeps one child per combination of label values
+type vec struct {
+	name     string
+	help     string
+	labels   []string
+	mu       sync.RWMutex
+	children map[string]any
+	values   map[string][]string
+}
+
+func newVec(name, help string, labels []string) vec {
+	return vec{name: name, help: help, labels: labels, children: make(map[string]any), values: make(map[string][]string)}
+}
+func (v *vec) child(values []string, newChild func() any) any {
+	if len(values) != len(v.labels) {
+		panic("metrics: " + v.name + " expects " + strconv.Itoa(len(v.labels)) + " label values")
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	c, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.children[key]; !ok {
+		c = newChild()
+		v.children[key] = c
+		v.values[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+// each calls f with the label pairs and the child of every combination, sorted by label values
+func (v *vec) each(f func(labels []string, child any)) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]any, len(keys))
+	values := make([][]string, len(keys))
+	for i, key := range keys {
+		children[i], values[i] = v.children[key], v.values[key]
+	}
+	v.mu.RUnlock()
+	for i := range keys {
+		f(labelPairs(v.labels, values[i]), children[i])
+	}
+}
+
+// Counter is a value which only goes up
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// CounterVec is a family of counters told apart by their labels
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{vec: newVec(name, help, labels)}
+}
+
+// With returns the counter of the label values, it is created on first use
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.child(values, func() any { return &Counter{} }).(*Counter)
+}
+func (v *CounterVec) Collect(w *Writer) {
+	w.Family(v.name, v.help, "counter")
+	v.each(func(labels []string, child any) {
+		w.Sample(v.name, float64(child.(*Counter).Value()), labels...)
+	})
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	r := NewRegistry()
+	calls := NewCounterVec("calls_total", "Calls made", "cmd")
+	latency := NewHistogramVec("latency_seconds", "Latency", []float64{0.1, 1}, "cmd")
+	r.Register(calls, latency, CollectorFunc(func(w *Writer) {
+		w.Family("clients", "Clients\nconnected", "gauge")
+		w.Sample("clients", 3, "name", `a"b\c`)
+	}))
+	calls.With("get").Inc()
+	calls.With("get").Add(2)
+	calls.With("del").Inc()
+	latency.With("get").Observe(0.05)
+	latency.With("get").Observe(0.5)
+	latency.With("get").Observe(5)
+
+	var out strings.Builder
+	if err := r.WriteText(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP calls_total Calls made
+# TYPE calls_total counter
+calls_total{cmd="del"} 1
+calls_total{cmd="get"} 3
+# HELP latency_seconds Latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{cmd="get",le="0.1"} 1
+latency_seconds_bucket{cmd="get",le="1"} 2
+latency_seconds_bucket{cmd="get",le="+Inf"} 3
+latency_seconds_sum{cmd="get"} 5.55
+latency_seconds_count{cmd="get"} 3
+# HELP clients Clients\nconnected
+# TYPE clients gauge
+clients{name="a\"b\\c"} 3
+`
+	if out.String() != want {
+		t.Errorf("unexpected text\n%s", out.String())
+	}
+}
+
+func TestRegistry_Unregister(t *testing.T) {
+	r := NewRegistry()
+	a, b := NewCounterVec("a", "a"), NewCounterVec("b", "b")
+	r.Register(a, b)
+	r.Unregister(a)
+	var out strings.Builder
+	_ = r.WriteText(&out)
+	if strings.Contains(out.String(), "# TYPE a ") || !strings.Contains(out.String(), "# TYPE b ") {
+		t.Errorf("except only b but got\n%s", out.String())
+	}
+}
@@ -104,3 +104,31 @@ func (pool *Pool) Drain() {
 	}
 	pool.mu.Unlock()
 }
+
+// Discard destroys x which was taken by Get instead of giving it back, e.g. a broken connection
+func (pool *Pool) Discard(x any) {
+	pool.finalizer(x)
+	pool.mu.Lock()
+	pool.activeCount--
+	pool.cond.Broadcast()
+	pool.mu.Unlock()
+}
+
+// Stats tells how many objects the pool holds, Active counts the idle ones too
+type Stats struct {
+	Active    uint `json:"active"`
+	Idle      uint `json:"idle"`
+	MaxActive uint `json:"maxActive"`
+	MaxIdle   uint `json:"maxIdle"`
+}
+
+func (pool *Pool) Stats() Stats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return Stats{
+		Active:    pool.activeCount,
+		Idle:      uint(len(pool.idles)),
+		MaxActive: pool.MaxActive,
+		MaxIdle:   pool.MaxIdle,
+	}
+}
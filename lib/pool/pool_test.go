@@ -34,3 +34,19 @@ func TestPool_Get(t *testing.T) {
 
 	})
 }
+
+func TestPool_Stats(t *testing.T) {
+	pool := NewPool(func() (any, error) {
+		return new(int), nil
+	}, func(any) {}, Config{MaxActive: 4, MaxIdle: 1})
+	a, _ := pool.Get()
+	b, _ := pool.Get()
+	if stats := pool.Stats(); stats != (Stats{Active: 2, MaxActive: 4, MaxIdle: 1}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	pool.Put(a)
+	pool.Put(b)
+	if stats := pool.Stats(); stats.Active != 1 || stats.Idle != 1 {
+		t.Errorf("except one idle object left but got %+v", stats)
+	}
+}
@@ -0,0 +1,136 @@
+package pubsub
+
+import (
+	"bytes"
+	cmi "mygodis/common/commoninterface"
+	"mygodis/resp"
+	"strings"
+	"sync"
+)
+
+// Hub keeps the subscribers of every channel
+type Hub struct {
+	mu   sync.RWMutex
+	subs map[string]map[cmi.Connection]struct{}
+}
+
+func MakeHub() *Hub {
+	return &Hub{subs: make(map[string]map[cmi.Connection]struct{})}
+}
+
+// replies is several pushes answered to one command, SUBSCRIBE confirms every channel on its own
+type replies []resp.Reply
+
+func (r replies) ToBytes() []byte {
+	var buf bytes.Buffer
+	for _, reply := range r {
+		buf.Write(reply.ToBytes())
+	}
+	return buf.Bytes()
+}
+
+func push(kind string, channel string, count int) resp.Reply {
+	return resp.MakeMultiRawReply(
+		resp.MakeBulkReply([]byte(kind)),
+		resp.MakeBulkReply([]byte(channel)),
+		resp.MakeIntReply(int64(count)),
+	)
+}
+
+// Subscribe implements SUBSCRIBE channel [channel ...]
+func (h *Hub) Subscribe(conn cmi.Connection, args [][]byte) resp.Reply {
+	if len(args) == 0 {
+		return resp.MakeArgNumErrReply("subscribe")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := make(replies, 0, len(args))
+	for _, arg := range args {
+		channel := string(arg)
+		subscribers, ok := h.subs[channel]
+		if !ok {
+			subscribers = make(map[cmi.Connection]struct{})
+			h.subs[channel] = subscribers
+		}
+		subscribers[conn] = struct{}{}
+		conn.Subscribe(channel)
+		result = append(result, push("subscribe", channel, conn.SubsCount()))
+	}
+	return result
+}
+
+// Unsubscribe implements UNSUBSCRIBE [channel ...], every channel of conn is left if none is given
+func (h *Hub) Unsubscribe(conn cmi.Connection, args [][]byte) resp.Reply {
+	channels := make([]string, 0, len(args))
+	for _, arg := range args {
+		channels = append(channels, string(arg))
+	}
+	if len(channels) == 0 {
+		channels = conn.GetChannels()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(channels) == 0 {
+		return resp.MakeMultiRawReply(
+			resp.MakeBulkReply([]byte("unsubscribe")),
+			resp.MakeNullBulkReply(),
+			resp.MakeIntReply(0),
+		)
+	}
+	result := make(replies, 0, len(channels))
+	for _, channel := range channels {
+		h.remove(conn, channel)
+		result = append(result, push("unsubscribe", channel, conn.SubsCount()))
+	}
+	return result
+}
+
+// UnsubscribeAll drops conn from every channel, it is called when the connection closes
+func (h *Hub) UnsubscribeAll(conn cmi.Connection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, channel := range conn.GetChannels() {
+		h.remove(conn, channel)
+	}
+}
+
+// remove must be called with mu held
+func (h *Hub) remove(conn cmi.Connection, channel string) {
+	conn.UnSubscribe(channel)
+	if subscribers, ok := h.subs[channel]; ok {
+		delete(subscribers, conn)
+		if len(subscribers) == 0 {
+			delete(h.subs, channel)
+		}
+	}
+}
+
+// Publish sends message to the subscribers of channel and returns how many received it
+func (h *Hub) Publish(channel []byte, message []byte) int {
+	payload := resp.MakeMultiBulkReply([][]byte{[]byte("message"), channel, message}).ToBytes()
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	received := 0
+	for conn := range h.subs[string(channel)] {
+		if _, err := conn.Write(payload); err == nil {
+			received++
+		}
+	}
+	return received
+}
+
+// Exec serves SUBSCRIBE, UNSUBSCRIBE and PUBLISH
+func (h *Hub) Exec(conn cmi.Connection, cmdLine [][]byte) resp.Reply {
+	switch strings.ToUpper(string(cmdLine[0])) {
+	case "SUBSCRIBE":
+		return h.Subscribe(conn, cmdLine[1:])
+	case "UNSUBSCRIBE":
+		return h.Unsubscribe(conn, cmdLine[1:])
+	case "PUBLISH":
+		if len(cmdLine) != 3 {
+			return resp.MakeArgNumErrReply("publish")
+		}
+		return resp.MakeIntReply(int64(h.Publish(cmdLine[1], cmdLine[2])))
+	}
+	return resp.MakeErrReply("ERR unknown command '" + string(cmdLine[0]) + "'")
+}
@@ -0,0 +1,72 @@
+package raft
+
+// EntryType tells how an entry is applied
+type EntryType int
+
+const (
+	// EntryCommand is handed to the state machine
+	EntryCommand EntryType = iota
+	// EntryConfig holds the members of the group, it takes effect as soon as it is in the log
+	EntryConfig
+	// EntryNoop is appended by a new leader so entries of former terms can commit
+	EntryNoop
+)
+
+// Entry is one record of the replicated log
+type Entry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Type  EntryType `json:"type"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+// Snapshot is the state machine as of Index together with the members of the group at that point
+type Snapshot struct {
+	Index uint64   `json:"index"`
+	Term  uint64   `json:"term"`
+	Peers []string `json:"peers"`
+	Data  []byte   `json:"data"`
+}
+
+// MessageType is the kind of a request between members, every request is answered by a message of the same type
+type MessageType int
+
+const (
+	MsgVote MessageType = iota
+	MsgAppend
+	MsgSnapshot
+	// MsgReadIndex asks the leader for an index a linearizable read has to wait for
+	MsgReadIndex
+)
+
+// Message is a request or a response between members
+type Message struct {
+	Type MessageType `json:"type"`
+	Term uint64      `json:"term"`
+	From string      `json:"from"`
+	// LastLogIndex and LastLogTerm describe the log of a candidate
+	LastLogIndex uint64 `json:"lastLogIndex,omitempty"`
+	LastLogTerm  uint64 `json:"lastLogTerm,omitempty"`
+	// PrevLogIndex and PrevLogTerm locate Entries in the log of the leader
+	PrevLogIndex uint64    `json:"prevLogIndex,omitempty"`
+	PrevLogTerm  uint64    `json:"prevLogTerm,omitempty"`
+	Entries      []Entry   `json:"entries,omitempty"`
+	Commit       uint64    `json:"commit,omitempty"`
+	Snapshot     *Snapshot `json:"snapshot,omitempty"`
+	// Success answers a request, Index is the last matching entry of a follower or the index of a read
+	Success bool   `json:"success,omitempty"`
+	Index   uint64 `json:"index,omitempty"`
+	Leader  string `json:"leader,omitempty"`
+}
+
+// Transport delivers a request to another member and returns its response
+type Transport interface {
+	Send(to string, m *Message) (*Message, error)
+}
+
+// StateMachine is what the log is applied to
+type StateMachine interface {
+	Apply(data []byte)
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
@@ -0,0 +1,963 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	logger "mygodis/log"
+	"sync"
+	"time"
+)
+
+const (
+	Follower  = "follower"
+	Candidate = "candidate"
+	Leader    = "leader"
+)
+
+// maxAppendEntries is the most entries sent to a follower with one message
+const maxAppendEntries = 512
+
+var (
+	ErrNotLeader        = errors.New("raft: not the leader")
+	ErrTimeout          = errors.New("raft: timeout")
+	ErrStopped          = errors.New("raft: stopped")
+	ErrConfigInProgress = errors.New("raft: another membership change is in progress")
+	ErrLost             = errors.New("raft: entry overwritten by another leader")
+)
+
+type Config struct {
+	ID string
+	// Peers are the members a new group starts with, this node included. A node started without peers and
+	// without a saved state waits until a leader adds it
+	Peers        []string
+	Transport    Transport
+	StateMachine StateMachine
+	Storage      Storage
+	// ElectionTimeout is the least time without a leader before a member campaigns, the actual timeout is
+	// picked in [ElectionTimeout, 2*ElectionTimeout)
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is how many applied entries are kept before the log is compacted, 0 never compacts
+	SnapshotThreshold uint64
+}
+
+// Status describes a member
+type Status struct {
+	ID      string
+	State   string
+	Term    uint64
+	Leader  string
+	Commit  uint64
+	Applied uint64
+	Peers   []string
+}
+
+// waiter is a proposal waiting to be applied
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// Node is a member of a raft group
+type Node struct {
+	cfg Config
+
+	mu       sync.Mutex
+	state    string
+	term     uint64
+	vote     string
+	leader   string
+	votes    int
+	lastSeen time.Time
+	deadline time.Time
+	// log holds the entries after snapshot
+	snapshot *Snapshot
+	log      []Entry
+	peers    []string
+	commit   uint64
+	applied  uint64
+	// appliedPeers are the members as of applied, they are written to snapshots
+	appliedPeers []string
+
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	replicating map[string]bool
+
+	// pendingSnapshot was received from the leader and is restored by the applier
+	pendingSnapshot *Snapshot
+	waiters         map[uint64]waiter
+	applyC          chan struct{}
+	// appliedC is closed and replaced whenever applied moves
+	appliedC chan struct{}
+	stopC    chan struct{}
+	stopOnce sync.Once
+}
+
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.Storage == nil {
+		cfg.Storage = NewMemoryStorage()
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 100 * time.Millisecond
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = 10 * cfg.HeartbeatInterval
+	}
+	n := &Node{
+		cfg:         cfg,
+		state:       Follower,
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		replicating: make(map[string]bool),
+		waiters:     make(map[uint64]waiter),
+		applyC:      make(chan struct{}, 1),
+		appliedC:    make(chan struct{}),
+		stopC:       make(chan struct{}),
+	}
+	state, snapshot, entries, err := cfg.Storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	n.term, n.vote, n.snapshot, n.log = state.Term, state.Vote, snapshot, entries
+	if snapshot != nil {
+		if err := cfg.StateMachine.Restore(snapshot.Data); err != nil {
+			return nil, err
+		}
+		n.commit, n.applied = snapshot.Index, snapshot.Index
+		n.appliedPeers = snapshot.Peers
+	}
+	if snapshot == nil && len(entries) == 0 && len(cfg.Peers) > 0 {
+		// every member of a new group starts with the same first entry
+		data, _ := json.Marshal(cfg.Peers)
+		n.log = []Entry{{Index: 1, Term: 0, Type: EntryConfig, Data: data}}
+		n.persist()
+	}
+	n.peers = n.lastConfig()
+	return n, nil
+}
+
+// Start runs the timers of the member and applies committed entries until Stop
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetDeadline()
+	n.mu.Unlock()
+	go n.tickLoop()
+	go n.applyLoop()
+}
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stopC)
+	})
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:      n.cfg.ID,
+		State:   n.state,
+		Term:    n.term,
+		Leader:  n.leader,
+		Commit:  n.commit,
+		Applied: n.applied,
+		Peers:   append([]string{}, n.peers...),
+	}
+}
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state == Leader
+}
+
+// Propose appends data to the log and returns once it was applied by this member
+func (n *Node) Propose(data []byte, timeout time.Duration) error {
+	return n.propose(EntryCommand, func() ([]byte, error) { return data, nil }, timeout)
+}
+
+// AddPeer makes peer a member of the group
+func (n *Node) AddPeer(peer string, timeout time.Duration) error {
+	return n.changePeers(func(peers []string) []string {
+		if contains(peers, peer) {
+			return peers
+		}
+		return append(peers, peer)
+	}, timeout)
+}
+
+// RemovePeer takes peer out of the group
+func (n *Node) RemovePeer(peer string, timeout time.Duration) error {
+	return n.changePeers(func(peers []string) []string {
+		result := make([]string, 0, len(peers))
+		for _, p := range peers {
+			if p != peer {
+				result = append(result, p)
+			}
+		}
+		return result
+	}, timeout)
+}
+
+// changePeers proposes the members change computes from the current ones, one change is in progress at a time
+func (n *Node) changePeers(change func([]string) []string, timeout time.Duration) error {
+	return n.propose(EntryConfig, func() ([]byte, error) {
+		for _, e := range n.log {
+			if e.Type == EntryConfig && e.Index > n.commit {
+				return nil, ErrConfigInProgress
+			}
+		}
+		return json.Marshal(change(append([]string{}, n.peers...)))
+	}, timeout)
+}
+
+// propose appends an entry whose data is built with mu held
+func (n *Node) propose(entryType EntryType, build func() ([]byte, error), timeout time.Duration) error {
+	n.mu.Lock()
+	if n.state != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	data, err := build()
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.term, Type: entryType, Data: data}
+	n.appendEntries([]Entry{entry})
+	n.persist()
+	w := waiter{term: n.term, done: make(chan error, 1)}
+	n.waiters[entry.Index] = w
+	n.advanceCommit()
+	n.mu.Unlock()
+	go n.broadcast()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-w.done:
+		return err
+	case <-timer.C:
+		n.mu.Lock()
+		delete(n.waiters, entry.Index)
+		n.mu.Unlock()
+		return ErrTimeout
+	case <-n.stopC:
+		return ErrStopped
+	}
+}
+
+// ReadBarrier returns once this member applied every entry committed before it was called, reads of the state
+// machine after it are linearizable
+func (n *Node) ReadBarrier(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	n.mu.Lock()
+	isLeader, leader, term := n.state == Leader, n.leader, n.term
+	n.mu.Unlock()
+	var index uint64
+	if isLeader {
+		var err error
+		if index, err = n.readIndex(deadline); err != nil {
+			return err
+		}
+	} else {
+		if leader == "" {
+			return ErrNotLeader
+		}
+		response, err := n.cfg.Transport.Send(leader, &Message{Type: MsgReadIndex, Term: term, From: n.cfg.ID})
+		if err != nil {
+			return err
+		}
+		if !response.Success {
+			return ErrNotLeader
+		}
+		index = response.Index
+	}
+	return n.waitApplied(index, deadline)
+}
+func (n *Node) waitApplied(index uint64, deadline time.Time) error {
+	for {
+		n.mu.Lock()
+		applied, appliedC := n.applied, n.appliedC
+		n.mu.Unlock()
+		if applied >= index {
+			return nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return ErrTimeout
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-appliedC:
+		case <-timer.C:
+		case <-n.stopC:
+			timer.Stop()
+			return ErrStopped
+		}
+		timer.Stop()
+	}
+}
+
+// readIndex returns the commit index once a majority confirmed this member still leads
+func (n *Node) readIndex(deadline time.Time) (uint64, error) {
+	for {
+		n.mu.Lock()
+		if n.state != Leader {
+			n.mu.Unlock()
+			return 0, ErrNotLeader
+		}
+		// the commit index is only known once an entry of this term committed
+		if t, _ := n.termAt(n.commit); t == n.term {
+			break
+		}
+		appliedC := n.appliedC
+		n.mu.Unlock()
+		if err := n.waitChange(appliedC, deadline); err != nil {
+			return 0, err
+		}
+	}
+	index, term := n.commit, n.term
+	others := n.others()
+	quorum := len(n.peers)/2 + 1
+	confirmed := 0
+	if contains(n.peers, n.cfg.ID) {
+		confirmed++
+	}
+	n.mu.Unlock()
+	acks := make(chan bool, len(others))
+	for _, peer := range others {
+		go func(peer string) {
+			acks <- n.heartbeat(peer, term)
+		}(peer)
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for i := 0; confirmed < quorum && i < len(others); i++ {
+		select {
+		case ok := <-acks:
+			if ok {
+				confirmed++
+			}
+		case <-timer.C:
+			return 0, ErrTimeout
+		}
+	}
+	if confirmed < quorum {
+		return 0, ErrNotLeader
+	}
+	return index, nil
+}
+func (n *Node) waitChange(ch chan struct{}, deadline time.Time) error {
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return ErrTimeout
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return ErrTimeout
+	case <-n.stopC:
+		return ErrStopped
+	}
+}
+
+// Handle answers a request of another member
+func (n *Node) Handle(m *Message) *Message {
+	if m.Type == MsgReadIndex {
+		index, err := n.readIndex(time.Now().Add(n.cfg.ElectionTimeout))
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return &Message{Type: MsgReadIndex, Term: n.term, From: n.cfg.ID, Success: err == nil, Index: index, Leader: n.leader}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch m.Type {
+	case MsgVote:
+		return n.handleVote(m)
+	case MsgAppend:
+		return n.handleAppend(m)
+	case MsgSnapshot:
+		return n.handleSnapshot(m)
+	}
+	return &Message{Type: m.Type, Term: n.term, From: n.cfg.ID}
+}
+
+func (n *Node) tickLoop() {
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopC:
+			return
+		case <-ticker.C:
+			n.tick()
+		}
+	}
+}
+func (n *Node) tick() {
+	n.mu.Lock()
+	if n.state == Leader {
+		n.mu.Unlock()
+		n.broadcast()
+		return
+	}
+	if time.Now().After(n.deadline) && contains(n.peers, n.cfg.ID) {
+		n.campaign()
+	}
+	n.mu.Unlock()
+}
+func (n *Node) resetDeadline() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+// campaign starts an election, it must be called with mu held
+func (n *Node) campaign() {
+	n.term++
+	n.state = Candidate
+	n.vote = n.cfg.ID
+	n.leader = ""
+	n.votes = 1
+	n.persist()
+	n.resetDeadline()
+	if n.votes >= len(n.peers)/2+1 {
+		n.becomeLeader()
+		return
+	}
+	request := &Message{Type: MsgVote, Term: n.term, From: n.cfg.ID, LastLogIndex: n.lastIndex(), LastLogTerm: n.lastTerm()}
+	for _, peer := range n.others() {
+		go func(peer string) {
+			response, err := n.cfg.Transport.Send(peer, request)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if response.Term > n.term {
+				n.becomeFollower(response.Term, "")
+				return
+			}
+			if n.state != Candidate || n.term != request.Term || !response.Success {
+				return
+			}
+			n.votes++
+			if n.votes >= len(n.peers)/2+1 {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeFollower adopts term and leader, it must be called with mu held
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.vote = ""
+		n.persist()
+	}
+	if n.state == Leader {
+		logger.Info("raft", n.cfg.ID, "steps down in term", n.term)
+	}
+	n.state = Follower
+	n.leader = leader
+}
+func (n *Node) becomeLeader() {
+	logger.Info("raft", n.cfg.ID, "becomes leader in term", n.term)
+	n.state = Leader
+	n.leader = n.cfg.ID
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+	n.appendEntries([]Entry{{Index: n.lastIndex() + 1, Term: n.term, Type: EntryNoop}})
+	n.persist()
+	n.advanceCommit()
+	go n.broadcast()
+}
+
+// broadcast sends the missing entries, or a heartbeat, to every other member
+func (n *Node) broadcast() {
+	n.mu.Lock()
+	if n.state != Leader {
+		n.mu.Unlock()
+		return
+	}
+	others := n.others()
+	n.mu.Unlock()
+	for _, peer := range others {
+		go n.replicate(peer)
+	}
+}
+
+// replicate sends entries to peer until it is up to date, one replication runs per peer at a time
+func (n *Node) replicate(peer string) {
+	n.mu.Lock()
+	if n.state != Leader || n.replicating[peer] {
+		n.mu.Unlock()
+		return
+	}
+	n.replicating[peer] = true
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.replicating, peer)
+		n.mu.Unlock()
+	}()
+	for {
+		n.mu.Lock()
+		if n.state != Leader {
+			n.mu.Unlock()
+			return
+		}
+		request := n.appendRequest(peer, true)
+		n.mu.Unlock()
+		response, err := n.cfg.Transport.Send(peer, request)
+		if err != nil {
+			return
+		}
+		n.mu.Lock()
+		more := n.handleAppendResponse(peer, request, response)
+		n.mu.Unlock()
+		if !more {
+			return
+		}
+	}
+}
+
+// heartbeat sends an empty append to peer and returns whether peer still follows this member in term
+func (n *Node) heartbeat(peer string, term uint64) bool {
+	n.mu.Lock()
+	if n.state != Leader || n.term != term {
+		n.mu.Unlock()
+		return false
+	}
+	request := n.appendRequest(peer, false)
+	n.mu.Unlock()
+	response, err := n.cfg.Transport.Send(peer, request)
+	if err != nil {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.handleAppendResponse(peer, request, response)
+	return response.Term == term
+}
+
+// appendRequest builds the next message for peer, a snapshot if the entries it misses were compacted
+func (n *Node) appendRequest(peer string, withEntries bool) *Message {
+	next := n.nextIndex[peer]
+	if next == 0 {
+		next = n.lastIndex() + 1
+		n.nextIndex[peer] = next
+	}
+	if next <= n.snapIndex() {
+		if withEntries {
+			return &Message{Type: MsgSnapshot, Term: n.term, From: n.cfg.ID, Snapshot: n.snapshot}
+		}
+		next = n.snapIndex() + 1
+	}
+	prevTerm, _ := n.termAt(next - 1)
+	request := &Message{Type: MsgAppend, Term: n.term, From: n.cfg.ID, PrevLogIndex: next - 1, PrevLogTerm: prevTerm, Commit: n.commit}
+	if withEntries {
+		entries := n.entriesFrom(next)
+		if len(entries) > maxAppendEntries {
+			entries = entries[:maxAppendEntries]
+		}
+		request.Entries = entries
+	}
+	return request
+}
+
+// handleAppendResponse returns whether peer still misses entries
+func (n *Node) handleAppendResponse(peer string, request *Message, response *Message) bool {
+	if response.Term > n.term {
+		n.becomeFollower(response.Term, "")
+		return false
+	}
+	if n.state != Leader || request.Term != n.term {
+		return false
+	}
+	switch {
+	case request.Type == MsgSnapshot:
+		n.matchIndex[peer] = request.Snapshot.Index
+		n.nextIndex[peer] = request.Snapshot.Index + 1
+	case response.Success:
+		match := request.PrevLogIndex + uint64(len(request.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+	default:
+		next := response.Index + 1
+		if next >= n.nextIndex[peer] {
+			next = n.nextIndex[peer] - 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[peer] = next
+		return true
+	}
+	n.advanceCommit()
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+// advanceCommit commits the newest entry of this term stored by a majority, it must be called with mu held
+func (n *Node) advanceCommit() {
+	quorum := len(n.peers)/2 + 1
+	for index := n.lastIndex(); index > n.commit; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			break
+		}
+		count := 0
+		for _, peer := range n.peers {
+			if peer == n.cfg.ID || n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= quorum {
+			n.commit = index
+			n.notifyApply()
+			break
+		}
+	}
+	if !contains(n.peers, n.cfg.ID) && n.state == Leader && n.lastConfigIndex() <= n.commit {
+		// the change removing this member committed
+		n.becomeFollower(n.term, "")
+	}
+}
+
+func (n *Node) handleVote(m *Message) *Message {
+	response := &Message{Type: MsgVote, From: n.cfg.ID}
+	leaderAlive := n.state == Leader || n.leader != "" && time.Since(n.lastSeen) < n.cfg.ElectionTimeout
+	if m.Term < n.term || m.Term > n.term && leaderAlive {
+		// a member which cannot hear the leader must not disturb the others
+		response.Term = n.term
+		return response
+	}
+	if m.Term > n.term {
+		n.becomeFollower(m.Term, "")
+	}
+	upToDate := m.LastLogTerm > n.lastTerm() || m.LastLogTerm == n.lastTerm() && m.LastLogIndex >= n.lastIndex()
+	if (n.vote == "" || n.vote == m.From) && upToDate {
+		n.vote = m.From
+		n.persist()
+		n.resetDeadline()
+		response.Success = true
+	}
+	response.Term = n.term
+	return response
+}
+func (n *Node) handleAppend(m *Message) *Message {
+	response := &Message{Type: MsgAppend, From: n.cfg.ID}
+	if m.Term < n.term {
+		response.Term, response.Index = n.term, n.lastIndex()
+		return response
+	}
+	n.becomeFollower(m.Term, m.From)
+	n.lastSeen = time.Now()
+	n.resetDeadline()
+	response.Term = n.term
+	prev, prevTerm, entries := m.PrevLogIndex, m.PrevLogTerm, m.Entries
+	if prev < n.snapIndex() {
+		// entries up to the snapshot are committed and so equal to the ones of the leader
+		skip := n.snapIndex() - prev
+		if uint64(len(entries)) <= skip {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prev, prevTerm = n.snapIndex(), n.snapTerm()
+	}
+	if prev > n.lastIndex() {
+		response.Index = n.lastIndex()
+		return response
+	}
+	if term, _ := n.termAt(prev); term != prevTerm {
+		// skip the whole conflicting term at once
+		index := prev - 1
+		for index > n.snapIndex() {
+			if t, _ := n.termAt(index); t != term {
+				break
+			}
+			index--
+		}
+		response.Index = index
+		return response
+	}
+	changed := false
+	for i, entry := range entries {
+		if entry.Index <= n.lastIndex() {
+			if term, _ := n.termAt(entry.Index); term == entry.Term {
+				continue
+			}
+			n.log = n.log[:entry.Index-n.snapIndex()-1]
+		}
+		n.appendEntries(entries[i:])
+		changed = true
+		break
+	}
+	if changed {
+		n.peers = n.lastConfig()
+		n.persist()
+	}
+	last := prev + uint64(len(entries))
+	if commit := m.Commit; commit > n.commit {
+		if commit > last {
+			commit = last
+		}
+		if commit > n.commit {
+			n.commit = commit
+			n.notifyApply()
+		}
+	}
+	response.Success = true
+	response.Index = last
+	return response
+}
+func (n *Node) handleSnapshot(m *Message) *Message {
+	response := &Message{Type: MsgSnapshot, From: n.cfg.ID}
+	if m.Term < n.term {
+		response.Term = n.term
+		return response
+	}
+	n.becomeFollower(m.Term, m.From)
+	n.lastSeen = time.Now()
+	n.resetDeadline()
+	response.Term = n.term
+	s := m.Snapshot
+	if s == nil || s.Index <= n.commit {
+		response.Success = true
+		response.Index = n.commit
+		return response
+	}
+	if term, ok := n.termAt(s.Index); ok && term == s.Term {
+		n.log = n.entriesFrom(s.Index + 1)
+	} else {
+		n.log = nil
+	}
+	n.snapshot = s
+	n.pendingSnapshot = s
+	n.commit = s.Index
+	n.peers = n.lastConfig()
+	n.persist()
+	n.notifyApply()
+	response.Success = true
+	response.Index = s.Index
+	return response
+}
+
+func (n *Node) notifyApply() {
+	select {
+	case n.applyC <- struct{}{}:
+	default:
+	}
+}
+func (n *Node) applyLoop() {
+	for {
+		select {
+		case <-n.stopC:
+			return
+		case <-n.applyC:
+			n.applyCommitted()
+		}
+	}
+}
+
+// applyCommitted applies the committed entries in order, it is the only place where applied moves
+func (n *Node) applyCommitted() {
+	for {
+		n.mu.Lock()
+		if s := n.pendingSnapshot; s != nil {
+			n.pendingSnapshot = nil
+			n.mu.Unlock()
+			if err := n.cfg.StateMachine.Restore(s.Data); err != nil {
+				logger.Error("raft restore snapshot", err)
+			}
+			n.mu.Lock()
+			if s.Index > n.applied {
+				n.applied = s.Index
+				n.appliedPeers = s.Peers
+				n.appliedMoved()
+			}
+			n.mu.Unlock()
+			continue
+		}
+		if n.applied >= n.commit {
+			n.mu.Unlock()
+			return
+		}
+		entries := make([]Entry, 0, n.commit-n.applied)
+		for index := n.applied + 1; index <= n.commit; index++ {
+			if index <= n.snapIndex() {
+				continue
+			}
+			entries = append(entries, n.log[index-n.snapIndex()-1])
+		}
+		n.mu.Unlock()
+		for _, entry := range entries {
+			if entry.Type == EntryCommand {
+				n.cfg.StateMachine.Apply(entry.Data)
+			}
+		}
+		n.mu.Lock()
+		for _, entry := range entries {
+			if entry.Type == EntryConfig {
+				_ = json.Unmarshal(entry.Data, &n.appliedPeers)
+			}
+			if w, ok := n.waiters[entry.Index]; ok {
+				delete(n.waiters, entry.Index)
+				if w.term == entry.Term {
+					w.done <- nil
+				} else {
+					w.done <- ErrLost
+				}
+			}
+			if entry.Index > n.applied {
+				n.applied = entry.Index
+			}
+		}
+		n.appliedMoved()
+		n.mu.Unlock()
+		n.maybeSnapshot()
+	}
+}
+func (n *Node) appliedMoved() {
+	close(n.appliedC)
+	n.appliedC = make(chan struct{})
+}
+
+// maybeSnapshot compacts the log once SnapshotThreshold entries were applied since the last snapshot
+func (n *Node) maybeSnapshot() {
+	n.mu.Lock()
+	threshold := n.cfg.SnapshotThreshold
+	if threshold == 0 || n.applied-n.snapIndex() < threshold {
+		n.mu.Unlock()
+		return
+	}
+	index := n.applied
+	peers := append([]string{}, n.appliedPeers...)
+	n.mu.Unlock()
+	// only the applier touches the state machine, so it is still as of index
+	data, err := n.cfg.StateMachine.Snapshot()
+	if err != nil {
+		logger.Error("raft snapshot", err)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	term, ok := n.termAt(index)
+	if !ok || index <= n.snapIndex() {
+		return
+	}
+	n.log = n.entriesFrom(index + 1)
+	n.snapshot = &Snapshot{Index: index, Term: term, Peers: peers, Data: data}
+	n.persist()
+}
+
+func (n *Node) persist() {
+	if err := n.cfg.Storage.Save(HardState{Term: n.term, Vote: n.vote}, n.snapshot, n.log); err != nil {
+		logger.Error("raft save state", err)
+	}
+}
+func (n *Node) appendEntries(entries []Entry) {
+	n.log = append(n.log, entries...)
+	for _, entry := range entries {
+		if entry.Type == EntryConfig {
+			n.peers = n.lastConfig()
+			for _, peer := range n.peers {
+				if _, ok := n.nextIndex[peer]; !ok {
+					n.nextIndex[peer] = n.lastIndex() + 1
+				}
+			}
+		}
+	}
+}
+
+// lastConfig returns the members of the newest configuration, configurations take effect once appended
+func (n *Node) lastConfig() []string {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Type == EntryConfig {
+			var peers []string
+			_ = json.Unmarshal(n.log[i].Data, &peers)
+			return peers
+		}
+	}
+	if n.snapshot != nil {
+		return n.snapshot.Peers
+	}
+	return nil
+}
+func (n *Node) lastConfigIndex() uint64 {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Type == EntryConfig {
+			return n.log[i].Index
+		}
+	}
+	return n.snapIndex()
+}
+func (n *Node) others() []string {
+	others := make([]string, 0, len(n.peers))
+	for _, peer := range n.peers {
+		if peer != n.cfg.ID {
+			others = append(others, peer)
+		}
+	}
+	return others
+}
+func (n *Node) snapIndex() uint64 {
+	if n.snapshot == nil {
+		return 0
+	}
+	return n.snapshot.Index
+}
+func (n *Node) snapTerm() uint64 {
+	if n.snapshot == nil {
+		return 0
+	}
+	return n.snapshot.Term
+}
+func (n *Node) lastIndex() uint64 {
+	if len(n.log) > 0 {
+		return n.log[len(n.log)-1].Index
+	}
+	return n.snapIndex()
+}
+func (n *Node) lastTerm() uint64 {
+	if len(n.log) > 0 {
+		return n.log[len(n.log)-1].Term
+	}
+	return n.snapTerm()
+}
+
+// termAt returns the term of the entry at index, false if it was compacted or does not exist
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	if index == n.snapIndex() {
+		return n.snapTerm(), true
+	}
+	if index < n.snapIndex() || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[index-n.snapIndex()-1].Term, true
+}
+func (n *Node) entriesFrom(index uint64) []Entry {
+	if index > n.lastIndex() {
+		return nil
+	}
+	return append([]Entry{}, n.log[index-n.snapIndex()-1:]...)
+}
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,305 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryNetwork delivers messages between nodes of one process, members can be cut off
+type memoryNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	down  map[string]bool
+}
+
+type memoryTransport struct {
+	network *memoryNetwork
+	from    string
+}
+
+func (t *memoryTransport) Send(to string, m *Message) (*Message, error) {
+	t.network.mu.Lock()
+	node, ok := t.network.nodes[to]
+	cut := t.network.down[to] || t.network.down[t.from]
+	t.network.mu.Unlock()
+	if !ok || cut {
+		return nil, errors.New("unreachable")
+	}
+	// messages go through json like they do on the wire
+	encoded, _ := json.Marshal(m)
+	var request Message
+	_ = json.Unmarshal(encoded, &request)
+	return node.Handle(&request), nil
+}
+func (network *memoryNetwork) setDown(id string, down bool) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	network.down[id] = down
+}
+
+// listMachine appends every command to a list
+type listMachine struct {
+	mu    sync.Mutex
+	items []string
+}
+
+func (m *listMachine) Apply(data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items = append(m.items, string(data))
+}
+func (m *listMachine) Snapshot() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return json.Marshal(m.items)
+}
+func (m *listMachine) Restore(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items = nil
+	return json.Unmarshal(data, &m.items)
+}
+func (m *listMachine) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.items)
+}
+
+type testGroup struct {
+	network  *memoryNetwork
+	nodes    map[string]*Node
+	machines map[string]*listMachine
+}
+
+func (g *testGroup) add(t *testing.T, id string, peers []string, threshold uint64) {
+	machine := &listMachine{}
+	node, err := NewNode(Config{
+		ID:                id,
+		Peers:             peers,
+		Transport:         &memoryTransport{network: g.network, from: id},
+		StateMachine:      machine,
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+		SnapshotThreshold: threshold,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.network.mu.Lock()
+	g.network.nodes[id] = node
+	g.network.mu.Unlock()
+	g.nodes[id] = node
+	g.machines[id] = machine
+	node.Start()
+}
+func (g *testGroup) stop() {
+	for _, node := range g.nodes {
+		node.Stop()
+	}
+}
+
+func makeTestGroup(t *testing.T, size int, threshold uint64) *testGroup {
+	g := &testGroup{
+		network:  &memoryNetwork{nodes: make(map[string]*Node), down: make(map[string]bool)},
+		nodes:    make(map[string]*Node),
+		machines: make(map[string]*listMachine),
+	}
+	peers := make([]string, 0, size)
+	for i := 0; i < size; i++ {
+		peers = append(peers, "n"+strconv.Itoa(i))
+	}
+	for _, id := range peers {
+		g.add(t, id, peers, threshold)
+	}
+	return g
+}
+
+// leader waits until exactly one reachable member leads
+func (g *testGroup) leader(t *testing.T) *Node {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []*Node
+		for id, node := range g.nodes {
+			g.network.mu.Lock()
+			down := g.network.down[id]
+			g.network.mu.Unlock()
+			if !down && node.IsLeader() {
+				leaders = append(leaders, node)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+func (g *testGroup) waitApplied(t *testing.T, id string, count int) {
+	deadline := time.Now().Add(3 * time.Second)
+	for g.machines[id].len() < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s applied %d of %d commands", id, g.machines[id].len(), count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+func propose(t *testing.T, node *Node, from int, to int) {
+	for i := from; i < to; i++ {
+		if err := node.Propose([]byte(strconv.Itoa(i)), time.Second); err != nil {
+			t.Fatalf("propose %d: %v", i, err)
+		}
+	}
+}
+
+func TestNode_replication(t *testing.T) {
+	g := makeTestGroup(t, 3, 0)
+	defer g.stop()
+	leader := g.leader(t)
+	propose(t, leader, 0, 50)
+	for id := range g.nodes {
+		g.waitApplied(t, id, 50)
+	}
+	for id, machine := range g.machines {
+		for i, item := range machine.items {
+			if item != strconv.Itoa(i) {
+				t.Fatalf("%s applied %s at %d", id, item, i)
+			}
+		}
+	}
+	follower := g.nodes["n0"]
+	if follower == leader {
+		follower = g.nodes["n1"]
+	}
+	if err := follower.Propose([]byte("x"), time.Second); err != ErrNotLeader {
+		t.Errorf("except ErrNotLeader but got %v", err)
+	}
+}
+
+func TestNode_leaderFailure(t *testing.T) {
+	g := makeTestGroup(t, 3, 0)
+	defer g.stop()
+	old := g.leader(t)
+	propose(t, old, 0, 10)
+	g.network.setDown(old.cfg.ID, true)
+	leader := g.leader(t)
+	if leader == old {
+		t.Fatal("except a new leader")
+	}
+	propose(t, leader, 10, 20)
+	g.network.setDown(old.cfg.ID, false)
+	g.waitApplied(t, old.cfg.ID, 20)
+	if old.IsLeader() {
+		t.Error("except former leader stepped down")
+	}
+}
+
+func TestNode_snapshot(t *testing.T) {
+	g := makeTestGroup(t, 3, 10)
+	defer g.stop()
+	leader := g.leader(t)
+	propose(t, leader, 0, 35)
+	leader.mu.Lock()
+	compacted := leader.snapIndex()
+	leader.mu.Unlock()
+	if compacted == 0 {
+		t.Fatal("except the log compacted")
+	}
+	// a new member catches up from the snapshot of the leader
+	g.add(t, "n3", nil, 10)
+	if err := leader.AddPeer("n3", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	g.waitApplied(t, "n3", 35)
+	propose(t, leader, 35, 40)
+	g.waitApplied(t, "n3", 40)
+	if peers := g.nodes["n3"].Status().Peers; len(peers) != 4 {
+		t.Errorf("except 4 members but got %v", peers)
+	}
+}
+
+func TestNode_ReadBarrier(t *testing.T) {
+	g := makeTestGroup(t, 3, 0)
+	defer g.stop()
+	leader := g.leader(t)
+	propose(t, leader, 0, 5)
+	for id, node := range g.nodes {
+		if err := node.ReadBarrier(time.Second); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if got := g.machines[id].len(); got != 5 {
+			t.Errorf("%s except 5 commands applied after the barrier but got %d", id, got)
+		}
+	}
+	// a leader cut off from the majority can not serve linearizable reads
+	g.network.setDown(leader.cfg.ID, true)
+	if err := leader.ReadBarrier(300 * time.Millisecond); err == nil {
+		t.Error("except isolated leader to fail the read barrier")
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.json")
+	entries := func(term uint64, from, to int) []Entry {
+		result := make([]Entry, 0)
+		for i := from; i <= to; i++ {
+			result = append(result, Entry{Index: uint64(i), Term: term, Data: []byte(strconv.Itoa(i))})
+		}
+		return result
+	}
+	load := func() (HardState, *Snapshot, []Entry) {
+		state, snapshot, loaded, err := NewFileStorage(path).Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state, snapshot, loaded
+	}
+
+	s := NewFileStorage(path)
+	state := HardState{Term: 1, Vote: "n0"}
+	log := entries(1, 1, 3)
+	if err := s.Save(state, nil, log); err != nil {
+		t.Fatal(err)
+	}
+	// new entries are appended to the log file
+	log = append(log, entries(1, 4, 5)...)
+	if err := s.Save(state, nil, log); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path + ".log"); bytes.Count(content, []byte("\n")) != 5 {
+		t.Errorf("except 5 entries logged but got %q", content)
+	}
+	if got, _, loaded := load(); got != state || !reflect.DeepEqual(loaded, log) {
+		t.Errorf("unexpected state %v and entries %v", got, loaded)
+	}
+
+	// a conflicting leader replaces the tail
+	log = append(log[:3], entries(2, 4, 4)...)
+	state.Term = 2
+	if err := s.Save(state, nil, log); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, loaded := load(); !reflect.DeepEqual(loaded, log) {
+		t.Errorf("except the tail replaced but got %v", loaded)
+	}
+
+	// entries covered by the snapshot are dropped, a line torn by a crash is ignored
+	snapshot := &Snapshot{Index: 3, Term: 1, Peers: []string{"n0"}, Data: []byte("3")}
+	if err := s.Save(state, snapshot, log[3:]); err != nil {
+		t.Fatal(err)
+	}
+	file, _ := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"index":5,"te`)
+	file.Close()
+	if _, got, loaded := load(); got == nil || got.Index != 3 || !reflect.DeepEqual(loaded, log[3:]) {
+		t.Errorf("unexpected snapshot %v and entries %v", got, loaded)
+	}
+}
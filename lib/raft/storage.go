@@ -0,0 +1,265 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// HardState is what a member must remember across restarts besides its log
+type HardState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote"`
+}
+
+// Storage persists the state of a member, Save is called before a member answers a request depending on it
+type Storage interface {
+	Load() (HardState, *Snapshot, []Entry, error)
+	Save(state HardState, snapshot *Snapshot, entries []Entry) error
+}
+
+// MemoryStorage keeps the state in memory, it survives a restart of the node but not of the process
+type MemoryStorage struct {
+	mu       sync.Mutex
+	state    HardState
+	snapshot *Snapshot
+	entries  []Entry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+func (s *MemoryStorage) Load() (HardState, *Snapshot, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.snapshot, append([]Entry{}, s.entries...), nil
+}
+func (s *MemoryStorage) Save(state HardState, snapshot *Snapshot, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state, s.snapshot, s.entries = state, snapshot, append([]Entry{}, entries...)
+	return nil
+}
+
+// FileStorage keeps the term, the vote and the snapshot in one json file, rewritten when they change, and appends the
+// log entries to path.log one json line each. Save returns once everything is synced to the disk.
+type FileStorage struct {
+	mu   sync.Mutex
+	path string
+	// state and snapshot are the ones in the file, first and last bound the entries in the log file and logged counts
+	// them, -1 if the log file has to be written again
+	state       HardState
+	snapshot    *Snapshot
+	first, last entryID
+	logged      int
+}
+
+// entryID names an entry, two logs holding the same entryID hold the same entries up to it
+type entryID struct {
+	index, term uint64
+}
+
+type fileContent struct {
+	State    HardState `json:"state"`
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+	// Entries are only found in the files written before the log file existed
+	Entries []Entry `json:"entries,omitempty"`
+}
+
+func NewFileStorage(path string) *FileStorage {
+	// nothing is known of a log file left behind, the first Save writes it again
+	return &FileStorage{path: path, logged: -1}
+}
+func (s *FileStorage) logPath() string {
+	return s.path + ".log"
+}
+func (s *FileStorage) Load() (HardState, *Snapshot, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var f fileContent
+	content, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return HardState{}, nil, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &f); err != nil {
+			return HardState{}, nil, nil, err
+		}
+	}
+	entries, err := readEntries(s.logPath())
+	if err != nil {
+		return HardState{}, nil, nil, err
+	}
+	if entries == nil {
+		entries = f.Entries
+	}
+	// a crash after the snapshot was written leaves the entries it covers in the log file
+	kept := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if f.Snapshot == nil || entry.Index > f.Snapshot.Index {
+			kept = append(kept, entry)
+		}
+	}
+	s.state, s.snapshot = f.State, f.Snapshot
+	// the first Save writes the log file again, in its own format and without the entries dropped
+	s.logged = -1
+	return f.State, f.Snapshot, kept, nil
+}
+
+// readEntries reads the log file, a last line torn by a crash is dropped as its entry was never acknowledged
+func readEntries(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := make([]Entry, 0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("broken raft log entry after index %d: %v", len(entries), err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Save writes the state and the snapshot if they changed, then appends the entries the log file misses. The log file
+// is written again when the entries do not extend it, after a snapshot or a conflicting leader.
+func (s *FileStorage) Save(state HardState, snapshot *Snapshot, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state != s.state || snapshot != s.snapshot {
+		// the snapshot goes first, the entries it covers are dropped by Load if the log file is not written yet
+		content, err := json.Marshal(fileContent{State: state, Snapshot: snapshot})
+		if err != nil {
+			return err
+		}
+		if err := writeFileSync(s.path, content); err != nil {
+			return err
+		}
+		s.state, s.snapshot = state, snapshot
+	}
+	if s.extends(entries) {
+		if err := s.appendEntries(entries[s.logged:]); err != nil {
+			return err
+		}
+	} else if err := s.rewriteEntries(entries); err != nil {
+		return err
+	}
+	s.logged = len(entries)
+	if len(entries) > 0 {
+		s.first = entryID{entries[0].Index, entries[0].Term}
+		s.last = entryID{entries[len(entries)-1].Index, entries[len(entries)-1].Term}
+	}
+	return nil
+}
+
+// extends tells whether entries are the ones in the log file followed by new ones
+func (s *FileStorage) extends(entries []Entry) bool {
+	if s.logged < 0 || len(entries) < s.logged {
+		return false
+	}
+	if s.logged == 0 {
+		return true
+	}
+	first, last := entries[0], entries[s.logged-1]
+	return s.first == entryID{first.Index, first.Term} && s.last == entryID{last.Index, last.Term}
+}
+func (s *FileStorage) appendEntries(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	content, err := encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	_, statErr := os.Stat(s.logPath())
+	file, err := os.OpenFile(s.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if os.IsNotExist(statErr) {
+		return syncDir(s.logPath())
+	}
+	return nil
+}
+func (s *FileStorage) rewriteEntries(entries []Entry) error {
+	content, err := encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(s.logPath(), content)
+}
+func encodeEntries(entries []Entry) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// writeFileSync replaces path with content through a synced temporary file, so a crash leaves either version
+func writeFileSync(path string, content []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// syncDir syncs the directory of path, which makes a file created or renamed in it durable
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
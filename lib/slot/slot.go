@@ -0,0 +1,56 @@
+package slot
+
+// Count is the number of hash slots used by redis cluster
+const Count = 1 << 14
+
+var crc16Table [256]uint16
+
+func init() {
+	// CRC16-CCITT (XMODEM), polynomial 0x1021
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+// CRC16 returns the XMODEM crc16 checksum of data, the same one used by redis cluster
+func CRC16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// HashTag returns the part of key used for hashing.
+// If key contains a '{' followed by a '}' with at least one char in between,
+// only the chars between the first '{' and the first '}' after it are hashed.
+func HashTag(key []byte) []byte {
+	for i := 0; i < len(key); i++ {
+		if key[i] != '{' {
+			continue
+		}
+		for j := i + 1; j < len(key); j++ {
+			if key[j] == '}' {
+				if j == i+1 {
+					return key
+				}
+				return key[i+1 : j]
+			}
+		}
+		return key
+	}
+	return key
+}
+
+// Of returns the hash slot of key
+func Of(key []byte) int {
+	return int(CRC16(HashTag(key)) & (Count - 1))
+}
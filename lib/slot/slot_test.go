@@ -0,0 +1,33 @@
+package slot
+
+import "testing"
+
+func TestCRC16(t *testing.T) {
+	if got := CRC16([]byte("123456789")); got != 0x31c3 {
+		t.Errorf("except %x but got %x", 0x31c3, got)
+	}
+}
+
+func TestOf(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"foo", 12182},
+		{"bar", 5061},
+		{"123456789", 12739},
+		{"{user1000}.following", Of([]byte("user1000"))},
+		{"{user1000}.followers", Of([]byte("user1000"))},
+		{"foo{}{bar}", int(CRC16([]byte("foo{}{bar}")) & (Count - 1))},
+		{"foo{{bar}}zap", Of([]byte("{bar"))},
+		{"foo{bar}{zap}", Of([]byte("bar"))},
+		{"{bar", int(CRC16([]byte("{bar")) & (Count - 1))},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			if got := Of([]byte(test.key)); got != test.want {
+				t.Errorf("except %d but got %d", test.want, got)
+			}
+		})
+	}
+}
@@ -1,105 +1,120 @@
 package lockermap
 
-import "sync"
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
 
+// LockerMap guards keys with a fixed table of RWMutex, keys hashed to the same slot share a lock
 type LockerMap struct {
-	locks map[string]*sync.RWMutex
+	locks []*sync.RWMutex
 }
 
 func NewLockerMap(size int) *LockerMap {
+	if size <= 0 {
+		size = 1
+	}
+	locks := make([]*sync.RWMutex, size)
+	for i := range locks {
+		locks[i] = &sync.RWMutex{}
+	}
 	return &LockerMap{
-		locks: make(map[string]*sync.RWMutex, size),
+		locks: locks,
 	}
 }
+func (lm *LockerMap) index(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(lm.locks)))
+}
 func (lm *LockerMap) WLock(key string) {
-	lm.locks[key].Lock()
+	lm.locks[lm.index(key)].Lock()
 }
 func (lm *LockerMap) RLock(key string) {
-	lm.locks[key].RLock()
+	lm.locks[lm.index(key)].RLock()
 }
 func (lm *LockerMap) WUnLock(key string) {
-	lm.locks[key].Unlock()
+	lm.locks[lm.index(key)].Unlock()
 }
 func (lm *LockerMap) RUnLock(key string) {
-	lm.locks[key].RUnlock()
+	lm.locks[lm.index(key)].RUnlock()
 }
 func (lm *LockerMap) WLockBatch(keys ...string) {
-	for _, key := range keys {
-		lm.locks[key].Lock()
-	}
+	lm.RWLockBatch(keys, nil)
 }
 func (lm *LockerMap) RLockBatch(keys ...string) {
-	for _, key := range keys {
-		lm.locks[key].RLock()
-	}
+	lm.RWLockBatch(nil, keys)
 }
 func (lm *LockerMap) WUnLockBatch(keys ...string) {
-	for _, key := range keys {
-		lm.locks[key].Unlock()
-	}
+	lm.URWLockBatch(keys, nil)
 }
 func (lm *LockerMap) RUnLockBatch(keys ...string) {
-	for _, key := range keys {
-		lm.locks[key].RUnlock()
-	}
+	lm.URWLockBatch(nil, keys)
 }
-func (lm *LockerMap) lockOrUnLockBatch0(writeKeys []string, readKeys []string, lock bool) {
-	var wg sync.WaitGroup
 
-	// Deduplicate keys
-	keysMap := make(map[string]struct{})
-	deduplicatedKeys := make([]string, 0, len(writeKeys)+len(readKeys))
+// toLockIndices returns the distinct lock slots of the keys in ascending order, a slot is written if any of its keys is
+func (lm *LockerMap) toLockIndices(writeKeys []string, readKeys []string) ([]int, map[int]bool) {
+	writes := make(map[int]bool)
 	for _, key := range writeKeys {
-		if _, ok := keysMap[key]; !ok {
-			keysMap[key] = struct{}{}
-			deduplicatedKeys = append(deduplicatedKeys, key)
-		}
+		writes[lm.index(key)] = true
 	}
 	for _, key := range readKeys {
-		if _, ok := keysMap[key]; !ok {
-			keysMap[key] = struct{}{}
-			deduplicatedKeys = append(deduplicatedKeys, key)
+		i := lm.index(key)
+		if _, ok := writes[i]; !ok {
+			writes[i] = false
 		}
 	}
-	// Lock write locks
-	for _, key := range deduplicatedKeys {
-		wg.Add(1)
-		go func(k string) {
-			defer wg.Done()
-			if lock {
-				lm.lock(writeKeys, k)
-			}
-			lm.unlock(writeKeys, k)
-		}(key)
+	indices := make([]int, 0, len(writes))
+	for i := range writes {
+		indices = append(indices, i)
 	}
-
-	wg.Wait()
+	sort.Ints(indices)
+	return indices, writes
 }
+
+// RWLockBatch locks writeKeys for writing and readKeys for reading, locks are taken in a fixed order so batches never deadlock
 func (lm *LockerMap) RWLockBatch(write []string, read []string) {
-	lm.lockOrUnLockBatch0(write, read, true)
+	lm.lockIndices(lm.toLockIndices(write, read))
 }
 func (lm *LockerMap) URWLockBatch(write []string, read []string) {
-	lm.lockOrUnLockBatch0(write, read, false)
+	lm.unlockIndices(lm.toLockIndices(write, read))
 }
-func contains(keys []string, key string) bool {
-	for _, k := range keys {
-		if k == key {
-			return true
-		}
+
+// RWLockAll locks every slot, those of writeKeys for writing and the others for reading
+func (lm *LockerMap) RWLockAll(write []string) {
+	lm.lockIndices(lm.allIndices(write))
+}
+func (lm *LockerMap) URWLockAll(write []string) {
+	lm.unlockIndices(lm.allIndices(write))
+}
+func (lm *LockerMap) allIndices(writeKeys []string) ([]int, map[int]bool) {
+	writes := make(map[int]bool, len(lm.locks))
+	indices := make([]int, len(lm.locks))
+	for i := range lm.locks {
+		indices[i] = i
 	}
-	return false
-}
-func (lm *LockerMap) lock(keys []string, key string) {
-	if contains(keys, key) {
-		lm.WLock(key)
-	} else {
-		lm.RLock(key)
+	for _, key := range writeKeys {
+		writes[lm.index(key)] = true
+	}
+	return indices, writes
+}
+func (lm *LockerMap) lockIndices(indices []int, writes map[int]bool) {
+	for _, i := range indices {
+		if writes[i] {
+			lm.locks[i].Lock()
+		} else {
+			lm.locks[i].RLock()
+		}
 	}
 }
-func (lm *LockerMap) unlock(keys []string, key string) {
-	if contains(keys, key) {
-		lm.WUnLock(key)
-	} else {
-		lm.RUnLock(key)
+func (lm *LockerMap) unlockIndices(indices []int, writes map[int]bool) {
+	for j := len(indices) - 1; j >= 0; j-- {
+		i := indices[j]
+		if writes[i] {
+			lm.locks[i].Unlock()
+		} else {
+			lm.locks[i].RUnlock()
+		}
 	}
 }
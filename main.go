@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"mygodis/cluster/admin"
 	"mygodis/config"
 	logger "mygodis/log"
 	"mygodis/server"
@@ -14,9 +15,15 @@ var defaultProperties = &config.ServerProperties{
 	Port:       6379,
 	AppendOnly: false,
 	MaxClients: 1024,
+	// without a password the dashboard is only reachable from this host
+	DashboardEnabled: true,
+	DashboardAuth:    "none",
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "cluster" {
+		os.Exit(admin.Run(os.Args[2:], os.Stdout))
+	}
 	logger.Setup(&logger.Settings{
 		Path:       "logs",
 		Name:       "MYGODIS",
@@ -12,6 +12,13 @@ import (
 	"strconv"
 )
 
+// maxArrayPrealloc bounds the room made for the elements of an array before they are read, a client announcing a
+// huge array has to send the elements to make it grow
+const maxArrayPrealloc = 1024
+
+// maxArrayDepth bounds the nesting of arrays, every level is a call of readArray on the stack of the connection
+const maxArrayDepth = 32
+
 type Payload struct {
 	Data resp.Reply
 	Err  error
@@ -59,6 +66,7 @@ func parse0(reader io.Reader, ch chan<- *Payload) {
 			ch <- &Payload{
 				Err: errors.New("server error"),
 			}
+			close(ch)
 		}
 	}()
 	bufioReader := bufio.NewReader(reader)
@@ -130,77 +138,119 @@ func parseArray(line []byte, reader *bufio.Reader, ch chan<- *Payload) error {
 	if len(line) == 0 || line[0] != '*' {
 		return nil
 	}
+	reply, err := readArray(line, reader, 1)
+	if err != nil {
+		return err
+	}
+	ch <- &Payload{
+		Data: reply,
+	}
+	return nil
+}
+
+// readArray reads the elements of the array headed by line at the given depth, arrays of bulk strings become a
+// MultiBulkReply and arrays holding other replies a MultiRawReply. A protocol error is returned as the error, the
+// rest of the array is still in reader and the connection cannot be read any further.
+func readArray(line []byte, reader *bufio.Reader, depth int) (resp.Reply, error) {
+	if depth > maxArrayDepth {
+		return nil, &resp.ProtocolErrReply{Msg: "too many nested arrays"}
+	}
 	length, err := strconv.ParseInt(string(line[1:]), 10, 64)
 	if err != nil {
-		ch <- &Payload{
-			Data: &resp.ProtocolErrReply{
-				Msg: fmt.Sprintf("illegal number %v", err),
-			},
-		}
-		return nil
+		return nil, &resp.ProtocolErrReply{Msg: fmt.Sprintf("illegal number %v", err)}
 	}
-	if length <= 0 {
-		ch <- &Payload{
-			Data: resp.MakeEmptyMultiBulkReply(),
-		}
-		return nil
+	if length < 0 {
+		return resp.MakeNullBulkReply(), nil
+	}
+	if length == 0 {
+		return resp.MakeEmptyMultiBulkReply(), nil
+	}
+	capacity := length
+	if capacity > maxArrayPrealloc {
+		capacity = maxArrayPrealloc
 	}
-	results := make([][]byte, 0)
+	replies := make([]resp.Reply, 0, capacity)
+	bulks := true
 	for i := 0; i < int(length); i++ {
-		bufBytes, err := reader.ReadBytes('\n')
+		element, err := readElement(reader, depth)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if len(bufBytes) == 0 || bufBytes[0] != '$' || bufBytes[len(bufBytes)-1] != '\n' {
-			continue
-		}
-		if len(bufBytes) == -1 {
-			results = append(results, []byte{})
-		}
-		bufBytes = bytes.TrimSuffix(bufBytes, []byte{'\r', '\n'})
-		strLen, pErr := strconv.ParseInt(string(bufBytes[1:]), 10, 64)
-		if pErr != nil {
-			return pErr
-		}
-		payload := make([]byte, strLen+2)
-		read, rErr := reader.Read(payload)
-		if rErr != nil || read != int(strLen+2) {
-			return rErr
+		switch element := element.(type) {
+		case *resp.ProtocolErrReply:
+			return nil, element
+		case *resp.BulkReply, *resp.NullBulkReply:
+		default:
+			bulks = false
 		}
-		results = append(results, payload[:strLen])
+		replies = append(replies, element)
 	}
-	ch <- &Payload{
-		Data: resp.MakeMultiBulkReply(results),
+	if !bulks {
+		return resp.MakeMultiRawReply(replies...), nil
 	}
-	return nil
-
+	args := make([][]byte, len(replies))
+	for i, reply := range replies {
+		if bulk, ok := reply.(*resp.BulkReply); ok {
+			args[i] = bulk.Arg
+		}
+	}
+	return resp.MakeMultiBulkReply(args), nil
 }
-func parseBulkString(line []byte, reader io.Reader, ch chan<- *Payload) error {
-	length, err := strconv.ParseInt(string(line[1:]), 10, 64)
+
+// readElement reads one reply of an array at depth
+func readElement(reader *bufio.Reader, depth int) (resp.Reply, error) {
+	line, err := reader.ReadBytes('\n')
 	if err != nil {
-		ch <- &Payload{
-			Data: &resp.ProtocolErrReply{
-				Msg: fmt.Sprintf("illegal number %v", err),
-			},
-		}
-		return nil
+		return nil, err
 	}
-	if length <= 0 {
-		ch <- &Payload{
-			Data: resp.MakeNullBulkReply(),
+	line = bytes.TrimSuffix(line, []byte{'\r', '\n'})
+	if len(line) == 0 {
+		return &resp.ProtocolErrReply{Msg: "empty line"}, nil
+	}
+	switch line[0] {
+	case '+':
+		return resp.MakeSimpleStringReply(string(line[1:])), nil
+	case '-':
+		return resp.MakeErrReply(string(line[1:])), nil
+	case ':':
+		val, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return &resp.ProtocolErrReply{Msg: fmt.Sprintf("illegal number %v", err)}, nil
 		}
-		return nil
+		return resp.MakeIntReply(val), nil
+	case '$':
+		return readBulkString(line, reader)
+	case '*':
+		return readArray(line, reader, depth+1)
 	}
-	buf := make([]byte, length+2)
-	_, err = io.ReadFull(reader, buf)
+	return &resp.ProtocolErrReply{Msg: "illegal reply type " + strconv.Quote(string(line[:1]))}, nil
+}
+func parseBulkString(line []byte, reader io.Reader, ch chan<- *Payload) error {
+	reply, err := readBulkString(line, reader)
 	if err != nil {
 		return err
 	}
 	ch <- &Payload{
-		Data: resp.MakeBulkReply(buf[:len(buf)-2]),
+		Data: reply,
 	}
 	return nil
 }
+
+// readBulkString reads the body of the bulk string headed by line, $-1 is null and $0 an empty string
+func readBulkString(line []byte, reader io.Reader) (resp.Reply, error) {
+	length, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil {
+		return &resp.ProtocolErrReply{Msg: fmt.Sprintf("illegal number %v", err)}, nil
+	}
+	if length < 0 {
+		return resp.MakeNullBulkReply(), nil
+	}
+	buf := make([]byte, length+2)
+	if _, err = io.ReadFull(reader, buf); err != nil {
+		return nil, err
+	}
+	return resp.MakeBulkReply(buf[:length]), nil
+}
 func parseRDBBulkString(reader *bufio.Reader, ch chan<- *Payload) error {
 	head, err := reader.ReadBytes('\n')
 	if err != nil {
@@ -4,6 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
+	"mygodis/resp"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -41,3 +46,87 @@ func TestParseOne(t *testing.T) {
 	}
 	t.Log(resp)
 }
+
+func TestParse_splitReplies(t *testing.T) {
+	data := "*3\r\n$0\r\n\r\n$-1\r\n$5\r\nhello\r\n" +
+		"*2\r\n:1\r\n*1\r\n+OK\r\n" +
+		"$" + strconv.Itoa(1<<16) + "\r\n" + strings.Repeat("x", 1<<16) + "\r\n"
+	reader, writer := io.Pipe()
+	go func() {
+		// one byte per write, so every reply is split across reads
+		for i := 0; i < len(data); i++ {
+			_, _ = writer.Write([]byte{data[i]})
+		}
+		_ = writer.Close()
+	}()
+	var replies []string
+	for payload := range Parse(reader) {
+		if payload.Err != nil {
+			break
+		}
+		replies = append(replies, string(payload.Data.ToBytes()))
+	}
+	if len(replies) != 3 {
+		t.Fatalf("except 3 replies but got %d", len(replies))
+	}
+	if replies[0] != "*3\r\n$0\r\n\r\n$-1\r\n$5\r\nhello\r\n" {
+		t.Errorf("except empty and null bulks kept apart but got %q", replies[0])
+	}
+	if replies[1] != "*2\r\n:1\r\n*1\r\n+OK\r\n" {
+		t.Errorf("unexpected nested array %q", replies[1])
+	}
+	if len(replies[2]) != 1<<16+len(strconv.Itoa(1<<16))+5 {
+		t.Errorf("unexpected bulk of %d bytes", len(replies[2]))
+	}
+}
+
+func TestParse_hugeArrayHeader(t *testing.T) {
+	// the length is announced but never sent, nothing as large must be allocated for it
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for payload := range Parse(strings.NewReader("*2000000000\r\n$1\r\na\r\n")) {
+		if payload.Err == nil {
+			t.Errorf("except the truncated array to fail but got %q", payload.Data.ToBytes())
+		}
+	}
+	runtime.ReadMemStats(&after)
+	if grown := after.TotalAlloc - before.TotalAlloc; grown > 1<<20 {
+		t.Errorf("except little memory allocated but got %d bytes", grown)
+	}
+}
+
+func TestParse_deepArray(t *testing.T) {
+	// every level would be a frame on the stack of the connection, too deep a nesting is refused instead
+	payloads := 0
+	for payload := range Parse(strings.NewReader(strings.Repeat("*1\r\n", 1<<20) + ":1\r\n")) {
+		payloads++
+		if _, ok := payload.Err.(*resp.ProtocolErrReply); !ok {
+			t.Errorf("except a protocol error but got %v", payload.Err)
+		}
+	}
+	if payloads != 1 {
+		t.Errorf("except the parser to stop at the error but got %d payloads", payloads)
+	}
+	if _, err := ParseOne([]byte(strings.Repeat("*1\r\n", maxArrayDepth) + ":1\r\n")); err != nil {
+		t.Errorf("except %d levels to be read but got %v", maxArrayDepth, err)
+	}
+}
+
+func TestParse_errorInArray(t *testing.T) {
+	// the rest of the array and the next command must not be read as commands
+	var replies []string
+	var errs []error
+	for payload := range Parse(strings.NewReader("*3\r\n$3\r\nGET\r\n&x\r\n*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nPING\r\n")) {
+		if payload.Err != nil {
+			errs = append(errs, payload.Err)
+			continue
+		}
+		replies = append(replies, string(payload.Data.ToBytes()))
+	}
+	if len(replies) != 0 || len(errs) != 1 {
+		t.Fatalf("except one error and nothing else but got %q %v", replies, errs)
+	}
+	if _, ok := errs[0].(*resp.ProtocolErrReply); !ok {
+		t.Errorf("except a protocol error but got %v", errs[0])
+	}
+}
@@ -42,6 +42,11 @@ func (m MultiRawReply) ToBytes() []byte {
 	return buf.Bytes()
 }
 
+// Replies returns the elements of the array
+func (m *MultiRawReply) Replies() []Reply {
+	return m.replies
+}
+
 func MakeMultiRawReply(replies ...Reply) Reply {
 	return &MultiRawReply{
 		replies: replies,
@@ -9,6 +9,7 @@ import (
 	"mygodis/config"
 	"mygodis/dashboard"
 	"mygodis/db"
+	"mygodis/lib/metrics"
 	logger "mygodis/log"
 	"mygodis/parse"
 	"mygodis/resp"
@@ -26,6 +27,8 @@ type Handler struct {
 	activeConn *sync.Map
 	db         commoninterface.DB
 	closing    atomic.Bool
+	// dashboard is nil unless dashboard-enabled is set
+	dashboard *dashboard.Dashboard
 }
 
 func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
@@ -41,7 +44,8 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 		if payload.Err != nil {
 			if payload.Err == io.EOF || payload.Err == io.ErrUnexpectedEOF || strings.Contains(payload.Err.Error(), "use of closed network connection") {
 				h.closeConnection(connection)
-				logger.Info("connection closed: " + connection.RemoteAddr())
+				// Close may already have given connection back to the pool, conn is still ours
+				logger.Info("connection closed: " + conn.RemoteAddr().String())
 				return
 			}
 			errReply := resp.MakeErrReply(payload.Err.Error())
@@ -81,10 +85,17 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 		}
 
 	}
+	// the parser stops at a protocol error, whatever follows it cannot be read as commands
+	h.closeConnection(connection)
 }
 
 func (h *Handler) Close() error {
 	h.closing.Swap(true)
+	if h.dashboard != nil {
+		if err := h.dashboard.Close(); err != nil {
+			logger.Error("close dashboard error: " + err.Error())
+		}
+	}
 	h.activeConn.Range(func(key, value any) bool {
 		h.closeConnection(key.(commoninterface.Connection))
 		return true
@@ -93,14 +104,14 @@ func (h *Handler) Close() error {
 	return nil
 }
 
+// closeConnection releases the subscriptions of connection before it goes back to the pool of connections
 func (h *Handler) closeConnection(connection commoninterface.Connection) {
-	err := connection.Close()
-	if err != nil {
+	if _, active := h.activeConn.LoadAndDelete(connection); !active {
 		return
 	}
 	h.db.RemoveClient(connection)
 	h.db.AfterClientClose(connection)
-	h.activeConn.Delete(connection)
+	_ = connection.Close()
 }
 func (h *Handler) Clients() *sync.Map {
 	return h.activeConn
@@ -108,22 +119,49 @@ func (h *Handler) Clients() *sync.Map {
 
 func MakeHandler() *Handler {
 	var dbi commoninterface.DB
+	var local commoninterface.StandaloneDBEngine
+	var node dashboard.ClusterNode
 	clusterEnable := config.Properties.ClusterEnable
 
 	if clusterEnable {
-		dbi = cluster.MakeCluster()
+		c := cluster.MakeCluster()
+		// the keys and the commands shown by the dashboard are the ones of this node
+		dbi, local, node = c, c.LocalDB(), c
 		logger.Info("start with cluster mode")
 	} else {
-		dbi = db.MakeStandaloneServer()
-		go initDashBoard()
+		standalone := db.MakeStandaloneServer()
+		dbi, local = standalone, standalone
 		logger.Info("start with standalone mode")
 	}
+	// only the server of the process reports its keys and clients on /metrics
+	if collector, ok := dbi.(metrics.Collector); ok {
+		metrics.Default.Register(collector)
+	}
+	h := NewHandler(dbi)
+	if config.Properties.DashboardEnabled {
+		h.dashboard = startDashboard(local, node)
+	}
+	return h
+}
+
+// NewHandler serves the connections with dbi
+func NewHandler(dbi commoninterface.DB) *Handler {
 	return &Handler{
 		db:         dbi,
 		activeConn: new(sync.Map),
 	}
-
 }
-func initDashBoard() {
-	dashboard.DefaultDashboard.Start()
+
+// startDashboard serves the dashboard of dbi in the background, node is nil in standalone mode
+func startDashboard(dbi commoninterface.StandaloneDBEngine, node dashboard.ClusterNode) *dashboard.Dashboard {
+	d := dashboard.MakeDashboard(config.Properties.DashboardAddress(), dbi, config.Properties)
+	if node != nil {
+		d.WithCluster(node)
+	}
+	go func() {
+		if err := d.Start(); err != nil {
+			logger.Error("dashboard error: " + err.Error())
+		}
+	}()
+	return d
 }
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	cm "mygodis/common"
+	"mygodis/common/commoninterface"
+	"mygodis/resp"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingDB subscribes on SUBSCRIBE and records the commands and the channels a connection still has when it is
+// released
+type recordingDB struct {
+	mu       sync.Mutex
+	executed []string
+	released [][]string
+}
+
+func (d *recordingDB) Exec(connection commoninterface.Connection, args cm.CmdLine) resp.Reply {
+	d.mu.Lock()
+	d.executed = append(d.executed, string(args[0]))
+	d.mu.Unlock()
+	if strings.EqualFold(string(args[0]), "SUBSCRIBE") {
+		connection.Subscribe(string(args[1]))
+	}
+	return resp.MakeOkReply()
+}
+func (d *recordingDB) AfterClientClose(connection commoninterface.Connection) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.released = append(d.released, connection.GetChannels())
+}
+func (d *recordingDB) Close()                                             {}
+func (d *recordingDB) AddClient(connection commoninterface.Connection)    {}
+func (d *recordingDB) RemoveClient(connection commoninterface.Connection) {}
+
+func TestHandler_closeConnection(t *testing.T) {
+	db := &recordingDB{}
+	h := NewHandler(db)
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Handle(context.Background(), server)
+	}()
+	if _, err := client.Write([]byte("*2\r\n$9\r\nSUBSCRIBE\r\n$2\r\nch\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(client).ReadString('\n'); err != nil || line != "+OK\r\n" {
+		t.Fatalf("except +OK but got %q %v", line, err)
+	}
+	_ = client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("except the handler to return once the client is gone")
+	}
+	// closing the handler afterwards releases nothing twice
+	_ = h.Close()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.released) != 1 {
+		t.Fatalf("except the connection released once but got %d", len(db.released))
+	}
+	if len(db.released[0]) != 1 || db.released[0][0] != "ch" {
+		t.Errorf("except the subscriptions released before the connection is reset but got %v", db.released[0])
+	}
+}
+
+func TestHandler_protocolError(t *testing.T) {
+	db := &recordingDB{}
+	h := NewHandler(db)
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Handle(context.Background(), server)
+	}()
+	go func() {
+		_, _ = client.Write([]byte("*3\r\n$3\r\nGET\r\n&x\r\n*1\r\n$4\r\nPING\r\n"))
+	}()
+	reader := bufio.NewReader(client)
+	if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "-ERR Protocol error") {
+		t.Fatalf("except a protocol error but got %q %v", line, err)
+	}
+	if line, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("except the connection closed but got %q", line)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("except the handler to return after a protocol error")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.executed) != 0 || len(db.released) != 1 {
+		t.Errorf("except nothing executed and the connection released but got %v %d", db.executed, len(db.released))
+	}
+}
@@ -20,7 +20,7 @@ type Config struct {
 
 func ListenAndServeWithSignal(config *Config, handler commoninterface.Handler) error {
 	closeC := make(chan struct{})
-	sigC := make(chan os.Signal)
+	sigC := make(chan os.Signal, 1)
 	signal.Notify(sigC, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
 		sig := <-sigC
@@ -33,7 +33,7 @@ func ListenAndServeWithSignal(config *Config, handler commoninterface.Handler) e
 	if err != nil {
 		return err
 	}
-	logger.Info("bind: %s, start listening...", config.Address)
+	logger.Info("bind: " + config.Address + ", start listening...")
 	listenAndServe(listener, handler, closeC)
 	return nil
 }
@@ -49,7 +49,7 @@ func listenAndServe(listener net.Listener, handler commoninterface.Handler, clos
 		case <-closeC:
 			logger.Info("get exit signal")
 		case er := <-errorC:
-			logger.Error("error: %s", er)
+			logger.Error("error: " + er.Error())
 		}
 		logger.Info("server closed")
 	}()
@@ -62,7 +62,7 @@ func listenAndServe(listener net.Listener, handler commoninterface.Handler, clos
 			errorC <- err
 			break
 		}
-		logger.Info("accept: %s", accept.RemoteAddr())
+		logger.Info("accept: " + accept.RemoteAddr().String())
 		wt.Add(1)
 		go func() {
 			defer wt.Done()